@@ -12,6 +12,7 @@ import (
 
 	"github.com/mellowdrifter/bgpwatch/internal/server"
 	pb "github.com/mellowdrifter/bgpwatch/proto"
+	api "github.com/osrg/gobgp/v3/api"
 	"github.com/stretchr/testify/require"
 )
 
@@ -489,3 +490,210 @@ func TestGracefulRestart10_AddPath(t *testing.T) {
 
 	t.Log("Success: Partial path ID withdrawal handled during GR")
 }
+
+// TestGracefulRestart11_PeerRestartTime verifies that stale routes are purged after the restart
+// time the peer advertised rather than the configured maximum.
+func TestGracefulRestart11_PeerRestartTime(t *testing.T) {
+	t.Log("Test 11: Peer advertises a 3 second restart time")
+
+	bgpPort, grpcPort := portPair(65)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGPWithRestartTime(t, 64500, "10.0.0.1", "127.0.0.1", "", 64533, bgpPort, false, true, 3)
+	waitForSession(t, gobgp, "127.0.0.1", 30*time.Second)
+
+	prefix := "11.11.11.0"
+	announceIPv4(t, gobgp, prefix, 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && resp.Found
+	}, 30*time.Second)
+
+	stopGoBGP()
+	start := time.Now()
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && !resp.Found
+	}, 30*time.Second)
+	require.Less(t, time.Since(start), 15*time.Second)
+
+	t.Log("Success: Stale routes purged after the peer's restart time")
+}
+
+// TestGracefulRestart12_LongLived verifies that routes of a peer with Long-Lived Graceful
+// Restart are kept past its restart time, tagged LLGR_STALE, unless they carry NO_LLGR.
+func TestGracefulRestart12_LongLived(t *testing.T) {
+	t.Log("Test 12: Peer advertises a 2 second restart time and a 1 hour LLGR stale time")
+
+	bgpPort, grpcPort := portPair(66)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGPWithGR(t, 64500, "10.0.0.1", "127.0.0.1", "", 64533, bgpPort, false,
+		goBGPGR{enabled: true, restartTime: 2, llgrStaleTime: 3600})
+	waitForSession(t, gobgp, "127.0.0.1", 30*time.Second)
+
+	kept, dropped := "12.12.12.0", "12.12.13.0"
+	announceIPv4(t, gobgp, kept, 24, "10.0.0.1", []uint32{64500})
+	announceIPv4WithCommunities(t, gobgp, dropped, 24, "10.0.0.1", []uint32{64500}, []uint32{0xffff0007})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: dropped + "/24"})
+		return resp != nil && resp.Found
+	}, 30*time.Second)
+
+	stopGoBGP()
+	var route *pb.Route
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: kept + "/24"})
+		if resp == nil || !resp.Found {
+			return false
+		}
+		for _, c := range resp.Route.Communities {
+			if c.High == 65535 && c.Low == 6 {
+				route = resp.Route
+				return true
+			}
+		}
+		return false
+	}, 30*time.Second)
+	require.Zero(t, route.StaleSeconds)
+
+	resp, err := client.GetRoute(context.Background(), &pb.RouteRequest{Address: dropped + "/24"})
+	require.NoError(t, err)
+	require.False(t, resp.Found, "NO_LLGR route should be removed when the restart time expires")
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, stats.PeerStats, 1)
+	for _, ps := range stats.PeerStats {
+		require.Equal(t, "LLGR Stale", ps.State)
+	}
+
+	t.Log("Success: Routes kept as LLGR_STALE past the restart time")
+}
+
+// TestGracefulRestart13_CeaseWithoutNBit verifies that routes are removed straight away when a
+// peer that did not set the N bit ends the session with a NOTIFICATION.
+func TestGracefulRestart13_CeaseWithoutNBit(t *testing.T) {
+	t.Log("Test 13: Peer without the N bit sends a Cease")
+
+	bgpPort, grpcPort := portPair(67)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, true)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 30*time.Second)
+
+	prefix := "13.13.13.0"
+	announceIPv4(t, gobgp, prefix, 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && resp.Found
+	}, 30*time.Second)
+
+	// Stopping GoBGP sends Cease / Peer De-configured
+	gobgp.Stop()
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && !resp.Found
+	}, 5*time.Second)
+
+	t.Log("Success: Routes removed after a NOTIFICATION without the N bit")
+}
+
+// TestGracefulRestart14_HardReset verifies that a Hard Reset removes routes straight away even
+// though the peer set the N bit.
+func TestGracefulRestart14_HardReset(t *testing.T) {
+	t.Log("Test 14: Peer with the N bit sends a Hard Reset")
+
+	bgpPort, grpcPort := portPair(68)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGPWithGR(t, 64500, "10.0.0.1", "127.0.0.1", "", 64533, bgpPort, false,
+		goBGPGR{enabled: true, restartTime: 120, notification: true})
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 30*time.Second)
+
+	prefix := "14.14.14.0"
+	announceIPv4(t, gobgp, prefix, 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && resp.Found
+	}, 30*time.Second)
+
+	// With the N bit negotiated GoBGP sends its Peer De-configured Cease as a Hard Reset
+	gobgp.Stop()
+	waitForNotification(t, client, "Hard Reset")
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && !resp.Found
+	}, 5*time.Second)
+
+	t.Log("Success: Routes removed after a Hard Reset")
+}
+
+// TestGracefulRestart15_NotificationWithNBit verifies that routes are held when a peer that set
+// the N bit ends the session with a NOTIFICATION other than Hard Reset.
+func TestGracefulRestart15_NotificationWithNBit(t *testing.T) {
+	t.Log("Test 15: Peer with the N bit sends an Administrative Reset")
+
+	bgpPort, grpcPort := portPair(69)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGPWithGR(t, 64500, "10.0.0.1", "127.0.0.1", "", 64533, bgpPort, false,
+		goBGPGR{enabled: true, restartTime: 120, notification: true})
+	waitForSession(t, gobgp, "127.0.0.1", 30*time.Second)
+
+	prefix := "15.15.15.0"
+	announceIPv4(t, gobgp, prefix, 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && resp.Found
+	}, 30*time.Second)
+
+	err := gobgp.ResetPeer(context.Background(), &api.ResetPeerRequest{Address: "127.0.0.1"})
+	require.NoError(t, err)
+	waitForNotification(t, client, "Administrative Reset")
+	// Keep GoBGP from coming back
+	stopGoBGP()
+
+	waitForConvergence(t, func() bool {
+		resp, _ := client.GetRoute(context.Background(), &pb.RouteRequest{Address: prefix + "/24"})
+		return resp != nil && resp.Found && resp.Route.StaleSeconds > 0
+	}, 10*time.Second)
+
+	t.Log("Success: Routes held after a NOTIFICATION with the N bit")
+}
+
+// waitForNotification waits for bgpwatch to receive a Cease with the given subcode name.
+func waitForNotification(t *testing.T, client pb.BGPWatchClient, subcode string) {
+	t.Helper()
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if !n.Sent && n.CodeName == "Cease" && n.SubcodeName == subcode {
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+}
@@ -6,6 +6,9 @@ package integration
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -41,6 +44,126 @@ func startBGPWatch(t *testing.T, bgpPort, grpcPort int, eor bool) func() {
 	}
 }
 
+func startBGPWatchWithPeers(t *testing.T, bgpPort, grpcPort int, peers map[string]server.PeerConfig) func() {
+	rid, err := server.GetRid("0.0.0.1")
+	require.NoError(t, err)
+
+	conf := server.Config{
+		Rid:         rid,
+		Port:        bgpPort,
+		GrpcPort:    grpcPort,
+		Quiet:       true,
+		Asn:         64533,
+		PeersConfig: peers,
+	}
+	srv := server.New(conf)
+	go srv.Start()
+
+	time.Sleep(500 * time.Millisecond)
+
+	return func() {
+		srv.Stop()
+	}
+}
+
+func startBGPWatchWithRanges(t *testing.T, bgpPort, grpcPort int, ranges []server.ListenRange) func() {
+	rid, err := server.GetRid("0.0.0.1")
+	require.NoError(t, err)
+
+	conf := server.Config{
+		Rid:          rid,
+		Port:         bgpPort,
+		GrpcPort:     grpcPort,
+		Quiet:        true,
+		Asn:          64533,
+		ListenRanges: ranges,
+	}
+	srv := server.New(conf)
+	go srv.Start()
+
+	time.Sleep(500 * time.Millisecond)
+
+	return func() {
+		srv.Stop()
+	}
+}
+
+// startBGPWatchWithConfigFile starts bgpwatch with the peers and listen ranges in file, which
+// is read again on ReloadConfig.
+func startBGPWatchWithConfigFile(t *testing.T, bgpPort, grpcPort int, file string) func() {
+	rid, err := server.GetRid("0.0.0.1")
+	require.NoError(t, err)
+	cf, err := server.ReadConfigFile(file)
+	require.NoError(t, err)
+
+	peers := make(map[string]server.PeerConfig)
+	for _, p := range cf.Peers {
+		peers[p.IP] = p
+	}
+	conf := server.Config{
+		Rid:          rid,
+		Port:         bgpPort,
+		GrpcPort:     grpcPort,
+		Quiet:        true,
+		Asn:          64533,
+		PeersConfig:  peers,
+		ListenRanges: cf.ListenRanges,
+		ConfigFile:   file,
+		RPKI:         cf.RPKI,
+	}
+	srv := server.New(conf)
+	go srv.Start()
+
+	time.Sleep(500 * time.Millisecond)
+
+	return func() {
+		srv.Stop()
+	}
+}
+
+// startGoBGPPassive starts a GoBGP instance that listens on listenPort and waits for
+// bgpwatch to connect to it.
+func startGoBGPPassive(t *testing.T, localAS uint32, routerID, peerAddr string,
+	peerAS uint32, listenPort int) (*gobgpserver.BgpServer, func()) {
+
+	s := gobgpserver.NewBgpServer()
+	go s.Serve()
+
+	err := s.StartBgp(context.Background(), &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:             localAS,
+			RouterId:        routerID,
+			ListenPort:      int32(listenPort),
+			ListenAddresses: []string{"127.0.0.1"},
+		},
+	})
+	require.NoError(t, err)
+
+	peer := &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: peerAddr,
+			PeerAsn:         peerAS,
+		},
+		Transport: &api.Transport{
+			PassiveMode: true,
+		},
+		AfiSafis: []*api.AfiSafi{
+			{
+				Config: &api.AfiSafiConfig{
+					Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+				},
+			},
+		},
+	}
+
+	err = s.AddPeer(context.Background(), &api.AddPeerRequest{Peer: peer})
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Stop()
+	}
+}
+
 func startGoBGP(t *testing.T, localAS uint32, routerID, peerAddr string,
 	peerAS uint32, bgpPort int, addPath bool, gr bool) (*gobgpserver.BgpServer, func()) {
 	return startGoBGPWithLocalAddr(t, localAS, routerID, peerAddr, "", peerAS, bgpPort, addPath, gr)
@@ -48,6 +171,35 @@ func startGoBGP(t *testing.T, localAS uint32, routerID, peerAddr string,
 
 func startGoBGPWithLocalAddr(t *testing.T, localAS uint32, routerID, peerAddr, localAddr string,
 	peerAS uint32, bgpPort int, addPath bool, gr bool) (*gobgpserver.BgpServer, func()) {
+	return startGoBGPWithRestartTime(t, localAS, routerID, peerAddr, localAddr, peerAS, bgpPort, addPath, gr, 120)
+}
+
+// startGoBGPWithRestartTime starts GoBGP advertising the given Graceful Restart time if gr is set.
+func startGoBGPWithRestartTime(t *testing.T, localAS uint32, routerID, peerAddr, localAddr string,
+	peerAS uint32, bgpPort int, addPath bool, gr bool, restartTime uint32) (*gobgpserver.BgpServer, func()) {
+	return startGoBGPWithGR(t, localAS, routerID, peerAddr, localAddr, peerAS, bgpPort, addPath,
+		goBGPGR{enabled: gr, restartTime: restartTime})
+}
+
+// goBGPGR is the Graceful Restart configuration of a GoBGP instance.
+type goBGPGR struct {
+	enabled       bool
+	restartTime   uint32
+	llgrStaleTime uint32 // Long-Lived Graceful Restart for both families if not zero
+	notification  bool   // RFC 8538 N bit
+}
+
+// startGoBGPWithGR starts GoBGP with the given Graceful Restart configuration. With Graceful
+// Restart enabled, GoBGP connects through a relay and the returned cleanup cuts the connection
+// before stopping GoBGP, as if it had crashed. Stopping GoBGP itself sends a Cease that ends
+// Graceful Restart.
+func startGoBGPWithGR(t *testing.T, localAS uint32, routerID, peerAddr, localAddr string,
+	peerAS uint32, bgpPort int, addPath bool, gr goBGPGR) (*gobgpserver.BgpServer, func()) {
+
+	remotePort, cut := bgpPort, func() {}
+	if gr.enabled {
+		remotePort, cut = startRelay(t, peerAddr, localAddr, bgpPort)
+	}
 
 	s := gobgpserver.NewBgpServer()
 	go s.Serve()
@@ -67,14 +219,17 @@ func startGoBGPWithLocalAddr(t *testing.T, localAS uint32, routerID, peerAddr, l
 			PeerAsn:         peerAS,
 		},
 		Transport: &api.Transport{
-			RemotePort:   uint32(bgpPort),
+			RemotePort:   uint32(remotePort),
 			LocalAddress: localAddr,
 		},
 	}
 
 	// Enable Graceful Restart to ensure EoR is sent
 	peer.GracefulRestart = &api.GracefulRestart{
-		Enabled: gr,
+		Enabled:             gr.enabled,
+		RestartTime:         gr.restartTime,
+		LonglivedEnabled:    gr.llgrStaleTime > 0,
+		NotificationEnabled: gr.notification,
 	}
 
 	// Enable Add-Path if requested
@@ -91,6 +246,22 @@ func startGoBGPWithLocalAddr(t *testing.T, localAS uint32, routerID, peerAddr, l
 		},
 	}
 
+	// Both families are listed in the GR capability, so bgpwatch holds their routes
+	if gr.enabled {
+		for _, fs := range peer.AfiSafis {
+			fs.MpGracefulRestart = &api.MpGracefulRestart{
+				Config: &api.MpGracefulRestartConfig{Enabled: true},
+			}
+		}
+	}
+	if gr.llgrStaleTime > 0 {
+		for _, fs := range peer.AfiSafis {
+			fs.LongLivedGracefulRestart = &api.LongLivedGracefulRestart{
+				Config: &api.LongLivedGracefulRestartConfig{Enabled: true, RestartTime: gr.llgrStaleTime},
+			}
+		}
+	}
+
 	if addPath {
 		for _, fs := range peer.AfiSafis {
 			fs.AddPaths = &api.AddPaths{
@@ -106,11 +277,149 @@ func startGoBGPWithLocalAddr(t *testing.T, localAS uint32, routerID, peerAddr, l
 	require.NoError(t, err)
 
 	cleanup := func() {
+		cut()
 		s.Stop()
 	}
 	return s, cleanup
 }
 
+// startGoBGPWithPassword starts GoBGP connecting to bgpwatch from localAddr with a TCP MD5
+// password.
+func startGoBGPWithPassword(t *testing.T, localAS uint32, routerID, localAddr string,
+	peerAS uint32, bgpPort int, password string) (*gobgpserver.BgpServer, func()) {
+
+	s := gobgpserver.NewBgpServer()
+	go s.Serve()
+
+	err := s.StartBgp(context.Background(), &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:        localAS,
+			RouterId:   routerID,
+			ListenPort: -1,
+		},
+	})
+	require.NoError(t, err)
+
+	peer := &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: "127.0.0.1",
+			PeerAsn:         peerAS,
+			AuthPassword:    password,
+		},
+		Transport: &api.Transport{
+			RemotePort:   uint32(bgpPort),
+			LocalAddress: localAddr,
+		},
+		AfiSafis: []*api.AfiSafi{
+			{
+				Config: &api.AfiSafiConfig{
+					Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+				},
+			},
+		},
+	}
+	err = s.AddPeer(context.Background(), &api.AddPeerRequest{Peer: peer})
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Stop()
+	}
+}
+
+// startGoBGPWithTTLSecurity starts GoBGP connecting to bgpwatch from localAddr, with GTSM
+// accepting packets with a TTL of at least ttlMin if it is set.
+func startGoBGPWithTTLSecurity(t *testing.T, localAS uint32, routerID, localAddr string,
+	peerAS uint32, bgpPort int, ttlMin uint32) (*gobgpserver.BgpServer, func()) {
+
+	s := gobgpserver.NewBgpServer()
+	go s.Serve()
+
+	err := s.StartBgp(context.Background(), &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:        localAS,
+			RouterId:   routerID,
+			ListenPort: -1,
+		},
+	})
+	require.NoError(t, err)
+
+	peer := &api.Peer{
+		Conf: &api.PeerConf{
+			NeighborAddress: "127.0.0.1",
+			PeerAsn:         peerAS,
+		},
+		TtlSecurity: &api.TtlSecurity{
+			Enabled: ttlMin > 0,
+			TtlMin:  ttlMin,
+		},
+		Transport: &api.Transport{
+			RemotePort:   uint32(bgpPort),
+			LocalAddress: localAddr,
+		},
+		AfiSafis: []*api.AfiSafi{
+			{
+				Config: &api.AfiSafiConfig{
+					Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+				},
+			},
+		},
+	}
+	err = s.AddPeer(context.Background(), &api.AddPeerRequest{Peer: peer})
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Stop()
+	}
+}
+
+// startRelay listens on listenAddr and forwards each connection to bgpwatch on bgpPort, from
+// localAddr if set. It returns the port to connect to and a function that closes the listener
+// and every connection without a NOTIFICATION.
+func startRelay(t *testing.T, listenAddr, localAddr string, bgpPort int) (int, func()) {
+	l, err := net.Listen("tcp", net.JoinHostPort(listenAddr, "0"))
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var d net.Dialer
+			if localAddr != "" {
+				d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localAddr)}
+			}
+			out, err := d.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bgpPort))
+			if err != nil {
+				in.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, in, out)
+			mu.Unlock()
+			go func() {
+				io.Copy(out, in)
+				out.Close()
+			}()
+			go func() {
+				io.Copy(in, out)
+				in.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
 func waitForSession(t *testing.T, s *gobgpserver.BgpServer, peerAddr string, timeout time.Duration) {
 	t.Helper()
 	deadline := time.Now().Add(timeout)
@@ -324,6 +633,29 @@ func announceIPv4WithLargeCommunities(t *testing.T, s *gobgpserver.BgpServer,
 	require.NoError(t, err)
 }
 
+// announceIPv4WithPathAttrs announces a prefix with the given AS path segments and any
+// further attributes on top of ORIGIN and NEXT_HOP.
+func announceIPv4WithPathAttrs(t *testing.T, s *gobgpserver.BgpServer,
+	prefix string, maskLen uint32, nextHop string, segments []*api.AsSegment, extra ...*anypb.Any) {
+
+	nlri, _ := anypb.New(&api.IPAddressPrefix{
+		Prefix:    prefix,
+		PrefixLen: maskLen,
+	})
+	origin, _ := anypb.New(&api.OriginAttribute{Origin: 2})
+	nh, _ := anypb.New(&api.NextHopAttribute{NextHop: nextHop})
+	asp, _ := anypb.New(&api.AsPathAttribute{Segments: segments})
+
+	_, err := s.AddPath(context.Background(), &api.AddPathRequest{
+		Path: &api.Path{
+			Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+			Nlri:   nlri,
+			Pattrs: append([]*anypb.Any{origin, nh, asp}, extra...),
+		},
+	})
+	require.NoError(t, err)
+}
+
 func announceIPv4WithUnknownAttr(t *testing.T, s *gobgpserver.BgpServer,
 	prefix string, maskLen uint32, nextHop string) {
 
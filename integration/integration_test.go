@@ -12,6 +12,9 @@ import (
 	pb "github.com/mellowdrifter/bgpwatch/proto"
 	api "github.com/osrg/gobgp/v3/api"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 const (
@@ -846,3 +849,142 @@ func TestBestPathFlipOnWithdrawal(t *testing.T) {
 	require.Equal(t, uint32(100), resp.Route.LocalPref)
 }
 
+
+func TestRouteAttributes(t *testing.T) {
+	t.Log("Testing that every path attribute is returned for a route")
+
+	bgpPort, grpcPort := portPair(62)
+	stop := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stop()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	med, _ := anypb.New(&api.MultiExitDiscAttribute{Med: 50})
+	atomic, _ := anypb.New(&api.AtomicAggregateAttribute{})
+	aggregator, _ := anypb.New(&api.AggregatorAttribute{Asn: 64501, Address: "192.0.2.1"})
+	segments := []*api.AsSegment{
+		{Type: api.AsSegment_AS_SEQUENCE, Numbers: []uint32{64501}},
+		{Type: api.AsSegment_AS_SET, Numbers: []uint32{64502, 64503}},
+	}
+	announceIPv4WithPathAttrs(t, gobgp, "3.3.3.0", 24, "10.0.0.1", segments, med, atomic, aggregator)
+
+	client := grpcClient(t, grpcPort)
+	var route *pb.Route
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetRoute(context.Background(), &pb.RouteRequest{Address: "3.3.3.0/24"})
+		if err != nil || !resp.Found {
+			return false
+		}
+		route = resp.Route
+		return true
+	}, 10*time.Second)
+
+	require.Equal(t, "INCOMPLETE", route.Origin)
+	require.Equal(t, uint32(50), route.Med)
+	require.Equal(t, "10.0.0.1", route.NextHop)
+	require.True(t, route.AtomicAggregate)
+	require.Equal(t, uint32(64501), route.AggregatorAs)
+	require.Equal(t, "192.0.2.1", route.AggregatorAddress)
+	require.Equal(t, []uint32{64500, 64501}, route.AsPath)
+	require.Len(t, route.AsPathSegments, 2)
+	require.Equal(t, "AS_SEQUENCE", route.AsPathSegments[0].Type)
+	require.Equal(t, []uint32{64500, 64501}, route.AsPathSegments[0].Asns)
+	require.Equal(t, "AS_SET", route.AsPathSegments[1].Type)
+	require.Equal(t, []uint32{64502, 64503}, route.AsPathSegments[1].Asns)
+}
+
+func TestExtendedCommunitySearch(t *testing.T) {
+	t.Log("Testing extended community decoding and lookups")
+
+	bgpPort, grpcPort := portPair(63)
+	stop := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stop()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	rt, _ := anypb.New(&api.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 0x02, Asn: 64500, LocalAdmin: 100})
+	soo, _ := anypb.New(&api.IPv4AddressSpecificExtended{IsTransitive: true, SubType: 0x03, Address: "192.0.2.1", LocalAdmin: 7})
+	ecs, _ := anypb.New(&api.ExtendedCommunitiesAttribute{Communities: []*anypb.Any{rt, soo}})
+	segments := []*api.AsSegment{{Type: api.AsSegment_AS_SEQUENCE, Numbers: []uint32{64500}}}
+	announceIPv4WithPathAttrs(t, gobgp, "4.4.4.0", 24, "10.0.0.1", segments, ecs)
+	announceIPv4(t, gobgp, "5.5.5.0", 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	var routes []*pb.Route
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetPrefixesByExtendedCommunity(context.Background(), &pb.ExtendedCommunityRequest{Community: "rt:64500:100"})
+		if err != nil {
+			return false
+		}
+		routes = resp.Routes
+		return len(routes) == 1
+	}, 10*time.Second)
+
+	require.Equal(t, "4.4.4.0/24", routes[0].Prefix)
+	require.Len(t, routes[0].ExtendedCommunities, 2)
+	require.Equal(t, "route-target", routes[0].ExtendedCommunities[0].Kind)
+	require.Equal(t, "rt:64500:100", routes[0].ExtendedCommunities[0].Value)
+	require.Equal(t, "route-origin", routes[0].ExtendedCommunities[1].Kind)
+	require.Equal(t, "192.0.2.1", routes[0].ExtendedCommunities[1].GlobalAdmin)
+	require.Equal(t, uint32(7), routes[0].ExtendedCommunities[1].LocalAdmin)
+
+	resp, err := client.GetPrefixesByExtendedCommunity(context.Background(), &pb.ExtendedCommunityRequest{Community: "soo:192.0.2.1:7"})
+	require.NoError(t, err)
+	require.Len(t, resp.Routes, 1)
+
+	_, err = client.GetPrefixesByExtendedCommunity(context.Background(), &pb.ExtendedCommunityRequest{Community: "bogus"})
+	require.Error(t, err)
+}
+
+func TestRefreshPeer(t *testing.T) {
+	t.Log("Testing that RefreshPeer re-pulls a peer's table without resetting the session")
+
+	bgpPort, grpcPort := portPair(64)
+	stop := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stop()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	announceIPv4(t, gobgp, "4.4.4.0", 24, "10.0.0.1", []uint32{64500})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 1
+	}, 10*time.Second)
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, stats.PeerStats, 1)
+	var name string
+	for name = range stats.PeerStats {
+	}
+
+	_, err = client.RefreshPeer(context.Background(), &pb.RefreshPeerRequest{Peer: name, Afi: 1, Safi: 1})
+	require.NoError(t, err)
+
+	_, err = client.RefreshPeer(context.Background(), &pb.RefreshPeerRequest{Peer: "no-such-peer", Afi: 1, Safi: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// The peer answers by re-sending its table over the same session
+	var after *pb.PeerStats
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+		if err != nil || resp.PeerStats[name] == nil {
+			return false
+		}
+		after = resp.PeerStats[name]
+		return after.InUpdates > stats.PeerStats[name].InUpdates
+	}, 10*time.Second)
+	require.Equal(t, stats.PeerStats[name].Flaps, after.Flaps)
+
+	resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), resp.Ipv4Count)
+}
@@ -0,0 +1,56 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/server"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+)
+
+func TestMaxPrefixTeardown(t *testing.T) {
+	t.Log("Testing that a peer exceeding its maximum prefixes is sent a Cease and its routes removed")
+	bgpPort, grpcPort := portPair(70)
+	stopBW := startBGPWatchWithPeers(t, bgpPort, grpcPort, map[string]server.PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", MaxPrefixesV4: 2},
+	})
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	client := grpcClient(t, grpcPort)
+	announceIPv4(t, gobgp, "192.0.2.0", 24, "10.0.0.1", []uint32{64500})
+	announceIPv4(t, gobgp, "198.51.100.0", 24, "10.0.0.1", []uint32{64500})
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 2
+	}, 10*time.Second)
+
+	announceIPv4(t, gobgp, "203.0.113.0", 24, "10.0.0.1", []uint32{64500})
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if n.Sent && n.SubcodeName == "Maximum Number of Prefixes Reached" && n.Message == "AFI 1 SAFI 1 limit 2" {
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 0
+	}, 10*time.Second)
+}
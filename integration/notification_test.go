@@ -0,0 +1,87 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/server"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownCommunication(t *testing.T) {
+	t.Log("Testing that an RFC 8203 shutdown communication from the peer is decoded")
+	bgpPort, grpcPort := portPair(61)
+	stopBW := startBGPWatch(t, bgpPort, grpcPort, false)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	err := gobgp.ShutdownPeer(context.Background(), &api.ShutdownPeerRequest{
+		Address:       "127.0.0.1",
+		Communication: "maintenance until 02:00",
+	})
+	require.NoError(t, err)
+
+	client := grpcClient(t, grpcPort)
+	var got *pb.Notification
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if !n.Sent {
+					got = n
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+
+	require.Equal(t, "Cease", got.CodeName)
+	require.Equal(t, "Administrative Shutdown", got.SubcodeName)
+	require.Equal(t, "maintenance until 02:00", got.Message)
+}
+
+func TestUnexpectedRemoteAS(t *testing.T) {
+	t.Log("Testing that a peer announcing an AS other than its configured remote_as is refused")
+	bgpPort, grpcPort := portPair(71)
+	stopBW := startBGPWatchWithPeers(t, bgpPort, grpcPort, map[string]server.PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", RemoteAS: server.ASNSet{{Low: 64510, High: 64520}}},
+	})
+	defer stopBW()
+
+	_, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if n.Sent && n.CodeName == "OPEN Message Error" && n.SubcodeName == "Bad Peer AS" {
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+
+	resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Zero(t, resp.Ipv4Count)
+}
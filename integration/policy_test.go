@@ -0,0 +1,91 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportPolicy(t *testing.T) {
+	t.Log("Testing that routes go through the peer's import policy before they are stored")
+	bgpPort, grpcPort := portPair(79)
+	file := filepath.Join(t.TempDir(), "peers.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{
+		"peers": [{"ip": "127.0.0.1", "name": "policy", "import_policy": "in"}],
+		"prefix_lists": {"default": [{"prefix": "0.0.0.0/0"}]},
+		"as_path_lists": {"transit": ["_174_"]},
+		"community_lists": {"internal": ["3356:*"]},
+		"policies": {"in": [
+			{"name": "default", "prefix_list": "default", "action": "reject"},
+			{"name": "too-specific", "longer_than_v4": 24, "action": "reject"},
+			{"name": "private-asns", "bogon_asn": true, "action": "reject"},
+			{"name": "scrub", "strip_communities": "internal"},
+			{"name": "transit", "as_path_list": "transit", "set_local_pref": 80, "add_communities": ["64533:174"]}
+		]}
+	}`), 0o600))
+
+	stopBW := startBGPWatchWithConfigFile(t, bgpPort, grpcPort, file)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 3356, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	client := grpcClient(t, grpcPort)
+	announceIPv4(t, gobgp, "0.0.0.0", 0, "10.0.0.1", []uint32{174})
+	announceIPv4(t, gobgp, "1.1.1.0", 25, "10.0.0.1", []uint32{13335})
+	announceIPv4(t, gobgp, "8.8.8.0", 24, "10.0.0.1", []uint32{15169, 64512})
+	announceIPv4WithCommunities(t, gobgp, "1.1.1.0", 24, "10.0.0.1", []uint32{174, 13335}, []uint32{3356<<16 | 1, 13335<<16 | 1})
+	announceIPv4(t, gobgp, "9.9.9.0", 24, "10.0.0.1", []uint32{19281})
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, ps := range resp.PeerStats {
+			return ps.PolicyRejects == 3
+		}
+		return false
+	}, 10*time.Second)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 2
+	}, 10*time.Second)
+
+	resp, err := client.GetRoute(context.Background(), &pb.RouteRequest{Address: "1.1.1.1"})
+	require.NoError(t, err)
+	require.True(t, resp.Found)
+	require.Equal(t, "1.1.1.0/24", resp.Route.Prefix)
+	require.Equal(t, uint32(80), resp.Route.LocalPref)
+	require.Len(t, resp.Route.Communities, 2)
+	require.ElementsMatch(t, []uint32{13335<<16 | 1, 64533<<16 | 174}, []uint32{
+		resp.Route.Communities[0].High<<16 | resp.Route.Communities[0].Low,
+		resp.Route.Communities[1].High<<16 | resp.Route.Communities[1].Low,
+	})
+
+	// The routes as sent are kept for the pre view
+	for view, want := range map[string]int{"pre": 1, "post": 0} {
+		routes, err := client.GetRoutes(context.Background(), &pb.RouteRequest{Address: "8.8.8.0/24", View: view})
+		require.NoError(t, err)
+		require.Len(t, routes.Routes, want, view)
+	}
+	routes, err := client.GetRoutes(context.Background(), &pb.RouteRequest{Address: "1.1.1.1", View: "pre"})
+	require.NoError(t, err)
+	require.Len(t, routes.Routes, 1)
+	require.Equal(t, "1.1.1.0/25", routes.Routes[0].Prefix)
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	for _, ps := range stats.PeerStats {
+		require.Equal(t, uint64(5), ps.PrePolicyPathCount)
+		require.Equal(t, uint64(2), ps.PathCount)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginValidation(t *testing.T) {
+	t.Log("Testing that routes are validated against the VRPs of an rpki-client export")
+	bgpPort, grpcPort := portPair(77)
+	dir := t.TempDir()
+	vrps := filepath.Join(dir, "vrps.json")
+	require.NoError(t, os.WriteFile(vrps, []byte(`{"roas": [
+		{"asn": 64500, "prefix": "192.0.2.0/24", "maxLength": 24, "ta": "test"},
+		{"asn": 64511, "prefix": "198.51.100.0/22", "maxLength": 24, "ta": "test"}
+	]}`), 0o600))
+	file := filepath.Join(dir, "peers.json")
+	require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf(`{
+		"peers": [{"ip": "127.0.0.1", "name": "rov"}],
+		"rpki": {"vrp_file": %q}
+	}`, vrps)), 0o600))
+
+	stopBW := startBGPWatchWithConfigFile(t, bgpPort, grpcPort, file)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	client := grpcClient(t, grpcPort)
+	announceIPv4(t, gobgp, "192.0.2.0", 24, "10.0.0.1", []uint32{64500})
+	announceIPv4(t, gobgp, "198.51.100.0", 24, "10.0.0.1", []uint32{64500})
+	announceIPv4(t, gobgp, "203.0.113.0", 24, "10.0.0.1", []uint32{64500})
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 3
+	}, 10*time.Second)
+
+	for state, want := range map[string]string{
+		"valid":     "192.0.2.0/24",
+		"invalid":   "198.51.100.0/24",
+		"not-found": "203.0.113.0/24",
+	} {
+		resp, err := client.GetRoutesByValidationState(context.Background(), &pb.ValidationStateRequest{State: state})
+		require.NoError(t, err)
+		require.Len(t, resp.Routes, 1, state)
+		require.Equal(t, want, resp.Routes[0].Prefix, state)
+		require.Equal(t, state, resp.Routes[0].ValidationState)
+	}
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, stats.PeerStats, 1)
+	for _, ps := range stats.PeerStats {
+		require.Equal(t, uint64(1), ps.RpkiInvalids)
+	}
+}
+
+func TestASPAVerification(t *testing.T) {
+	t.Log("Testing that AS paths are verified against the ASPAs of an rpki-client export")
+	bgpPort, grpcPort := portPair(78)
+	dir := t.TempDir()
+	vrps := filepath.Join(dir, "vrps.json")
+	require.NoError(t, os.WriteFile(vrps, []byte(`{"roas": [], "aspas": [
+		{"customer_asid": 64500, "expires": 1700000000, "providers": [64510]},
+		{"customer_asid": 64501, "expires": 1700000000, "providers": [64500]},
+		{"customer_asid": 64503, "expires": 1700000000, "providers": [64510]}
+	]}`), 0o600))
+	file := filepath.Join(dir, "peers.json")
+	require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf(`{
+		"peers": [{"ip": "127.0.0.1", "name": "aspa"}],
+		"rpki": {"vrp_file": %q}
+	}`, vrps)), 0o600))
+
+	stopBW := startBGPWatchWithConfigFile(t, bgpPort, grpcPort, file)
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGP(t, 64500, "10.0.0.1", "127.0.0.1", 64533, bgpPort, false, false)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	client := grpcClient(t, grpcPort)
+	// 64500 64501: from a customer of the peer
+	announceIPv4(t, gobgp, "192.0.2.0", 24, "10.0.0.1", []uint32{64501})
+	// 64500 64502 64503: AS64502 is a provider of neither AS64503 nor AS64500
+	announceIPv4(t, gobgp, "198.51.100.0", 24, "10.0.0.1", []uint32{64502, 64503})
+	// 64500 64504 64505: no ASPAs for AS64504 or AS64505
+	announceIPv4(t, gobgp, "203.0.113.0", 24, "10.0.0.1", []uint32{64504, 64505})
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetTotals(context.Background(), &pb.Empty{})
+		return err == nil && resp.Ipv4Count == 3
+	}, 10*time.Second)
+
+	resp, err := client.GetASPAInvalidRoutes(context.Background(), &pb.ViewRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Routes, 1)
+	require.Equal(t, "198.51.100.0/24", resp.Routes[0].Prefix)
+	require.Equal(t, "invalid", resp.Routes[0].AspaState)
+	require.Equal(t, []uint32{64500, 64502, 64503}, resp.Routes[0].AsPath)
+}
@@ -0,0 +1,177 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/server"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActiveSession(t *testing.T) {
+	t.Log("Testing an outbound session initiated by bgpwatch")
+	t.Log("Expected: bgpwatch dials the passive GoBGP peer and learns its routes")
+	bgpPort, grpcPort := portPair(60)
+	gobgpPort := bgpPort + 1
+
+	gobgp, stopGoBGP := startGoBGPPassive(t, 64500, "10.0.0.1", "127.0.0.1", 64533, gobgpPort)
+	defer stopGoBGP()
+
+	stopBW := startBGPWatchWithPeers(t, bgpPort, grpcPort, map[string]server.PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Active: true, Port: gobgpPort, ConnectRetry: 1},
+	})
+	defer stopBW()
+
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	announceIPv4(t, gobgp, "8.8.8.0", 24, "10.0.0.1", []uint32{64500, 15169})
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetRoute(context.Background(), &pb.RouteRequest{Address: "8.8.8.0/24"})
+		return err == nil && resp.Found
+	}, 10*time.Second)
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, stats.PeerStats, 1)
+	for _, ps := range stats.PeerStats {
+		require.Equal(t, "Established", ps.SessionState)
+	}
+}
+
+func TestDynamicNeighbor(t *testing.T) {
+	t.Log("Testing that a peer within a listen range is accepted with its peer group's settings")
+	bgpPort, grpcPort := portPair(72)
+	stopBW := startBGPWatchWithRanges(t, bgpPort, grpcPort, []server.ListenRange{
+		{
+			Prefix: netip.MustParsePrefix("127.0.0.0/24"),
+			Template: server.PeerConfig{
+				Name:     "edge-{ip}",
+				Password: "s3cret",
+				RemoteAS: server.ASNSet{{Low: 64500, High: 64510}},
+			},
+		},
+	})
+	defer stopBW()
+
+	gobgp, stopGoBGP := startGoBGPWithPassword(t, 64500, "10.0.0.2", "127.0.0.2", 64533, bgpPort, "s3cret")
+	defer stopGoBGP()
+
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	client := grpcClient(t, grpcPort)
+	resp, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Contains(t, resp.PeerStats, "edge-127.0.0.2-v4")
+
+	// A peer in the range with the wrong AS is still refused
+	_, stopWrongAS := startGoBGPWithPassword(t, 64520, "10.0.0.3", "127.0.0.3", 64533, bgpPort, "s3cret")
+	defer stopWrongAS()
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if n.Sent && n.SubcodeName == "Bad Peer AS" {
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Log("Testing that a reloaded config adds, renames and removes peers on the running server")
+	bgpPort, grpcPort := portPair(73)
+	file := filepath.Join(t.TempDir(), "peers.json")
+	writeConfig := func(config string) {
+		require.NoError(t, os.WriteFile(file, []byte(config), 0o600))
+	}
+	writeConfig(`{"peers": [{"ip": "127.0.0.2", "name": "before", "password": "s3cret"}]}`)
+
+	stopBW := startBGPWatchWithConfigFile(t, bgpPort, grpcPort, file)
+	defer stopBW()
+
+	first, stopFirst := startGoBGPWithPassword(t, 64500, "10.0.0.2", "127.0.0.2", 64533, bgpPort, "s3cret")
+	defer stopFirst()
+	waitForSession(t, first, "127.0.0.1", 10*time.Second)
+
+	// The new peer's MD5 key must be installed on the listening socket to get in
+	writeConfig(`{"peers": [
+		{"ip": "127.0.0.2", "name": "after", "password": "s3cret"},
+		{"ip": "127.0.0.3", "password": "an0ther"}
+	]}`)
+	client := grpcClient(t, grpcPort)
+	resp, err := client.ReloadConfig(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.3"}, resp.Added)
+	require.Equal(t, []string{"127.0.0.2"}, resp.Changed)
+
+	second, stopSecond := startGoBGPWithPassword(t, 64501, "10.0.0.3", "127.0.0.3", 64533, bgpPort, "an0ther")
+	defer stopSecond()
+	waitForSession(t, second, "127.0.0.1", 15*time.Second)
+
+	stats, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Contains(t, stats.PeerStats, "after-v4")
+
+	writeConfig(`{"peers": [{"ip": "127.0.0.3", "password": "an0ther"}]}`)
+	resp, err = client.ReloadConfig(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.2"}, resp.Removed)
+
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetNotifications(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for _, history := range resp.Peers {
+			for _, n := range history.Notifications {
+				if n.Sent && n.SubcodeName == "Peer De-configured" {
+					return true
+				}
+			}
+		}
+		return false
+	}, 10*time.Second)
+}
+
+func TestTTLSecurity(t *testing.T) {
+	t.Log("Testing that a GTSM peer is accepted at TTL 255 and connections with a lower TTL are refused")
+	bgpPort, grpcPort := portPair(74)
+	stopBW := startBGPWatchWithPeers(t, bgpPort, grpcPort, map[string]server.PeerConfig{
+		"127.0.0.2": {IP: "127.0.0.2", Name: "gtsm", TTLSecurity: 1},
+	})
+	defer stopBW()
+
+	// GoBGP only accepts our packets if they are sent with TTL 255
+	gobgp, stopGoBGP := startGoBGPWithTTLSecurity(t, 64500, "10.0.0.2", "127.0.0.2", 64533, bgpPort, 255)
+	defer stopGoBGP()
+	waitForSession(t, gobgp, "127.0.0.1", 10*time.Second)
+
+	// Without GTSM the connection arrives with the default TTL and is refused
+	_, stopNoGTSM := startGoBGPWithTTLSecurity(t, 64500, "10.0.0.3", "127.0.0.2", 64533, bgpPort, 0)
+	defer stopNoGTSM()
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		stats, ok := resp.PeerStats["gtsm-v4"]
+		return ok && stats.TtlSecurityDrops > 0 && stats.SessionState == "Established"
+	}, 10*time.Second)
+}
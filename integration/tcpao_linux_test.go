@@ -0,0 +1,67 @@
+//go:build integration && linux
+// +build integration,linux
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/server"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// tcpAOSupported reports whether the kernel was built with TCP-AO. Without it TCP_AO_INFO is
+// not supported at all, with it the int is too short to be a struct tcp_ao_info_opt.
+func tcpAOSupported(t *testing.T) bool {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	require.NoError(t, err)
+
+	var optErr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		_, optErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, 40)
+	}))
+	return !errors.Is(optErr, unix.ENOPROTOOPT) && !errors.Is(optErr, unix.EOPNOTSUPP)
+}
+
+func TestTCPAO(t *testing.T) {
+	t.Log("Testing a session between two bgpwatch instances authenticated with TCP-AO")
+	if !tcpAOSupported(t) {
+		t.Skip("kernel built without TCP-AO")
+	}
+	bgpPort, grpcPort := portPair(75)
+	activePort, activeGrpcPort := portPair(76)
+	keys := []server.TCPAOKey{{ID: 1, Algorithm: "aes-128-cmac-96", Secret: "s3cret"}}
+
+	stopPassive := startBGPWatchWithPeers(t, bgpPort, grpcPort, map[string]server.PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Name: "ao", TCPAO: keys},
+	})
+	defer stopPassive()
+	stopActive := startBGPWatchWithPeers(t, activePort, activeGrpcPort, map[string]server.PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Active: true, Port: bgpPort, ConnectRetry: 1, LocalAS: 64999, TCPAO: keys},
+	})
+	defer stopActive()
+
+	client := grpcClient(t, grpcPort)
+	waitForConvergence(t, func() bool {
+		resp, err := client.GetSystemStats(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		for name, stats := range resp.PeerStats {
+			if strings.HasPrefix(name, "ao") && stats.SessionState == "Established" {
+				return true
+			}
+		}
+		return false
+	}, 15*time.Second)
+}
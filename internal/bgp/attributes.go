@@ -7,28 +7,42 @@ import (
 	"io"
 	"log"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 const (
 	// Type Codes
-	tcOrigin          = 1
-	tcASPath          = 2
-	tcNextHop         = 3
-	tcMED             = 4
-	tcLPref           = 5
-	tcAtoAgg          = 6
-	tcAggregator      = 7
-	tcCommunity       = 8
-	tcOriginator      = 9
-	tcClusterList     = 10
-	tcMPReachNLRI     = 14
-	tcExtendCommunity = 16
-	tcMPUnreachNLRI   = 15
-	tcLargeCommunity  = 32
+	tcOrigin           = 1
+	tcASPath           = 2
+	tcNextHop          = 3
+	tcMED              = 4
+	tcLPref            = 5
+	tcAtoAgg           = 6
+	tcAggregator       = 7
+	tcCommunity        = 8
+	tcOriginator       = 9
+	tcClusterList      = 10
+	tcMPReachNLRI      = 14
+	tcExtendCommunity  = 16
+	tcMPUnreachNLRI    = 15
+	tcAS4Path          = 17
+	tcAS4Aggregator    = 18
+	tcIPv6ExtCommunity = 25
+	tcLargeCommunity   = 32
+	tcOTC              = 35
 )
 
+// Confederation AS path segment types (RFC 5065)
+const (
+	asConfedSequence = 3
+	asConfedSet      = 4
+)
+
+// ASTrans is the 2-octet placeholder for a 4-octet ASN (RFC 6793)
+const ASTrans = 23456
+
 var (
 	// Some attributes here were deprecated a while back, while others
 	// were added in RFC8093
@@ -87,10 +101,20 @@ type PathAttr struct {
 	Communities       []Community
 	LargeCommunities  []LargeCommunity
 	ExtendCommunities []ExtendCommunity
+	OTC               uint32 // Only-To-Customer (RFC 9234), 0 if absent
 	NextHopsv6        []string
 	Ipv6NLRI          []V6Addr
 	V6Withdraws       []V6Addr
 	V6EoR             bool
+
+	// IPv4 unicast carried in MP_REACH_NLRI and MP_UNREACH_NLRI (RFC 4760)
+	NextHopsv4  []string
+	Ipv4NLRI    []V4Addr
+	V4Withdraws []V4Addr
+	V4EoR       bool
+
+	// Errors lists malformed attributes that were handled without resetting the session
+	Errors []AttrError
 }
 
 type Community struct {
@@ -104,19 +128,19 @@ type LargeCommunity struct {
 	Low   uint32
 }
 
-type ExtendCommunity struct {
-}
-
 type PrefixAttributes struct {
 	Attr        *PathAttr
 	V4prefixes  []V4Addr
 	V6prefixes  []V6Addr
 	V4Withdraws []V4Addr
 	V6Withdraws []V6Addr
-	V4NextHop   string
+	V4NextHops  []string
 	V6NextHops  []string
 	V4EoR       bool
 	V6EoR       bool
+
+	// TreatAsWithdraw is set when announced prefixes must be withdrawn instead (RFC 7606)
+	TreatAsWithdraw bool
 }
 
 type V4Addr struct {
@@ -131,21 +155,28 @@ type V6Addr struct {
 	ID     uint32
 }
 
-// DecodePathAttributes decodes the BGP Path Attributes from an UPDATE message.
-func DecodePathAttributes(attr []byte, v6AddPath bool, ignoreComms bool) (*PathAttr, error) {
+// DecodePathAttributes decodes the BGP Path Attributes from an UPDATE message. asn4 is set
+// when both sides have the 4-octet AS capability, otherwise AS_PATH and AGGREGATOR carry 2-octet
+// ASNs and are merged with AS4_PATH and AS4_AGGREGATOR. Malformed attributes are handled as per
+// RFC 7606 and recorded in PathAttr.Errors. An error is only returned when the session must be
+// reset, in which case it is an *AttrError.
+func DecodePathAttributes(attr []byte, asn4, v4AddPath, v6AddPath, ignoreComms bool) (*PathAttr, error) {
 	r := bytes.NewReader(attr)
 
 	var pa PathAttr
-	for {
-		if r.Len() == 0 {
-			break
-		}
+	var as4Path []AsnSegment
+	var as4AgAS uint32
+	var as4AgOrigin net.IP
+	seen := make(map[uint8]bool)
+	for r.Len() > 0 {
+		start := len(attr) - r.Len()
+
+		// A truncated attribute header or an attribute running past the end of the path
+		// attributes leaves the rest unparseable, but the NLRI can still be found.
 		var ah attrHeader
 		if err := binary.Read(r, binary.BigEndian, &ah); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+			pa.Errors = append(pa.Errors, AttrError{Action: ActionTreatAsWithdraw, Subcode: MalformedAttrList, Err: err})
+			break
 		}
 
 		buf := new(bytes.Buffer)
@@ -154,33 +185,64 @@ func DecodePathAttributes(attr []byte, v6AddPath bool, ignoreComms bool) (*PathA
 		if isExtended(ah.Type.Flags) {
 			var length uint16
 			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-				return nil, err
+				pa.Errors = append(pa.Errors, AttrError{Code: ah.Type.Code, Action: ActionTreatAsWithdraw, Subcode: MalformedAttrList, Err: err})
+				break
 			}
 			length64 = int64(length)
 		} else {
 			var length uint8
 			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
-				return nil, err
+				pa.Errors = append(pa.Errors, AttrError{Code: ah.Type.Code, Action: ActionTreatAsWithdraw, Subcode: MalformedAttrList, Err: err})
+				break
 			}
 			length64 = int64(length)
 		}
 
 		if _, err := io.CopyN(buf, r, length64); err != nil {
-			return nil, err
+			pa.Errors = append(pa.Errors, AttrError{Code: ah.Type.Code, Action: ActionTreatAsWithdraw, Subcode: AttrLengthError, Data: attr[start:], Err: err})
+			break
+		}
+		raw := attr[start : len(attr)-r.Len()]
+
+		// Only the first instance of an attribute is used, except for the MP attributes where
+		// we can't tell which NLRI to trust (RFC 7606 section 3g).
+		code := ah.Type.Code
+		if seen[code] {
+			if code == tcMPReachNLRI || code == tcMPUnreachNLRI {
+				return nil, &AttrError{Code: code, Action: ActionSessionReset, Subcode: MalformedAttrList, Err: fmt.Errorf("attribute repeated")}
+			}
+			pa.Errors = append(pa.Errors, AttrError{Code: code, Action: ActionAttributeDiscard, Subcode: MalformedAttrList, Err: fmt.Errorf("attribute repeated")})
+			continue
+		}
+		seen[code] = true
+
+		data := buf.Bytes()
+		if subcode, err := validateAttr(code, ah.Type.Flags, length64, asn4); err != nil {
+			e := newAttrError(code, subcode, data, err)
+			e.Data = raw
+			if e.Action == ActionSessionReset {
+				return nil, &e
+			}
+			pa.Errors = append(pa.Errors, e)
+			continue
 		}
 
 		var err error
-		switch ah.Type.Code {
+		switch code {
 		case tcOrigin:
 			pa.Origin, err = decodeOrigin(buf)
 		case tcASPath:
-			for buf.Len() > 0 {
-				var asns []AsnSegment
-				asns, err = decodeASPath(buf)
-				if err != nil {
-					break
+			pa.Aspath, err = decodeASPathSegments(buf, asn4)
+		case tcAS4Path:
+			// Only a 2-octet speaker has any use for AS4_PATH, and it must not carry
+			// confederation segments (RFC 6793 section 6)
+			var path []AsnSegment
+			if path, err = decodeASPathSegments(buf, true); err == nil && !asn4 {
+				for _, seg := range path {
+					if seg.Type == asSet || seg.Type == asSequence {
+						as4Path = append(as4Path, seg)
+					}
 				}
-				pa.Aspath = append(pa.Aspath, asns...)
 			}
 		case tcNextHop:
 			pa.NextHopv4, err = decode4byteIPv4(buf)
@@ -191,11 +253,17 @@ func DecodePathAttributes(attr []byte, v6AddPath bool, ignoreComms bool) (*PathA
 		case tcAtoAgg:
 			pa.Atomic = true
 		case tcAggregator:
-			pa.AgAS, pa.AgOrigin, err = decodeAggregator(buf)
+			pa.AgAS, pa.AgOrigin, err = decodeAggregator(buf, asn4)
+		case tcAS4Aggregator:
+			var asn uint32
+			var ip net.IP
+			if asn, ip, err = decodeAggregator(buf, true); err == nil && !asn4 {
+				as4AgAS, as4AgOrigin = asn, ip
+			}
 		case tcMPReachNLRI:
-			pa.Ipv6NLRI, pa.NextHopsv6, err = decodeMPReachNLRI(buf, v6AddPath)
+			err = pa.decodeMPReachNLRI(buf, v4AddPath, v6AddPath)
 		case tcMPUnreachNLRI:
-			pa.V6EoR, pa.V6Withdraws, err = decodeMPUnreachNLRI(buf, length64, v6AddPath)
+			err = pa.decodeMPUnreachNLRI(buf, v4AddPath, v6AddPath)
 		case tcCommunity:
 			if ignoreComms {
 				_, err = io.CopyN(io.Discard, buf, length64)
@@ -213,22 +281,53 @@ func DecodePathAttributes(attr []byte, v6AddPath bool, ignoreComms bool) (*PathA
 				_, err = io.CopyN(io.Discard, buf, length64)
 				continue
 			}
-			pa.ExtendCommunities, err = decodeExtendedCommunities(buf, length64)
+			var ecs []ExtendCommunity
+			ecs, err = decodeExtendedCommunities(buf, false)
+			pa.ExtendCommunities = append(pa.ExtendCommunities, ecs...)
+		case tcIPv6ExtCommunity:
+			if ignoreComms {
+				_, err = io.CopyN(io.Discard, buf, length64)
+				continue
+			}
+			var ecs []ExtendCommunity
+			ecs, err = decodeExtendedCommunities(buf, true)
+			pa.ExtendCommunities = append(pa.ExtendCommunities, ecs...)
 		case tcOriginator:
 			pa.Originator, err = decode4byteIPv4(buf)
 		case tcClusterList:
 			pa.ClusterList, err = decodeClusterList(buf, length64)
+		case tcOTC:
+			pa.OTC, err = decode4ByteNumber(buf)
 
 		default:
 			_, err = io.CopyN(io.Discard, buf, length64)
 		}
 
 		if err != nil {
-			return nil, err
+			e := newAttrError(code, valueSubcode(code), data, err)
+			e.Data = raw
+			if e.Action == ActionSessionReset {
+				return nil, &e
+			}
+			pa.Errors = append(pa.Errors, e)
+			continue
 		}
 
-		if desc, ok := deprecatedAttrs[ah.Type.Code]; ok {
-			log.Printf("Path Attribute %s (%d) is deprecated", desc, ah.Type.Code)
+		if desc, ok := deprecatedAttrs[code]; ok {
+			log.Printf("Path Attribute %s (%d) is deprecated", desc, code)
+		}
+	}
+
+	if !asn4 {
+		pa.mergeAS4(as4Path, as4AgAS, as4AgOrigin)
+	}
+
+	// ORIGIN and AS_PATH must be present unless the UPDATE only withdraws (RFC 7606 section 3d)
+	if len(seen) > 0 && !(len(seen) == 1 && seen[tcMPUnreachNLRI]) {
+		for _, code := range []uint8{tcOrigin, tcASPath} {
+			if !seen[code] {
+				pa.Errors = append(pa.Errors, AttrError{Code: code, Action: ActionTreatAsWithdraw, Subcode: MissingWellKnown, Data: []byte{code}, Err: fmt.Errorf("missing well-known attribute")})
+			}
 		}
 	}
 	return &pa, nil
@@ -243,6 +342,9 @@ func decodeOrigin(b *bytes.Buffer) (Origin, error) {
 	if err := binary.Read(b, binary.BigEndian, &o); err != nil {
 		return o, err
 	}
+	if o > 2 {
+		return o, fmt.Errorf("invalid origin: %d", o)
+	}
 	return o, nil
 }
 
@@ -275,31 +377,61 @@ type asnTL struct {
 	Length uint8
 }
 
+// AsnSegment is one segment of an AS path: an AS_SET, AS_SEQUENCE or one of the
+// confederation types, with its ASNs in order.
 type AsnSegment struct {
 	Type uint8
-	ASN  uint32
+	ASNs []uint32
 }
 
-func decodeASPath(b *bytes.Buffer) ([]AsnSegment, error) {
+// decodeASPathSegments decodes every segment of an AS_PATH or AS4_PATH, with 2-octet ASNs
+// unless asn4 is set.
+func decodeASPathSegments(b *bytes.Buffer, asn4 bool) ([]AsnSegment, error) {
+	var path []AsnSegment
+	for b.Len() > 0 {
+		seg, err := decodeASPath(b, asn4)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, seg)
+	}
+	return path, nil
+}
+
+func decodeASPath(b *bytes.Buffer, asn4 bool) (AsnSegment, error) {
 	var tl asnTL
 	if err := binary.Read(b, binary.BigEndian, &tl); err != nil {
-		return nil, err
+		return AsnSegment{}, err
 	}
-	var asns = make([]AsnSegment, tl.Length)
-	for i := uint8(0); i < tl.Length; i++ {
-		var asn AsnSegment
-		asn.Type = tl.Type
-		if err := binary.Read(b, binary.BigEndian, &asn.ASN); err != nil {
-			return nil, err
+	// AS_SET, AS_SEQUENCE and the two confederation types (RFC 5065)
+	if tl.Type < asSet || tl.Type > asConfedSet {
+		return AsnSegment{}, fmt.Errorf("invalid AS_PATH segment type: %d", tl.Type)
+	}
+	seg := AsnSegment{Type: tl.Type, ASNs: make([]uint32, tl.Length)}
+	for i := range seg.ASNs {
+		asn, err := decodeASN(b, asn4)
+		if err != nil {
+			return AsnSegment{}, err
 		}
-		asns[i] = asn
+		seg.ASNs[i] = asn
 	}
-	return asns, nil
+	return seg, nil
 }
 
-func decodeAggregator(b *bytes.Buffer) (uint32, net.IP, error) {
-	var asn uint32
+func decodeASN(b *bytes.Buffer, asn4 bool) (uint32, error) {
+	if asn4 {
+		return decode4ByteNumber(b)
+	}
+	var asn uint16
 	if err := binary.Read(b, binary.BigEndian, &asn); err != nil {
+		return 0, err
+	}
+	return uint32(asn), nil
+}
+
+func decodeAggregator(b *bytes.Buffer, asn4 bool) (uint32, net.IP, error) {
+	asn, err := decodeASN(b, asn4)
+	if err != nil {
 		return 0, nil, err
 	}
 	ip := make([]byte, 4)
@@ -309,6 +441,73 @@ func decodeAggregator(b *bytes.Buffer) (uint32, net.IP, error) {
 	return asn, net.IP(ip), nil
 }
 
+// mergeAS4 rebuilds the AS path and aggregator of a route from a 2-octet speaker using the
+// AS4_PATH and AS4_AGGREGATOR attributes, as per RFC 6793 section 4.2.3.
+func (pa *PathAttr) mergeAS4(as4Path []AsnSegment, as4AgAS uint32, as4AgOrigin net.IP) {
+	if pa.AgOrigin != nil {
+		// An aggregator that isn't AS_TRANS was added by a 2-octet speaker after the last
+		// 4-octet one, so neither AS4 attribute can be trusted
+		if pa.AgAS != ASTrans {
+			return
+		}
+		if as4AgOrigin != nil {
+			pa.AgAS, pa.AgOrigin = as4AgAS, as4AgOrigin
+		}
+	}
+
+	n, n4 := pathLength(pa.Aspath), pathLength(as4Path)
+	if len(as4Path) == 0 || n < n4 {
+		return
+	}
+
+	// Keep the leading ASNs that AS4_PATH doesn't cover, along with any confederation
+	// segments, then replace the rest with AS4_PATH
+	var merged []AsnSegment
+	need := n - n4
+keep:
+	for _, seg := range pa.Aspath {
+		switch seg.Type {
+		case asSequence:
+			if need == 0 {
+				break keep
+			}
+			k := min(need, len(seg.ASNs))
+			merged = append(merged, AsnSegment{Type: asSequence, ASNs: slices.Clone(seg.ASNs[:k])})
+			need -= k
+		case asSet:
+			if need == 0 {
+				break keep
+			}
+			merged = append(merged, seg)
+			need--
+		default:
+			merged = append(merged, seg)
+		}
+	}
+
+	// A sequence kept from AS_PATH runs straight on into one leading AS4_PATH
+	if last := len(merged) - 1; last >= 0 && merged[last].Type == asSequence && as4Path[0].Type == asSequence {
+		merged[last].ASNs = append(merged[last].ASNs, as4Path[0].ASNs...)
+		as4Path = as4Path[1:]
+	}
+	pa.Aspath = append(merged, as4Path...)
+}
+
+// pathLength is the RFC 4271 section 9.1.2.2 length of an AS path. An AS_SET counts as one
+// and confederation segments not at all.
+func pathLength(path []AsnSegment) int {
+	n := 0
+	for _, seg := range path {
+		switch seg.Type {
+		case asSequence:
+			n += len(seg.ASNs)
+		case asSet:
+			n++
+		}
+	}
+	return n
+}
+
 func decodeCommunities(b *bytes.Buffer, length int64) ([]Community, error) {
 	var communities = make([]Community, 0, length/4)
 	for b.Len() > 0 {
@@ -339,13 +538,6 @@ func decodeLargeCommunities(b *bytes.Buffer, length int64) ([]LargeCommunity, er
 	return communities, nil
 }
 
-func decodeExtendedCommunities(b *bytes.Buffer, length int64) ([]ExtendCommunity, error) {
-	if _, err := io.CopyN(io.Discard, b, length); err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
-
 func decodeClusterList(b *bytes.Buffer, length int64) ([]string, error) {
 	ids := int(length / 4)
 	var cluster = make([]string, 0, ids)
@@ -442,59 +634,100 @@ func getIPv6Prefix(b *bytes.Buffer, mask uint8) (net.IP, error) {
 	return net.IP(ip), nil
 }
 
-func decodeMPReachNLRI(b *bytes.Buffer, addPath bool) ([]V6Addr, []string, error) {
-	var afi uint16
-	var safi uint8
-	if err := binary.Read(b, binary.BigEndian, &afi); err != nil {
-		return nil, nil, err
+type mpHeader struct {
+	AFI  uint16
+	SAFI uint8
+}
+
+func (h mpHeader) ipv4Unicast() bool {
+	return h.AFI == 1 && h.SAFI == 1
+}
+
+func (h mpHeader) ipv6Unicast() bool {
+	return h.AFI == 2 && h.SAFI == 1
+}
+
+// decodeMPReachNLRI decodes an MP_REACH_NLRI into the fields for its AFI/SAFI. Families other
+// than IPv4 and IPv6 unicast are skipped.
+func (pa *PathAttr) decodeMPReachNLRI(b *bytes.Buffer, v4AddPath, v6AddPath bool) error {
+	var h mpHeader
+	if err := binary.Read(b, binary.BigEndian, &h); err != nil {
+		return err
 	}
-	if err := binary.Read(b, binary.BigEndian, &safi); err != nil {
-		return nil, nil, err
+	if !h.ipv4Unicast() && !h.ipv6Unicast() {
+		b.Next(b.Len())
+		return nil
 	}
 
 	var nhLen uint8
 	if err := binary.Read(b, binary.BigEndian, &nhLen); err != nil {
-		return nil, nil, err
+		return err
 	}
-
-	var nextHops []string
-	nh := bytes.NewBuffer(make([]byte, 0, 16))
-	if _, err := io.CopyN(nh, b, 16); err != nil {
-		return nil, nil, err
+	// IPv4 routes may also have IPv6 next hops (RFC 8950)
+	if (h.ipv4Unicast() && nhLen != 4 && nhLen != 16 && nhLen != 32) || (h.ipv6Unicast() && nhLen != 16 && nhLen != 32) {
+		return fmt.Errorf("invalid next hop length %d for AFI %d SAFI %d", nhLen, h.AFI, h.SAFI)
 	}
-	ip, err := decode16byteIPv6(nh)
+	nextHops, err := decodeMPNextHops(b, nhLen)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	nextHops = append(nextHops, ip)
 
-	if nhLen == 32 {
-		llnh := bytes.NewBuffer(make([]byte, 0, 16))
-		if _, err := io.CopyN(llnh, b, 16); err != nil {
-			return nil, nil, err
-		}
-		llip, err := decode16byteIPv6(llnh)
+	// Skip SNPA
+	b.Next(1)
+
+	if h.ipv4Unicast() {
+		pa.NextHopsv4 = nextHops
+		pa.Ipv4NLRI, err = DecodeIPv4NLRI(bytes.NewReader(b.Next(b.Len())), v4AddPath)
+		return err
+	}
+	pa.NextHopsv6 = nextHops
+	pa.Ipv6NLRI, err = decodeIPv6NLRI(b, v6AddPath)
+	return err
+}
+
+// decodeMPNextHops decodes an IPv4 next hop, or an IPv6 global next hop optionally followed
+// by a link-local one (RFC 2545).
+func decodeMPNextHops(b *bytes.Buffer, nhLen uint8) ([]string, error) {
+	if nhLen == 4 {
+		nh, err := decode4byteIPv4(b)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		nextHops = append(nextHops, llip)
+		return []string{nh}, nil
 	}
 
-	// Skip SNPA
-	b.Next(1)
-
-	nlri, err := decodeIPv6NLRI(b, addPath)
-	return nlri, nextHops, err
+	var nextHops []string
+	for range nhLen / 16 {
+		nh, err := decode16byteIPv6(b)
+		if err != nil {
+			return nil, err
+		}
+		nextHops = append(nextHops, nh)
+	}
+	return nextHops, nil
 }
 
-func decodeMPUnreachNLRI(b *bytes.Buffer, length int64, addPath bool) (bool, []V6Addr, error) {
-	if length == 3 {
-		b.Next(3)
-		return true, nil, nil
+// decodeMPUnreachNLRI decodes an MP_UNREACH_NLRI into the fields for its AFI/SAFI. One with no
+// withdrawn routes is the End-of-RIB marker for the family (RFC 4724 section 2).
+func (pa *PathAttr) decodeMPUnreachNLRI(b *bytes.Buffer, v4AddPath, v6AddPath bool) error {
+	var h mpHeader
+	if err := binary.Read(b, binary.BigEndian, &h); err != nil {
+		return err
 	}
-	b.Next(3)
-	nlri, err := decodeIPv6NLRI(b, addPath)
-	return false, nlri, err
+	eor := b.Len() == 0
+
+	var err error
+	switch {
+	case h.ipv4Unicast():
+		pa.V4EoR = eor
+		pa.V4Withdraws, err = DecodeIPv4NLRI(bytes.NewReader(b.Next(b.Len())), v4AddPath)
+	case h.ipv6Unicast():
+		pa.V6EoR = eor
+		pa.V6Withdraws, err = decodeIPv6NLRI(b, v6AddPath)
+	default:
+		b.Next(b.Len())
+	}
+	return err
 }
 
 // DecodeIPv4Withdraws decodes IPv4 withdrawals.
@@ -511,28 +744,21 @@ func DecodeIPv4Withdraws(wd []byte, addPath bool) (*PrefixAttributes, error) {
 
 // FormatASPath returns a formatted AS-PATH string.
 func FormatASPath(asns *[]AsnSegment) string {
-	var sequence, set []int
 	var b strings.Builder
 
-	for _, asn := range *asns {
-		if asn.Type == 2 {
-			sequence = append(sequence, int(asn.ASN))
-			continue
-		}
-		if asn.Type == 1 {
-			set = append(set, int(asn.ASN))
-		}
-	}
-
-	for _, v := range sequence {
-		b.WriteString(strconv.Itoa(v) + " ")
-	}
-	if len(set) > 0 {
-		b.WriteString("{ ")
-		for _, v := range set {
-			b.WriteString(strconv.Itoa(v) + " ")
+	for _, seg := range *asns {
+		switch seg.Type {
+		case asSequence:
+			for _, v := range seg.ASNs {
+				b.WriteString(strconv.Itoa(int(v)) + " ")
+			}
+		case asSet:
+			b.WriteString("{ ")
+			for _, v := range seg.ASNs {
+				b.WriteString(strconv.Itoa(int(v)) + " ")
+			}
+			b.WriteString("} ")
 		}
-		b.WriteString("}")
 	}
 
 	return strings.TrimSpace(b.String())
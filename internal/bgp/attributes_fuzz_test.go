@@ -7,12 +7,14 @@ import (
 
 func FuzzDecodePathAttributes(f *testing.F) {
 	// Add some seed corpus
-	f.Add([]byte{0x40, 0x01, 0x01, 0x00}, false)                               // Origin IGP
-	f.Add([]byte{0x40, 0x02, 0x04, 0x02, 0x01, 0x00, 0x00, 0x00, 0x64}, false) // AS Path [100]
+	f.Add([]byte{0x40, 0x01, 0x01, 0x00}, true, false)                               // Origin IGP
+	f.Add([]byte{0x40, 0x02, 0x04, 0x02, 0x01, 0x00, 0x00, 0x00, 0x64}, true, false) // AS Path [100]
+	// AS Path [AS_TRANS] from a 2-octet speaker, with AS4_PATH [65536]
+	f.Add([]byte{0x40, 0x02, 0x04, 0x02, 0x01, 0x5b, 0xa0, 0xc0, 0x11, 0x06, 0x02, 0x01, 0x00, 0x01, 0x00, 0x00}, false, false)
 
-	f.Fuzz(func(t *testing.T, data []byte, ignoreComms bool) {
+	f.Fuzz(func(t *testing.T, data []byte, asn4, ignoreComms bool) {
 		// We don't care about the result, only that it doesn't panic
-		_, _ = DecodePathAttributes(data, false, ignoreComms)
+		_, _ = DecodePathAttributes(data, asn4, false, false, ignoreComms)
 	})
 }
 
@@ -48,8 +50,8 @@ func FuzzDecodeMPReachNLRI(f *testing.F) {
 	f.Add([]byte{0, 2, 1, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 64, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0})
 
 	f.Fuzz(func(t *testing.T, data []byte) {
-		buf := bytes.NewBuffer(data)
-		_, _, _ = decodeMPReachNLRI(buf, false)
+		var pa PathAttr
+		_ = pa.decodeMPReachNLRI(bytes.NewBuffer(data), false, false)
 	})
 }
 
@@ -58,7 +60,7 @@ func FuzzDecodeMPUnreachNLRI(f *testing.F) {
 	f.Add([]byte{0, 2, 1, 64, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0})
 
 	f.Fuzz(func(t *testing.T, data []byte) {
-		buf := bytes.NewBuffer(data)
-		_, _, _ = decodeMPUnreachNLRI(buf, int64(len(data)), false)
+		var pa PathAttr
+		_ = pa.decodeMPUnreachNLRI(bytes.NewBuffer(data), false, false)
 	})
 }
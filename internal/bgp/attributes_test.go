@@ -2,6 +2,8 @@ package bgp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"net"
 	"testing"
 
@@ -20,11 +22,7 @@ func TestDecodeASPath(t *testing.T) {
 			want: []AsnSegment{
 				AsnSegment{
 					Type: 2,
-					ASN:  37100,
-				},
-				AsnSegment{
-					Type: 2,
-					ASN:  6453,
+					ASNs: []uint32{37100, 6453},
 				},
 			},
 		},
@@ -34,11 +32,41 @@ func TestDecodeASPath(t *testing.T) {
 			want: []AsnSegment{
 				AsnSegment{
 					Type: 1,
-					ASN:  52367,
+					ASNs: []uint32{52367, 263726},
+				},
+			},
+		},
+		{
+			desc: "Test 3, two adjacent AS_SETs",
+			input: []byte{
+				0x01, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+				0x01, 0x02, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x04,
+			},
+			want: []AsnSegment{
+				AsnSegment{
+					Type: 1,
+					ASNs: []uint32{1, 2},
 				},
 				AsnSegment{
 					Type: 1,
-					ASN:  263726,
+					ASNs: []uint32{3, 4},
+				},
+			},
+		},
+		{
+			desc: "Test 4, confederation sequence then AS_SEQUENCE",
+			input: []byte{
+				0x03, 0x01, 0x00, 0x00, 0xfd, 0xe8,
+				0x02, 0x01, 0x00, 0x00, 0x00, 0x64,
+			},
+			want: []AsnSegment{
+				AsnSegment{
+					Type: 3,
+					ASNs: []uint32{65000},
+				},
+				AsnSegment{
+					Type: 2,
+					ASNs: []uint32{100},
 				},
 			},
 		},
@@ -46,7 +74,7 @@ func TestDecodeASPath(t *testing.T) {
 
 	for _, test := range tests {
 		buf := bytes.NewBuffer(test.input)
-		got, _ := decodeASPath(buf)
+		got, _ := decodeASPathSegments(buf, true)
 
 		if !cmp.Equal(got, test.want) {
 			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got, test.want)
@@ -110,7 +138,7 @@ func TestDecodeAggregator(t *testing.T) {
 
 	for _, test := range tests {
 		buf := bytes.NewBuffer(test.input)
-		gotASN, gotIP, _ := decodeAggregator(buf)
+		gotASN, gotIP, _ := decodeAggregator(buf, true)
 
 		if !cmp.Equal(gotASN, test.wantASN) {
 			t.Errorf("Test (%s): got %+v, want %+v", test.desc, gotASN, test.wantASN)
@@ -285,7 +313,9 @@ func TestDecodeMPReachNLRI(t *testing.T) {
 	}
 	for _, test := range tests {
 		buf := bytes.NewBuffer(test.input)
-		ip, nh, _ := decodeMPReachNLRI(buf, false)
+		var pa PathAttr
+		pa.decodeMPReachNLRI(buf, false, false)
+		ip, nh := pa.Ipv6NLRI, pa.NextHopsv6
 
 		if !cmp.Equal(nh, test.wantNH) {
 			t.Errorf("Test (%s): got %+v, want %+v", test.desc, nh, test.wantNH)
@@ -296,6 +326,96 @@ func TestDecodeMPReachNLRI(t *testing.T) {
 	}
 }
 
+func TestDecodeMPFamilies(t *testing.T) {
+	tests := []struct {
+		desc      string
+		reach     bool
+		input     []byte
+		want      PathAttr
+		wantError bool
+	}{
+		{
+			desc:  "IPv4 unicast in MP_REACH_NLRI",
+			reach: true,
+			input: []byte{0x00, 0x01, 0x01, 0x04, 0xc0, 0x00, 0x02, 0x01, 0x00, 0x18, 0xc6, 0x33, 0x64},
+			want: PathAttr{
+				NextHopsv4: []string{"192.0.2.1"},
+				Ipv4NLRI:   []V4Addr{{Mask: 24, Prefix: net.IP{198, 51, 100, 0}}},
+			},
+		},
+		{
+			desc:  "IPv4 unicast with IPv6 global and link-local next hops",
+			reach: true,
+			input: []byte{
+				0x00, 0x01, 0x01, 0x20, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01, 0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01, 0x00, 0x18, 0xc6, 0x33, 0x64,
+			},
+			want: PathAttr{
+				NextHopsv4: []string{"2001:db8::1", "fe80::1"},
+				Ipv4NLRI:   []V4Addr{{Mask: 24, Prefix: net.IP{198, 51, 100, 0}}},
+			},
+		},
+		{
+			desc:      "IPv4 unicast with a bad next hop length",
+			reach:     true,
+			input:     append([]byte{0x00, 0x01, 0x01, 0x08}, make([]byte, 9)...),
+			wantError: true,
+		},
+		{
+			desc:      "IPv6 unicast with an IPv4 next hop",
+			reach:     true,
+			input:     []byte{0x00, 0x02, 0x01, 0x04, 0xc0, 0x00, 0x02, 0x01, 0x00},
+			wantError: true,
+		},
+		{
+			desc:  "other families are skipped",
+			reach: true,
+			input: []byte{0x00, 0x01, 0x85, 0x00, 0x00, 0x07, 0x01, 0x04, 0xc0, 0x00, 0x02, 0x01},
+		},
+		{
+			desc:  "IPv4 withdrawn in MP_UNREACH_NLRI",
+			input: []byte{0x00, 0x01, 0x01, 0x18, 0xc6, 0x33, 0x64},
+			want: PathAttr{
+				V4Withdraws: []V4Addr{{Mask: 24, Prefix: net.IP{198, 51, 100, 0}}},
+			},
+		},
+		{
+			desc:  "IPv4 End-of-RIB",
+			input: []byte{0x00, 0x01, 0x01},
+			want:  PathAttr{V4EoR: true},
+		},
+		{
+			desc:  "IPv6 End-of-RIB",
+			input: []byte{0x00, 0x02, 0x01},
+			want:  PathAttr{V6EoR: true},
+		},
+		{
+			desc:  "End-of-RIB for other families is ignored",
+			input: []byte{0x00, 0x01, 0x02},
+		},
+	}
+	for _, test := range tests {
+		var got PathAttr
+		var err error
+		if test.reach {
+			err = got.decodeMPReachNLRI(bytes.NewBuffer(test.input), false, false)
+		} else {
+			err = got.decodeMPUnreachNLRI(bytes.NewBuffer(test.input), false, false)
+		}
+		if (err != nil) != test.wantError {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantError)
+			continue
+		}
+		if test.wantError {
+			continue
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
 func TestDecodePathAttributes(t *testing.T) {
 	tests := []struct {
 		desc  string
@@ -349,7 +469,7 @@ func TestDecodePathAttributes(t *testing.T) {
 				Aspath: []AsnSegment{
 					AsnSegment{
 						Type: 2,
-						ASN:  123,
+						ASNs: []uint32{123},
 					},
 				},
 				NextHopv4: "10.20.30.49",
@@ -363,15 +483,301 @@ func TestDecodePathAttributes(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "Only-To-Customer",
+			input: []byte{
+				0x40, 0x01, 0x01, 0x00, 0x40, 0x02, 0x00, 0xc0, 0x23, 0x04, 0x00, 0x00, 0xfd, 0xe8,
+			},
+			want: &PathAttr{
+				OTC: 65000,
+			},
+		},
 	}
 	for _, test := range tests {
-		got, _ := DecodePathAttributes(test.input, false, false)
+		got, _ := DecodePathAttributes(test.input, true, false, false, false)
 		if !cmp.Equal(got, test.want) {
 			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got, test.want)
 		}
 	}
 }
 
+func TestDecodePathAttributesAS4(t *testing.T) {
+	// attr builds an attribute from segments of 2 or 4 octet ASNs
+	attr := func(flags, code uint8, asnLen int, segs ...[]uint32) []byte {
+		var value []byte
+		for _, seg := range segs {
+			value = append(value, uint8(seg[0]), uint8(len(seg)-1))
+			for _, asn := range seg[1:] {
+				if asnLen == 2 {
+					value = binary.BigEndian.AppendUint16(value, uint16(asn))
+				} else {
+					value = binary.BigEndian.AppendUint32(value, asn)
+				}
+			}
+		}
+		return append([]byte{flags, code, uint8(len(value))}, value...)
+	}
+	aspath := func(segs ...[]uint32) []byte { return attr(0x40, tcASPath, 2, segs...) }
+	as4path := func(segs ...[]uint32) []byte { return attr(0xc0, tcAS4Path, 4, segs...) }
+	aggregator := []byte{0xc0, tcAggregator, 0x06, 0x00, 0x64, 0xc0, 0x00, 0x02, 0x01}
+	transAggregator := []byte{0xc0, tcAggregator, 0x06, 0x5b, 0xa0, 0xc0, 0x00, 0x02, 0x01}
+	as4Aggregator := []byte{0xc0, tcAS4Aggregator, 0x08, 0x00, 0x01, 0x00, 0x00, 0xc0, 0x00, 0x02, 0x02}
+	seq := func(asns ...uint32) []AsnSegment {
+		return []AsnSegment{{Type: asSequence, ASNs: asns}}
+	}
+
+	tests := []struct {
+		desc       string
+		asn4       bool
+		input      []byte
+		wantPath   []AsnSegment
+		wantAgAS   uint32
+		wantAgAddr net.IP
+	}{
+		{
+			desc:     "2-octet AS_PATH",
+			input:    aspath([]uint32{asSequence, 64512, 100}),
+			wantPath: seq(64512, 100),
+		},
+		{
+			desc:     "AS_TRANS replaced by AS4_PATH",
+			input:    bytes.Join([][]byte{aspath([]uint32{asSequence, 100, ASTrans, ASTrans}), as4path([]uint32{asSequence, 65536, 65537})}, nil),
+			wantPath: seq(100, 65536, 65537),
+		},
+		{
+			desc:     "AS4_PATH longer than AS_PATH is ignored",
+			input:    bytes.Join([][]byte{aspath([]uint32{asSequence, ASTrans}), as4path([]uint32{asSequence, 65536, 65537})}, nil),
+			wantPath: seq(ASTrans),
+		},
+		{
+			desc:     "AS4_PATH from a 4-octet speaker is ignored",
+			asn4:     true,
+			input:    bytes.Join([][]byte{attr(0x40, tcASPath, 4, []uint32{asSequence, ASTrans}), as4path([]uint32{asSequence, 65536})}, nil),
+			wantPath: seq(ASTrans),
+		},
+		{
+			desc: "AS_SET counts as one",
+			input: bytes.Join([][]byte{
+				aspath([]uint32{asSequence, 100, ASTrans}, []uint32{asSet, 200, 300}),
+				as4path([]uint32{asSequence, 65536}, []uint32{asSet, 200, 300}),
+			}, nil),
+			wantPath: append(seq(100, 65536), AsnSegment{Type: asSet, ASNs: []uint32{200, 300}}),
+		},
+		{
+			desc: "adjacent AS_SETs count as one each",
+			input: bytes.Join([][]byte{
+				aspath([]uint32{asSequence, 100, 200, ASTrans}, []uint32{asSet, 300}, []uint32{asSet, 400}),
+				as4path([]uint32{asSequence, 65536}, []uint32{asSet, 300}, []uint32{asSet, 400}),
+			}, nil),
+			wantPath: append(seq(100, 200, 65536), AsnSegment{Type: asSet, ASNs: []uint32{300}}, AsnSegment{Type: asSet, ASNs: []uint32{400}}),
+		},
+		{
+			desc: "leading confederation segments are kept",
+			input: bytes.Join([][]byte{
+				aspath([]uint32{asConfedSequence, 65000}, []uint32{asSequence, 100, ASTrans}),
+				as4path([]uint32{asSequence, 65536}),
+			}, nil),
+			wantPath: append([]AsnSegment{{Type: asConfedSequence, ASNs: []uint32{65000}}}, seq(100, 65536)...),
+		},
+		{
+			desc:     "confederation segments in AS4_PATH are dropped",
+			input:    bytes.Join([][]byte{aspath([]uint32{asSequence, ASTrans}), as4path([]uint32{asConfedSequence, 65000}, []uint32{asSequence, 65536})}, nil),
+			wantPath: seq(65536),
+		},
+		{
+			desc:       "aggregator from a 2-octet speaker ignores both AS4 attributes",
+			input:      bytes.Join([][]byte{aspath([]uint32{asSequence, ASTrans}), as4path([]uint32{asSequence, 65536}), aggregator, as4Aggregator}, nil),
+			wantPath:   seq(ASTrans),
+			wantAgAS:   100,
+			wantAgAddr: net.IP{192, 0, 2, 1},
+		},
+		{
+			desc:       "AS_TRANS aggregator replaced by AS4_AGGREGATOR",
+			input:      bytes.Join([][]byte{aspath([]uint32{asSequence, ASTrans}), as4path([]uint32{asSequence, 65536}), transAggregator, as4Aggregator}, nil),
+			wantPath:   seq(65536),
+			wantAgAS:   65536,
+			wantAgAddr: net.IP{192, 0, 2, 2},
+		},
+	}
+	for _, test := range tests {
+		got, err := DecodePathAttributes(test.input, test.asn4, false, false, false)
+		if err != nil {
+			t.Fatalf("Test (%s): unexpected error: %v", test.desc, err)
+		}
+		if !cmp.Equal(got.Aspath, test.wantPath) {
+			t.Errorf("Test (%s): got AS path %+v, want %+v", test.desc, got.Aspath, test.wantPath)
+		}
+		if got.AgAS != test.wantAgAS || !got.AgOrigin.Equal(test.wantAgAddr) {
+			t.Errorf("Test (%s): got aggregator %d %v, want %d %v", test.desc, got.AgAS, got.AgOrigin, test.wantAgAS, test.wantAgAddr)
+		}
+	}
+}
+
+func TestPathLength(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []AsnSegment
+		want  int
+	}{
+		{
+			desc:  "AS_SEQUENCE",
+			input: []AsnSegment{{Type: asSequence, ASNs: []uint32{1, 2, 3}}},
+			want:  3,
+		},
+		{
+			desc:  "AS_SET counts as one",
+			input: []AsnSegment{{Type: asSequence, ASNs: []uint32{1}}, {Type: asSet, ASNs: []uint32{2, 3}}},
+			want:  2,
+		},
+		{
+			desc:  "adjacent AS_SETs count as one each",
+			input: []AsnSegment{{Type: asSet, ASNs: []uint32{1, 2}}, {Type: asSet, ASNs: []uint32{3, 4}}},
+			want:  2,
+		},
+		{
+			desc:  "confederation segments don't count",
+			input: []AsnSegment{{Type: asConfedSequence, ASNs: []uint32{65000, 65001}}, {Type: asConfedSet, ASNs: []uint32{65002}}, {Type: asSequence, ASNs: []uint32{1}}},
+			want:  1,
+		},
+	}
+	for _, test := range tests {
+		if got := pathLength(test.input); got != test.want {
+			t.Errorf("Test (%s): got %d, want %d", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestDecodePathAttributesErrors(t *testing.T) {
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0x00, 0x7b}
+	join := func(attrs ...[]byte) []byte {
+		return bytes.Join(attrs, nil)
+	}
+
+	tests := []struct {
+		desc       string
+		input      []byte
+		wantAction ErrorAction
+		wantCodes  []uint8
+		wantAFI    uint16
+	}{
+		{
+			desc:       "valid",
+			input:      join(origin, aspath),
+			wantAction: ActionNone,
+		},
+		{
+			desc:       "origin with bad length",
+			input:      join([]byte{0x40, 0x01, 0x02, 0x00, 0x00}, aspath),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcOrigin},
+		},
+		{
+			desc:       "origin with undefined value",
+			input:      join([]byte{0x40, 0x01, 0x01, 0x03}, aspath),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcOrigin},
+		},
+		{
+			desc:       "origin flagged optional",
+			input:      join([]byte{0xc0, 0x01, 0x01, 0x00}, aspath),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcOrigin},
+		},
+		{
+			desc:       "atomic aggregate with a value",
+			input:      join(origin, aspath, []byte{0x40, 0x06, 0x01, 0x00}),
+			wantAction: ActionAttributeDiscard,
+			wantCodes:  []uint8{tcAtoAgg},
+		},
+		{
+			desc:       "repeated community",
+			input:      join(origin, aspath, []byte{0xc0, 0x08, 0x04, 0xfd, 0xe8, 0x02, 0x9a}, []byte{0xc0, 0x08, 0x04, 0xfd, 0xe8, 0x02, 0x9b}),
+			wantAction: ActionAttributeDiscard,
+			wantCodes:  []uint8{tcCommunity},
+		},
+		{
+			desc:       "as_path segment overrun",
+			input:      join(origin, []byte{0x40, 0x02, 0x06, 0x02, 0x02, 0x00, 0x00, 0x00, 0x7b}),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcASPath},
+		},
+		{
+			desc:       "missing as_path",
+			input:      origin,
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcASPath},
+		},
+		{
+			desc:       "attribute overruns the path attributes",
+			input:      join(aspath, []byte{0x40, 0x01, 0x05, 0x00}),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcOrigin, tcOrigin},
+		},
+		{
+			desc:       "truncated mp_reach_nlri",
+			input:      join([]byte{0x80, 0x0e, 0x05, 0x00, 0x02, 0x01, 0x10, 0x00}, origin, aspath),
+			wantAction: ActionAFISAFIDisable,
+			wantCodes:  []uint8{tcMPReachNLRI},
+			wantAFI:    2,
+		},
+		{
+			desc:       "only-to-customer with bad length",
+			input:      join(origin, aspath, []byte{0xc0, 0x23, 0x02, 0xfd, 0xe8}),
+			wantAction: ActionTreatAsWithdraw,
+			wantCodes:  []uint8{tcOTC},
+		},
+		{
+			desc:       "withdraw only",
+			input:      []byte{0x80, 0x0f, 0x03, 0x00, 0x02, 0x01},
+			wantAction: ActionNone,
+		},
+	}
+	for _, test := range tests {
+		got, err := DecodePathAttributes(test.input, true, false, false, false)
+		if err != nil {
+			t.Errorf("Test (%s): unexpected error: %v", test.desc, err)
+			continue
+		}
+		if got.Action() != test.wantAction {
+			t.Errorf("Test (%s): got action %s, want %s", test.desc, got.Action(), test.wantAction)
+		}
+		var codes []uint8
+		for _, e := range got.Errors {
+			codes = append(codes, e.Code)
+			if e.Action == ActionAFISAFIDisable && e.AFI != test.wantAFI {
+				t.Errorf("Test (%s): got AFI %d, want %d", test.desc, e.AFI, test.wantAFI)
+			}
+		}
+		if !cmp.Equal(codes, test.wantCodes) {
+			t.Errorf("Test (%s): got errors for %v, want %v", test.desc, codes, test.wantCodes)
+		}
+	}
+}
+
+func TestDecodePathAttributesSessionReset(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []byte
+	}{
+		{
+			desc:  "mp_reach_nlri too short for AFI/SAFI",
+			input: []byte{0x80, 0x0e, 0x02, 0x00, 0x02},
+		},
+		{
+			desc:  "repeated mp_unreach_nlri",
+			input: []byte{0x80, 0x0f, 0x03, 0x00, 0x02, 0x01, 0x80, 0x0f, 0x03, 0x00, 0x02, 0x01},
+		},
+	}
+	for _, test := range tests {
+		_, err := DecodePathAttributes(test.input, true, false, false, false)
+		var ae *AttrError
+		if !errors.As(err, &ae) || ae.Action != ActionSessionReset {
+			t.Errorf("Test (%s): got %v, want session reset", test.desc, err)
+		}
+	}
+}
+
 func TestFormatASPath(t *testing.T) {
 	tests := []struct {
 		desc  string
@@ -388,7 +794,7 @@ func TestFormatASPath(t *testing.T) {
 			input: []AsnSegment{
 				AsnSegment{
 					Type: 2,
-					ASN:  98765,
+					ASNs: []uint32{98765},
 				},
 			},
 			want: "98765",
@@ -398,11 +804,7 @@ func TestFormatASPath(t *testing.T) {
 			input: []AsnSegment{
 				AsnSegment{
 					Type: 2,
-					ASN:  98765,
-				},
-				AsnSegment{
-					Type: 2,
-					ASN:  123,
+					ASNs: []uint32{98765, 123},
 				},
 			},
 			want: "98765 123",
@@ -412,15 +814,11 @@ func TestFormatASPath(t *testing.T) {
 			input: []AsnSegment{
 				AsnSegment{
 					Type: 2,
-					ASN:  98765,
-				},
-				AsnSegment{
-					Type: 2,
-					ASN:  123,
+					ASNs: []uint32{98765, 123},
 				},
 				AsnSegment{
 					Type: 1,
-					ASN:  345,
+					ASNs: []uint32{345},
 				},
 			},
 			want: "98765 123 { 345 }",
@@ -430,19 +828,11 @@ func TestFormatASPath(t *testing.T) {
 			input: []AsnSegment{
 				AsnSegment{
 					Type: 2,
-					ASN:  98765,
-				},
-				AsnSegment{
-					Type: 2,
-					ASN:  123,
-				},
-				AsnSegment{
-					Type: 1,
-					ASN:  345,
+					ASNs: []uint32{98765, 123},
 				},
 				AsnSegment{
 					Type: 1,
-					ASN:  153489,
+					ASNs: []uint32{345, 153489},
 				},
 			},
 			want: "98765 123 { 345 153489 }",
@@ -452,14 +842,14 @@ func TestFormatASPath(t *testing.T) {
 			input: []AsnSegment{
 				AsnSegment{
 					Type: 1,
-					ASN:  345,
+					ASNs: []uint32{345},
 				},
 				AsnSegment{
 					Type: 1,
-					ASN:  153489,
+					ASNs: []uint32{153489},
 				},
 			},
-			want: "{ 345 153489 }",
+			want: "{ 345 } { 153489 }",
 		},
 	}
 	for _, test := range tests {
@@ -25,6 +25,7 @@ const (
 	HoldTimeExpired = 4
 	FsmError        = 5
 	Cease           = 6
+	RefreshError    = 7
 
 	// min and max BGP message size in bytes
 	MinMessage         = 19
@@ -84,11 +85,17 @@ func CreateOpen(asn uint32, holdtime uint16, rid BGPID, p *Parameters) []byte {
 
 // CreateNotification creates a BGP NOTIFICATION message.
 func CreateNotification(code, subcode uint8) []byte {
+	return CreateNotificationWithData(code, subcode, nil)
+}
+
+// CreateNotificationWithData creates a BGP NOTIFICATION message with a data field.
+func CreateNotificationWithData(code, subcode uint8, data []byte) []byte {
 	var b bytes.Buffer
 	writeMarker(&b)
 	b.Write([]byte{0, 0, Notification})
 	b.WriteByte(code)
 	b.WriteByte(subcode)
+	b.Write(data)
 
 	buf := b.Bytes()
 	setSizeOfMessage(&buf)
@@ -128,15 +135,21 @@ func createParameters(p *Parameters, asn uint32) ([]byte, uint8) {
 	initial := []byte{
 		2, // Parameter Type: Capabilities
 		0, // Length placeholder
+		capRouteRefresh,
+		0, // route refresh size 0
 		capRefresh,
-		0, // refresh size 0
+		0, // enhanced refresh size 0
 		cap4Byte,
 		4, // 4 byte ASN size 4
 	}
 	param = append(param, initial...)
 	param = append(param, uint32ToByte(asn)...)
 	param = append(param, capExtendedMessage, 0)
-	param = append(param, capGracefulRestart, 6, 0, 0, 0, 1, 1, 0) // IPv4 Unicast GR
+	param = append(param, capGracefulRestart, 6, grNotification<<4, 0, 0, 1, 1, 0) // IPv4 Unicast GR, N bit
+	param = append(param, capLLGR, 0)                                              // LLGR helper, no families of our own
+	if p.HasRole {
+		param = append(param, capRole, 1, byte(p.Role))
+	}
 
 	for _, a := range p.AddrFamilies {
 		if isIPv4Unicast(a) {
@@ -156,6 +169,14 @@ func createParameters(p *Parameters, asn uint32) ([]byte, uint8) {
 		}
 	}
 
+	// IPv4 unicast with IPv6 next hops is the only extended next hop we can decode
+	for _, e := range p.ExtendedNextHop {
+		if e.AFI == 1 && e.SAFI == 1 && e.NextHopAFI == 2 {
+			param = append(param, []byte{capExtendedNextHop, 6, 0, 1, 0, 1, 0, 2}...)
+			break
+		}
+	}
+
 	param[1] = byte(len(param) - 2)
 	return param, uint8(len(param))
 }
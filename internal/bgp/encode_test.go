@@ -47,3 +47,79 @@ func TestUint32ToByte(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateNotificationWithData(t *testing.T) {
+	tests := []struct {
+		desc    string
+		code    uint8
+		subcode uint8
+		data    []byte
+		want    []byte
+	}{
+		{
+			desc:    "no data",
+			code:    HoldTimeExpired,
+			subcode: 0,
+			want:    []byte{0, 21, Notification, HoldTimeExpired, 0},
+		},
+		{
+			desc:    "bad message length",
+			code:    HeaderError,
+			subcode: BadMessageLength,
+			data:    []byte{0x10, 0x01},
+			want:    []byte{0, 23, Notification, HeaderError, BadMessageLength, 0x10, 0x01},
+		},
+	}
+	for _, test := range tests {
+		got := CreateNotificationWithData(test.code, test.subcode, test.data)
+		if !cmp.Equal(got[16:], test.want) {
+			t.Errorf("Test (%s): got %#v, want %#v", test.desc, got[16:], test.want)
+		}
+	}
+}
+
+func TestCreateParametersGracefulRestart(t *testing.T) {
+	param, _ := createParameters(&Parameters{}, 64512)
+	got, err := DecodeOptionalParameters(&param)
+	if err != nil {
+		t.Fatalf("unable to decode parameters: %v", err)
+	}
+	if !got.GracefulRestart || got.GRCapability == nil {
+		t.Fatalf("got no graceful restart capability")
+	}
+	if !got.GRCapability.Notification() || got.GRCapability.Restarting() {
+		t.Errorf("got restart flags %#x, want N bit only", got.GRCapability.RestartFlags)
+	}
+}
+
+func TestCreateParametersExtendedNextHop(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []ExtendedNextHop
+		want  []ExtendedNextHop
+	}{
+		{
+			desc: "not offered",
+		},
+		{
+			desc:  "IPv4 unicast over IPv6 is echoed",
+			input: []ExtendedNextHop{{AFI: 1, SAFI: 1, NextHopAFI: 2}},
+			want:  []ExtendedNextHop{{AFI: 1, SAFI: 1, NextHopAFI: 2}},
+		},
+		{
+			desc:  "families we can't decode are left out",
+			input: []ExtendedNextHop{{AFI: 1, SAFI: 128, NextHopAFI: 2}, {AFI: 1, SAFI: 1, NextHopAFI: 2}},
+			want:  []ExtendedNextHop{{AFI: 1, SAFI: 1, NextHopAFI: 2}},
+		},
+	}
+	for _, test := range tests {
+		param, _ := createParameters(&Parameters{ExtendedNextHop: test.input}, 64512)
+		got, err := DecodeOptionalParameters(&param)
+		if err != nil {
+			t.Fatalf("Test (%s): unable to decode parameters: %v", test.desc, err)
+		}
+		if !cmp.Equal(got.ExtendedNextHop, test.want) {
+			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got.ExtendedNextHop, test.want)
+		}
+	}
+}
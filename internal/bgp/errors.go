@@ -0,0 +1,257 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Message Header Error subcodes (RFC 4271 section 6.1)
+const (
+	ConnNotSynchronized = 1
+	BadMessageLength    = 2
+	BadMessageType      = 3
+)
+
+// OPEN Message Error subcodes (RFC 4271 section 6.2, RFC 5492 and RFC 9234)
+const (
+	UnsupportedVersion    = 1
+	BadPeerAS             = 2
+	BadBGPIdentifier      = 3
+	UnsupportedOptParam   = 4
+	UnacceptableHoldTime  = 6
+	UnsupportedCapability = 7
+	RoleMismatch          = 11
+)
+
+// ErrUnsupportedOptParam is returned when an OPEN carries an optional parameter other than
+// Capabilities.
+var ErrUnsupportedOptParam = errors.New("unsupported optional parameter")
+
+// UPDATE Message Error subcodes (RFC 4271 section 6.3)
+const (
+	MalformedAttrList     = 1
+	UnrecognizedWellKnown = 2
+	MissingWellKnown      = 3
+	AttrFlagsError        = 4
+	AttrLengthError       = 5
+	InvalidOrigin         = 6
+	InvalidNextHop        = 8
+	OptionalAttrError     = 9
+	InvalidNetworkField   = 10
+	MalformedASPath       = 11
+)
+
+// Finite State Machine Error subcodes (RFC 6608)
+const (
+	FsmUnexpectedOpenSent    = 1
+	FsmUnexpectedOpenConfirm = 2
+	FsmUnexpectedEstablished = 3
+)
+
+// ROUTE-REFRESH Message Error subcodes (RFC 7313 section 5)
+const (
+	InvalidRefreshLength = 1
+)
+
+// ErrorAction is the RFC 7606 approach taken for a malformed UPDATE. Actions are ordered
+// by severity so the strongest of several errors can be picked with max.
+type ErrorAction uint8
+
+const (
+	ActionNone ErrorAction = iota
+	ActionAttributeDiscard
+	ActionTreatAsWithdraw
+	ActionAFISAFIDisable
+	ActionSessionReset
+)
+
+func (a ErrorAction) String() string {
+	switch a {
+	case ActionNone:
+		return "none"
+	case ActionAttributeDiscard:
+		return "attribute-discard"
+	case ActionTreatAsWithdraw:
+		return "treat-as-withdraw"
+	case ActionAFISAFIDisable:
+		return "afi-safi-disable"
+	case ActionSessionReset:
+		return "session-reset"
+	}
+	return "unknown"
+}
+
+// AttrError is a malformed path attribute along with the action RFC 7606 requires for it.
+// Subcode is the UPDATE Message Error subcode to use if the session is reset, while AFI and
+// SAFI are only set for ActionAFISAFIDisable. Data is the offending attribute, for use in the
+// NOTIFICATION data field. A Code of 0 is an error outside any attribute.
+type AttrError struct {
+	Code    uint8
+	Action  ErrorAction
+	Subcode uint8
+	AFI     uint16
+	SAFI    uint8
+	Data    []byte
+	Err     error
+}
+
+func (e *AttrError) Error() string {
+	return fmt.Sprintf("path attribute %d (%s): %v", e.Code, e.Action, e.Err)
+}
+
+func (e *AttrError) Unwrap() error {
+	return e.Err
+}
+
+// attrAction is the RFC 7606 section 7 action for a malformed instance of each attribute we
+// understand. Attributes not listed here are passed over without validation.
+var attrAction = map[uint8]ErrorAction{
+	tcOrigin:           ActionTreatAsWithdraw,
+	tcASPath:           ActionTreatAsWithdraw,
+	tcNextHop:          ActionTreatAsWithdraw,
+	tcMED:              ActionTreatAsWithdraw,
+	tcLPref:            ActionTreatAsWithdraw,
+	tcAtoAgg:           ActionAttributeDiscard,
+	tcAggregator:       ActionAttributeDiscard,
+	tcCommunity:        ActionTreatAsWithdraw,
+	tcOriginator:       ActionTreatAsWithdraw,
+	tcClusterList:      ActionTreatAsWithdraw,
+	tcMPReachNLRI:      ActionAFISAFIDisable,
+	tcMPUnreachNLRI:    ActionAFISAFIDisable,
+	tcExtendCommunity:  ActionTreatAsWithdraw,
+	tcIPv6ExtCommunity: ActionTreatAsWithdraw,
+	tcLargeCommunity:   ActionTreatAsWithdraw,
+	tcOTC:              ActionTreatAsWithdraw,
+	tcAS4Path:          ActionAttributeDiscard,
+	tcAS4Aggregator:    ActionAttributeDiscard,
+}
+
+// wellKnown attributes must have the Optional bit clear and the Transitive bit set.
+var wellKnown = map[uint8]bool{
+	tcOrigin:  true,
+	tcASPath:  true,
+	tcNextHop: true,
+	tcLPref:   true,
+	tcAtoAgg:  true,
+}
+
+// optionalTransitive attributes must have both the Optional and Transitive bits set. Every
+// other attribute in attrAction is optional non-transitive.
+var optionalTransitive = map[uint8]bool{
+	tcAggregator:       true,
+	tcCommunity:        true,
+	tcExtendCommunity:  true,
+	tcIPv6ExtCommunity: true,
+	tcLargeCommunity:   true,
+	tcOTC:              true,
+	tcAS4Path:          true,
+	tcAS4Aggregator:    true,
+}
+
+// checkFlags reports whether the Optional and Transitive bits are correct for the attribute.
+func checkFlags(code, flags uint8) bool {
+	optional := flags&0x80 != 0
+	transitive := flags&0x40 != 0
+	switch {
+	case wellKnown[code]:
+		return !optional && transitive
+	case optionalTransitive[code]:
+		return optional && transitive
+	default:
+		return optional && !transitive
+	}
+}
+
+// checkLength validates the attribute length against RFC 4271 and RFC 7606 section 7. The
+// AGGREGATOR length depends on whether ASNs are 2 or 4 octets.
+func checkLength(code uint8, length int64, asn4 bool) bool {
+	switch code {
+	case tcOrigin:
+		return length == 1
+	case tcNextHop, tcMED, tcLPref, tcOriginator, tcOTC:
+		return length == 4
+	case tcAtoAgg:
+		return length == 0
+	case tcAggregator:
+		if !asn4 {
+			return length == 6
+		}
+		return length == 8
+	case tcAS4Aggregator:
+		return length == 8
+	case tcCommunity, tcClusterList:
+		return length > 0 && length%4 == 0
+	case tcExtendCommunity:
+		return length%8 == 0
+	case tcIPv6ExtCommunity:
+		return length%20 == 0
+	case tcLargeCommunity:
+		return length%12 == 0
+	case tcMPReachNLRI:
+		return length >= 5
+	case tcMPUnreachNLRI:
+		return length >= 3
+	}
+	return true
+}
+
+// validateAttr checks the flags and length of the attributes we understand, returning the
+// UPDATE Message Error subcode to use if they are wrong.
+func validateAttr(code, flags uint8, length int64, asn4 bool) (uint8, error) {
+	if _, ok := attrAction[code]; !ok {
+		return 0, nil
+	}
+	if !checkFlags(code, flags) {
+		return AttrFlagsError, fmt.Errorf("invalid flags 0x%02x", flags)
+	}
+	if !checkLength(code, length, asn4) {
+		return AttrLengthError, fmt.Errorf("invalid length %d", length)
+	}
+	return 0, nil
+}
+
+// newAttrError builds the error for a malformed attribute with value data. A malformed
+// MP_REACH_NLRI or MP_UNREACH_NLRI disables its AFI/SAFI, or resets the session if not even
+// that can be read (RFC 7606 section 7.11).
+func newAttrError(code, subcode uint8, data []byte, err error) AttrError {
+	e := AttrError{
+		Code:    code,
+		Action:  attrAction[code],
+		Subcode: subcode,
+		Err:     err,
+	}
+	if e.Action == ActionAFISAFIDisable {
+		if len(data) < 3 {
+			e.Action = ActionSessionReset
+		} else {
+			e.AFI = binary.BigEndian.Uint16(data)
+			e.SAFI = data[2]
+		}
+	}
+	return e
+}
+
+// valueSubcode is the UPDATE Message Error subcode for an attribute whose value is invalid.
+func valueSubcode(code uint8) uint8 {
+	switch code {
+	case tcOrigin:
+		return InvalidOrigin
+	case tcASPath, tcAS4Path:
+		return MalformedASPath
+	case tcNextHop:
+		return InvalidNextHop
+	case tcMPReachNLRI, tcMPUnreachNLRI:
+		return OptionalAttrError
+	}
+	return AttrLengthError
+}
+
+// Action returns the most severe RFC 7606 action required by errors found while decoding.
+func (pa *PathAttr) Action() ErrorAction {
+	var worst ErrorAction
+	for _, e := range pa.Errors {
+		worst = max(worst, e.Action)
+	}
+	return worst
+}
@@ -0,0 +1,221 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Extended community types and subtypes (RFC 4360, RFC 5668 and RFC 5701). The high-order
+// type octet also carries the IANA authority and transitive bits, which ecTypeMask clears.
+const (
+	ecTwoOctetAS  = 0x00
+	ecIPv4        = 0x01
+	ecFourOctetAS = 0x02
+	ecOpaque      = 0x03
+
+	ecNonTransitive = 0x40
+	ecTypeMask      = 0x3f
+
+	ecRouteTarget   = 0x02
+	ecRouteOrigin   = 0x03
+	ecLinkBandwidth = 0x04
+)
+
+// ExtendCommunity is an RFC 4360 extended community, or an RFC 5701 IPv6 address specific one
+// when IPv6 is set. Value holds the octets after the type and subtype: 6 of them, or 18 for IPv6.
+type ExtendCommunity struct {
+	IPv6    bool
+	Type    uint8
+	Subtype uint8
+	Value   []byte
+}
+
+func decodeExtendedCommunities(b *bytes.Buffer, ipv6 bool) ([]ExtendCommunity, error) {
+	size := 8
+	if ipv6 {
+		size = 20
+	}
+	var ecs []ExtendCommunity
+	for b.Len() > 0 {
+		ec := make([]byte, size)
+		if _, err := io.ReadFull(b, ec); err != nil {
+			return nil, err
+		}
+		ecs = append(ecs, ExtendCommunity{
+			IPv6:    ipv6,
+			Type:    ec[0],
+			Subtype: ec[1],
+			Value:   ec[2:],
+		})
+	}
+	return ecs, nil
+}
+
+// hasAdmin reports whether the value is split into a global and local administrator.
+func (e ExtendCommunity) hasAdmin() bool {
+	if len(e.Value) != 6 && len(e.Value) != 18 {
+		return false
+	}
+	if e.IPv6 {
+		return e.Type&ecTypeMask == ecTwoOctetAS
+	}
+	switch e.Type & ecTypeMask {
+	case ecTwoOctetAS, ecIPv4, ecFourOctetAS:
+		return true
+	}
+	return false
+}
+
+// Kind is route-target, route-origin, link-bandwidth or opaque for anything else.
+func (e ExtendCommunity) Kind() string {
+	switch {
+	case e.hasAdmin() && e.Subtype == ecRouteTarget:
+		return "route-target"
+	case e.hasAdmin() && e.Subtype == ecRouteOrigin:
+		return "route-origin"
+	case !e.IPv6 && e.Type&ecTypeMask == ecTwoOctetAS && e.Subtype == ecLinkBandwidth && len(e.Value) == 6:
+		return "link-bandwidth"
+	}
+	return "opaque"
+}
+
+// GlobalAdmin returns the ASN or address in the global administrator field.
+func (e ExtendCommunity) GlobalAdmin() string {
+	if !e.hasAdmin() {
+		return ""
+	}
+	if e.IPv6 {
+		return netip.AddrFrom16([16]byte(e.Value[:16])).String()
+	}
+	switch e.Type & ecTypeMask {
+	case ecTwoOctetAS:
+		return strconv.Itoa(int(binary.BigEndian.Uint16(e.Value)))
+	case ecIPv4:
+		return netip.AddrFrom4([4]byte(e.Value[:4])).String()
+	}
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(e.Value)), 10)
+}
+
+// LocalAdmin returns the local administrator field.
+func (e ExtendCommunity) LocalAdmin() uint32 {
+	if !e.hasAdmin() {
+		return 0
+	}
+	if !e.IPv6 && e.Type&ecTypeMask == ecTwoOctetAS {
+		return binary.BigEndian.Uint32(e.Value[2:])
+	}
+	return uint32(binary.BigEndian.Uint16(e.Value[len(e.Value)-2:]))
+}
+
+// Bandwidth returns the link bandwidth in bytes per second.
+func (e ExtendCommunity) Bandwidth() float32 {
+	if e.Kind() != "link-bandwidth" {
+		return 0
+	}
+	return math.Float32frombits(binary.BigEndian.Uint32(e.Value[2:]))
+}
+
+// String returns rt:, soo: or lbw: followed by the global and local administrator or the
+// bandwidth, or the raw octets in hex for anything else. ParseExtendedCommunity accepts the
+// same forms.
+func (e ExtendCommunity) String() string {
+	switch e.Kind() {
+	case "route-target":
+		return fmt.Sprintf("rt:%s:%d", e.GlobalAdmin(), e.LocalAdmin())
+	case "route-origin":
+		return fmt.Sprintf("soo:%s:%d", e.GlobalAdmin(), e.LocalAdmin())
+	case "link-bandwidth":
+		return fmt.Sprintf("lbw:%d:%s", binary.BigEndian.Uint16(e.Value), strconv.FormatFloat(float64(e.Bandwidth()), 'f', -1, 32))
+	}
+	return "0x" + hex.EncodeToString(append([]byte{e.Type, e.Subtype}, e.Value...))
+}
+
+// FormatExtendedCommunities returns a formatted Extended Communities string.
+func FormatExtendedCommunities(com *[]ExtendCommunity) string {
+	var b strings.Builder
+	for _, v := range *com {
+		b.WriteString(v.String() + " ")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// ParseExtendedCommunity parses an extended community in the form returned by String. Route
+// targets and origins are encoded with the smallest type that fits, so an ASN of up to 65535
+// is always 2-octet AS specific.
+func ParseExtendedCommunity(s string) (ExtendCommunity, error) {
+	if raw, ok := strings.CutPrefix(s, "0x"); ok {
+		b, err := hex.DecodeString(raw)
+		if err != nil || (len(b) != 8 && len(b) != 20) {
+			return ExtendCommunity{}, fmt.Errorf("invalid extended community %q", s)
+		}
+		return ExtendCommunity{IPv6: len(b) == 20, Type: b[0], Subtype: b[1], Value: b[2:]}, nil
+	}
+
+	kind, rest, ok := strings.Cut(s, ":")
+	i := strings.LastIndex(rest, ":")
+	if !ok || i < 0 {
+		return ExtendCommunity{}, fmt.Errorf("invalid extended community %q", s)
+	}
+	global, local := rest[:i], rest[i+1:]
+
+	var subtype uint8
+	switch kind {
+	case "rt":
+		subtype = ecRouteTarget
+	case "soo":
+		subtype = ecRouteOrigin
+	case "lbw":
+		asn, err := strconv.ParseUint(global, 10, 16)
+		if err != nil {
+			return ExtendCommunity{}, fmt.Errorf("invalid link bandwidth ASN %q", global)
+		}
+		bw, err := strconv.ParseFloat(local, 32)
+		if err != nil {
+			return ExtendCommunity{}, fmt.Errorf("invalid link bandwidth %q", local)
+		}
+		value := binary.BigEndian.AppendUint16(nil, uint16(asn))
+		value = binary.BigEndian.AppendUint32(value, math.Float32bits(float32(bw)))
+		return ExtendCommunity{Type: ecNonTransitive | ecTwoOctetAS, Subtype: ecLinkBandwidth, Value: value}, nil
+	default:
+		return ExtendCommunity{}, fmt.Errorf("unknown extended community type %q", kind)
+	}
+
+	if ip, err := netip.ParseAddr(global); err == nil {
+		la, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return ExtendCommunity{}, fmt.Errorf("invalid local administrator %q", local)
+		}
+		ec := ExtendCommunity{IPv6: ip.Is6(), Type: ecIPv4, Subtype: subtype, Value: ip.AsSlice()}
+		if ec.IPv6 {
+			ec.Type = ecTwoOctetAS
+		}
+		ec.Value = binary.BigEndian.AppendUint16(ec.Value, uint16(la))
+		return ec, nil
+	}
+
+	asn, err := strconv.ParseUint(global, 10, 32)
+	if err != nil {
+		return ExtendCommunity{}, fmt.Errorf("invalid global administrator %q", global)
+	}
+	if asn <= math.MaxUint16 {
+		la, err := strconv.ParseUint(local, 10, 32)
+		if err != nil {
+			return ExtendCommunity{}, fmt.Errorf("invalid local administrator %q", local)
+		}
+		value := binary.BigEndian.AppendUint16(nil, uint16(asn))
+		return ExtendCommunity{Type: ecTwoOctetAS, Subtype: subtype, Value: binary.BigEndian.AppendUint32(value, uint32(la))}, nil
+	}
+	la, err := strconv.ParseUint(local, 10, 16)
+	if err != nil {
+		return ExtendCommunity{}, fmt.Errorf("invalid local administrator %q", local)
+	}
+	value := binary.BigEndian.AppendUint32(nil, uint32(asn))
+	return ExtendCommunity{Type: ecFourOctetAS, Subtype: subtype, Value: binary.BigEndian.AppendUint16(value, uint16(la))}, nil
+}
@@ -0,0 +1,97 @@
+package bgp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeExtendedCommunities(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []byte
+		ipv6  bool
+		want  []string
+		kinds []string
+	}{
+		{
+			desc: "route targets of each type",
+			input: []byte{
+				0x00, 0x02, 0xfd, 0xe8, 0x00, 0x00, 0x00, 0x64,
+				0x01, 0x02, 0xc0, 0x00, 0x02, 0x01, 0x00, 0x07,
+				0x02, 0x02, 0x00, 0x01, 0x00, 0x00, 0x00, 0x0a,
+			},
+			want:  []string{"rt:65000:100", "rt:192.0.2.1:7", "rt:65536:10"},
+			kinds: []string{"route-target", "route-target", "route-target"},
+		},
+		{
+			desc:  "route origin",
+			input: []byte{0x00, 0x03, 0xfd, 0xe8, 0x00, 0x00, 0x00, 0x01},
+			want:  []string{"soo:65000:1"},
+			kinds: []string{"route-origin"},
+		},
+		{
+			desc:  "link bandwidth of 4Gbps",
+			input: []byte{0x40, 0x04, 0xfd, 0xe8, 0x4d, 0xee, 0x6b, 0x28},
+			want:  []string{"lbw:65000:500000000"},
+			kinds: []string{"link-bandwidth"},
+		},
+		{
+			desc:  "opaque",
+			input: []byte{0x03, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08},
+			want:  []string{"0x030c000000000008"},
+			kinds: []string{"opaque"},
+		},
+		{
+			desc: "IPv6 address specific route target",
+			input: []byte{
+				0x00, 0x02, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x01, 0x00, 0x64,
+			},
+			ipv6:  true,
+			want:  []string{"rt:2001:db8::1:100"},
+			kinds: []string{"route-target"},
+		},
+	}
+	for _, test := range tests {
+		ecs, err := decodeExtendedCommunities(bytes.NewBuffer(test.input), test.ipv6)
+		if err != nil {
+			t.Fatalf("Test (%s): unexpected error: %v", test.desc, err)
+		}
+		var got, kinds []string
+		for _, ec := range ecs {
+			got = append(got, ec.String())
+			kinds = append(kinds, ec.Kind())
+
+			// Everything we print should parse back to the same community
+			parsed, err := ParseExtendedCommunity(ec.String())
+			if err != nil || !cmp.Equal(parsed, ec) {
+				t.Errorf("Test (%s): parsed %s as %+v (%v), want %+v", test.desc, ec, parsed, err, ec)
+			}
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+		if !cmp.Equal(kinds, test.kinds) {
+			t.Errorf("Test (%s): got kinds %v, want %v", test.desc, kinds, test.kinds)
+		}
+	}
+}
+
+func TestParseExtendedCommunityErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"rt:65000",
+		"xx:65000:1",
+		"rt:65536:65536",
+		"rt:192.0.2.1:65536",
+		"lbw:65536:1",
+		"0x0002",
+		"0xzz",
+	} {
+		if _, err := ParseExtendedCommunity(input); err == nil {
+			t.Errorf("Test (%s): got no error, want one", input)
+		}
+	}
+}
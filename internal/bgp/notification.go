@@ -0,0 +1,248 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cease subcodes (RFC 4486, RFC 8538 and RFC 9384)
+const (
+	CeaseMaxPrefixes      = 1
+	CeaseAdminShutdown    = 2
+	CeasePeerDeconfigured = 3
+	CeaseAdminReset       = 4
+	CeaseConnRejected     = 5
+	CeaseConfigChange     = 6
+	CeaseCollision        = 7
+	CeaseOutOfResources   = 8
+	CeaseHardReset        = 9
+	CeaseBFDDown          = 10
+)
+
+var codeNames = map[uint8]string{
+	HeaderError:     "Message Header Error",
+	OpenError:       "OPEN Message Error",
+	UpdateError:     "UPDATE Message Error",
+	HoldTimeExpired: "Hold Timer Expired",
+	FsmError:        "Finite State Machine Error",
+	Cease:           "Cease",
+	RefreshError:    "ROUTE-REFRESH Message Error",
+}
+
+var subcodeNames = map[uint8]map[uint8]string{
+	HeaderError: {
+		ConnNotSynchronized: "Connection Not Synchronized",
+		BadMessageLength:    "Bad Message Length",
+		BadMessageType:      "Bad Message Type",
+	},
+	OpenError: {
+		UnsupportedVersion:    "Unsupported Version Number",
+		BadPeerAS:             "Bad Peer AS",
+		BadBGPIdentifier:      "Bad BGP Identifier",
+		UnsupportedOptParam:   "Unsupported Optional Parameter",
+		UnacceptableHoldTime:  "Unacceptable Hold Time",
+		UnsupportedCapability: "Unsupported Capability",
+		RoleMismatch:          "Role Mismatch",
+	},
+	UpdateError: {
+		MalformedAttrList:     "Malformed Attribute List",
+		UnrecognizedWellKnown: "Unrecognized Well-known Attribute",
+		MissingWellKnown:      "Missing Well-known Attribute",
+		AttrFlagsError:        "Attribute Flags Error",
+		AttrLengthError:       "Attribute Length Error",
+		InvalidOrigin:         "Invalid ORIGIN Attribute",
+		InvalidNextHop:        "Invalid NEXT_HOP Attribute",
+		OptionalAttrError:     "Optional Attribute Error",
+		InvalidNetworkField:   "Invalid Network Field",
+		MalformedASPath:       "Malformed AS_PATH",
+	},
+	FsmError: {
+		FsmUnexpectedOpenSent:    "Receive Unexpected Message in OpenSent State",
+		FsmUnexpectedOpenConfirm: "Receive Unexpected Message in OpenConfirm State",
+		FsmUnexpectedEstablished: "Receive Unexpected Message in Established State",
+	},
+	Cease: {
+		CeaseMaxPrefixes:      "Maximum Number of Prefixes Reached",
+		CeaseAdminShutdown:    "Administrative Shutdown",
+		CeasePeerDeconfigured: "Peer De-configured",
+		CeaseAdminReset:       "Administrative Reset",
+		CeaseConnRejected:     "Connection Rejected",
+		CeaseConfigChange:     "Other Configuration Change",
+		CeaseCollision:        "Connection Collision Resolution",
+		CeaseOutOfResources:   "Out of Resources",
+		CeaseHardReset:        "Hard Reset",
+		CeaseBFDDown:          "BFD Down",
+	},
+	RefreshError: {
+		InvalidRefreshLength: "Invalid Message Length",
+	},
+}
+
+var attrNames = map[uint8]string{
+	tcOrigin:           "ORIGIN",
+	tcASPath:           "AS_PATH",
+	tcNextHop:          "NEXT_HOP",
+	tcMED:              "MULTI_EXIT_DISC",
+	tcLPref:            "LOCAL_PREF",
+	tcAtoAgg:           "ATOMIC_AGGREGATE",
+	tcAggregator:       "AGGREGATOR",
+	tcCommunity:        "COMMUNITY",
+	tcOriginator:       "ORIGINATOR_ID",
+	tcClusterList:      "CLUSTER_LIST",
+	tcMPReachNLRI:      "MP_REACH_NLRI",
+	tcMPUnreachNLRI:    "MP_UNREACH_NLRI",
+	tcExtendCommunity:  "EXTENDED COMMUNITIES",
+	tcAS4Path:          "AS4_PATH",
+	tcAS4Aggregator:    "AS4_AGGREGATOR",
+	tcIPv6ExtCommunity: "IPv6 Address Specific Extended Community",
+	tcLargeCommunity:   "LARGE_COMMUNITY",
+}
+
+// NotificationMessage is a decoded BGP NOTIFICATION message.
+type NotificationMessage struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+// DecodeNotification decodes the body of a NOTIFICATION message, following the message type.
+func DecodeNotification(b []byte) (NotificationMessage, error) {
+	if len(b) < 2 {
+		return NotificationMessage{}, fmt.Errorf("notification too short: %d bytes", len(b))
+	}
+	return NotificationMessage{
+		Code:    b[0],
+		Subcode: b[1],
+		Data:    bytes.Clone(b[2:]),
+	}, nil
+}
+
+// CodeName returns the IANA name of the error code.
+func (n NotificationMessage) CodeName() string {
+	if name, ok := codeNames[n.Code]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown code %d", n.Code)
+}
+
+// SubcodeName returns the IANA name of the error subcode, or an empty string for the
+// unspecific subcode 0.
+func (n NotificationMessage) SubcodeName() string {
+	if n.Subcode == 0 {
+		return ""
+	}
+	if name, ok := subcodeNames[n.Code][n.Subcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown subcode %d", n.Subcode)
+}
+
+// Message returns the data field in human readable form where we know how to decode it, or
+// as hex otherwise.
+func (n NotificationMessage) Message() string {
+	if len(n.Data) == 0 {
+		return ""
+	}
+	switch n.Code {
+	case HeaderError:
+		switch n.Subcode {
+		case BadMessageLength:
+			if len(n.Data) == 2 {
+				return fmt.Sprintf("length %d", binary.BigEndian.Uint16(n.Data))
+			}
+		case BadMessageType:
+			return fmt.Sprintf("type %d", n.Data[0])
+		}
+	case OpenError:
+		switch n.Subcode {
+		case UnsupportedVersion:
+			if len(n.Data) == 2 {
+				return fmt.Sprintf("supported version %d", binary.BigEndian.Uint16(n.Data))
+			}
+		case UnsupportedCapability:
+			if caps, ok := capabilityNames(n.Data); ok {
+				return caps
+			}
+		}
+	case UpdateError:
+		// Missing Well-known Attribute carries just the type code, the others the whole attribute
+		if n.Subcode == MissingWellKnown {
+			return attrName(n.Data[0])
+		}
+		if len(n.Data) >= 2 {
+			return attrName(n.Data[1])
+		}
+	case Cease:
+		switch n.Subcode {
+		case CeaseAdminShutdown, CeaseAdminReset:
+			if msg, err := ShutdownCommunication(n.Data); err == nil {
+				return msg
+			}
+		case CeaseMaxPrefixes:
+			if len(n.Data) == 7 {
+				return fmt.Sprintf("AFI %d SAFI %d limit %d", binary.BigEndian.Uint16(n.Data), n.Data[2], binary.BigEndian.Uint32(n.Data[3:]))
+			}
+		}
+	}
+	return hex.EncodeToString(n.Data)
+}
+
+func (n NotificationMessage) String() string {
+	s := n.CodeName()
+	if sub := n.SubcodeName(); sub != "" {
+		s += " / " + sub
+	}
+	if msg := n.Message(); msg != "" {
+		s += ": " + msg
+	}
+	return s
+}
+
+// ShutdownCommunication decodes the RFC 9003 Shutdown Communication carried by an
+// Administrative Shutdown or Reset: a length octet followed by that many octets of UTF-8.
+func ShutdownCommunication(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("no shutdown communication")
+	}
+	l := int(data[0])
+	if l > len(data)-1 {
+		return "", fmt.Errorf("shutdown communication length %d exceeds data", l)
+	}
+	msg := data[1 : 1+l]
+	if !utf8.Valid(msg) {
+		return "", fmt.Errorf("shutdown communication is not valid UTF-8")
+	}
+	return string(msg), nil
+}
+
+func attrName(code uint8) string {
+	if name, ok := attrNames[code]; ok {
+		return fmt.Sprintf("attribute %s (%d)", name, code)
+	}
+	return fmt.Sprintf("attribute %d", code)
+}
+
+// capabilityNames lists the capabilities in the data of an Unsupported Capability error.
+func capabilityNames(data []byte) (string, bool) {
+	var names []string
+	for len(data) >= 2 {
+		code, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			return "", false
+		}
+		name, ok := capMap[code]
+		if !ok {
+			name = fmt.Sprintf("capability %d", code)
+		}
+		if code == capMpBgp && length == 4 {
+			name += fmt.Sprintf(" (AFI %d SAFI %d)", binary.BigEndian.Uint16(data[2:]), data[5])
+		}
+		names = append(names, name)
+		data = data[2+length:]
+	}
+	return strings.Join(names, ", "), len(data) == 0
+}
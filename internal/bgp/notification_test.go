@@ -0,0 +1,76 @@
+package bgp
+
+import (
+	"testing"
+)
+
+func TestNotificationString(t *testing.T) {
+	shutdown := append([]byte{Cease, CeaseAdminShutdown, 23}, "maintenance until 02:00"...)
+	tests := []struct {
+		desc  string
+		input []byte
+		want  string
+	}{
+		{
+			desc:  "hold timer expired",
+			input: []byte{HoldTimeExpired, 0},
+			want:  "Hold Timer Expired",
+		},
+		{
+			desc:  "RFC 8203 shutdown communication",
+			input: shutdown,
+			want:  "Cease / Administrative Shutdown: maintenance until 02:00",
+		},
+		{
+			desc:  "shutdown communication longer than the data",
+			input: []byte{Cease, CeaseAdminReset, 5, 'a', 'b'},
+			want:  "Cease / Administrative Reset: 056162",
+		},
+		{
+			desc:  "shutdown communication not UTF-8",
+			input: []byte{Cease, CeaseAdminShutdown, 2, 0xff, 0xfe},
+			want:  "Cease / Administrative Shutdown: 02fffe",
+		},
+		{
+			desc:  "maximum prefixes",
+			input: []byte{Cease, CeaseMaxPrefixes, 0, 1, 1, 0, 0, 0x03, 0xe8},
+			want:  "Cease / Maximum Number of Prefixes Reached: AFI 1 SAFI 1 limit 1000",
+		},
+		{
+			desc:  "unsupported capability",
+			input: []byte{OpenError, UnsupportedCapability, 1, 4, 0, 2, 0, 1, 70, 0},
+			want:  "OPEN Message Error / Unsupported Capability: Multiprotocol Extensions for BGP-4 (AFI 2 SAFI 1), Enhanced Route Refresh Capability",
+		},
+		{
+			desc:  "bad attribute",
+			input: []byte{UpdateError, AttrFlagsError, 0xc0, 0x01, 0x01, 0x00},
+			want:  "UPDATE Message Error / Attribute Flags Error: attribute ORIGIN (1)",
+		},
+		{
+			desc:  "missing attribute",
+			input: []byte{UpdateError, MissingWellKnown, 2},
+			want:  "UPDATE Message Error / Missing Well-known Attribute: attribute AS_PATH (2)",
+		},
+		{
+			desc:  "unknown code",
+			input: []byte{99, 1},
+			want:  "Unknown code 99 / Unknown subcode 1",
+		},
+	}
+	for _, test := range tests {
+		n, err := DecodeNotification(test.input)
+		if err != nil {
+			t.Errorf("Test (%s): unexpected error: %v", test.desc, err)
+			continue
+		}
+		if got := n.String(); got != test.want {
+			t.Errorf("Test (%s): got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestDecodeNotificationShort(t *testing.T) {
+	if _, err := DecodeNotification([]byte{Cease}); err == nil {
+		t.Error("expected an error decoding a one byte notification")
+	}
+}
@@ -3,6 +3,7 @@ package bgp
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 )
@@ -13,11 +14,15 @@ const (
 
 	// capability codes I support
 	capMpBgp           uint8 = 1
+	capRouteRefresh    uint8 = 2
+	capExtendedNextHop uint8 = 5
+	capRole            uint8 = 9
 	cap4Byte           uint8 = 65
 	capExtendedMessage uint8 = 6
 	capAddPath         uint8 = 69
-	capRefresh         uint8 = 70 // Only support enhanced refresh
+	capRefresh         uint8 = 70 // Enhanced route refresh
 	capGracefulRestart uint8 = 64
+	capLLGR            uint8 = 71
 )
 
 var capMap = map[uint8]string{
@@ -44,11 +49,17 @@ var capMap = map[uint8]string{
 
 type Parameters struct {
 	ASN32           [4]byte
-	Refresh         bool
+	RouteRefresh    bool
+	EnhancedRefresh bool
 	GracefulRestart bool
 	GRCapability    *GracefulRestartCapability
+	LongLivedGR     bool
+	LLGRFamilies    []LLGRFamily
+	HasRole         bool
+	Role            Role
 	ExtendedMessage bool
 	AddPath         []AddPathCapability
+	ExtendedNextHop []ExtendedNextHop
 	AddrFamilies    []Addr
 	Supported       []uint8
 	Unsupported     []uint8
@@ -66,6 +77,14 @@ type AddPathCapability struct {
 	SendReceive uint8 // 1 = receive, 2 = send, 3 = both
 }
 
+// ExtendedNextHop is an NLRI family that may be sent with next hops of another address family
+// (RFC 8950).
+type ExtendedNextHop struct {
+	AFI        uint16
+	SAFI       uint16
+	NextHopAFI uint16
+}
+
 type GracefulRestartCapability struct {
 	RestartFlags uint8
 	RestartTime  uint16
@@ -78,6 +97,51 @@ type GRAddressFamily struct {
 	Flags uint8
 }
 
+// LLGRFamily is an AFI/SAFI in the Long-Lived Graceful Restart capability (RFC 9494) and
+// how long, in seconds, its routes may be kept once the restart time has expired.
+type LLGRFamily struct {
+	AFI       uint16
+	SAFI      uint8
+	Flags     uint8
+	StaleTime uint32
+}
+
+// ForwardingPreserved reports whether the Forwarding State (F) bit is set for the family.
+func (f LLGRFamily) ForwardingPreserved() bool {
+	return f.Flags&grForwardingState != 0
+}
+
+// Well-known communities used by Long-Lived Graceful Restart (RFC 9494 section 4.1). LLGRStale
+// marks a route kept past the restart time and NoLLGR asks that it is not.
+const (
+	LLGRStale uint32 = 0xffff0006
+	NoLLGR    uint32 = 0xffff0007
+)
+
+// Graceful Restart flags (RFC 4724 section 3 and RFC 8538 section 2). RestartFlags holds the
+// top four bits of the capability, so the Restart State bit is its high bit.
+const (
+	grRestartState    = 0x8
+	grNotification    = 0x4
+	grForwardingState = 0x80
+)
+
+// Restarting reports whether the Restart State (R) bit is set, i.e. the peer has restarted.
+func (g *GracefulRestartCapability) Restarting() bool {
+	return g.RestartFlags&grRestartState != 0
+}
+
+// Notification reports whether the Graceful Notification (N) bit is set, i.e. the peer applies
+// Graceful Restart to sessions that end with a NOTIFICATION.
+func (g *GracefulRestartCapability) Notification() bool {
+	return g.RestartFlags&grNotification != 0
+}
+
+// ForwardingPreserved reports whether the Forwarding State (F) bit is set for the family.
+func (f GRAddressFamily) ForwardingPreserved() bool {
+	return f.Flags&grForwardingState != 0
+}
+
 type parameterHeader struct {
 	Type   uint8
 	Length uint8
@@ -106,6 +170,9 @@ func DecodeOptionalParameters(param *[]byte) (Parameters, error) {
 		if r.Len() == 0 {
 			break
 		}
+		if p.Type != capabilities {
+			return par, fmt.Errorf("%w: %d", ErrUnsupportedOptParam, p.Type)
+		}
 
 		c := make([]byte, p.Length)
 		if _, err := io.ReadFull(r, c); err != nil {
@@ -153,9 +220,14 @@ func decodeCapability(cap []byte, p *Parameters) error {
 			p.ASN32 = asn32
 			p.Supported = append(p.Supported, msgCap.Code)
 
+		case capRouteRefresh:
+			log.Printf("%s supported", capMap[msgCap.Code])
+			p.RouteRefresh = true
+			p.Supported = append(p.Supported, msgCap.Code)
+
 		case capRefresh:
 			log.Printf("%s supported", capMap[msgCap.Code])
-			p.Refresh = true
+			p.EnhancedRefresh = true
 			p.Supported = append(p.Supported, msgCap.Code)
 
 		case capMpBgp:
@@ -184,6 +256,20 @@ func decodeCapability(cap []byte, p *Parameters) error {
 			}
 			p.Supported = append(p.Supported, msgCap.Code)
 
+		case capExtendedNextHop:
+			log.Printf("%s supported", capMap[msgCap.Code])
+			if _, err := io.CopyN(buf, r, int64(msgCap.Length)); err != nil {
+				return err
+			}
+			for buf.Len() > 0 {
+				var e ExtendedNextHop
+				if err := binary.Read(buf, binary.BigEndian, &e); err != nil {
+					return err
+				}
+				p.ExtendedNextHop = append(p.ExtendedNextHop, e)
+			}
+			p.Supported = append(p.Supported, msgCap.Code)
+
 		case capGracefulRestart:
 			log.Printf("%s supported", capMap[msgCap.Code])
 			p.GracefulRestart = true
@@ -197,6 +283,35 @@ func decodeCapability(cap []byte, p *Parameters) error {
 			p.GRCapability = &gr
 			p.Supported = append(p.Supported, msgCap.Code)
 
+		case capLLGR:
+			log.Printf("%s supported", capMap[msgCap.Code])
+			p.LongLivedGR = true
+			if _, err := io.CopyN(buf, r, int64(msgCap.Length)); err != nil {
+				return err
+			}
+			llgr, err := decodeLLGR(buf)
+			if err != nil {
+				return err
+			}
+			p.LLGRFamilies = llgr
+			p.Supported = append(p.Supported, msgCap.Code)
+
+		case capRole:
+			log.Printf("%s supported", capMap[msgCap.Code])
+			if msgCap.Length != 1 {
+				return fmt.Errorf("invalid BGP role length: %d", msgCap.Length)
+			}
+			var role Role
+			if err := binary.Read(r, binary.BigEndian, &role); err != nil {
+				return err
+			}
+			if p.HasRole && p.Role != role {
+				return fmt.Errorf("%w: %v and %v", ErrRoleMismatch, p.Role, role)
+			}
+			p.HasRole = true
+			p.Role = role
+			p.Supported = append(p.Supported, msgCap.Code)
+
 		default:
 			if desc, ok := capMap[msgCap.Code]; ok {
 				log.Printf("%s is not supported", desc)
@@ -266,3 +381,20 @@ func decodeGracefulRestart(b *bytes.Buffer) (GracefulRestartCapability, error) {
 	}
 	return gr, nil
 }
+
+func decodeLLGR(b *bytes.Buffer) ([]LLGRFamily, error) {
+	if b.Len()%7 != 0 {
+		return nil, fmt.Errorf("invalid long-lived graceful restart capability length: %d", b.Len())
+	}
+	var families []LLGRFamily
+	for b.Len() > 0 {
+		t := b.Next(7)
+		families = append(families, LLGRFamily{
+			AFI:       binary.BigEndian.Uint16(t),
+			SAFI:      t[2],
+			Flags:     t[3],
+			StaleTime: uint32(t[4])<<16 | uint32(t[5])<<8 | uint32(t[6]),
+		})
+	}
+	return families, nil
+}
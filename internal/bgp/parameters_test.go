@@ -1,6 +1,7 @@
 package bgp
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -20,7 +21,8 @@ func TestDecodeOptionalParameters(t *testing.T) {
 			},
 			want: Parameters{
 				ASN32:           [4]byte{0x00, 0x00, 0xfc, 0x15},
-				Refresh:         true,
+				RouteRefresh:    true,
+				EnhancedRefresh: true,
 				GracefulRestart: true,
 				GRCapability: &GracefulRestartCapability{
 					RestartFlags: 0,
@@ -32,8 +34,8 @@ func TestDecodeOptionalParameters(t *testing.T) {
 						SAFI: 1,
 					},
 				},
-				Supported:   []uint8{1, 64, 65, 70},
-				Unsupported: []uint8{2, 71},
+				LongLivedGR: true,
+				Supported:   []uint8{1, 2, 64, 65, 70, 71},
 			},
 		},
 		{
@@ -43,16 +45,42 @@ func TestDecodeOptionalParameters(t *testing.T) {
 				0x02, 0x02, 0x02, 0x00,
 			},
 			want: Parameters{
-				ASN32:   [4]byte{0x00, 0x00, 0x00, 0x00},
-				Refresh: false,
+				ASN32:        [4]byte{0x00, 0x00, 0x00, 0x00},
+				RouteRefresh: true,
 				AddrFamilies: []Addr{
 					Addr{
 						AFI:  1,
 						SAFI: 1,
 					},
 				},
-				Supported:   []uint8{1},
-				Unsupported: []uint8{128, 2},
+				Supported:   []uint8{1, 2},
+				Unsupported: []uint8{128},
+			},
+		},
+		{
+			desc: "Long-lived graceful restart",
+			input: []byte{
+				0x02, 0x09, 0x47, 0x07, 0x00, 0x01, 0x01, 0x80, 0x00, 0x0e, 0x10,
+			},
+			want: Parameters{
+				AddrFamilies: []Addr{},
+				LongLivedGR:  true,
+				LLGRFamilies: []LLGRFamily{
+					{AFI: 1, SAFI: 1, Flags: 0x80, StaleTime: 3600},
+				},
+				Supported: []uint8{71},
+			},
+		},
+		{
+			desc: "BGP role",
+			input: []byte{
+				0x02, 0x03, 0x09, 0x01, 0x03,
+			},
+			want: Parameters{
+				AddrFamilies: []Addr{},
+				HasRole:      true,
+				Role:         RoleCustomer,
+				Supported:    []uint8{9},
 			},
 		},
 	}
@@ -64,3 +92,16 @@ func TestDecodeOptionalParameters(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeConflictingRoles(t *testing.T) {
+	input := []byte{0x02, 0x06, 0x09, 0x01, 0x03, 0x09, 0x01, 0x04}
+	if _, err := DecodeOptionalParameters(&input); !errors.Is(err, ErrRoleMismatch) {
+		t.Errorf("got error %v, want %v", err, ErrRoleMismatch)
+	}
+
+	// The same role sent twice is not a conflict
+	input = []byte{0x02, 0x06, 0x09, 0x01, 0x04, 0x09, 0x01, 0x04}
+	if _, err := DecodeOptionalParameters(&input); err != nil {
+		t.Errorf("got error %v for a repeated role", err)
+	}
+}
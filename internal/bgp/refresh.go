@@ -0,0 +1,62 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ROUTE-REFRESH message subtypes (RFC 7313). Subtype 0 is a plain RFC 2918 request.
+const (
+	RefreshRequest = 0
+	RefreshBoRR    = 1
+	RefreshEoRR    = 2
+)
+
+// RouteRefresh is a decoded ROUTE-REFRESH message.
+type RouteRefresh struct {
+	AFI     uint16
+	Subtype uint8
+	SAFI    uint8
+}
+
+// CreateRouteRefresh creates a BGP ROUTE-REFRESH message for the AFI/SAFI.
+func CreateRouteRefresh(afi uint16, safi, subtype uint8) []byte {
+	var b bytes.Buffer
+	writeMarker(&b)
+	b.Write([]byte{0, 0, Refresh})
+	b.Write(uint16ToByte(afi))
+	b.WriteByte(subtype)
+	b.WriteByte(safi)
+
+	buf := b.Bytes()
+	setSizeOfMessage(&buf)
+	return buf
+}
+
+// DecodeRouteRefresh decodes the body of a ROUTE-REFRESH message, following the message type.
+func DecodeRouteRefresh(b []byte) (RouteRefresh, error) {
+	if len(b) != 4 {
+		return RouteRefresh{}, fmt.Errorf("route refresh must be 4 bytes, got %d", len(b))
+	}
+	return RouteRefresh{
+		AFI:     binary.BigEndian.Uint16(b),
+		Subtype: b[2],
+		SAFI:    b[3],
+	}, nil
+}
+
+func (r RouteRefresh) String() string {
+	var kind string
+	switch r.Subtype {
+	case RefreshRequest:
+		kind = "request"
+	case RefreshBoRR:
+		kind = "BoRR"
+	case RefreshEoRR:
+		kind = "EoRR"
+	default:
+		kind = fmt.Sprintf("subtype %d", r.Subtype)
+	}
+	return fmt.Sprintf("%s for AFI %d SAFI %d", kind, r.AFI, r.SAFI)
+}
@@ -0,0 +1,72 @@
+package bgp
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCreateRouteRefresh(t *testing.T) {
+	tests := []struct {
+		desc    string
+		afi     uint16
+		safi    uint8
+		subtype uint8
+		want    []byte
+	}{
+		{
+			desc:    "IPv4 unicast request",
+			afi:     1,
+			safi:    1,
+			subtype: RefreshRequest,
+			want:    []byte{0, 23, Refresh, 0, 1, 0, 1},
+		},
+		{
+			desc:    "IPv6 unicast EoRR",
+			afi:     2,
+			safi:    1,
+			subtype: RefreshEoRR,
+			want:    []byte{0, 23, Refresh, 0, 2, 2, 1},
+		},
+	}
+	for _, test := range tests {
+		got := CreateRouteRefresh(test.afi, test.safi, test.subtype)
+		if !cmp.Equal(got[16:], test.want) {
+			t.Errorf("Test (%s): got %#v, want %#v", test.desc, got[16:], test.want)
+		}
+	}
+}
+
+func TestDecodeRouteRefresh(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   []byte
+		want    RouteRefresh
+		wantErr bool
+	}{
+		{
+			desc:  "IPv6 unicast BoRR",
+			input: []byte{0, 2, 1, 1},
+			want:  RouteRefresh{AFI: 2, Subtype: RefreshBoRR, SAFI: 1},
+		},
+		{
+			desc:    "too short",
+			input:   []byte{0, 1, 0},
+			wantErr: true,
+		},
+		{
+			desc:    "too long",
+			input:   []byte{0, 1, 0, 1, 0},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := DecodeRouteRefresh(test.input)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bgp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role is a BGP Role (RFC 9234 section 4.1), the relationship of a speaker to its peer.
+type Role uint8
+
+const (
+	RoleProvider Role = 0
+	RoleRS       Role = 1
+	RoleRSClient Role = 2
+	RoleCustomer Role = 3
+	RolePeer     Role = 4
+)
+
+var roleNames = map[Role]string{
+	RoleProvider: "provider",
+	RoleRS:       "rs",
+	RoleRSClient: "rs-client",
+	RoleCustomer: "customer",
+	RolePeer:     "peer",
+}
+
+// ErrRoleMismatch is returned when an OPEN carries BGP Role capabilities with different
+// values (RFC 9234 section 4.2).
+var ErrRoleMismatch = errors.New("conflicting BGP roles")
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(r))
+}
+
+// ParseRole returns the Role for one of provider, rs, rs-client, customer or peer.
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown BGP role: %q", s)
+}
+
+// Matches reports whether remote is the role a peer must have when we have role r.
+func (r Role) Matches(remote Role) bool {
+	switch r {
+	case RoleProvider:
+		return remote == RoleCustomer
+	case RoleCustomer:
+		return remote == RoleProvider
+	case RoleRS:
+		return remote == RoleRSClient
+	case RoleRSClient:
+		return remote == RoleRS
+	case RolePeer:
+		return remote == RolePeer
+	}
+	return false
+}
+
+// IngressOTC returns the Only-To-Customer value to store for a route received from a peer in
+// AS peerASN (RFC 9234 section 5), where local is our role towards that peer and otc the
+// route's OTC attribute, 0 if absent. Routes from a provider, peer or route server without
+// OTC are given the peer's AS.
+func IngressOTC(local Role, peerASN, otc uint32) uint32 {
+	if otc == 0 && (local == RoleCustomer || local == RoleRSClient || local == RolePeer) {
+		return peerASN
+	}
+	return otc
+}
+
+// IsRouteLeak reports whether a route from a peer in AS peerASN with the given OTC is a route
+// leak (RFC 9234 section 5): any OTC from a customer or RS-client, or an OTC other than the
+// peer's own AS from a lateral peer.
+func IsRouteLeak(local Role, peerASN, otc uint32) bool {
+	switch local {
+	case RoleProvider, RoleRS:
+		return otc != 0
+	case RolePeer:
+		return otc != 0 && otc != peerASN
+	}
+	return false
+}
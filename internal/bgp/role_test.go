@@ -0,0 +1,106 @@
+package bgp
+
+import (
+	"testing"
+)
+
+func TestRoleMatches(t *testing.T) {
+	tests := []struct {
+		local  Role
+		remote Role
+		want   bool
+	}{
+		{local: RoleProvider, remote: RoleCustomer, want: true},
+		{local: RoleCustomer, remote: RoleProvider, want: true},
+		{local: RoleRS, remote: RoleRSClient, want: true},
+		{local: RoleRSClient, remote: RoleRS, want: true},
+		{local: RolePeer, remote: RolePeer, want: true},
+		{local: RoleProvider, remote: RoleProvider},
+		{local: RolePeer, remote: RoleCustomer},
+		{local: Role(5), remote: RolePeer},
+	}
+	for _, test := range tests {
+		if got := test.local.Matches(test.remote); got != test.want {
+			t.Errorf("Test (%v with %v): got %t, want %t", test.local, test.remote, got, test.want)
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	for r, name := range roleNames {
+		got, err := ParseRole(name)
+		if err != nil || got != r {
+			t.Errorf("Test (%s): got %v, %v, want %v", name, got, err, r)
+		}
+	}
+	if _, err := ParseRole("upstream"); err == nil {
+		t.Errorf("Test (upstream): got no error")
+	}
+}
+
+func TestRouteLeak(t *testing.T) {
+	tests := []struct {
+		desc     string
+		local    Role
+		otc      uint32
+		wantOTC  uint32
+		wantLeak bool
+	}{
+		{
+			desc:     "OTC from a customer",
+			local:    RoleProvider,
+			otc:      64500,
+			wantOTC:  64500,
+			wantLeak: true,
+		},
+		{
+			desc:  "no OTC from a customer",
+			local: RoleProvider,
+		},
+		{
+			desc:     "OTC from an RS-client",
+			local:    RoleRS,
+			otc:      64501,
+			wantOTC:  64501,
+			wantLeak: true,
+		},
+		{
+			desc:     "someone else's OTC from a peer",
+			local:    RolePeer,
+			otc:      64501,
+			wantOTC:  64501,
+			wantLeak: true,
+		},
+		{
+			desc:    "peer's own OTC from a peer",
+			local:   RolePeer,
+			otc:     64500,
+			wantOTC: 64500,
+		},
+		{
+			desc:    "no OTC from a peer",
+			local:   RolePeer,
+			wantOTC: 64500,
+		},
+		{
+			desc:    "no OTC from a provider",
+			local:   RoleCustomer,
+			wantOTC: 64500,
+		},
+		{
+			desc:    "OTC from a route server",
+			local:   RoleRSClient,
+			otc:     64501,
+			wantOTC: 64501,
+		},
+	}
+	for _, test := range tests {
+		otc := IngressOTC(test.local, 64500, test.otc)
+		if otc != test.wantOTC {
+			t.Errorf("Test (%s): got OTC %d, want %d", test.desc, otc, test.wantOTC)
+		}
+		if got := IsRouteLeak(test.local, 64500, otc); got != test.wantLeak {
+			t.Errorf("Test (%s): got leak %t, want %t", test.desc, got, test.wantLeak)
+		}
+	}
+}
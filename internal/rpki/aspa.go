@@ -0,0 +1,173 @@
+package rpki
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ASPAState is the result of verifying an AS path against ASPAs
+// (draft-ietf-sidrops-aspa-verification section 6).
+type ASPAState uint8
+
+const (
+	ASPAUnknown ASPAState = iota
+	ASPAValid
+	ASPAInvalid
+)
+
+func (s ASPAState) String() string {
+	switch s {
+	case ASPAValid:
+		return "valid"
+	case ASPAInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseASPAState parses the name of an ASPA verification state.
+func ParseASPAState(s string) (ASPAState, error) {
+	for _, st := range []ASPAState{ASPAUnknown, ASPAValid, ASPAInvalid} {
+		if s == st.String() {
+			return st, nil
+		}
+	}
+	return ASPAUnknown, fmt.Errorf("unknown ASPA state %q", s)
+}
+
+// ASPA is a validated Autonomous System Provider Authorization: the set of ASes that
+// CustomerASN attests are its providers. A customer without providers lists only AS 0.
+type ASPA struct {
+	CustomerASN uint32
+	Providers   []uint32
+}
+
+func (a ASPA) String() string {
+	return fmt.Sprintf("AS%d providers %v", a.CustomerASN, a.Providers)
+}
+
+// hop is the result of looking up one pair of adjacent ASes in a path.
+type hop uint8
+
+const (
+	noAttestation hop = iota
+	providerPlus
+	notProviderPlus
+)
+
+// ASPATable is a set of ASPAs that AS paths are verified against, safe for concurrent use.
+type ASPATable struct {
+	mu        sync.RWMutex
+	providers map[uint32]map[uint32]bool
+}
+
+func NewASPATable() *ASPATable {
+	return &ASPATable{providers: make(map[uint32]map[uint32]bool)}
+}
+
+// Replace replaces the ASPAs in the table. ASPAs for the same customer, such as those issued
+// under two trust anchors, are merged.
+func (t *ASPATable) Replace(aspas []ASPA) {
+	providers := make(map[uint32]map[uint32]bool, len(aspas))
+	for _, a := range aspas {
+		set, ok := providers[a.CustomerASN]
+		if !ok {
+			set = make(map[uint32]bool, len(a.Providers))
+			providers[a.CustomerASN] = set
+		}
+		for _, p := range a.Providers {
+			set[p] = true
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.providers = providers
+}
+
+// Len returns the number of customer ASes with an ASPA.
+func (t *ASPATable) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.providers)
+}
+
+// hop reports whether provider is attested as a provider of customer. Called with t.mu held.
+func (t *ASPATable) hop(customer, provider uint32) hop {
+	set, ok := t.providers[customer]
+	switch {
+	case !ok:
+		return noAttestation
+	case set[provider]:
+		return providerPlus
+	default:
+		return notProviderPlus
+	}
+}
+
+// Verify returns the state of an AS path made of AS_SEQUENCE segments only, most recently
+// added AS first, as it is received. The upstream algorithm is for paths received from a
+// customer, a lateral peer or a route server client, which must only have gone up from the
+// origin. The downstream algorithm is for paths received from a provider, which may have
+// gone up and then down. Checking the neighbor AS and rejecting AS_SETs is left to the
+// caller.
+func (t *ASPATable) Verify(path []uint32, upstream bool) ASPAState {
+	// Index from the origin, with prepends collapsed
+	var asns []uint32
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(asns) == 0 || asns[len(asns)-1] != path[i] {
+			asns = append(asns, path[i])
+		}
+	}
+	n := len(asns)
+	if n <= 1 {
+		return ASPAValid
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// The up-ramp runs from the origin while each AS attests the next as a provider. Its
+	// maximum length stops at the first hop that is not a provider, its minimum length at the
+	// first hop that is not known to be one.
+	maxUp, minUp := ramp(n, func(i int) hop { return t.hop(asns[i], asns[i+1]) })
+	if upstream {
+		switch {
+		case maxUp < n:
+			return ASPAInvalid
+		case minUp < n:
+			return ASPAUnknown
+		default:
+			return ASPAValid
+		}
+	}
+
+	// The down-ramp runs the same way from the neighbor towards the origin
+	maxDown, minDown := ramp(n, func(i int) hop { return t.hop(asns[n-1-i], asns[n-2-i]) })
+	switch {
+	case maxUp+maxDown < n:
+		return ASPAInvalid
+	case minUp+minDown < n:
+		return ASPAUnknown
+	default:
+		return ASPAValid
+	}
+}
+
+// ramp returns the maximum and minimum number of ASes in a ramp of a path of n ASes, given
+// the result of each of its n-1 hops in order.
+func ramp(n int, lookup func(int) hop) (maxLen, minLen int) {
+	maxLen, minLen = n, n
+	for i := 0; i < n-1; i++ {
+		h := lookup(i)
+		if h != providerPlus && minLen == n {
+			minLen = i + 1
+		}
+		if h == notProviderPlus {
+			maxLen = i + 1
+			break
+		}
+	}
+	return maxLen, minLen
+}
@@ -0,0 +1,128 @@
+package rpki
+
+import "testing"
+
+func TestVerify(t *testing.T) {
+	table := NewASPATable()
+	table.Replace([]ASPA{
+		{CustomerASN: 64500, Providers: []uint32{64510}},
+		{CustomerASN: 64501, Providers: []uint32{64511}},
+		{CustomerASN: 64502, Providers: []uint32{0}},
+		{CustomerASN: 64510, Providers: []uint32{64520}},
+		{CustomerASN: 64511, Providers: []uint32{64520}},
+		{CustomerASN: 64520, Providers: []uint32{0}},
+	})
+
+	tests := []struct {
+		desc     string
+		path     []uint32
+		upstream bool
+		want     ASPAState
+	}{
+		{
+			desc:     "from a customer",
+			path:     []uint32{64510, 64500},
+			upstream: true,
+			want:     ASPAValid,
+		},
+		{
+			desc:     "prepended",
+			path:     []uint32{64520, 64510, 64510, 64500, 64500},
+			upstream: true,
+			want:     ASPAValid,
+		},
+		{
+			desc:     "origin only",
+			path:     []uint32{64500},
+			upstream: true,
+			want:     ASPAValid,
+		},
+		{
+			desc:     "not a provider",
+			path:     []uint32{64599, 64500},
+			upstream: true,
+			want:     ASPAInvalid,
+		},
+		{
+			desc:     "customer without providers",
+			path:     []uint32{64520, 64502},
+			upstream: true,
+			want:     ASPAInvalid,
+		},
+		{
+			desc:     "no attestation",
+			path:     []uint32{64510, 64503},
+			upstream: true,
+			want:     ASPAUnknown,
+		},
+		{
+			desc:     "down from a provider",
+			path:     []uint32{64510, 64520},
+			upstream: true,
+			want:     ASPAInvalid,
+		},
+		{
+			desc: "up and down",
+			path: []uint32{64501, 64511, 64520, 64510, 64500},
+			want: ASPAValid,
+		},
+		{
+			desc: "leaked to a lateral peer",
+			path: []uint32{64511, 64500, 64510, 64520},
+			want: ASPAInvalid,
+		},
+		{
+			desc: "two ASes from a provider",
+			path: []uint32{64599, 64500},
+			want: ASPAValid,
+		},
+		{
+			desc: "no attestation from a provider",
+			path: []uint32{64521, 64503, 64500},
+			want: ASPAUnknown,
+		},
+		{
+			desc: "down only",
+			path: []uint32{64500, 64510, 64520},
+			want: ASPAValid,
+		},
+	}
+	for _, test := range tests {
+		if got := table.Verify(test.path, test.upstream); got != test.want {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestASPATableReplace(t *testing.T) {
+	table := NewASPATable()
+	table.Replace([]ASPA{
+		{CustomerASN: 64500, Providers: []uint32{64510}},
+		{CustomerASN: 64500, Providers: []uint32{64511}},
+	})
+	if got := table.Len(); got != 1 {
+		t.Errorf("got %d customers, want 1", got)
+	}
+	for _, provider := range []uint32{64510, 64511} {
+		if got := table.Verify([]uint32{provider, 64500}, true); got != ASPAValid {
+			t.Errorf("Test (AS%d): got %v, want valid", provider, got)
+		}
+	}
+
+	table.Replace(nil)
+	if got := table.Verify([]uint32{64599, 64500}, true); got != ASPAUnknown {
+		t.Errorf("Test (replaced): got %v, want unknown", got)
+	}
+}
+
+func TestParseASPAState(t *testing.T) {
+	for _, s := range []ASPAState{ASPAUnknown, ASPAValid, ASPAInvalid} {
+		got, err := ParseASPAState(s.String())
+		if err != nil || got != s {
+			t.Errorf("Test (%s): got %v, %v, want %v", s, got, err, s)
+		}
+	}
+	if _, err := ParseASPAState("not-found"); err == nil {
+		t.Errorf("Test (not-found): got no error")
+	}
+}
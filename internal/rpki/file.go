@@ -0,0 +1,133 @@
+package rpki
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// File is the validated RPKI data in a JSON export: the VRPs and, in exports that have them,
+// the ASPAs.
+type File struct {
+	VRPs  []VRP
+	ASPAs []ASPA
+}
+
+// jsonFile is the layout shared by the JSON exports of rpki-client (-j) and Routinator
+// (--format json). Anything else in them, such as the metadata, is ignored.
+type jsonFile struct {
+	ROAs []struct {
+		Prefix    string  `json:"prefix"`
+		MaxLength int     `json:"maxLength"`
+		ASN       jsonASN `json:"asn"`
+	} `json:"roas"`
+	// rpki-client names the customer customer_asid, Routinator customer
+	ASPAs []struct {
+		CustomerASID *jsonASN  `json:"customer_asid"`
+		Customer     *jsonASN  `json:"customer"`
+		Providers    []jsonASN `json:"providers"`
+	} `json:"aspas"`
+}
+
+// jsonASN is an AS number written as 64496, as rpki-client does, or as "AS64496", as
+// Routinator does.
+type jsonASN uint32
+
+func (a *jsonASN) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = strings.TrimPrefix(strings.ToUpper(unquoted), "AS")
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid ASN %s", b)
+	}
+	*a = jsonASN(n)
+	return nil
+}
+
+// ReadFile reads and parses a JSON export.
+func ReadFile(name string) (*File, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJSON(b)
+}
+
+// ParseJSON parses a JSON export, checking every entry in it.
+func ParseJSON(b []byte) (*File, error) {
+	var jf jsonFile
+	if err := json.Unmarshal(b, &jf); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	f := &File{VRPs: make([]VRP, 0, len(jf.ROAs))}
+	for _, roa := range jf.ROAs {
+		prefix, err := netip.ParsePrefix(roa.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("roa %q: %v", roa.Prefix, err)
+		}
+		if roa.MaxLength < prefix.Bits() || roa.MaxLength > prefix.Addr().BitLen() {
+			return nil, fmt.Errorf("roa %s: invalid maxLength %d", prefix, roa.MaxLength)
+		}
+		f.VRPs = append(f.VRPs, VRP{
+			Prefix:    prefix.Masked(),
+			MaxLength: uint8(roa.MaxLength),
+			ASN:       uint32(roa.ASN),
+		})
+	}
+
+	f.ASPAs = make([]ASPA, 0, len(jf.ASPAs))
+	for _, aspa := range jf.ASPAs {
+		customer := aspa.CustomerASID
+		if customer == nil {
+			customer = aspa.Customer
+		}
+		if customer == nil {
+			return nil, fmt.Errorf("aspa without a customer AS")
+		}
+		a := ASPA{CustomerASN: uint32(*customer)}
+		for _, p := range aspa.Providers {
+			a.Providers = append(a.Providers, uint32(p))
+		}
+		// An empty list authorizes no providers, the same as listing only AS 0
+		if len(a.Providers) == 0 {
+			a.Providers = []uint32{0}
+		}
+		slices.Sort(a.Providers)
+		a.Providers = slices.Compact(a.Providers)
+		f.ASPAs = append(f.ASPAs, a)
+	}
+	return f, nil
+}
+
+// Diff returns the VRPs in to that are not in from, and those in from no longer in to. A VRP
+// listed more than once, such as one issued under two trust anchors, is returned once.
+func Diff(from, to []VRP) (added, removed []VRP) {
+	have := make(map[VRP]bool, len(from))
+	for _, v := range from {
+		have[v] = true
+	}
+	want := make(map[VRP]bool, len(to))
+	for _, v := range to {
+		if want[v] {
+			continue
+		}
+		want[v] = true
+		if !have[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range from {
+		if have[v] && !want[v] {
+			removed = append(removed, v)
+			have[v] = false
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,149 @@
+package rpki
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		desc    string
+		json    string
+		want    []VRP
+		wantErr bool
+	}{
+		{
+			desc: "rpki-client",
+			json: `{
+				"metadata": {"buildmachine": "rpki", "roas": 2},
+				"roas": [
+					{"asn": 64500, "prefix": "192.0.2.0/24", "maxLength": 24, "ta": "apnic", "expires": 1700000000},
+					{"asn": 64501, "prefix": "2001:db8::/32", "maxLength": 48, "ta": "ripe", "expires": 1700000000}
+				]
+			}`,
+			want: []VRP{vrp("192.0.2.0/24", 24, 64500), vrp("2001:db8::/32", 48, 64501)},
+		},
+		{
+			desc: "routinator",
+			json: `{
+				"metadata": {"generated": 1700000000},
+				"roas": [{"asn": "AS64500", "prefix": "198.51.100.0/22", "maxLength": 24, "ta": "arin"}]
+			}`,
+			want: []VRP{vrp("198.51.100.0/22", 24, 64500)},
+		},
+		{
+			desc: "host bits set",
+			json: `{"roas": [{"asn": 64500, "prefix": "192.0.2.1/24", "maxLength": 24}]}`,
+			want: []VRP{vrp("192.0.2.0/24", 24, 64500)},
+		},
+		{
+			desc: "no roas",
+			json: `{"metadata": {}}`,
+			want: []VRP{},
+		},
+		{
+			desc:    "max length too short",
+			json:    `{"roas": [{"asn": 64500, "prefix": "192.0.2.0/24", "maxLength": 23}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "max length too long",
+			json:    `{"roas": [{"asn": 64500, "prefix": "192.0.2.0/24", "maxLength": 33}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "bad prefix",
+			json:    `{"roas": [{"asn": 64500, "prefix": "192.0.2.0", "maxLength": 24}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "bad ASN",
+			json:    `{"roas": [{"asn": "ASX", "prefix": "192.0.2.0/24", "maxLength": 24}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseJSON([]byte(test.json))
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !cmp.Equal(got.VRPs, test.want, cmpPrefixes) {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got.VRPs, test.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, b, c := vrp("192.0.2.0/24", 24, 64500), vrp("192.0.2.0/24", 24, 64501), vrp("2001:db8::/32", 48, 64500)
+	added, removed := Diff([]VRP{a, b, b}, []VRP{b, c, c})
+	if want := []VRP{c}; !cmp.Equal(added, want, cmpPrefixes) {
+		t.Errorf("got added %v, want %v", added, want)
+	}
+	if want := []VRP{a}; !cmp.Equal(removed, want, cmpPrefixes) {
+		t.Errorf("got removed %v, want %v", removed, want)
+	}
+}
+
+func TestParseJSONASPAs(t *testing.T) {
+	tests := []struct {
+		desc    string
+		json    string
+		want    []ASPA
+		wantErr bool
+	}{
+		{
+			desc: "rpki-client",
+			json: `{"aspas": [
+				{"customer_asid": 64500, "expires": 1700000000, "providers": [64511, 64510, 64511]},
+				{"customer_asid": 64501, "expires": 1700000000, "providers": [0]}
+			]}`,
+			want: []ASPA{
+				{CustomerASN: 64500, Providers: []uint32{64510, 64511}},
+				{CustomerASN: 64501, Providers: []uint32{0}},
+			},
+		},
+		{
+			desc: "routinator",
+			json: `{"aspas": [{"customer": "AS64500", "providers": ["AS64510"]}]}`,
+			want: []ASPA{{CustomerASN: 64500, Providers: []uint32{64510}}},
+		},
+		{
+			desc: "no aspas",
+			json: `{"roas": []}`,
+			want: []ASPA{},
+		},
+		{
+			desc:    "no customer",
+			json:    `{"aspas": [{"providers": [64510]}]}`,
+			wantErr: true,
+		},
+		{
+			desc: "no providers",
+			json: `{"aspas": [{"customer_asid": 64500, "providers": []}]}`,
+			want: []ASPA{{CustomerASN: 64500, Providers: []uint32{0}}},
+		},
+		{
+			desc:    "bad provider",
+			json:    `{"aspas": [{"customer_asid": 64500, "providers": ["ASX"]}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseJSON([]byte(test.json))
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !cmp.Equal(got.ASPAs, test.want) {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got.ASPAs, test.want)
+		}
+	}
+}
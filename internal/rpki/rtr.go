@@ -0,0 +1,417 @@
+package rpki
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// rtrVersion is the RTR version first offered to a cache. 1 is RFC 8210 and 0 is RFC 6810.
+const rtrVersion = 1
+
+// PDU types (RFC 8210 section 5)
+const (
+	pduSerialNotify  = 0
+	pduSerialQuery   = 1
+	pduResetQuery    = 2
+	pduCacheResponse = 3
+	pduIPv4Prefix    = 4
+	pduIPv6Prefix    = 6
+	pduEndOfData     = 7
+	pduCacheReset    = 8
+	pduRouterKey     = 9
+	pduErrorReport   = 10
+)
+
+// Error Report codes (RFC 8210 section 12)
+const (
+	errNoDataAvailable    = 2
+	errUnsupportedVersion = 4
+)
+
+const (
+	pduHeaderLen = 8
+	maxPDULen    = 64 * 1024
+	dialTimeout  = 10 * time.Second
+)
+
+// Default timers (RFC 8210 section 6), used until a cache sends its own and with version 0
+// caches, which do not.
+const (
+	defaultRefresh = time.Hour
+	defaultRetry   = 10 * time.Minute
+	defaultExpire  = 2 * time.Hour
+)
+
+// errDowngrade ends a session with a cache that does not support our version, to retry
+// straight away with the version it does.
+var errDowngrade = errors.New("cache does not support the RTR version")
+
+type pdu struct {
+	version uint8
+	typ     uint8
+	session uint16 // the session ID, or the error code of an Error Report
+	body    []byte
+}
+
+func readPDU(r io.Reader) (pdu, error) {
+	var hdr [pduHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return pdu{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n < pduHeaderLen || n > maxPDULen {
+		return pdu{}, fmt.Errorf("invalid PDU length %d", n)
+	}
+	p := pdu{
+		version: hdr[0],
+		typ:     hdr[1],
+		session: binary.BigEndian.Uint16(hdr[2:]),
+		body:    make([]byte, n-pduHeaderLen),
+	}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return pdu{}, err
+	}
+	return p, nil
+}
+
+func (p pdu) marshal() []byte {
+	b := []byte{p.version, p.typ}
+	b = binary.BigEndian.AppendUint16(b, p.session)
+	b = binary.BigEndian.AppendUint32(b, uint32(pduHeaderLen+len(p.body)))
+	return append(b, p.body...)
+}
+
+// prefix decodes an IPv4 or IPv6 Prefix PDU, returning the VRP and whether it is announced
+// rather than withdrawn.
+func (p pdu) prefix() (VRP, bool, error) {
+	size := 4
+	if p.typ == pduIPv6Prefix {
+		size = 16
+	}
+	if len(p.body) != 8+size {
+		return VRP{}, false, fmt.Errorf("invalid prefix PDU length %d", pduHeaderLen+len(p.body))
+	}
+	flags, bits, maxLength := p.body[0], p.body[1], p.body[2]
+	addr, _ := netip.AddrFromSlice(p.body[4 : 4+size])
+	prefix := netip.PrefixFrom(addr, int(bits))
+	if !prefix.IsValid() || maxLength < bits || int(maxLength) > addr.BitLen() {
+		return VRP{}, false, fmt.Errorf("invalid prefix %s/%d-%d", addr, bits, maxLength)
+	}
+	v := VRP{
+		Prefix:    prefix.Masked(),
+		MaxLength: maxLength,
+		ASN:       binary.BigEndian.Uint32(p.body[4+size:]),
+	}
+	return v, flags&1 == 1, nil
+}
+
+// errorText returns the diagnostic text of an Error Report.
+func (p pdu) errorText() string {
+	b := p.body
+	if len(b) < 4 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	if len(b) < 8+n {
+		return ""
+	}
+	b = b[4+n:]
+	n = int(binary.BigEndian.Uint32(b))
+	if len(b) < 4+n {
+		return ""
+	}
+	return string(b[4 : 4+n])
+}
+
+type update struct {
+	vrp      VRP
+	announce bool
+}
+
+// Client keeps a copy of the VRPs held by an RTR cache (RFC 8210), falling back to version 0
+// (RFC 6810) for a cache that does not support version 1. Each change is passed to apply as
+// the VRPs announced and withdrawn.
+type Client struct {
+	addr  string
+	apply func(announced, withdrawn []VRP)
+
+	version   uint8
+	session   uint16
+	serial    uint32
+	hasSerial bool // session and serial are those of the last completed sync
+	lastSync  time.Time
+	vrps      map[VRP]bool
+
+	refresh, retry, expire time.Duration
+}
+
+func NewClient(addr string, apply func(announced, withdrawn []VRP)) *Client {
+	return &Client{
+		addr:    addr,
+		apply:   apply,
+		version: rtrVersion,
+		vrps:    make(map[VRP]bool),
+		refresh: defaultRefresh,
+		retry:   defaultRetry,
+		expire:  defaultExpire,
+	}
+}
+
+// Run syncs with the cache until stop is closed, reconnecting after the retry interval when
+// the session fails. The VRPs are withdrawn once none could be fetched for the expire
+// interval.
+func (c *Client) Run(stop <-chan struct{}) {
+	for {
+		err := c.connect(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("RTR session with %s: %v\n", c.addr, err)
+		if len(c.vrps) > 0 && time.Since(c.lastSync) >= c.expire {
+			log.Printf("RTR data from %s expired, withdrawing %d VRPs\n", c.addr, len(c.vrps))
+			c.replace(nil)
+			c.hasSerial = false
+		}
+		if errors.Is(err, errDowngrade) {
+			continue
+		}
+
+		t := time.NewTimer(c.retry)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) connect(stop <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	return c.sync(conn)
+}
+
+// query asks the cache for the changes since the last sync, or for all of its data if there
+// has not been one, returning true for the latter.
+func (c *Client) query(w io.Writer) (bool, error) {
+	q := pdu{version: c.version, typ: pduResetQuery}
+	if c.hasSerial {
+		q = pdu{version: c.version, typ: pduSerialQuery, session: c.session}
+		q.body = binary.BigEndian.AppendUint32(nil, c.serial)
+	}
+	_, err := w.Write(q.marshal())
+	return !c.hasSerial, err
+}
+
+// sync runs a session with the cache: it fetches the data, then asks for changes each time
+// the cache notifies us of some or the refresh interval passes.
+func (c *Client) sync(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	reset, err := c.query(conn)
+	if err != nil {
+		return err
+	}
+	waiting, inResponse := true, false
+	var updates []update
+
+	for {
+		deadline := c.lastSync.Add(c.refresh)
+		if waiting {
+			deadline = time.Now().Add(c.retry)
+		}
+		conn.SetReadDeadline(deadline)
+		p, err := readPDU(r)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !waiting {
+			if reset, err = c.query(conn); err != nil {
+				return err
+			}
+			waiting = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.typ == pduErrorReport {
+			switch {
+			case p.session == errUnsupportedVersion && p.version < c.version && !c.hasSerial:
+				c.version = p.version
+				return fmt.Errorf("%w %d, using version %d", errDowngrade, rtrVersion, p.version)
+			case p.session == errNoDataAvailable:
+				return fmt.Errorf("cache has no data yet")
+			}
+			return fmt.Errorf("error report %d from cache: %s", p.session, p.errorText())
+		}
+		if p.version != c.version {
+			return fmt.Errorf("version %d PDU in a version %d session", p.version, c.version)
+		}
+
+		switch p.typ {
+		case pduSerialNotify:
+			if waiting {
+				continue
+			}
+			if reset, err = c.query(conn); err != nil {
+				return err
+			}
+			waiting = true
+
+		case pduCacheResponse:
+			if c.hasSerial && !reset && p.session != c.session {
+				c.hasSerial = false
+				return fmt.Errorf("cache session ID changed from %d to %d", c.session, p.session)
+			}
+			inResponse = true
+			updates = updates[:0]
+
+		case pduIPv4Prefix, pduIPv6Prefix:
+			if !inResponse {
+				return fmt.Errorf("prefix PDU outside of a cache response")
+			}
+			v, announce, err := p.prefix()
+			if err != nil {
+				return err
+			}
+			updates = append(updates, update{v, announce})
+
+		case pduEndOfData:
+			if !inResponse {
+				return fmt.Errorf("end of data outside of a cache response")
+			}
+			if err := c.endOfData(p); err != nil {
+				return err
+			}
+			if reset {
+				vrps := make([]VRP, 0, len(updates))
+				for _, u := range updates {
+					if u.announce {
+						vrps = append(vrps, u.vrp)
+					}
+				}
+				c.replace(vrps)
+			} else {
+				c.change(updates)
+			}
+			updates = nil
+			inResponse, waiting = false, false
+
+		case pduCacheReset:
+			c.hasSerial = false
+			if reset, err = c.query(conn); err != nil {
+				return err
+			}
+			waiting = true
+
+		case pduRouterKey:
+			// BGPsec router keys are of no use for origin validation
+
+		default:
+			return fmt.Errorf("unexpected PDU type %d", p.typ)
+		}
+	}
+}
+
+// endOfData records the session, serial and, from a version 1 cache, the timers of a
+// completed sync.
+func (c *Client) endOfData(p pdu) error {
+	want := 4
+	if p.version > 0 {
+		want = 16
+	}
+	if len(p.body) != want {
+		return fmt.Errorf("invalid end of data PDU length %d", pduHeaderLen+len(p.body))
+	}
+	c.session = p.session
+	c.serial = binary.BigEndian.Uint32(p.body)
+	c.hasSerial = true
+	c.lastSync = time.Now()
+	if p.version > 0 {
+		setTimer(&c.refresh, p.body[4:])
+		setTimer(&c.retry, p.body[8:])
+		setTimer(&c.expire, p.body[12:])
+	}
+	return nil
+}
+
+// setTimer sets t to the interval in seconds at the start of b, unless it is 0.
+func setTimer(t *time.Duration, b []byte) {
+	if secs := binary.BigEndian.Uint32(b); secs > 0 {
+		*t = time.Duration(secs) * time.Second
+	}
+}
+
+// change applies the announcements and withdrawals of a serial response. Announcements of
+// VRPs we have and withdrawals of those we do not are ignored.
+func (c *Client) change(updates []update) {
+	delta := make(map[VRP]bool)
+	for _, u := range updates {
+		if u.announce == c.vrps[u.vrp] {
+			continue
+		}
+		if u.announce {
+			c.vrps[u.vrp] = true
+		} else {
+			delete(c.vrps, u.vrp)
+		}
+		// A VRP withdrawn and announced again in the same response is unchanged
+		if _, ok := delta[u.vrp]; ok {
+			delete(delta, u.vrp)
+		} else {
+			delta[u.vrp] = u.announce
+		}
+	}
+
+	var announced, withdrawn []VRP
+	for v, announce := range delta {
+		if announce {
+			announced = append(announced, v)
+		} else {
+			withdrawn = append(withdrawn, v)
+		}
+	}
+	c.notify(announced, withdrawn)
+}
+
+// replace makes vrps, from a reset response, the cache's data.
+func (c *Client) replace(vrps []VRP) {
+	current := make([]VRP, 0, len(c.vrps))
+	for v := range c.vrps {
+		current = append(current, v)
+	}
+	announced, withdrawn := Diff(current, vrps)
+	for _, v := range withdrawn {
+		delete(c.vrps, v)
+	}
+	for _, v := range announced {
+		c.vrps[v] = true
+	}
+	c.notify(announced, withdrawn)
+}
+
+func (c *Client) notify(announced, withdrawn []VRP) {
+	log.Printf("RTR cache %s: serial %d, %d VRPs, %d announced, %d withdrawn\n", c.addr, c.serial, len(c.vrps), len(announced), len(withdrawn))
+	if len(announced) > 0 || len(withdrawn) > 0 {
+		c.apply(announced, withdrawn)
+	}
+}
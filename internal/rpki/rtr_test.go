@@ -0,0 +1,242 @@
+package rpki
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeCache is an RTR cache accepting one router at a time.
+type fakeCache struct {
+	t  *testing.T
+	ln net.Listener
+}
+
+func newFakeCache(t *testing.T) *fakeCache {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeCache{t: t, ln: ln}
+}
+
+func (f *fakeCache) accept() net.Conn {
+	f.t.Helper()
+	conn, err := f.ln.Accept()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expect reads a PDU from the router and checks its version, type and session.
+func (f *fakeCache) expect(conn net.Conn, version, typ uint8, session uint16) pdu {
+	f.t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := readPDU(conn)
+	if err != nil {
+		f.t.Fatalf("reading PDU: %v", err)
+	}
+	if p.version != version || p.typ != typ || p.session != session {
+		f.t.Fatalf("got version %d type %d session %d, want version %d type %d session %d", p.version, p.typ, p.session, version, typ, session)
+	}
+	return p
+}
+
+func (f *fakeCache) send(conn net.Conn, pdus ...pdu) {
+	f.t.Helper()
+	for _, p := range pdus {
+		if _, err := conn.Write(p.marshal()); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func prefixPDU(version uint8, v VRP, announce bool) pdu {
+	typ, addr := uint8(pduIPv4Prefix), v.Prefix.Addr().AsSlice()
+	if v.Prefix.Addr().Is6() {
+		typ = pduIPv6Prefix
+	}
+	var flags uint8
+	if announce {
+		flags = 1
+	}
+	body := append([]byte{flags, uint8(v.Prefix.Bits()), v.MaxLength, 0}, addr...)
+	return pdu{version: version, typ: typ, body: binary.BigEndian.AppendUint32(body, v.ASN)}
+}
+
+func endOfData(version uint8, session uint16, serial uint32) pdu {
+	body := binary.BigEndian.AppendUint32(nil, serial)
+	if version > 0 {
+		for _, secs := range []uint32{3600, 1, 7200} {
+			body = binary.BigEndian.AppendUint32(body, secs)
+		}
+	}
+	return pdu{version: version, typ: pduEndOfData, session: session, body: body}
+}
+
+type change struct {
+	announced, withdrawn []VRP
+}
+
+func runClient(t *testing.T, addr string) chan change {
+	changes := make(chan change, 10)
+	c := NewClient(addr, func(announced, withdrawn []VRP) {
+		sort := func(v []VRP) {
+			slices.SortFunc(v, func(a, b VRP) int { return a.Prefix.Compare(b.Prefix) })
+		}
+		sort(announced)
+		sort(withdrawn)
+		changes <- change{announced, withdrawn}
+	})
+	c.retry = 10 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Run(stop)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return changes
+}
+
+func wantChange(t *testing.T, changes chan change, want change) {
+	t.Helper()
+	select {
+	case got := <-changes:
+		if !cmp.Equal(got, want, cmp.AllowUnexported(change{}), cmpPrefixes) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change applied, want %+v", want)
+	}
+}
+
+func TestClient(t *testing.T) {
+	cache := newFakeCache(t)
+	changes := runClient(t, cache.ln.Addr().String())
+	a, b, c := vrp("192.0.2.0/24", 24, 64500), vrp("2001:db8::/32", 48, 64501), vrp("198.51.100.0/24", 24, 64502)
+
+	conn := cache.accept()
+	cache.expect(conn, 1, pduResetQuery, 0)
+	cache.send(conn,
+		pdu{version: 1, typ: pduCacheResponse, session: 42},
+		prefixPDU(1, a, true),
+		prefixPDU(1, b, true),
+		pdu{version: 1, typ: pduRouterKey, body: make([]byte, 32)},
+		endOfData(1, 42, 7),
+	)
+	wantChange(t, changes, change{announced: []VRP{a, b}})
+
+	// A notify is answered with a serial query for the changes since the last serial
+	cache.send(conn, pdu{version: 1, typ: pduSerialNotify, session: 42, body: []byte{0, 0, 0, 8}})
+	q := cache.expect(conn, 1, pduSerialQuery, 42)
+	if serial := binary.BigEndian.Uint32(q.body); serial != 7 {
+		t.Errorf("got serial %d, want 7", serial)
+	}
+	cache.send(conn,
+		pdu{version: 1, typ: pduCacheResponse, session: 42},
+		prefixPDU(1, a, false),
+		prefixPDU(1, c, true),
+		prefixPDU(1, c, false),
+		prefixPDU(1, c, true),
+		endOfData(1, 42, 8),
+	)
+	wantChange(t, changes, change{announced: []VRP{c}, withdrawn: []VRP{a}})
+
+	// After a cache reset the full data replaces what we have
+	cache.send(conn, pdu{version: 1, typ: pduCacheReset})
+	cache.expect(conn, 1, pduResetQuery, 0)
+	cache.send(conn,
+		pdu{version: 1, typ: pduCacheResponse, session: 43},
+		prefixPDU(1, a, true),
+		prefixPDU(1, c, true),
+		endOfData(1, 43, 1),
+	)
+	wantChange(t, changes, change{announced: []VRP{a}, withdrawn: []VRP{b}})
+
+	// A new connection carries on from the last serial
+	conn.Close()
+	conn = cache.accept()
+	cache.expect(conn, 1, pduSerialQuery, 43)
+}
+
+func TestClientVersion0(t *testing.T) {
+	cache := newFakeCache(t)
+	changes := runClient(t, cache.ln.Addr().String())
+	a := vrp("192.0.2.0/24", 24, 64500)
+
+	conn := cache.accept()
+	q := cache.expect(conn, 1, pduResetQuery, 0)
+	// Unsupported Protocol Version, with the query and no text
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(q.marshal())))
+	body = append(body, q.marshal()...)
+	body = binary.BigEndian.AppendUint32(body, 0)
+	cache.send(conn, pdu{version: 0, typ: pduErrorReport, session: errUnsupportedVersion, body: body})
+
+	conn = cache.accept()
+	cache.expect(conn, 0, pduResetQuery, 0)
+	cache.send(conn,
+		pdu{version: 0, typ: pduCacheResponse, session: 1},
+		prefixPDU(0, a, true),
+		endOfData(0, 1, 1),
+	)
+	wantChange(t, changes, change{announced: []VRP{a}})
+}
+
+func TestPrefixPDU(t *testing.T) {
+	tests := []struct {
+		desc     string
+		pdu      pdu
+		want     VRP
+		announce bool
+		wantErr  bool
+	}{
+		{
+			desc:     "IPv4 announce",
+			pdu:      prefixPDU(1, vrp("192.0.2.0/24", 24, 64500), true),
+			want:     vrp("192.0.2.0/24", 24, 64500),
+			announce: true,
+		},
+		{
+			desc: "IPv6 withdraw",
+			pdu:  prefixPDU(1, vrp("2001:db8::/32", 48, 64500), false),
+			want: vrp("2001:db8::/32", 48, 64500),
+		},
+		{
+			desc:    "max length below the prefix length",
+			pdu:     prefixPDU(1, VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLength: 16}, true),
+			wantErr: true,
+		},
+		{
+			desc:    "max length beyond the address",
+			pdu:     prefixPDU(1, VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLength: 33}, true),
+			wantErr: true,
+		},
+		{
+			desc:    "short",
+			pdu:     pdu{version: 1, typ: pduIPv6Prefix, body: make([]byte, 12)},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		got, announce, err := test.pdu.prefix()
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+			continue
+		}
+		if err == nil && (got != test.want || announce != test.announce) {
+			t.Errorf("Test (%s): got %v, %t, want %v, %t", test.desc, got, announce, test.want, test.announce)
+		}
+	}
+}
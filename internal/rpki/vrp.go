@@ -0,0 +1,216 @@
+// Package rpki validates the origin AS of routes against Validated ROA Payloads (RFC 6811),
+// loaded from a JSON export or kept in sync with an RTR cache, and verifies their AS paths
+// against ASPAs loaded from the same export.
+package rpki
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// State is the origin validation state of a route (RFC 6811 section 2).
+type State uint8
+
+const (
+	NotFound State = iota
+	Valid
+	Invalid
+)
+
+func (s State) String() string {
+	switch s {
+	case Valid:
+		return "valid"
+	case Invalid:
+		return "invalid"
+	default:
+		return "not-found"
+	}
+}
+
+// ParseState parses the name of a validation state.
+func ParseState(s string) (State, error) {
+	for _, st := range []State{NotFound, Valid, Invalid} {
+		if s == st.String() {
+			return st, nil
+		}
+	}
+	return NotFound, fmt.Errorf("unknown validation state %q", s)
+}
+
+// VRP is a Validated ROA Payload: ASN may originate Prefix and its more specifics up to
+// MaxLength. A VRP for AS 0 only says that no AS may originate them (RFC 6483 section 4).
+type VRP struct {
+	Prefix    netip.Prefix
+	MaxLength uint8
+	ASN       uint32
+}
+
+func (v VRP) String() string {
+	return fmt.Sprintf("%s-%d AS%d", v.Prefix, v.MaxLength, v.ASN)
+}
+
+type authorization struct {
+	maxLength uint8
+	asn       uint32
+}
+
+// Table is a set of VRPs that routes are validated against, safe for concurrent use. The same
+// VRP may be added by more than one source and is kept until all of them have removed it.
+type Table struct {
+	mu   sync.RWMutex
+	vrps map[netip.Prefix]map[authorization]int
+	idx  prefixIndex
+}
+
+func NewTable() *Table {
+	return &Table{vrps: make(map[netip.Prefix]map[authorization]int)}
+}
+
+// Update adds and removes VRPs, returning the prefixes whose authorizations changed. Routes
+// for these prefixes and their more specifics may have a new validation state.
+func (t *Table) Update(announced, withdrawn []VRP) []netip.Prefix {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := make(map[netip.Prefix]bool)
+	for _, v := range withdrawn {
+		p := v.Prefix.Masked()
+		auths := t.vrps[p]
+		a := authorization{v.MaxLength, v.ASN}
+		if auths[a] == 0 {
+			continue
+		}
+		if auths[a]--; auths[a] > 0 {
+			continue
+		}
+		delete(auths, a)
+		changed[p] = true
+		if len(auths) == 0 {
+			delete(t.vrps, p)
+			t.idx.remove(p)
+		}
+	}
+	for _, v := range announced {
+		p := v.Prefix.Masked()
+		auths, ok := t.vrps[p]
+		if !ok {
+			auths = make(map[authorization]int)
+			t.vrps[p] = auths
+			t.idx.add(p)
+		}
+		a := authorization{v.MaxLength, v.ASN}
+		if auths[a]++; auths[a] == 1 {
+			changed[p] = true
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for p := range changed {
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// Len returns the number of distinct VRPs.
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var n int
+	for _, auths := range t.vrps {
+		n += len(auths)
+	}
+	return n
+}
+
+// Validate returns the state of a route for prefix originated by origin, which is 0 when the
+// route has no origin AS because its AS path ends with an AS_SET. A route is valid if a VRP
+// covering it authorizes its origin and length, invalid if it is only covered by VRPs that do
+// not, and not found if no VRP covers it.
+func (t *Table) Validate(prefix netip.Prefix, origin uint32) State {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	state := NotFound
+	for _, p := range t.idx.lengths(prefix) {
+		auths, ok := t.vrps[p]
+		if !ok {
+			continue
+		}
+		for a := range auths {
+			if a.asn != 0 && a.asn == origin && prefix.Bits() <= int(a.maxLength) {
+				return Valid
+			}
+		}
+		state = Invalid
+	}
+	return state
+}
+
+// PrefixSet is a set of prefixes that can be asked whether it holds a prefix covering a route.
+type PrefixSet struct {
+	prefixes map[netip.Prefix]bool
+	idx      prefixIndex
+}
+
+func NewPrefixSet(prefixes []netip.Prefix) *PrefixSet {
+	s := &PrefixSet{prefixes: make(map[netip.Prefix]bool)}
+	for _, p := range prefixes {
+		p = p.Masked()
+		if !s.prefixes[p] {
+			s.prefixes[p] = true
+			s.idx.add(p)
+		}
+	}
+	return s
+}
+
+// Covers reports whether the set holds prefix or a less specific prefix containing it.
+func (s *PrefixSet) Covers(prefix netip.Prefix) bool {
+	for _, p := range s.idx.lengths(prefix) {
+		if s.prefixes[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixIndex counts the prefixes held of each family and length, so that a search for the
+// prefixes covering a route only looks at the lengths in use.
+type prefixIndex struct {
+	v4 [33]int
+	v6 [129]int
+}
+
+func (x *prefixIndex) counts(p netip.Prefix) []int {
+	if p.Addr().Is4() {
+		return x.v4[:]
+	}
+	return x.v6[:]
+}
+
+func (x *prefixIndex) add(p netip.Prefix) {
+	x.counts(p)[p.Bits()]++
+}
+
+func (x *prefixIndex) remove(p netip.Prefix) {
+	x.counts(p)[p.Bits()]--
+}
+
+// lengths returns prefix truncated to each length in use up to its own.
+func (x *prefixIndex) lengths(prefix netip.Prefix) []netip.Prefix {
+	if !prefix.IsValid() {
+		return nil
+	}
+	counts := x.counts(prefix)
+	var out []netip.Prefix
+	for bits := 0; bits <= prefix.Bits(); bits++ {
+		if counts[bits] == 0 {
+			continue
+		}
+		p, _ := prefix.Addr().Prefix(bits)
+		out = append(out, p)
+	}
+	return out
+}
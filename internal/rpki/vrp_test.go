@@ -0,0 +1,207 @@
+package rpki
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var cmpPrefixes = cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })
+
+func vrp(prefix string, maxLength uint8, asn uint32) VRP {
+	return VRP{Prefix: netip.MustParsePrefix(prefix), MaxLength: maxLength, ASN: asn}
+}
+
+func TestValidate(t *testing.T) {
+	table := NewTable()
+	table.Update([]VRP{
+		vrp("192.0.2.0/24", 24, 64500),
+		vrp("198.51.100.0/22", 24, 64501),
+		vrp("198.51.100.0/22", 22, 64502),
+		vrp("203.0.113.0/24", 24, 0),
+		vrp("2001:db8::/32", 48, 64503),
+	}, nil)
+
+	tests := []struct {
+		desc   string
+		prefix string
+		origin uint32
+		want   State
+	}{
+		{
+			desc:   "exact match",
+			prefix: "192.0.2.0/24",
+			origin: 64500,
+			want:   Valid,
+		},
+		{
+			desc:   "wrong origin",
+			prefix: "192.0.2.0/24",
+			origin: 64501,
+			want:   Invalid,
+		},
+		{
+			desc:   "more specific than the max length",
+			prefix: "192.0.2.0/25",
+			origin: 64500,
+			want:   Invalid,
+		},
+		{
+			desc:   "more specific within the max length",
+			prefix: "198.51.101.0/24",
+			origin: 64501,
+			want:   Valid,
+		},
+		{
+			desc:   "second VRP for the prefix",
+			prefix: "198.51.100.0/22",
+			origin: 64502,
+			want:   Valid,
+		},
+		{
+			desc:   "second VRP too short",
+			prefix: "198.51.100.0/23",
+			origin: 64502,
+			want:   Invalid,
+		},
+		{
+			desc:   "not covered",
+			prefix: "192.0.0.0/16",
+			origin: 64500,
+			want:   NotFound,
+		},
+		{
+			desc:   "AS 0",
+			prefix: "203.0.113.0/24",
+			want:   Invalid,
+		},
+		{
+			desc:   "AS_SET origin",
+			prefix: "192.0.2.0/24",
+			want:   Invalid,
+		},
+		{
+			desc:   "IPv6",
+			prefix: "2001:db8:1::/48",
+			origin: 64503,
+			want:   Valid,
+		},
+		{
+			desc:   "IPv6 not covered",
+			prefix: "2001:db9::/32",
+			origin: 64503,
+			want:   NotFound,
+		},
+	}
+	for _, test := range tests {
+		if got := table.Validate(netip.MustParsePrefix(test.prefix), test.origin); got != test.want {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	table := NewTable()
+	a, b := vrp("192.0.2.0/24", 24, 64500), vrp("192.0.2.0/24", 24, 64501)
+	prefix := netip.MustParsePrefix("192.0.2.0/24")
+
+	tests := []struct {
+		desc                 string
+		announced, withdrawn []VRP
+		want                 []netip.Prefix
+		wantLen              int
+		wantState            State
+	}{
+		{
+			desc:      "announce",
+			announced: []VRP{a},
+			want:      []netip.Prefix{prefix},
+			wantLen:   1,
+			wantState: Valid,
+		},
+		{
+			desc:      "announced by a second source",
+			announced: []VRP{a},
+			wantLen:   1,
+			wantState: Valid,
+		},
+		{
+			desc:      "withdrawn by one source",
+			withdrawn: []VRP{a},
+			wantLen:   1,
+			wantState: Valid,
+		},
+		{
+			desc:      "replaced",
+			announced: []VRP{b},
+			withdrawn: []VRP{a},
+			want:      []netip.Prefix{prefix},
+			wantLen:   1,
+			wantState: Invalid,
+		},
+		{
+			desc:      "withdraw unknown",
+			withdrawn: []VRP{a},
+			wantLen:   1,
+			wantState: Invalid,
+		},
+		{
+			desc:      "withdraw all",
+			withdrawn: []VRP{b},
+			want:      []netip.Prefix{prefix},
+			wantState: NotFound,
+		},
+	}
+	for _, test := range tests {
+		got := table.Update(test.announced, test.withdrawn)
+		slices.SortFunc(got, netip.Prefix.Compare)
+		if !cmp.Equal(got, test.want, cmpPrefixes) {
+			t.Errorf("Test (%s): got changed %v, want %v", test.desc, got, test.want)
+		}
+		if got := table.Len(); got != test.wantLen {
+			t.Errorf("Test (%s): got %d VRPs, want %d", test.desc, got, test.wantLen)
+		}
+		if got := table.Validate(prefix, 64500); got != test.wantState {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.wantState)
+		}
+	}
+}
+
+func TestPrefixSet(t *testing.T) {
+	set := NewPrefixSet([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.128/25"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{prefix: "10.0.0.0/8", want: true},
+		{prefix: "10.1.0.0/16", want: true},
+		{prefix: "0.0.0.0/0"},
+		{prefix: "192.0.2.0/24"},
+		{prefix: "192.0.2.128/26", want: true},
+		{prefix: "2001:db8:1::/48", want: true},
+		{prefix: "2001:db9::/32"},
+	}
+	for _, test := range tests {
+		if got := set.Covers(netip.MustParsePrefix(test.prefix)); got != test.want {
+			t.Errorf("Test (%s): got %t, want %t", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestParseState(t *testing.T) {
+	for _, s := range []State{NotFound, Valid, Invalid} {
+		got, err := ParseState(s.String())
+		if err != nil || got != s {
+			t.Errorf("Test (%s): got %v, %v, want %v", s, got, err, s)
+		}
+	}
+	if _, err := ParseState("unknown"); err == nil {
+		t.Errorf("Test (unknown): got no error")
+	}
+}
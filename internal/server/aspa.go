@@ -0,0 +1,56 @@
+package server
+
+import (
+	"slices"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// aspaNeighbor is what verifying the AS paths received from a peer depends on.
+type aspaNeighbor struct {
+	asn uint32
+	// upstream selects the algorithm for paths from a customer, lateral peer or route server
+	// client, rather than the one for paths from a provider
+	upstream bool
+	// checkAS is whether the peer must be the most recent AS in its paths, which is not so
+	// for iBGP peers or route servers
+	checkAS bool
+}
+
+// aspaNeighbor returns how the paths from p are verified. Our BGP Role towards the peer tells
+// which algorithm applies. Without one the peer is taken to be a provider, the most lenient,
+// so that only paths that cannot be valley free whatever the peer is to us are invalid.
+func (s *Server) aspaNeighbor(p *peer) aspaNeighbor {
+	role, ok := s.localRole(p.ip)
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return aspaNeighbor{
+		asn:      p.peerAsn,
+		upstream: ok && role != bgp.RoleCustomer,
+		checkAS:  !p.isIBGP && !(ok && role == bgp.RoleRSClient),
+	}
+}
+
+// verifyPath returns the ASPA state of a path from the neighbor
+// (draft-ietf-sidrops-aspa-verification section 6). It must only be called when ASPAs are
+// loaded.
+func (s *Server) verifyPath(n aspaNeighbor, ra *routing_table.RouteAttributes) rpki.ASPAState {
+	if slices.ContainsFunc(ra.AsPathSegments, func(seg routing_table.AsPathSegment) bool { return seg.Type == 1 }) { // AS_SET
+		return rpki.ASPAInvalid
+	}
+	if n.checkAS && (len(ra.AsPath) == 0 || ra.AsPath[0] != n.asn) {
+		return rpki.ASPAInvalid
+	}
+	return s.aspas.Verify(ra.AsPath, n.upstream)
+}
+
+// aspaState returns the name of the ASPA state of a path from p, or an empty string if no
+// ASPAs are loaded.
+func (s *Server) aspaState(p *peer, r *routing_table.Route) string {
+	if s.aspas == nil {
+		return ""
+	}
+	return s.verifyPath(s.aspaNeighbor(p), r.Attributes).String()
+}
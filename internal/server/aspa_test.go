@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/mellowdrifter/routing_table"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVerifyPath(t *testing.T) {
+	srv := New(Config{Asn: 64512, RPKI: RPKIConfig{VRPFile: "rpki.json"}})
+	srv.aspas.Replace([]rpki.ASPA{
+		{CustomerASN: 64500, Providers: []uint32{64510}},
+		{CustomerASN: 64510, Providers: []uint32{0}},
+	})
+	seq := func(asns ...uint32) *routing_table.RouteAttributes {
+		return &routing_table.RouteAttributes{AsPath: asns, AsPathSegments: []routing_table.AsPathSegment{{Type: 2, ASNs: asns}}}
+	}
+
+	tests := []struct {
+		desc     string
+		role     string
+		ibgp     bool
+		peerAsn  uint32
+		attrs    *routing_table.RouteAttributes
+		want     rpki.ASPAState
+		upstream bool
+	}{
+		{
+			desc:    "no role",
+			peerAsn: 64510,
+			attrs:   seq(64510, 64500),
+			want:    rpki.ASPAValid,
+		},
+		{
+			desc:     "from a customer",
+			role:     "provider",
+			peerAsn:  64510,
+			attrs:    seq(64510, 64500),
+			want:     rpki.ASPAValid,
+			upstream: true,
+		},
+		{
+			desc:     "from a lateral peer",
+			role:     "peer",
+			peerAsn:  64500,
+			attrs:    seq(64500, 64510),
+			want:     rpki.ASPAInvalid,
+			upstream: true,
+		},
+		{
+			desc:    "from a provider",
+			role:    "customer",
+			peerAsn: 64500,
+			attrs:   seq(64500, 64510),
+			want:    rpki.ASPAValid,
+		},
+		{
+			desc:    "neighbor AS missing",
+			peerAsn: 64520,
+			attrs:   seq(64510, 64500),
+			want:    rpki.ASPAInvalid,
+		},
+		{
+			desc:    "empty path",
+			peerAsn: 64520,
+			attrs:   seq(),
+			want:    rpki.ASPAInvalid,
+		},
+		{
+			desc:     "from a route server",
+			role:     "rs-client",
+			peerAsn:  64520,
+			attrs:    seq(64510, 64500),
+			want:     rpki.ASPAValid,
+			upstream: true,
+		},
+		{
+			desc:    "iBGP",
+			ibgp:    true,
+			peerAsn: 64512,
+			attrs:   seq(64510, 64500),
+			want:    rpki.ASPAValid,
+		},
+		{
+			desc:    "AS_SET",
+			peerAsn: 64510,
+			attrs: &routing_table.RouteAttributes{AsPath: []uint32{64510}, AsPathSegments: []routing_table.AsPathSegment{
+				{Type: 2, ASNs: []uint32{64510}},
+				{Type: 1, ASNs: []uint32{64500, 64501}},
+			}},
+			want: rpki.ASPAInvalid,
+		},
+	}
+	for _, test := range tests {
+		srv.peerConf.Store(&peerTable{peers: map[string]PeerConfig{"127.0.0.1": {Role: test.role}}})
+		p := &peer{server: srv, ip: "127.0.0.1", peerAsn: test.peerAsn, isIBGP: test.ibgp}
+		n := srv.aspaNeighbor(p)
+		if n.upstream != test.upstream {
+			t.Errorf("Test (%s): got upstream %t, want %t", test.desc, n.upstream, test.upstream)
+		}
+		if got := srv.verifyPath(n, test.attrs); got != test.want {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestGetASPAInvalidRoutes(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, RPKI: RPKIConfig{VRPFile: "rpki.json"}})
+	srv.aspas.Replace([]rpki.ASPA{
+		{CustomerASN: 64500, Providers: []uint32{64510}},
+		{CustomerASN: 65000, Providers: []uint32{64520}},
+	})
+	p := &peer{
+		server:  srv,
+		ip:      "127.0.0.1",
+		quiet:   true,
+		param:   bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+		peerAsn: 65000,
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	srv.peers = []*peer{p}
+	g := &grpcServer{bgp: srv}
+
+	// 65000 64501 64500: AS64501 is a provider of neither AS64500 nor AS65000, so it passed the
+	// path from one to the other without being the customer of either
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x0e, 0x02, 0x03, 0x00, 0x00, 0xfd, 0xe8, 0x00, 0x00, 0xfb, 0xf5, 0x00, 0x00, 0xfb, 0xf4}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), []byte{24, 192, 0, 2}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	announce(t, p, []byte{198, 51, 100})
+
+	resp, err := g.GetASPAInvalidRoutes(context.Background(), &pb.ViewRequest{})
+	if err != nil {
+		t.Fatalf("GetASPAInvalidRoutes: %v", err)
+	}
+	if len(resp.GetRoutes()) != 1 || resp.GetRoutes()[0].GetPrefix() != "192.0.2.0/24" || resp.GetRoutes()[0].GetAspaState() != "invalid" {
+		t.Errorf("got %v, want 192.0.2.0/24 invalid", resp.GetRoutes())
+	}
+	valid := p.v4rib.AllPaths(netip.MustParsePrefix("198.51.100.0/24"))[0]
+	if got := srv.formatRouteResponse(&valid, p, time.Time{}).GetAspaState(); got != "valid" {
+		t.Errorf("got %q for 198.51.100.0/24, want valid", got)
+	}
+
+	g = &grpcServer{bgp: New(Config{Rid: rid, Asn: 64512})}
+	if _, err := g.GetASPAInvalidRoutes(context.Background(), &pb.ViewRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v without a VRP file, want FailedPrecondition", err)
+	}
+}
@@ -3,7 +3,14 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
 )
 
 // PeerConfig holds the configuration for a single peer
@@ -11,16 +18,126 @@ type PeerConfig struct {
 	IP       string `json:"ip"`
 	Name     string `json:"name,omitempty"`
 	Password string `json:"password,omitempty"`
+
+	// TCPAO authenticates the session with TCP-AO (RFC 5925) instead of a Password. The first
+	// key is the one we send with and ask the peer to use, the others are only accepted. Keys
+	// are rolled over with a reload: add the new key, move it first once the peer has it as
+	// well, then remove the old one.
+	TCPAO []TCPAOKey `json:"tcp_ao,omitempty"`
+
+	// RemoteAS restricts the AS the peer may announce in its OPEN, any if empty. LocalAS
+	// replaces the global ASN for this peer, both in our OPEN and to tell iBGP from eBGP.
+	RemoteAS ASNSet `json:"remote_as,omitempty"`
+	LocalAS  uint32 `json:"local_as,omitempty"`
+
+	// Active makes bgpwatch initiate the session towards the peer as well as accept it.
+	// Port is the remote port to dial and ConnectRetry the initial connect retry time
+	// in seconds.
+	Active       bool `json:"active,omitempty"`
+	Port         int  `json:"port,omitempty"`
+	ConnectRetry int  `json:"connect_retry,omitempty"`
+
+	// HoldTime overrides the hold time offered to this peer. An explicit 0 disables
+	// keepalives and the hold timer if the peer agrees.
+	HoldTime *uint16 `json:"hold_time,omitempty"`
+
+	// TTLSecurity enables the Generalized TTL Security Mechanism (RFC 5082) for a peer at
+	// most this many hops away, 1 if directly connected. Its packets must arrive with a TTL
+	// of at least 256 minus the hop count and ours are sent with a TTL of 255.
+	TTLSecurity int `json:"ttl_security,omitempty"`
+
+	// Role is our BGP Role towards the peer (RFC 9234): provider, rs, rs-client, customer
+	// or peer. With StrictRole set, a peer that does not advertise a role is refused.
+	Role       string `json:"role,omitempty"`
+	StrictRole bool   `json:"strict_role,omitempty"`
+
+	// MaxPrefixesV4 and MaxPrefixesV6 limit the prefixes accepted from the peer per family,
+	// 0 for no limit. A warning is logged once MaxPrefixWarning percent of a limit is reached,
+	// 75 if not set. MaxPrefixAction is what happens beyond the limit: log, drop the excess
+	// routes, or teardown (the default) with a Cease. After a teardown the peer is refused for
+	// MaxPrefixRestart seconds, or until bgpwatch is restarted if that is 0.
+	MaxPrefixesV4    uint32 `json:"max_prefixes_v4,omitempty"`
+	MaxPrefixesV6    uint32 `json:"max_prefixes_v6,omitempty"`
+	MaxPrefixWarning int    `json:"max_prefix_warning,omitempty"`
+	MaxPrefixAction  string `json:"max_prefix_action,omitempty"`
+	MaxPrefixRestart int    `json:"max_prefix_restart,omitempty"`
+
+	// ImportPolicy names the policy that routes from the peer go through before they are
+	// stored. Import is that policy, filled in when the config file is read.
+	ImportPolicy string  `json:"import_policy,omitempty"`
+	Import       *Policy `json:"-"`
+
+	// PrePolicy keeps the routes the peer sent, before its import policy, for the pre view.
+	// It is on by default for peers with an import policy, and can be set to false to save
+	// the memory on full-table feeds.
+	PrePolicy *bool `json:"pre_policy,omitempty"`
+}
+
+// TCPAOKey is a TCP-AO master key tuple (RFC 5925 section 3.1). ID is used as both the
+// SendID and RecvID unless they are set. Algorithm is hmac-sha-1-96 or aes-128-cmac-96.
+type TCPAOKey struct {
+	ID        uint8  `json:"id"`
+	Algorithm string `json:"algorithm"`
+	Secret    string `json:"secret"`
+	SendID    *uint8 `json:"send_id,omitempty"`
+	RecvID    *uint8 `json:"recv_id,omitempty"`
 }
 
 // ConfigFile represents the JSON configuration file
 type ConfigFile struct {
 	Peers []PeerConfig `json:"peers"`
+
+	// PeerGroups are templates for the peers accepted from ListenRanges, by group name.
+	PeerGroups   map[string]PeerConfig `json:"peer_groups,omitempty"`
+	ListenRanges []ListenRange         `json:"listen_ranges,omitempty"`
+
+	RPKI RPKIConfig `json:"rpki"`
+
+	// Policies are the import policies peers can refer to, each a list of terms, and the
+	// others the named lists that their terms match routes against.
+	Policies       map[string][]PolicyTerm      `json:"policies,omitempty"`
+	PrefixLists    map[string][]PrefixListEntry `json:"prefix_lists,omitempty"`
+	ASPathLists    map[string][]string          `json:"as_path_lists,omitempty"`
+	CommunityLists map[string][]string          `json:"community_lists,omitempty"`
+}
+
+// RPKIConfig is where the VRPs that routes are validated against come from. VRPFile is a JSON
+// export from rpki-client or Routinator, loaded again whenever it is replaced, and RTRServer
+// the host:port of an RTR cache. VRPs from both are combined. AS paths are verified against
+// the ASPAs in VRPFile, if it has any. Unlike the peers, these are only read at startup.
+type RPKIConfig struct {
+	VRPFile   string `json:"vrp_file,omitempty"`
+	RTRServer string `json:"rtr_server,omitempty"`
+}
+
+// ListenRange accepts sessions from any address in Prefix that is not configured as a peer
+// of its own. Such peers take their settings from Template, the peer group named PeerGroup,
+// with {ip} in its name replaced by the peer's address.
+type ListenRange struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	PeerGroup string       `json:"peer_group"`
+	Template  PeerConfig   `json:"-"`
 }
 
 // LoadConfigFile reads and parses the JSON configuration file.
 // It returns a map of IP address strings to PeerConfig for O(1) lookups.
 func LoadConfigFile(filename string) (map[string]PeerConfig, error) {
+	cf, err := ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	peersMap := make(map[string]PeerConfig)
+	for _, p := range cf.Peers {
+		peersMap[p.IP] = p
+	}
+
+	return peersMap, nil
+}
+
+// ReadConfigFile reads, parses and validates the JSON configuration file. The listen ranges
+// are returned with the template of their peer group filled in.
+func ReadConfigFile(filename string) (*ConfigFile, error) {
 	if filename == "" {
 		return nil, fmt.Errorf("config filename is empty")
 	}
@@ -35,13 +152,242 @@ func LoadConfigFile(filename string) (map[string]PeerConfig, error) {
 		return nil, fmt.Errorf("failed to parse JSON config: %v", err)
 	}
 
-	peersMap := make(map[string]PeerConfig)
-	for _, p := range cf.Peers {
+	policies, err := compilePolicies(&cf)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range cf.Peers {
 		if p.IP == "" {
 			return nil, fmt.Errorf("peer entry missing IP address")
 		}
-		peersMap[p.IP] = p
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("peer %s: %v", p.IP, err)
+		}
+		if cf.Peers[i].Import, err = lookupPolicy(policies, p.ImportPolicy); err != nil {
+			return nil, fmt.Errorf("peer %s: %v", p.IP, err)
+		}
+	}
+	for name, g := range cf.PeerGroups {
+		if g.IP != "" || g.Active {
+			return nil, fmt.Errorf("peer group %s: ip and active are not allowed", name)
+		}
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("peer group %s: %v", name, err)
+		}
+		if g.Import, err = lookupPolicy(policies, g.ImportPolicy); err != nil {
+			return nil, fmt.Errorf("peer group %s: %v", name, err)
+		}
+		cf.PeerGroups[name] = g
+	}
+	for i, r := range cf.ListenRanges {
+		if !r.Prefix.IsValid() {
+			return nil, fmt.Errorf("listen range missing prefix")
+		}
+		g, ok := cf.PeerGroups[r.PeerGroup]
+		if !ok {
+			return nil, fmt.Errorf("listen range %s: unknown peer group %q", r.Prefix, r.PeerGroup)
+		}
+		cf.ListenRanges[i].Prefix = r.Prefix.Masked()
+		cf.ListenRanges[i].Template = g
+	}
+	if cf.RPKI.RTRServer != "" {
+		if _, _, err := net.SplitHostPort(cf.RPKI.RTRServer); err != nil {
+			return nil, fmt.Errorf("rpki: invalid rtr_server: %v", err)
+		}
 	}
 
-	return peersMap, nil
+	return &cf, nil
+}
+
+// validate checks the settings of a peer or peer group, other than its address.
+func (p PeerConfig) validate() error {
+	if p.Role != "" {
+		if _, err := bgp.ParseRole(p.Role); err != nil {
+			return err
+		}
+	} else if p.StrictRole {
+		return fmt.Errorf("strict_role requires a role")
+	}
+	if p.TTLSecurity < 0 || p.TTLSecurity >= maxTTL {
+		return fmt.Errorf("ttl_security must be between 1 and %d hops: %d", maxTTL-1, p.TTLSecurity)
+	}
+	if p.Password != "" && len(p.TCPAO) > 0 {
+		return fmt.Errorf("password and tcp_ao cannot both be set")
+	}
+	ids := make(map[[2]uint8]bool)
+	for _, k := range p.TCPAO {
+		if err := k.validate(); err != nil {
+			return fmt.Errorf("tcp_ao key %d: %v", k.ID, err)
+		}
+		id := [2]uint8{k.sendID(), k.recvID()}
+		if ids[id] {
+			return fmt.Errorf("tcp_ao key %d: duplicate send and receive IDs %d/%d", k.ID, id[0], id[1])
+		}
+		ids[id] = true
+	}
+	switch p.MaxPrefixAction {
+	case "", maxPrefixLog, maxPrefixDrop, maxPrefixTeardown:
+	default:
+		return fmt.Errorf("unknown max_prefix_action: %q", p.MaxPrefixAction)
+	}
+	if p.MaxPrefixWarning < 0 || p.MaxPrefixWarning > 100 {
+		return fmt.Errorf("max_prefix_warning must be a percentage: %d", p.MaxPrefixWarning)
+	}
+	if p.MaxPrefixRestart < 0 {
+		return fmt.Errorf("invalid max_prefix_restart: %d", p.MaxPrefixRestart)
+	}
+	return nil
+}
+
+// peerTable is the peer configuration in force. It is replaced as a whole when the config
+// file is reloaded.
+type peerTable struct {
+	peers  map[string]PeerConfig
+	ranges []ListenRange
+}
+
+// restricted reports whether only configured peers are accepted.
+func (t *peerTable) restricted() bool {
+	return t.peers != nil || len(t.ranges) > 0
+}
+
+// peerConfig returns the configuration for the peer at ip: its own entry if it has one,
+// otherwise the template of the most specific listen range containing it.
+func (s *Server) peerConfig(ip string) (PeerConfig, bool) {
+	return s.peerConf.Load().lookup(ip)
+}
+
+func (t *peerTable) lookup(ip string) (PeerConfig, bool) {
+	if pc, ok := t.peers[ip]; ok {
+		return pc, true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return PeerConfig{}, false
+	}
+	addr = addr.Unmap()
+
+	var match *ListenRange
+	for i, r := range t.ranges {
+		if r.Prefix.Contains(addr) && (match == nil || r.Prefix.Bits() > match.Prefix.Bits()) {
+			match = &t.ranges[i]
+		}
+	}
+	if match == nil {
+		return PeerConfig{}, false
+	}
+	pc := match.Template
+	pc.IP = ip
+	pc.Name = strings.ReplaceAll(pc.Name, "{ip}", ip)
+	return pc, true
+}
+
+// md5Key is the TCP MD5 password for the peers within a prefix.
+type md5Key struct {
+	prefix   netip.Prefix
+	password string
+}
+
+// md5Keys returns the MD5 passwords of the configured peers, as host prefixes, and of the
+// listen ranges.
+func (t *peerTable) md5Keys() []md5Key {
+	var keys []md5Key
+	for _, pc := range t.peers {
+		if pc.Password == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(pc.IP)
+		if err != nil {
+			log.Printf("Warning: Invalid IP address %s in config", pc.IP)
+			continue
+		}
+		ip = ip.Unmap()
+		keys = append(keys, md5Key{prefix: netip.PrefixFrom(ip, ip.BitLen()), password: pc.Password})
+	}
+	for _, r := range t.ranges {
+		if r.Template.Password != "" {
+			keys = append(keys, md5Key{prefix: r.Prefix, password: r.Template.Password})
+		}
+	}
+	return keys
+}
+
+// ASNSet is a set of ASNs. In JSON it is an ASN, a "low-high" range, or a list of either.
+type ASNSet []ASNRange
+
+// ASNRange is an inclusive range of ASNs.
+type ASNRange struct {
+	Low, High uint32
+}
+
+func (s *ASNSet) UnmarshalJSON(b []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(b, &list); err != nil {
+		list = []json.RawMessage{b}
+	}
+	set := make(ASNSet, 0, len(list))
+	for _, raw := range list {
+		var asn uint32
+		if err := json.Unmarshal(raw, &asn); err == nil {
+			set = append(set, ASNRange{Low: asn, High: asn})
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return fmt.Errorf("invalid ASN: %s", raw)
+		}
+		r, err := parseASNRange(str)
+		if err != nil {
+			return err
+		}
+		set = append(set, r)
+	}
+	for _, r := range set {
+		if r.Low == 0 || r.Low > r.High {
+			return fmt.Errorf("invalid ASN range: %v", r)
+		}
+	}
+	*s = set
+	return nil
+}
+
+// parseASNRange parses an ASN or a "low-high" range.
+func parseASNRange(s string) (ASNRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	low, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 32)
+	if err != nil {
+		return ASNRange{}, fmt.Errorf("invalid ASN: %q", s)
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 32); err != nil {
+			return ASNRange{}, fmt.Errorf("invalid ASN range: %q", s)
+		}
+	}
+	return ASNRange{Low: uint32(low), High: uint32(high)}, nil
+}
+
+// Contains reports whether asn is in the set.
+func (s ASNSet) Contains(asn uint32) bool {
+	for _, r := range s {
+		if asn >= r.Low && asn <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ASNRange) String() string {
+	if r.Low == r.High {
+		return strconv.FormatUint(uint64(r.Low), 10)
+	}
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+func (s ASNSet) String() string {
+	ranges := make([]string, len(s))
+	for i, r := range s {
+		ranges[i] = r.String()
+	}
+	return strings.Join(ranges, ", ")
 }
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestASNSetUnmarshal(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ASNSet
+		wantErr bool
+	}{
+		{
+			input: `64500`,
+			want:  ASNSet{{Low: 64500, High: 64500}},
+		},
+		{
+			input: `"64500-64510"`,
+			want:  ASNSet{{Low: 64500, High: 64510}},
+		},
+		{
+			input: `[64500, "4200000000-4200000010", "65000"]`,
+			want:  ASNSet{{Low: 64500, High: 64500}, {Low: 4200000000, High: 4200000010}, {Low: 65000, High: 65000}},
+		},
+		{
+			input:   `"64510-64500"`,
+			wantErr: true,
+		},
+		{
+			input:   `0`,
+			wantErr: true,
+		},
+		{
+			input:   `"AS64500"`,
+			wantErr: true,
+		},
+		{
+			input:   `4294967296`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		var got ASNSet
+		err := json.Unmarshal([]byte(test.input), &got)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.input, err, test.wantErr)
+			continue
+		}
+		if err == nil && !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestASNSetContains(t *testing.T) {
+	set := ASNSet{{Low: 64500, High: 64500}, {Low: 64510, High: 64520}}
+	for asn, want := range map[uint32]bool{64500: true, 64501: false, 64510: true, 64515: true, 64520: true, 64521: false} {
+		if got := set.Contains(asn); got != want {
+			t.Errorf("Test (%d): got %t, want %t", asn, got, want)
+		}
+	}
+	if got, want := set.String(), "64500, 64510-64520"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		wantErr bool
+	}{
+		{
+			desc: "listen range with a peer group using TCP-AO",
+			input: `{"peers": [{"ip": "192.0.2.1"}], "peer_groups": {"edge": {"name": "edge-{ip}", "remote_as": "64512-65000",
+				"tcp_ao": [{"id": 1, "algorithm": "aes-128-cmac-96", "secret": "s3cret"}, {"id": 2, "algorithm": "hmac-sha-1-96", "secret": "n3w", "send_id": 3}],
+				"import_policy": "feeds"}},
+				"listen_ranges": [{"prefix": "10.20.0.0/16", "peer_group": "edge"}],
+				"rpki": {"vrp_file": "/var/db/rpki-client/json", "rtr_server": "[2001:db8::1]:3323"},
+				"prefix_lists": {"martians": [{"prefix": "0.0.0.0/0"}, {"prefix": "10.0.0.0/8", "le": 32}]},
+				"as_path_lists": {"transit": ["_174_", "^3356_"]},
+				"community_lists": {"internal": ["64512:*", "64512:*:*"]},
+				"policies": {"feeds": [
+					{"name": "martians", "prefix_list": "martians", "action": "reject"},
+					{"bogon_asn": true, "action": "reject"},
+					{"longer_than_v4": 24, "longer_than_v6": 48, "action": "reject"},
+					{"as_path_list": "transit", "set_local_pref": 50, "add_communities": ["64512:100", "64512:1:2"]},
+					{"strip_communities": "internal"}
+				]}}`,
+		},
+		{
+			desc:    "unknown peer group",
+			input:   `{"listen_ranges": [{"prefix": "10.20.0.0/16", "peer_group": "core"}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "listen range without a prefix",
+			input:   `{"peer_groups": {"edge": {}}, "listen_ranges": [{"peer_group": "edge"}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "active peer group",
+			input:   `{"peer_groups": {"edge": {"active": true}}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "invalid role in a peer group",
+			input:   `{"peer_groups": {"edge": {"role": "upstream"}}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "TTL security beyond the maximum hops",
+			input:   `{"peers": [{"ip": "192.0.2.1", "ttl_security": 255}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "TCP-AO and MD5",
+			input:   `{"peers": [{"ip": "192.0.2.1", "password": "md5", "tcp_ao": [{"id": 1, "algorithm": "hmac-sha-1-96", "secret": "s3cret"}]}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "unknown TCP-AO algorithm",
+			input:   `{"peers": [{"ip": "192.0.2.1", "tcp_ao": [{"id": 1, "algorithm": "hmac-md5-96", "secret": "s3cret"}]}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "duplicate TCP-AO key IDs",
+			input:   `{"peer_groups": {"edge": {"tcp_ao": [{"id": 1, "algorithm": "hmac-sha-1-96", "secret": "a"}, {"id": 2, "algorithm": "hmac-sha-1-96", "secret": "b", "send_id": 1, "recv_id": 1}]}}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "RTR server without a port",
+			input:   `{"rpki": {"rtr_server": "192.0.2.1"}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "unknown import policy",
+			input:   `{"peers": [{"ip": "192.0.2.1", "import_policy": "feeds"}]}`,
+			wantErr: true,
+		},
+		{
+			desc:    "unknown prefix list",
+			input:   `{"policies": {"feeds": [{"prefix_list": "martians", "action": "reject"}]}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "prefix list ge beyond the address",
+			input:   `{"prefix_lists": {"martians": [{"prefix": "10.0.0.0/8", "ge": 33}]}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "invalid AS path regex",
+			input:   `{"as_path_lists": {"transit": ["_174_("]}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "wildcard community to add",
+			input:   `{"policies": {"feeds": [{"add_communities": ["64512:*"]}]}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "unknown policy action",
+			input:   `{"policies": {"feeds": [{"action": "deny"}]}}`,
+			wantErr: true,
+		},
+		{
+			desc:    "peer without an address",
+			input:   `{"peers": [{"name": "router1"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "peers.json")
+		if err := os.WriteFile(filename, []byte(test.input), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cf, err := ReadConfigFile(filename)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+			continue
+		}
+		if err == nil && (cf.ListenRanges[0].Template.Name != "edge-{ip}" || cf.ListenRanges[0].Template.Import == nil) {
+			t.Errorf("Test (%s): got template %+v", test.desc, cf.ListenRanges[0].Template)
+		}
+	}
+}
+
+func TestPeerConfig(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{
+		Rid: rid,
+		Asn: 64512,
+		PeersConfig: map[string]PeerConfig{
+			"10.20.0.1": {IP: "10.20.0.1", Name: "core"},
+		},
+		ListenRanges: []ListenRange{
+			{Prefix: netip.MustParsePrefix("10.20.0.0/16"), Template: PeerConfig{Name: "edge-{ip}"}},
+			{Prefix: netip.MustParsePrefix("10.20.30.0/24"), Template: PeerConfig{Name: "lab-{ip}"}},
+			{Prefix: netip.MustParsePrefix("2001:db8::/32"), Template: PeerConfig{Name: "v6-{ip}"}},
+		},
+	})
+
+	tests := []struct {
+		ip       string
+		wantName string
+		wantOK   bool
+	}{
+		{ip: "10.20.0.1", wantName: "core", wantOK: true},
+		{ip: "10.20.1.1", wantName: "edge-10.20.1.1", wantOK: true},
+		{ip: "10.20.30.1", wantName: "lab-10.20.30.1", wantOK: true},
+		{ip: "::ffff:10.20.1.1", wantName: "edge-::ffff:10.20.1.1", wantOK: true},
+		{ip: "2001:db8::1", wantName: "v6-2001:db8::1", wantOK: true},
+		{ip: "10.21.0.1"},
+	}
+	for _, test := range tests {
+		pc, ok := srv.peerConfig(test.ip)
+		if ok != test.wantOK || pc.Name != test.wantName {
+			t.Errorf("Test (%s): got %q, %t, want %q, %t", test.ip, pc.Name, ok, test.wantName, test.wantOK)
+		}
+		if ok && pc.IP != test.ip {
+			t.Errorf("Test (%s): got IP %s", test.ip, pc.IP)
+		}
+	}
+}
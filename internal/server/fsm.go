@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// SessionState is the RFC 4271 section 8 finite state machine state of a single BGP connection.
+type SessionState uint32
+
+const (
+	StateIdle SessionState = iota
+	StateConnect
+	StateActive
+	StateOpenSent
+	StateOpenConfirm
+	StateEstablished
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case StateIdle:
+		return "Idle"
+	case StateConnect:
+		return "Connect"
+	case StateActive:
+		return "Active"
+	case StateOpenSent:
+		return "OpenSent"
+	case StateOpenConfirm:
+		return "OpenConfirm"
+	case StateEstablished:
+		return "Established"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	bgpPort             = 179
+	defaultHoldTime     = 90
+	defaultConnectRetry = 30 * time.Second
+	maxConnectRetry     = 5 * time.Minute
+)
+
+// activeParameters are the capabilities offered when we initiate a session. With an inbound
+// session we simply mirror the peer's OPEN, but when dialing we speak first and must offer
+// everything we are able to receive.
+var activeParameters = bgp.Parameters{
+	AddrFamilies: []bgp.Addr{
+		{AFI: 1, SAFI: 1},
+		{AFI: 2, SAFI: 1},
+	},
+	AddPath: []bgp.AddPathCapability{
+		{AFI: 1, SAFI: 1, SendReceive: 1},
+		{AFI: 2, SAFI: 1, SendReceive: 1},
+	},
+	ExtendedNextHop: []bgp.ExtendedNextHop{
+		{AFI: 1, SAFI: 1, NextHopAFI: 2},
+	},
+}
+
+// activeSession drives the outbound side of the FSM for a peer configured with active mode.
+// It covers the Idle, Connect and Active states; once a TCP connection is up the session is
+// handed to a regular peer in OpenSent and its peerWorker takes over.
+type activeSession struct {
+	server   *Server
+	conf     PeerConfig
+	failures int
+}
+
+// startActiveSessions starts a connect loop for every peer configured in active mode that
+// does not already have one.
+func (s *Server) startActiveSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ip, pc := range s.peerConf.Load().peers {
+		if !pc.Active || s.activeSessions[ip] {
+			continue
+		}
+		s.activeSessions[ip] = true
+		a := &activeSession{
+			server: s,
+			conf:   pc,
+		}
+		go a.run()
+	}
+}
+
+func (a *activeSession) run() {
+	defer func() {
+		a.server.mutex.Lock()
+		delete(a.server.activeSessions, a.conf.IP)
+		a.server.mutex.Unlock()
+	}()
+
+	for {
+		if a.server.isStopped() {
+			return
+		}
+
+		// The configuration may have been reloaded since the last attempt
+		pc, ok := a.server.peerConfig(a.conf.IP)
+		if !ok || !pc.Active {
+			log.Printf("Peer %s is no longer configured as active, not connecting\n", a.conf.IP)
+			return
+		}
+		a.conf = pc
+		addr := net.JoinHostPort(a.conf.IP, strconv.Itoa(a.port()))
+
+		// Never dial while a session to this peer is already up or being set up, either
+		// one we initiated earlier or one the peer initiated towards us, nor while it is
+		// held down for exceeding its maximum prefixes.
+		if a.server.peerConnected(a.conf.IP) || a.server.prefixHeld(a.conf.IP) {
+			if !a.wait(a.connectRetry()) {
+				return
+			}
+			continue
+		}
+
+		conn, err := a.server.dialPeer(a.conf, addr, a.connectRetry())
+		if err != nil {
+			a.failures++
+			backoff := a.backoff()
+			log.Printf("Connect to %s failed: %v, retrying in %v\n", addr, err, backoff.Round(time.Second))
+			if !a.wait(backoff) {
+				return
+			}
+			continue
+		}
+
+		log.Printf("Outbound connection to %s established\n", addr)
+		p := a.server.addPeer(conn, a.conf.IP, true)
+		if err := p.send(bgp.CreateOpen(a.server.localASN(p.ip), a.server.localHoldTime(p.ip), p.rid, a.server.openParameters(p.ip, activeParameters))); err != nil {
+			log.Printf("Unable to send Open to %s: %v\n", addr, err)
+		}
+		p.peerWorker()
+
+		if p.reachedEstablished.Load() {
+			a.failures = 0
+		} else {
+			a.failures++
+		}
+		if !a.wait(a.backoff()) {
+			return
+		}
+	}
+}
+
+func (a *activeSession) port() int {
+	if a.conf.Port != 0 {
+		return a.conf.Port
+	}
+	return bgpPort
+}
+
+func (a *activeSession) connectRetry() time.Duration {
+	if a.conf.ConnectRetry > 0 {
+		return time.Duration(a.conf.ConnectRetry) * time.Second
+	}
+	return defaultConnectRetry
+}
+
+// backoff returns the ConnectRetryTimer value to use after the given number of consecutive
+// failures. The timer doubles on each failure up to maxConnectRetry and is jittered to between
+// 75% and 100% of its value as per RFC 4271 section 10.
+func (a *activeSession) backoff() time.Duration {
+	d := a.connectRetry()
+	for i := 1; i < a.failures && d < maxConnectRetry; i++ {
+		d *= 2
+	}
+	d = min(d, maxConnectRetry)
+	return d - time.Duration(rand.Int64N(int64(d)/4+1))
+}
+
+// wait sleeps for d, returning false if the server was stopped in the meantime.
+func (a *activeSession) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-a.server.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// peerConnected reports whether a live connection to ip exists in any state beyond Idle.
+func (s *Server) peerConnected(ip string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, p := range s.peers {
+		if p.ip == ip && SessionState(p.state.Load()) != StateIdle {
+			return true
+		}
+	}
+	return false
+}
+
+// closeLocalInitiated decides the RFC 4271 section 6.8 collision. The connection initiated by
+// the speaker with the higher BGP Identifier is retained.
+func closeLocalInitiated(local, remote bgp.BGPID) bool {
+	return binary.BigEndian.Uint32(local[:]) < binary.BigEndian.Uint32(remote[:])
+}
+
+// resolveCollision is called when p receives an OPEN while another connection to the same peer
+// may be in progress. It returns true if p should be kept. The losing connection is sent a
+// Cease / Connection Collision Resolution notification and closed.
+func (s *Server) resolveCollision(p *peer, remoteID bgp.BGPID) bool {
+	s.mutex.RLock()
+	other := p.collision
+	stillListed := false
+	for _, check := range s.peers {
+		if check == other {
+			stillListed = true
+			break
+		}
+	}
+	s.mutex.RUnlock()
+
+	if other == nil || !stillListed {
+		s.register(p)
+		return true
+	}
+
+	switch SessionState(other.state.Load()) {
+	case StateIdle:
+		// The other connection has already gone away, nothing to resolve.
+		s.register(p)
+		return true
+	case StateEstablished:
+		log.Printf("Collision with established session to %s, closing new connection\n", p.ip)
+		p.notify(bgp.Cease, bgp.CeaseCollision, nil)
+		return false
+	}
+
+	// Exactly one of the two connections was initiated by us.
+	loser := other
+	if closeLocalInitiated(s.Conf.Rid, remoteID) == p.outbound {
+		loser = p
+	}
+	log.Printf("Connection collision with %s, closing %s connection\n", p.ip, direction(loser.outbound))
+	loser.notify(bgp.Cease, bgp.CeaseCollision, nil)
+	if loser == p {
+		return false
+	}
+	s.register(p)
+	return true
+}
+
+func direction(outbound bool) string {
+	if outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
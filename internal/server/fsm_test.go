@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+func TestCloseLocalInitiated(t *testing.T) {
+	tests := []struct {
+		desc   string
+		local  string
+		remote string
+		want   bool
+	}{
+		{
+			desc:   "remote higher",
+			local:  "1.1.1.1",
+			remote: "2.2.2.2",
+			want:   true,
+		},
+		{
+			desc:   "local higher",
+			local:  "10.0.0.1",
+			remote: "9.255.255.255",
+			want:   false,
+		},
+		{
+			desc:   "compared as unsigned",
+			local:  "128.0.0.1",
+			remote: "127.0.0.1",
+			want:   false,
+		},
+	}
+	for _, test := range tests {
+		local, _ := GetRid(test.local)
+		remote, _ := GetRid(test.remote)
+		if got := closeLocalInitiated(local, remote); got != test.want {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestConnectRetryBackoff(t *testing.T) {
+	a := &activeSession{conf: PeerConfig{ConnectRetry: 10}}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 10 * time.Second},
+		{failures: 1, want: 10 * time.Second},
+		{failures: 2, want: 20 * time.Second},
+		{failures: 3, want: 40 * time.Second},
+		{failures: 10, want: maxConnectRetry},
+	}
+	for _, test := range tests {
+		a.failures = test.failures
+		got := a.backoff()
+		if got > test.want || got < test.want*3/4 {
+			t.Errorf("Test (%d failures): got %v, want between %v and %v", test.failures, got, test.want*3/4, test.want)
+		}
+	}
+}
+
+func TestUnexpectedMessage(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+
+	tests := []struct {
+		state   SessionState
+		msg     []byte
+		subcode uint8
+	}{
+		{state: StateActive, msg: generateEoR(), subcode: 0},
+		{state: StateOpenSent, msg: generateEoR(), subcode: bgp.FsmUnexpectedOpenSent},
+		{state: StateOpenConfirm, msg: generateEoR(), subcode: bgp.FsmUnexpectedOpenConfirm},
+		{state: StateEstablished, msg: bgp.CreateOpen(64513, 90, rid, &bgp.Parameters{}), subcode: bgp.FsmUnexpectedEstablished},
+	}
+	for _, test := range tests {
+		c1, c2 := net.Pipe()
+
+		p := &peer{
+			server: srv,
+			conn:   c1,
+			ip:     "127.0.0.1",
+			quiet:  true,
+		}
+		p.state.Store(uint32(test.state))
+
+		done := make(chan bool)
+		go func() {
+			p.peerWorker()
+			done <- true
+		}()
+
+		go c2.Write(test.msg)
+
+		// Expect an FSM error notification back
+		header := make([]byte, 21)
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c2, header); err != nil {
+			t.Fatalf("Test (%s): no notification received: %v", test.state, err)
+		}
+		if !bytes.Equal(header[:16], bgpMarker) || header[18] != bgp.Notification {
+			t.Fatalf("Test (%s): expected a notification, got %#v", test.state, header)
+		}
+		if binary.BigEndian.Uint16(header[16:18]) != 21 || header[19] != bgp.FsmError || header[20] != test.subcode {
+			t.Errorf("Test (%s): got notification %d/%d, want %d/%d", test.state, header[19], header[20], bgp.FsmError, test.subcode)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Test (%s): peerWorker did not exit after an unexpected message", test.state)
+		}
+		c2.Close()
+	}
+}
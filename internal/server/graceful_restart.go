@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
 )
 
 // PeerStatus defines the atomic state values for the Graceful Restart state machine.
@@ -20,6 +22,7 @@ const (
 	StatusWaitingForEOR
 	StatusPurging
 	StatusPurgingRemainingStale
+	StatusLLGRStale
 )
 
 func (s PeerStatus) String() string {
@@ -34,6 +37,8 @@ func (s PeerStatus) String() string {
 		return "Purging"
 	case StatusPurgingRemainingStale:
 		return "Purging Remaining Stale"
+	case StatusLLGRStale:
+		return "LLGR Stale"
 	default:
 		return "Unknown"
 	}
@@ -55,7 +60,8 @@ type GracefulRestartManager interface {
 
 type defaultGRManager struct {
 	server           *Server
-	restartTime      time.Duration
+	maxRestartTime   time.Duration
+	maxLLGRStaleTime time.Duration
 	fallbackDuration time.Duration
 	eorReceived      map[string]map[Family]bool
 	mu               sync.Mutex
@@ -67,6 +73,10 @@ func NewGracefulRestartManager(s *Server) GracefulRestartManager {
 	if rt == 0 {
 		rt = 15 * time.Minute
 	}
+	st := s.Conf.LLGRStaleTime
+	if st == 0 {
+		st = 24 * time.Hour
+	}
 	fb := s.Conf.GREoRFallbackTime
 	if fb == 0 {
 		fb = 15 * time.Minute
@@ -74,7 +84,8 @@ func NewGracefulRestartManager(s *Server) GracefulRestartManager {
 
 	return &defaultGRManager{
 		server:           s,
-		restartTime:      rt,
+		maxRestartTime:   rt,
+		maxLLGRStaleTime: st,
 		fallbackDuration: fb,
 		eorReceived:      make(map[string]map[Family]bool),
 	}
@@ -82,7 +93,7 @@ func NewGracefulRestartManager(s *Server) GracefulRestartManager {
 
 // SetTimersForTest allows modifying the hardcoded timers in integration tests.
 func (m *defaultGRManager) SetTimersForTest(restart, fallback time.Duration) {
-	m.restartTime = restart
+	m.maxRestartTime = restart
 	m.fallbackDuration = fallback
 }
 
@@ -118,6 +129,17 @@ func (m *defaultGRManager) ProcessCapExchange(ctx context.Context, peerIP string
 		p.eorFallbackTimer.Stop()
 		p.eorFallbackTimer = nil
 	}
+	for afi, t := range p.llgrTimers {
+		t.Stop()
+		delete(p.llgrTimers, afi)
+	}
+	if params.GRCapability != nil && params.GRCapability.Restarting() {
+		log.Printf("Peer %s has restarted (R bit set)", peerIP)
+	}
+
+	// Routes held from the previous session are only kept for families the peer still lists
+	// with its forwarding state preserved (RFC 4724 section 4.2, RFC 9494 section 4.2)
+	m.server.flushUnpreserved(params, p.v4rib, p.v6rib)
 
 	p.status.Store(uint32(StatusWaitingForEOR))
 
@@ -188,27 +210,253 @@ func (m *defaultGRManager) HandlePeerDown(ctx context.Context, peerIP string) er
 	}
 
 	p.mutex.Lock()
-	// If already in GRStale state, don't reset the timer (prevent flap extension)
-	if PeerStatus(p.status.Load()) == StatusGRStale && p.restartTimer != nil {
+	if msg := p.notification; msg != nil && !retainAfterNotification(p, *msg) {
+		if p.restartTimer != nil {
+			p.restartTimer.Stop()
+			p.restartTimer = nil
+		}
+		for afi, t := range p.llgrTimers {
+			t.Stop()
+			delete(p.llgrTimers, afi)
+		}
+		p.mutex.Unlock()
+		log.Printf("Peer %s session ended with notification %v, removing routes", peerIP, msg)
+		m.server.destroyPeer(peerIP)
+		return nil
+	}
+
+	// If the restart timer is already running, don't reset it (prevent flap extension)
+	if p.restartTimer != nil {
+		p.status.Store(uint32(StatusGRStale))
 		p.mutex.Unlock()
 		log.Printf("Peer %s down again, but already in GR_STALE, keeping original timer", peerIP)
 		return nil
 	}
+	if len(p.llgrTimers) > 0 {
+		p.status.Store(uint32(StatusLLGRStale))
+		p.mutex.Unlock()
+		log.Printf("Peer %s down again, but already in LLGR_STALE, keeping original timers", peerIP)
+		return nil
+	}
 
 	p.status.Store(uint32(StatusGRStale))
 
-	p.restartTimer = time.AfterFunc(m.restartTime, func() {
-		if PeerStatus(p.status.Load()) == StatusGRStale {
-			log.Printf("Restart timer expired for peer %s, destroying RIB", peerIP)
-			m.server.destroyPeer(peerIP)
-		}
+	params := p.param
+	restartTime := m.restartTime(params)
+	var t *time.Timer
+	t = time.AfterFunc(restartTime, func() {
+		m.restartTimerExpired(peerIP, &t, params)
 	})
+	p.restartTimer = t
 	p.mutex.Unlock()
 
-	log.Printf("Peer %s down, entered GR_STALE state (15m timer started)", peerIP)
+	log.Printf("Peer %s down, entered GR_STALE state (%v timer started)", peerIP, restartTime)
 	return nil
 }
 
+// retainAfterNotification reports whether Graceful Restart applies to a session that ended with
+// a NOTIFICATION (RFC 8538 section 4): only if the peer set the N bit, and never for a Hard
+// Reset, a maximum prefix teardown or a de-configured peer, which section 5 says should be
+// sent as one. A connection that failed before completing its OPEN leaves the timers of the
+// previous session running unless it was a Hard Reset. Called with p.mutex held.
+func retainAfterNotification(p *peer, msg bgp.NotificationMessage) bool {
+	if msg.Code == bgp.Cease {
+		switch msg.Subcode {
+		case bgp.CeaseHardReset, bgp.CeaseMaxPrefixes, bgp.CeasePeerDeconfigured:
+			return false
+		}
+	}
+	if p.restartTimer != nil || len(p.llgrTimers) > 0 {
+		return true
+	}
+	return p.param.GracefulRestart && p.param.GRCapability != nil && p.param.GRCapability.Notification()
+}
+
+// restartTime returns how long to hold a peer's routes after it goes down: the restart time
+// it advertised, capped at the configured maximum. A peer with only Long-Lived Graceful
+// Restart moves straight to the long-lived stale phase.
+func (m *defaultGRManager) restartTime(params bgp.Parameters) time.Duration {
+	if params.GRCapability == nil {
+		if params.LongLivedGR {
+			return 0
+		}
+		return m.maxRestartTime
+	}
+	return min(time.Duration(params.GRCapability.RestartTime)*time.Second, m.maxRestartTime)
+}
+
+// restartTimerExpired moves the routes of a peer that did not come back within its restart
+// time to the long-lived stale phase, or destroys its RIB if it did not advertise Long-Lived
+// Graceful Restart. The timer moves to a new connection from the peer until that completes
+// its OPEN. params are those of the session that went down. t is only read under the peer's
+// mutex, as the timer may fire before the caller has stored it.
+func (m *defaultGRManager) restartTimerExpired(peerIP string, t **time.Timer, params bgp.Parameters) {
+	p, ok := m.getPeer(peerIP)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	current := p.restartTimer == *t
+	if current {
+		p.restartTimer = nil
+	}
+	p.mutex.Unlock()
+	if !current {
+		return
+	}
+	if m.startLongLivedStale(p, params) {
+		return
+	}
+	log.Printf("Restart timer expired for peer %s, destroying RIB", peerIP)
+	if PeerStatus(p.status.Load()) != StatusGRStale {
+		p.conn.Close()
+	}
+	m.server.destroyPeer(peerIP)
+}
+
+// llgrStaleTime returns how long routes of an AFI are kept in the long-lived stale phase: the
+// stale time the peer advertised, capped at the configured maximum. Zero means not at all.
+func (m *defaultGRManager) llgrStaleTime(params bgp.Parameters, afi uint16) time.Duration {
+	if !params.LongLivedGR {
+		return 0
+	}
+	for _, f := range params.LLGRFamilies {
+		if f.AFI == afi && f.SAFI == 1 {
+			return min(time.Duration(f.StaleTime)*time.Second, m.maxLLGRStaleTime)
+		}
+	}
+	return 0
+}
+
+// startLongLivedStale moves the stale routes of the families the peer listed in its Long-Lived
+// Graceful Restart capability to the LLGR_STALE phase (RFC 9494 section 4.3) and flushes the
+// rest. It reports whether any family is kept.
+func (m *defaultGRManager) startLongLivedStale(p *peer, params bgp.Parameters) bool {
+	v4Time, v6Time := m.llgrStaleTime(params, 1), m.llgrStaleTime(params, 2)
+	if v4Time == 0 && v6Time == 0 {
+		return false
+	}
+
+	p.mutex.Lock()
+	var removedV4, removedV6 []netip.Prefix
+	if p.v4rib != nil {
+		if v4Time > 0 {
+			removedV4 = markLongLivedStale(p.v4rib)
+		} else {
+			removedV4 = p.v4rib.DeleteStaleRoutes()
+		}
+	}
+	if p.v6rib != nil {
+		if v6Time > 0 {
+			removedV6 = markLongLivedStale(p.v6rib)
+		} else {
+			removedV6 = p.v6rib.DeleteStaleRoutes()
+		}
+	}
+	if p.llgrTimers == nil {
+		p.llgrTimers = make(map[uint16]*time.Timer)
+	}
+	for afi, d := range map[uint16]time.Duration{1: v4Time, 2: v6Time} {
+		if d == 0 {
+			continue
+		}
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			m.llgrTimerExpired(p.ip, afi, &t)
+		})
+		p.llgrTimers[afi] = t
+	}
+	p.staleSince = time.Now()
+	// A new connection from the peer may be waiting for its OPEN, and keeps its status
+	if PeerStatus(p.status.Load()) == StatusGRStale {
+		p.status.Store(uint32(StatusLLGRStale))
+	}
+	p.mutex.Unlock()
+
+	m.server.removeGlobalV4(removedV4)
+	m.server.removeGlobalV6(removedV6)
+	log.Printf("Restart timer expired for peer %s, entered LLGR_STALE state (v4 %v, v6 %v)", p.ip, v4Time, v6Time)
+	return true
+}
+
+// llgrTimerExpired flushes a family whose long-lived stale time has run out, and destroys the
+// peer once none are left.
+func (m *defaultGRManager) llgrTimerExpired(peerIP string, afi uint16, t **time.Timer) {
+	p, ok := m.getPeer(peerIP)
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	if cur, ok := p.llgrTimers[afi]; !ok || cur != *t {
+		p.mutex.Unlock()
+		return
+	}
+	delete(p.llgrTimers, afi)
+	remaining := len(p.llgrTimers)
+	var removed []netip.Prefix
+	switch {
+	case afi == 1 && p.v4rib != nil:
+		removed = p.v4rib.DeleteStaleRoutes()
+	case afi == 2 && p.v6rib != nil:
+		removed = p.v6rib.DeleteStaleRoutes()
+	}
+	p.mutex.Unlock()
+
+	if afi == 1 {
+		m.server.removeGlobalV4(removed)
+	} else {
+		m.server.removeGlobalV6(removed)
+	}
+	log.Printf("LLGR stale timer expired for peer %s AFI %d, removed %d prefixes", peerIP, afi, len(removed))
+
+	if remaining > 0 {
+		return
+	}
+	log.Printf("All LLGR stale timers expired for peer %s, destroying RIB", peerIP)
+	if PeerStatus(p.status.Load()) != StatusLLGRStale {
+		p.conn.Close()
+	}
+	m.server.destroyPeer(peerIP)
+}
+
+// llgrRib is the part of an IPv4 or IPv6 RIB needed to mark routes long-lived stale.
+type llgrRib interface {
+	AllPrefixes() []netip.Prefix
+	AllPaths(netip.Prefix) []routing_table.Route
+	InsertBatch([]routing_table.Route) []netip.Prefix
+	DeleteBatch([]routing_table.PrefixWithID) []netip.Prefix
+	MarkAllStale()
+}
+
+// markLongLivedStale attaches the LLGR_STALE community to every route in the RIB and removes
+// those carrying NO_LLGR. Routes stay stale. It returns the prefixes that are now gone.
+func markLongLivedStale(rib llgrRib) []netip.Prefix {
+	var tagged []routing_table.Route
+	var dropped []routing_table.PrefixWithID
+	for _, pfx := range rib.AllPrefixes() {
+		for _, r := range rib.AllPaths(pfx) {
+			if r.Attributes == nil {
+				continue
+			}
+			if slices.Contains(r.Attributes.Communities, bgp.NoLLGR) {
+				dropped = append(dropped, routing_table.PrefixWithID{Prefix: pfx, PathID: r.PathID})
+				continue
+			}
+			if slices.Contains(r.Attributes.Communities, bgp.LLGRStale) {
+				continue
+			}
+			// Attributes are shared, so tag a copy
+			attrs := *r.Attributes
+			attrs.Communities = append(slices.Clone(attrs.Communities), bgp.LLGRStale)
+			r.Attributes = &attrs
+			tagged = append(tagged, r)
+		}
+	}
+	rib.InsertBatch(tagged)
+	rib.MarkAllStale()
+	return rib.DeleteBatch(dropped)
+}
+
 func (m *defaultGRManager) CompleteGracefulRestart(ctx context.Context, peerIP string) error {
 	p, ok := m.getPeer(peerIP)
 	if !ok {
@@ -259,3 +507,69 @@ func (m *defaultGRManager) purgeAllStalePaths(ctx context.Context, p *peer) erro
 		p.ip, len(removedV4), len(removedV6))
 	return nil
 }
+
+// grFamilies reports whether the peer listed IPv4 and IPv6 unicast in its Graceful Restart or
+// Long-Lived Graceful Restart capability. With preserved set, only families with the
+// Forwarding State bit count.
+func grFamilies(params bgp.Parameters, preserved bool) (v4, v6 bool) {
+	set := func(afi uint16) {
+		switch afi {
+		case 1:
+			v4 = true
+		case 2:
+			v6 = true
+		}
+	}
+	if params.GracefulRestart && params.GRCapability != nil {
+		for _, f := range params.GRCapability.AFIs {
+			if f.SAFI == 1 && (!preserved || f.ForwardingPreserved()) {
+				set(f.AFI)
+			}
+		}
+	}
+	if params.LongLivedGR {
+		for _, f := range params.LLGRFamilies {
+			if f.SAFI == 1 && f.StaleTime > 0 && (!preserved || f.ForwardingPreserved()) {
+				set(f.AFI)
+			}
+		}
+	}
+	return v4, v6
+}
+
+// retainStale marks the routes of a peer that went down as stale for the families listed in
+// its Graceful Restart or Long-Lived Graceful Restart capability and removes the rest. It reports whether any were kept.
+func (s *Server) retainStale(params bgp.Parameters, v4rib *routing_table.IPv4Rib, v6rib *routing_table.IPv6Rib) bool {
+	v4, v6 := grFamilies(params, false)
+	if v4rib != nil {
+		v4rib.MarkAllStale()
+		if !v4 {
+			s.removeGlobalV4(v4rib.DeleteStaleRoutes())
+		}
+	}
+	if v6rib != nil {
+		v6rib.MarkAllStale()
+		if !v6 {
+			s.removeGlobalV6(v6rib.DeleteStaleRoutes())
+		}
+	}
+	return v4 || v6
+}
+
+// flushUnpreserved removes the stale routes of the families a reconnecting peer did not
+// preserve forwarding state for.
+func (s *Server) flushUnpreserved(params bgp.Parameters, v4rib *routing_table.IPv4Rib, v6rib *routing_table.IPv6Rib) {
+	v4, v6 := grFamilies(params, true)
+	if !v4 && v4rib != nil {
+		if removed := v4rib.DeleteStaleRoutes(); len(removed) > 0 {
+			log.Printf("Forwarding state not preserved, removed %d stale v4 prefixes", len(removed))
+			s.removeGlobalV4(removed)
+		}
+	}
+	if !v6 && v6rib != nil {
+		if removed := v6rib.DeleteStaleRoutes(); len(removed) > 0 {
+			log.Printf("Forwarding state not preserved, removed %d stale v6 prefixes", len(removed))
+			s.removeGlobalV6(removed)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+func TestRestartTime(t *testing.T) {
+	tests := []struct {
+		desc   string
+		max    time.Duration
+		params bgp.Parameters
+		want   time.Duration
+	}{
+		{
+			desc:   "peer's restart time",
+			max:    15 * time.Minute,
+			params: bgp.Parameters{GracefulRestart: true, GRCapability: &bgp.GracefulRestartCapability{RestartTime: 120}},
+			want:   120 * time.Second,
+		},
+		{
+			desc:   "capped at the maximum",
+			max:    time.Minute,
+			params: bgp.Parameters{GracefulRestart: true, GRCapability: &bgp.GracefulRestartCapability{RestartTime: 4095}},
+			want:   time.Minute,
+		},
+		{
+			desc:   "zero restart time",
+			max:    15 * time.Minute,
+			params: bgp.Parameters{GracefulRestart: true, GRCapability: &bgp.GracefulRestartCapability{}},
+			want:   0,
+		},
+		{
+			desc: "no capability",
+			max:  15 * time.Minute,
+			want: 15 * time.Minute,
+		},
+		{
+			desc:   "long-lived graceful restart only",
+			max:    15 * time.Minute,
+			params: bgp.Parameters{LongLivedGR: true},
+			want:   0,
+		},
+	}
+	for _, test := range tests {
+		m := &defaultGRManager{maxRestartTime: test.max}
+		if got := m.restartTime(test.params); got != test.want {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+// grPeer returns a peer holding 192.0.2.0/24 and 2001:db8::/32.
+func grPeer(t *testing.T) *peer {
+	t.Helper()
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	p.v6rib = routing_table.NewIPv6Rib(srv.v6AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	mpReach := []byte{
+		0x80, 0x0e, 0x1a, 0x00, 0x02, 0x01, 0x10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+		0x00, 0x20, 0x20, 0x01, 0x0d, 0xb8,
+	}
+	attrs := bytes.Join([][]byte{origin, aspath, nexthop, mpReach}, nil)
+	p.in = bytes.NewReader(updateBody(nil, attrs, []byte{0x18, 0xc0, 0x00, 0x02}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if p.v4rib.Count() != 1 || p.v6rib.Count() != 1 {
+		t.Fatalf("got %d IPv4 and %d IPv6 prefixes, want 1 and 1", p.v4rib.Count(), p.v6rib.Count())
+	}
+	return p
+}
+
+func grParams(flags ...uint8) bgp.Parameters {
+	gr := &bgp.GracefulRestartCapability{RestartTime: 120}
+	for i, f := range flags {
+		gr.AFIs = append(gr.AFIs, bgp.GRAddressFamily{AFI: uint16(i + 1), SAFI: 1, Flags: f})
+	}
+	return bgp.Parameters{GracefulRestart: true, GRCapability: gr}
+}
+
+func TestRetainStale(t *testing.T) {
+	tests := []struct {
+		desc         string
+		params       bgp.Parameters
+		wantRetained bool
+		wantV4       int
+		wantV6       int
+	}{
+		{
+			desc:         "both families listed",
+			params:       grParams(0, 0),
+			wantRetained: true,
+			wantV4:       1,
+			wantV6:       1,
+		},
+		{
+			desc:         "only IPv4 listed",
+			params:       grParams(0),
+			wantRetained: true,
+			wantV4:       1,
+		},
+		{
+			desc:   "no families listed",
+			params: grParams(),
+		},
+		{
+			desc: "no graceful restart",
+		},
+	}
+	for _, test := range tests {
+		p := grPeer(t)
+		if got := p.server.retainStale(test.params, p.v4rib, p.v6rib); got != test.wantRetained {
+			t.Errorf("Test (%s): got retained %t, want %t", test.desc, got, test.wantRetained)
+		}
+		if p.v4rib.Count() != test.wantV4 || p.v6rib.Count() != test.wantV6 {
+			t.Errorf("Test (%s): got %d IPv4 and %d IPv6 prefixes, want %d and %d",
+				test.desc, p.v4rib.Count(), p.v6rib.Count(), test.wantV4, test.wantV6)
+		}
+	}
+}
+
+func TestFlushUnpreserved(t *testing.T) {
+	tests := []struct {
+		desc   string
+		params bgp.Parameters
+		wantV4 int
+		wantV6 int
+	}{
+		{
+			desc:   "forwarding state preserved for both",
+			params: grParams(0x80, 0x80),
+			wantV4: 1,
+			wantV6: 1,
+		},
+		{
+			desc:   "F bit clear for IPv6",
+			params: grParams(0x80, 0),
+			wantV4: 1,
+		},
+		{
+			desc:   "IPv6 no longer listed",
+			params: grParams(0x80),
+			wantV4: 1,
+		},
+		{
+			desc: "graceful restart no longer offered",
+		},
+	}
+	for _, test := range tests {
+		p := grPeer(t)
+		p.server.retainStale(grParams(0, 0), p.v4rib, p.v6rib)
+		p.server.flushUnpreserved(test.params, p.v4rib, p.v6rib)
+		if p.v4rib.Count() != test.wantV4 || p.v6rib.Count() != test.wantV6 {
+			t.Errorf("Test (%s): got %d IPv4 and %d IPv6 prefixes, want %d and %d",
+				test.desc, p.v4rib.Count(), p.v6rib.Count(), test.wantV4, test.wantV6)
+		}
+	}
+}
+
+func llgrParams(v4, v6 uint32) bgp.Parameters {
+	params := grParams(0, 0)
+	params.LongLivedGR = true
+	for i, st := range []uint32{v4, v6} {
+		if st > 0 {
+			params.LLGRFamilies = append(params.LLGRFamilies, bgp.LLGRFamily{AFI: uint16(i + 1), SAFI: 1, StaleTime: st})
+		}
+	}
+	return params
+}
+
+func TestStartLongLivedStale(t *testing.T) {
+	tests := []struct {
+		desc     string
+		params   bgp.Parameters
+		wantLLGR bool
+		wantV4   int
+		wantV6   int
+	}{
+		{
+			desc:     "both families",
+			params:   llgrParams(3600, 3600),
+			wantLLGR: true,
+			wantV4:   1,
+			wantV6:   1,
+		},
+		{
+			desc:     "only IPv6",
+			params:   llgrParams(0, 3600),
+			wantLLGR: true,
+			wantV6:   1,
+		},
+		{
+			desc:   "no long-lived graceful restart",
+			params: grParams(0, 0),
+			wantV4: 1,
+			wantV6: 1,
+		},
+	}
+	for _, test := range tests {
+		p := grPeer(t)
+
+		// A second IPv4 route asks not to be kept long-lived
+		origin := []byte{0x40, 0x01, 0x01, 0x00}
+		aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+		nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+		noLLGR := []byte{0xc0, 0x08, 0x04, 0xff, 0xff, 0x00, 0x07}
+		attrs := bytes.Join([][]byte{origin, aspath, nexthop, noLLGR}, nil)
+		p.in = bytes.NewReader(updateBody(nil, attrs, []byte{0x18, 0xc6, 0x33, 0x64}))
+		if err := p.handleUpdate(); err != nil {
+			t.Fatalf("handleUpdate: %v", err)
+		}
+
+		m := &defaultGRManager{server: p.server, maxLLGRStaleTime: time.Hour}
+		p.server.retainStale(test.params, p.v4rib, p.v6rib)
+		p.status.Store(uint32(StatusGRStale))
+		if got := m.startLongLivedStale(p, test.params); got != test.wantLLGR {
+			t.Errorf("Test (%s): got long-lived %t, want %t", test.desc, got, test.wantLLGR)
+		}
+		for _, timer := range p.llgrTimers {
+			timer.Stop()
+		}
+		if !test.wantLLGR {
+			// Nothing changes, the caller destroys the peer
+			if p.v4rib.Count() != 2 || p.v6rib.Count() != 1 {
+				t.Errorf("Test (%s): got %d IPv4 and %d IPv6 prefixes, want 2 and 1",
+					test.desc, p.v4rib.Count(), p.v6rib.Count())
+			}
+			continue
+		}
+		if p.v4rib.Count() != test.wantV4 || p.v6rib.Count() != test.wantV6 {
+			t.Errorf("Test (%s): got %d IPv4 and %d IPv6 prefixes, want %d and %d",
+				test.desc, p.v4rib.Count(), p.v6rib.Count(), test.wantV4, test.wantV6)
+		}
+		if got := PeerStatus(p.status.Load()); got != StatusLLGRStale {
+			t.Errorf("Test (%s): got status %v, want %v", test.desc, got, StatusLLGRStale)
+		}
+		for _, pfx := range []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")} {
+			var routes []routing_table.Route
+			if pfx.Addr().Is4() {
+				routes = p.v4rib.AllPaths(pfx)
+			} else {
+				routes = p.v6rib.AllPaths(pfx)
+			}
+			for _, r := range routes {
+				if !r.Stale || !slices.Contains(r.Attributes.Communities, bgp.LLGRStale) {
+					t.Errorf("Test (%s): got %v stale %t with communities %v, want stale with LLGR_STALE",
+						test.desc, pfx, r.Stale, r.Attributes.Communities)
+				}
+			}
+		}
+	}
+}
+
+func TestLLGRTimerExpired(t *testing.T) {
+	p := grPeer(t)
+	p.server.peers = append(p.server.peers, p)
+	m := &defaultGRManager{server: p.server, maxLLGRStaleTime: 20 * time.Millisecond}
+	params := llgrParams(1, 1)
+	var none *time.Timer
+	m.llgrTimerExpired(p.ip, 1, &none) // no timer running, ignored
+
+	p.server.retainStale(params, p.v4rib, p.v6rib)
+	p.status.Store(uint32(StatusGRStale))
+	if !m.startLongLivedStale(p, params) {
+		t.Fatalf("startLongLivedStale: peer not kept")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := m.getPeer(p.ip); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("peer still present after its long-lived stale time")
+}
+
+func TestRetainAfterNotification(t *testing.T) {
+	withN := grParams(0)
+	withN.GRCapability.RestartFlags = 0x4
+	hardReset := bgp.NotificationMessage{Code: bgp.Cease, Subcode: bgp.CeaseHardReset}
+	adminReset := bgp.NotificationMessage{Code: bgp.Cease, Subcode: bgp.CeaseAdminReset}
+	tests := []struct {
+		desc    string
+		params  bgp.Parameters
+		running bool
+		msg     bgp.NotificationMessage
+		want    bool
+	}{
+		{
+			desc:   "N bit",
+			params: withN,
+			msg:    adminReset,
+			want:   true,
+		},
+		{
+			desc:   "no N bit",
+			params: grParams(0),
+			msg:    adminReset,
+		},
+		{
+			desc:   "hard reset with N bit",
+			params: withN,
+			msg:    hardReset,
+		},
+		{
+			desc:   "de-configured peer with N bit",
+			params: withN,
+			msg:    bgp.NotificationMessage{Code: bgp.Cease, Subcode: bgp.CeasePeerDeconfigured},
+		},
+		{
+			desc:    "reconnecting peer fails its OPEN",
+			running: true,
+			msg:     bgp.NotificationMessage{Code: bgp.OpenError, Subcode: bgp.BadPeerAS},
+			want:    true,
+		},
+		{
+			desc:    "reconnecting peer sends a hard reset",
+			running: true,
+			msg:     hardReset,
+		},
+	}
+	for _, test := range tests {
+		p := &peer{param: test.params}
+		if test.running {
+			p.restartTimer = time.NewTimer(time.Hour)
+		}
+		if got := retainAfterNotification(p, test.msg); got != test.want {
+			t.Errorf("Test (%s): got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestLLGRStaleLeastPreferred(t *testing.T) {
+	g := &grpcServer{}
+	route := func(lp uint32, comms ...uint32) routing_table.Route {
+		return routing_table.Route{Attributes: &routing_table.RouteAttributes{LocalPref: lp, Communities: comms}}
+	}
+	tests := []struct {
+		desc       string
+		curr, best routing_table.Route
+		want       bool
+	}{
+		{
+			desc: "fresh path beats a stale one with a higher local pref",
+			curr: route(100),
+			best: route(200, bgp.LLGRStale),
+			want: true,
+		},
+		{
+			desc: "stale path loses to a fresh one with a lower local pref",
+			curr: route(200, bgp.LLGRStale),
+			best: route(100),
+		},
+		{
+			desc: "two stale paths are compared as usual",
+			curr: route(200, bgp.LLGRStale),
+			best: route(100, bgp.LLGRStale),
+			want: true,
+		},
+	}
+	for _, test := range tests {
+		if got := g.isBetter(test.curr, test.best); got != test.want {
+			t.Errorf("Test (%s): got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
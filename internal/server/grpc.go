@@ -7,14 +7,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
+	"unsafe"
 
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
 	pb "github.com/mellowdrifter/bgpwatch/proto"
 	"github.com/mellowdrifter/bogons"
 	"github.com/mellowdrifter/routing_table"
@@ -110,6 +115,33 @@ func (g *grpcServer) GetSystemStats(ctx context.Context, in *pb.Empty) (*pb.Syst
 	return g.bgp.collectStats(), nil
 }
 
+func (g *grpcServer) GetNotifications(ctx context.Context, in *pb.Empty) (*pb.NotificationsResponse, error) {
+	g.bgp.mutex.RLock()
+	defer g.bgp.mutex.RUnlock()
+
+	peers := make(map[string]*pb.NotificationHistory)
+	for ip, ps := range g.bgp.peerStats {
+		if len(ps.notifications) == 0 {
+			continue
+		}
+		history := &pb.NotificationHistory{}
+		for _, n := range ps.notifications {
+			history.Notifications = append(history.Notifications, &pb.Notification{
+				Timestamp:   n.time.Unix(),
+				Sent:        n.sent,
+				Code:        uint32(n.msg.Code),
+				Subcode:     uint32(n.msg.Subcode),
+				CodeName:    n.msg.CodeName(),
+				SubcodeName: n.msg.SubcodeName(),
+				Message:     n.msg.Message(),
+				Data:        n.msg.Data,
+			})
+		}
+		peers[g.bgp.peerLabel(ip)] = history
+	}
+	return &pb.NotificationsResponse{Peers: peers}, nil
+}
+
 func (s *Server) collectStats() *pb.SystemStatsResponse {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -119,7 +151,7 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 	copy(peers, s.peers)
 	s.mutex.RUnlock()
 
-	var totalPeerRam uint64
+	var totalPeerRam, totalPreRam uint64
 	peerStats := make(map[string]*pb.PeerStats)
 	for _, p := range peers {
 		var pmem routing_table.MemoryStats
@@ -136,10 +168,30 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 			pathCount = uint64(p.v6rib.PathCount())
 		}
 
+		var invalids uint64
+		if s.vrps != nil {
+			invalids = uint64(len(p.invalidRoutes()))
+		}
+
 		peerRam := pmem.RoutingTablesEffective + pmem.RoutingTablesOverhead +
 			pmem.RouteAttributesEffective + pmem.RouteAttributesOverhead
 		totalPeerRam += peerRam
 
+		// A dual-stack peer keeps both families as received
+		var preRam, prePathCount uint64
+		p.mutex.RLock()
+		v4pre, v6pre := p.v4pre, p.v6pre
+		p.mutex.RUnlock()
+		if v4pre != nil {
+			preRam += ribRam(v4pre.MemoryUsage())
+			prePathCount += uint64(v4pre.PathCount())
+		}
+		if v6pre != nil {
+			preRam += ribRam(v6pre.MemoryUsage())
+			prePathCount += uint64(v6pre.PathCount())
+		}
+		totalPreRam += preRam
+
 		p.mutex.RLock()
 		var duration uint64
 		if !p.establishedTime.IsZero() {
@@ -164,6 +216,14 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 			State:                      PeerStatus(p.status.Load()).String(),
 			PrefixCount:                pfxCount,
 			PathCount:                  pathCount,
+			SessionState:               SessionState(p.state.Load()).String(),
+			HoldTime:                   uint32(p.holdtime),
+			RpkiInvalids:               invalids,
+			PrePolicyRibRamBytes:       preRam,
+			PrePolicyPathCount:         prePathCount,
+		}
+		if role, ok := s.localRole(p.ip); ok {
+			stats.Role = role.String()
 		}
 
 		// Add persistent stats
@@ -171,6 +231,16 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 		if ps, ok := s.peerStats[p.ip]; ok {
 			stats.Flaps = ps.flaps
 			stats.LastNotification = ps.lastNotification
+			stats.AttributeDiscards = ps.attrDiscards
+			stats.TreatAsWithdraws = ps.treatAsWithdraws
+			stats.AfiSafiDisables = ps.afiSafiDisables
+			stats.UpdateSessionResets = ps.sessionResets
+			stats.RouteLeaks = ps.routeLeaks
+			stats.MaxPrefixWarnings = ps.maxPrefixWarnings
+			stats.MaxPrefixBreaches = ps.maxPrefixBreaches
+			stats.MaxPrefixDropped = ps.maxPrefixDropped
+			stats.TtlSecurityDrops = ps.ttlSecurityDrops
+			stats.PolicyRejects = ps.policyRejects
 		}
 		s.mutex.RUnlock()
 
@@ -180,6 +250,13 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 
 	ps := s.sampler.Get()
 
+	// The Loc-RIB is chosen from the post-policy RIBs when queried, so all it keeps is the
+	// count of peers with each prefix. The RIB library can't measure that, so it's estimated
+	// from the size of each entry, leaving out the overhead of the maps.
+	s.globalMasksMu.RLock()
+	locRibRam := uint64(len(s.v4PrefixRefs)+len(s.v6PrefixRefs)) * uint64(unsafe.Sizeof(netip.Prefix{})+unsafe.Sizeof(uint16(0)))
+	s.globalMasksMu.RUnlock()
+
 	return &pb.SystemStatsResponse{
 		TotalAppRamBytes:     m.Sys,
 		HeapAllocBytes:       m.HeapAlloc,
@@ -192,9 +269,18 @@ func (s *Server) collectStats() *pb.SystemStatsResponse {
 		PeerStats:            peerStats,
 		PssBytes:             uint64(ps.PSSBytes),
 		RssBytes:             uint64(ps.RSSBytes),
+
+		TotalPrePolicyRibRamBytes: totalPreRam,
+		LocRibEstimatedRamBytes:   locRibRam,
 	}
 }
 
+// ribRam returns the memory a RIB uses for its routes and their attributes.
+func ribRam(m routing_table.MemoryStats) uint64 {
+	return m.RoutingTablesEffective + m.RoutingTablesOverhead +
+		m.RouteAttributesEffective + m.RouteAttributesOverhead
+}
+
 // GetRoute looks up a route by IP address (LPM) or CIDR prefix (exact match).
 func (g *grpcServer) GetRoute(ctx context.Context, in *pb.RouteRequest) (*pb.RouteLookupResponse, error) {
 	if err := g.checkReady(); err != nil {
@@ -205,20 +291,25 @@ func (g *grpcServer) GetRoute(ctx context.Context, in *pb.RouteRequest) (*pb.Rou
 	if addr == "" {
 		return nil, status.Error(codes.InvalidArgument, "address is required")
 	}
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
+	}
 
 	peers := g.snapshotPeers()
 	var candidates []routing_table.Route
-	var peerIPs []string
+	var owners []*peer
 	var staleTimes []time.Time
 
 	for _, p := range peers {
-		r, err := g.performLookup(p, addr)
+		v4, v6 := p.viewRibs(view)
+		r, err := g.performLookup(v4, v6, addr)
 		if err != nil {
 			continue
 		}
 		if r != nil {
 			candidates = append(candidates, *r)
-			peerIPs = append(peerIPs, anonymizePeer(p.ip))
+			owners = append(owners, p)
 			p.mutex.RLock()
 			staleTimes = append(staleTimes, p.staleSince)
 			p.mutex.RUnlock()
@@ -239,28 +330,88 @@ func (g *grpcServer) GetRoute(ctx context.Context, in *pb.RouteRequest) (*pb.Rou
 
 	return &pb.RouteLookupResponse{
 		Found: true,
-		Route: formatRouteResponse(&candidates[bestIdx], peerIPs[bestIdx], staleTimes[bestIdx]),
+		Route: g.bgp.formatRouteResponse(&candidates[bestIdx], owners[bestIdx], staleTimes[bestIdx]),
 	}, nil
 }
 
-func formatRouteResponse(r *routing_table.Route, peerIP string, staleSince time.Time) *pb.Route {
+func (s *Server) formatRouteResponse(r *routing_table.Route, p *peer, staleSince time.Time) *pb.Route {
 	if r == nil {
 		return nil
 	}
-	var staleSeconds uint64
+	var staleSeconds, llgrStaleSeconds uint64
 	if r.Stale && !staleSince.IsZero() {
-		staleSeconds = uint64(time.Since(staleSince).Seconds())
+		// Routes kept past the restart time carry LLGR_STALE, and staleSince is when that began
+		if slices.Contains(r.Attributes.Communities, bgp.LLGRStale) {
+			llgrStaleSeconds = uint64(time.Since(staleSince).Seconds())
+		} else {
+			staleSeconds = uint64(time.Since(staleSince).Seconds())
+		}
 	}
 	return &pb.Route{
-		Prefix:           r.Prefix.String(),
-		PeerIp:           peerIP,
-		AsPath:           r.Attributes.AsPath,
-		LocalPref:        r.Attributes.LocalPref,
-		Communities:      formatRouteCommunities(r.Attributes.Communities),
-		LargeCommunities: formatRouteLargeCommunities(r.Attributes.LargeCommunities),
-		PathId:           r.PathID,
-		StaleSeconds:     staleSeconds,
+		Prefix:              r.Prefix.String(),
+		PeerIp:              anonymizePeer(p.ip),
+		AsPath:              r.Attributes.AsPath,
+		LocalPref:           r.Attributes.LocalPref,
+		Communities:         formatRouteCommunities(r.Attributes.Communities),
+		LargeCommunities:    formatRouteLargeCommunities(r.Attributes.LargeCommunities),
+		PathId:              r.PathID,
+		StaleSeconds:        staleSeconds,
+		Origin:              bgp.Origin(r.Attributes.Origin).String(),
+		Med:                 r.Attributes.Med,
+		NextHop:             formatAddr(r.Attributes.NextHop),
+		LinkLocalNextHop:    formatAddr(r.Attributes.LinkLocalNextHop),
+		AtomicAggregate:     r.Attributes.AtomicAggregate,
+		AggregatorAs:        r.Attributes.AggregatorAS,
+		AggregatorAddress:   formatAddr(r.Attributes.AggregatorAddr),
+		OriginatorId:        formatAddr(r.Attributes.OriginatorID),
+		ClusterList:         formatAddrs(r.Attributes.ClusterList),
+		AsPathSegments:      formatAsPathSegments(r.Attributes.AsPathSegments),
+		ExtendedCommunities: formatExtendedCommunities(r.Attributes.ExtendedCommunities),
+		LlgrStaleSeconds:    llgrStaleSeconds,
+		Otc:                 r.Attributes.OnlyToCustomer,
+		ValidationState:     s.validationState(p, r),
+		AspaState:           s.aspaState(p, r),
+	}
+}
+
+// formatAddr returns an empty string rather than "invalid IP" for an unset address.
+func formatAddr(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
 	}
+	return ip.String()
+}
+
+func formatAddrs(ips []netip.Addr) []string {
+	if len(ips) == 0 {
+		return nil
+	}
+	result := make([]string, len(ips))
+	for i, ip := range ips {
+		result[i] = formatAddr(ip)
+	}
+	return result
+}
+
+var asPathSegmentTypes = map[uint8]string{
+	1: "AS_SET",
+	2: "AS_SEQUENCE",
+	3: "AS_CONFED_SEQUENCE",
+	4: "AS_CONFED_SET",
+}
+
+func formatAsPathSegments(segs []routing_table.AsPathSegment) []*pb.AsPathSegment {
+	if len(segs) == 0 {
+		return nil
+	}
+	result := make([]*pb.AsPathSegment, len(segs))
+	for i, seg := range segs {
+		result[i] = &pb.AsPathSegment{
+			Type: asPathSegmentTypes[seg.Type],
+			Asns: seg.ASNs,
+		}
+	}
+	return result
 }
 
 // GetRoutes looks up a route across all peers.
@@ -273,29 +424,25 @@ func (g *grpcServer) GetRoutes(ctx context.Context, in *pb.RouteRequest) (*pb.Ro
 	if addr == "" {
 		return nil, status.Error(codes.InvalidArgument, "address is required")
 	}
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
 
-	peers := g.snapshotPeers()
-
-	var results []*pb.Route
-	for _, p := range peers {
-		routes, err := g.performMultiLookup(p, addr)
+	c := g.newCollector(view)
+	for _, p := range g.snapshotPeers() {
+		v4, v6 := p.viewRibs(view)
+		routes, err := g.performMultiLookup(v4, v6, addr)
 		if err != nil {
 			continue
 		}
-
-		p.mutex.RLock()
-		stSince := p.staleSince
-		p.mutex.RUnlock()
-
-		for _, r := range routes {
-			results = append(results, formatRouteResponse(&r, anonymizePeer(p.ip), stSince))
-		}
+		c.add(p, routes)
 	}
 
-	return &pb.RoutesResponse{Routes: results}, nil
+	return &pb.RoutesResponse{Routes: c.result()}, nil
 }
 
-func (g *grpcServer) performLookup(p *peer, addr string) (*routing_table.Route, error) {
+func (g *grpcServer) performLookup(v4, v6 queryRib, addr string) (*routing_table.Route, error) {
 	if strings.Contains(addr, "/") {
 		prefix, err := netip.ParsePrefix(addr)
 		if err != nil {
@@ -308,11 +455,11 @@ func (g *grpcServer) performLookup(p *peer, addr string) (*routing_table.Route,
 			return nil, status.Errorf(codes.InvalidArgument, "%s is a bogon prefix", addr)
 		}
 
-		if ip.Is4() && p.v4rib != nil {
-			return p.v4rib.Lookup(prefix), nil
+		if ip.Is4() && v4 != nil {
+			return v4.Lookup(prefix), nil
 		}
-		if ip.Is6() && p.v6rib != nil {
-			return p.v6rib.Lookup(prefix), nil
+		if ip.Is6() && v6 != nil {
+			return v6.Lookup(prefix), nil
 		}
 		return nil, nil
 	}
@@ -326,16 +473,16 @@ func (g *grpcServer) performLookup(p *peer, addr string) (*routing_table.Route,
 		return nil, status.Errorf(codes.InvalidArgument, "%s is a bogon address", addr)
 	}
 
-	if ip.Is4() && p.v4rib != nil {
-		return p.v4rib.Search(ip), nil
+	if ip.Is4() && v4 != nil {
+		return v4.Search(ip), nil
 	}
-	if ip.Is6() && p.v6rib != nil {
-		return p.v6rib.Search(ip), nil
+	if ip.Is6() && v6 != nil {
+		return v6.Search(ip), nil
 	}
 	return nil, nil
 }
 
-func (g *grpcServer) performMultiLookup(p *peer, addr string) ([]routing_table.Route, error) {
+func (g *grpcServer) performMultiLookup(v4, v6 queryRib, addr string) ([]routing_table.Route, error) {
 	if strings.Contains(addr, "/") {
 		prefix, err := netip.ParsePrefix(addr)
 		if err != nil {
@@ -348,11 +495,11 @@ func (g *grpcServer) performMultiLookup(p *peer, addr string) ([]routing_table.R
 			return nil, status.Errorf(codes.InvalidArgument, "%s is a bogon prefix", addr)
 		}
 
-		if ip.Is4() && p.v4rib != nil {
-			return p.v4rib.AllPaths(prefix), nil
+		if ip.Is4() && v4 != nil {
+			return v4.AllPaths(prefix), nil
 		}
-		if ip.Is6() && p.v6rib != nil {
-			return p.v6rib.AllPaths(prefix), nil
+		if ip.Is6() && v6 != nil {
+			return v6.AllPaths(prefix), nil
 		}
 		return nil, nil
 	}
@@ -366,11 +513,11 @@ func (g *grpcServer) performMultiLookup(p *peer, addr string) ([]routing_table.R
 		return nil, status.Errorf(codes.InvalidArgument, "%s is a bogon address", addr)
 	}
 
-	if ip.Is4() && p.v4rib != nil {
-		return p.v4rib.AllPathsSearch(ip), nil
+	if ip.Is4() && v4 != nil {
+		return v4.AllPathsSearch(ip), nil
 	}
-	if ip.Is6() && p.v6rib != nil {
-		return p.v6rib.AllPathsSearch(ip), nil
+	if ip.Is6() && v6 != nil {
+		return v6.AllPathsSearch(ip), nil
 	}
 	return nil, nil
 }
@@ -389,6 +536,35 @@ func formatRouteCommunities(communities []uint32) []*pb.Community {
 	return result
 }
 
+func formatExtendedCommunities(ecs []routing_table.ExtendedCommunity) []*pb.ExtendedCommunity {
+	if len(ecs) == 0 {
+		return nil
+	}
+	result := make([]*pb.ExtendedCommunity, len(ecs))
+	for i, rec := range ecs {
+		ec := bgp.ExtendCommunity{
+			IPv6:    rec.IPv6,
+			Type:    rec.Type,
+			Subtype: rec.Subtype,
+			Value:   rec.Value[:6],
+		}
+		if rec.IPv6 {
+			ec.Value = rec.Value[:]
+		}
+		result[i] = &pb.ExtendedCommunity{
+			Type:        uint32(ec.Type),
+			Subtype:     uint32(ec.Subtype),
+			Ipv6:        ec.IPv6,
+			Kind:        ec.Kind(),
+			GlobalAdmin: ec.GlobalAdmin(),
+			LocalAdmin:  ec.LocalAdmin(),
+			Bandwidth:   ec.Bandwidth(),
+			Value:       ec.String(),
+		}
+	}
+	return result
+}
+
 func formatRouteLargeCommunities(lc []routing_table.LargeCommunity) []*pb.LargeCommunity {
 	if len(lc) == 0 {
 		return nil
@@ -418,25 +594,25 @@ func (g *grpcServer) GetPrefixesByOrigin(ctx context.Context, in *pb.OriginReque
 		return nil, status.Errorf(codes.InvalidArgument, "AS%d is not a valid public ASN", asn)
 	}
 
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
+
 	peers := g.snapshotPeers()
 	seen := make(map[netip.Prefix]struct{})
 	var results []*pb.Prefix
 
 	for _, p := range peers {
-		var v4, v6 []routing_table.Route
-		if p.v4rib != nil {
-			v4 = p.v4rib.PrefixesByOriginASN(asn)
-		}
-		if p.v6rib != nil {
-			v6 = p.v6rib.PrefixesByOriginASN(asn)
+		var all []routing_table.Route
+		v4rib, v6rib := p.viewRibs(view)
+		if v4rib != nil {
+			all = v4rib.PrefixesByOriginASN(asn)
 		}
-		for _, r := range v4 {
-			if _, ok := seen[r.Prefix]; !ok {
-				seen[r.Prefix] = struct{}{}
-				results = append(results, &pb.Prefix{Prefix: r.Prefix.String()})
-			}
+		if v6rib != nil {
+			all = append(all, v6rib.PrefixesByOriginASN(asn)...)
 		}
-		for _, r := range v6 {
+		for _, r := range all {
 			if _, ok := seen[r.Prefix]; !ok {
 				seen[r.Prefix] = struct{}{}
 				results = append(results, &pb.Prefix{Prefix: r.Prefix.String()})
@@ -463,40 +639,15 @@ func (g *grpcServer) GetRoutesByOrigin(ctx context.Context, in *pb.OriginRequest
 		return nil, status.Errorf(codes.InvalidArgument, "AS%d is not a valid public ASN", asn)
 	}
 
-	peers := g.snapshotPeers()
-	type candidate struct {
-		route      routing_table.Route
-		peerIP     string
-		staleSince time.Time
-	}
-	prefixToBest := make(map[netip.Prefix]candidate)
-
-	for _, p := range peers {
-		var all []routing_table.Route
-		if p.v4rib != nil {
-			all = p.v4rib.PrefixesByOriginASN(asn)
-		}
-		if p.v6rib != nil {
-			all = append(all, p.v6rib.PrefixesByOriginASN(asn)...)
-		}
-		p.mutex.RLock()
-		stSince := p.staleSince
-		p.mutex.RUnlock()
-		for _, r := range all {
-			existing, ok := prefixToBest[r.Prefix]
-			if !ok || g.isBetter(r, existing.route) {
-				prefixToBest[r.Prefix] = candidate{route: r, peerIP: anonymizePeer(p.ip), staleSince: stSince}
-			}
-		}
-	}
-
-	results := make([]*pb.Route, 0, len(prefixToBest))
-	for _, c := range prefixToBest {
-		results = append(results, formatRouteResponse(&c.route, c.peerIP, c.staleSince))
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
 	}
 
 	return &pb.RoutesResponse{
-		Routes: results,
+		Routes: g.viewRoutes(view, func(rib queryRib) []routing_table.Route {
+			return rib.PrefixesByOriginASN(asn)
+		}),
 	}, nil
 }
 
@@ -516,40 +667,15 @@ func (g *grpcServer) GetPrefixesByAsPath(ctx context.Context, in *pb.AsPathReque
 		return nil, status.Errorf(codes.InvalidArgument, "invalid regex %q: %v", regexStr, err)
 	}
 
-	peers := g.snapshotPeers()
-	type candidate struct {
-		route      routing_table.Route
-		peerIP     string
-		staleSince time.Time
-	}
-	prefixToBest := make(map[netip.Prefix]candidate)
-
-	for _, p := range peers {
-		var all []routing_table.Route
-		if p.v4rib != nil {
-			all = p.v4rib.PrefixesByAsPathRegex(re)
-		}
-		if p.v6rib != nil {
-			all = append(all, p.v6rib.PrefixesByAsPathRegex(re)...)
-		}
-		p.mutex.RLock()
-		stSince := p.staleSince
-		p.mutex.RUnlock()
-		for _, r := range all {
-			existing, ok := prefixToBest[r.Prefix]
-			if !ok || g.isBetter(r, existing.route) {
-				prefixToBest[r.Prefix] = candidate{route: r, peerIP: anonymizePeer(p.ip), staleSince: stSince}
-			}
-		}
-	}
-
-	results := make([]*pb.Route, 0, len(prefixToBest))
-	for _, c := range prefixToBest {
-		results = append(results, formatRouteResponse(&c.route, c.peerIP, c.staleSince))
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
 	}
 
 	return &pb.RoutesResponse{
-		Routes: results,
+		Routes: g.viewRoutes(view, func(rib queryRib) []routing_table.Route {
+			return rib.PrefixesByAsPathRegex(re)
+		}),
 	}, nil
 }
 func (g *grpcServer) GetPrefixesByCommunity(ctx context.Context, in *pb.CommunityRequest) (*pb.RoutesResponse, error) {
@@ -562,40 +688,15 @@ func (g *grpcServer) GetPrefixesByCommunity(ctx context.Context, in *pb.Communit
 		return nil, status.Error(codes.InvalidArgument, "community is required")
 	}
 
-	peers := g.snapshotPeers()
-	type candidate struct {
-		route      routing_table.Route
-		peerIP     string
-		staleSince time.Time
-	}
-	prefixToBest := make(map[netip.Prefix]candidate)
-
-	for _, p := range peers {
-		var all []routing_table.Route
-		if p.v4rib != nil {
-			all = p.v4rib.PrefixesByCommunity(comm)
-		}
-		if p.v6rib != nil {
-			all = append(all, p.v6rib.PrefixesByCommunity(comm)...)
-		}
-		p.mutex.RLock()
-		stSince := p.staleSince
-		p.mutex.RUnlock()
-		for _, r := range all {
-			existing, ok := prefixToBest[r.Prefix]
-			if !ok || g.isBetter(r, existing.route) {
-				prefixToBest[r.Prefix] = candidate{route: r, peerIP: anonymizePeer(p.ip), staleSince: stSince}
-			}
-		}
-	}
-
-	results := make([]*pb.Route, 0, len(prefixToBest))
-	for _, c := range prefixToBest {
-		results = append(results, formatRouteResponse(&c.route, c.peerIP, c.staleSince))
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
 	}
 
 	return &pb.RoutesResponse{
-		Routes: results,
+		Routes: g.viewRoutes(view, func(rib queryRib) []routing_table.Route {
+			return rib.PrefixesByCommunity(comm)
+		}),
 	}, nil
 }
 
@@ -614,44 +715,224 @@ func (g *grpcServer) GetPrefixesByLargeCommunity(ctx context.Context, in *pb.Lar
 		LocalData2:  pbLc.LocalData2,
 	}
 
-	peers := g.snapshotPeers()
-	type candidate struct {
-		route      routing_table.Route
-		peerIP     string
-		staleSince time.Time
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
 	}
-	prefixToBest := make(map[netip.Prefix]candidate)
 
-	for _, p := range peers {
-		var all []routing_table.Route
-		if p.v4rib != nil {
-			all = p.v4rib.PrefixesByLargeCommunity(lc)
+	return &pb.RoutesResponse{
+		Routes: g.viewRoutes(view, func(rib queryRib) []routing_table.Route {
+			return rib.PrefixesByLargeCommunity(lc)
+		}),
+	}, nil
+}
+
+func (g *grpcServer) GetPrefixesByExtendedCommunity(ctx context.Context, in *pb.ExtendedCommunityRequest) (*pb.RoutesResponse, error) {
+	if err := g.checkReady(); err != nil {
+		return nil, err
+	}
+
+	if in.GetCommunity() == "" {
+		return nil, status.Error(codes.InvalidArgument, "extended community is required")
+	}
+	ec, err := bgp.ParseExtendedCommunity(in.GetCommunity())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	rec := toRIBExtendedCommunity(ec)
+
+	view, err := parseView(in.GetView(), viewLocRIB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RoutesResponse{
+		Routes: g.viewRoutes(view, func(rib queryRib) []routing_table.Route {
+			return rib.PrefixesByExtendedCommunity(rec)
+		}),
+	}, nil
+}
+
+func (g *grpcServer) RefreshPeer(ctx context.Context, in *pb.RefreshPeerRequest) (*pb.Empty, error) {
+	if in.GetPeer() == "" {
+		return nil, status.Error(codes.InvalidArgument, "peer is required")
+	}
+	if in.GetAfi() > math.MaxUint16 || in.GetSafi() > math.MaxUint8 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid AFI %d SAFI %d", in.GetAfi(), in.GetSafi())
+	}
+
+	for _, p := range g.snapshotPeers() {
+		if g.bgp.getPeerName(p) != in.GetPeer() && g.bgp.peerLabel(p.ip) != in.GetPeer() {
+			continue
 		}
-		if p.v6rib != nil {
-			all = append(all, p.v6rib.PrefixesByLargeCommunity(lc)...)
+		if err := p.requestRefresh(uint16(in.GetAfi()), uint8(in.GetSafi())); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "unable to refresh %s: %v", in.GetPeer(), err)
+		}
+		return &pb.Empty{}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "peer %s not found", in.GetPeer())
+}
+
+func (g *grpcServer) GetLeakedRoutes(ctx context.Context, in *pb.ViewRequest) (*pb.RoutesResponse, error) {
+	if err := g.checkReady(); err != nil {
+		return nil, err
+	}
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
+
+	c := g.newCollector(view)
+	for _, p := range g.snapshotPeers() {
+		role, ok := g.bgp.localRole(p.ip)
+		if !ok {
+			continue
 		}
 		p.mutex.RLock()
-		stSince := p.staleSince
+		asn := p.peerAsn
 		p.mutex.RUnlock()
-		for _, r := range all {
-			existing, ok := prefixToBest[r.Prefix]
-			if !ok || g.isBetter(r, existing.route) {
-				prefixToBest[r.Prefix] = candidate{route: r, peerIP: anonymizePeer(p.ip), staleSince: stSince}
+
+		v4, v6 := p.viewRibs(view)
+		c.add(p, filterPaths(v4, v6, func(r *routing_table.Route) bool {
+			return bgp.IsRouteLeak(role, asn, r.Attributes.OnlyToCustomer)
+		}))
+	}
+
+	return &pb.RoutesResponse{
+		Routes: c.result(),
+	}, nil
+}
+
+// GetRoutesByValidationState returns every path in the given origin validation state. Invalid
+// paths after the import policy are tracked per peer, the others are found by validating every
+// path.
+func (g *grpcServer) GetRoutesByValidationState(ctx context.Context, in *pb.ValidationStateRequest) (*pb.RoutesResponse, error) {
+	if g.bgp.vrps == nil {
+		return nil, status.Error(codes.FailedPrecondition, "RPKI is not configured")
+	}
+	state, err := rpki.ParseState(in.GetState())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkReady(); err != nil {
+		return nil, err
+	}
+
+	c := g.newCollector(view)
+	for _, p := range g.snapshotPeers() {
+		if state == rpki.Invalid && view != viewPre {
+			c.add(p, p.invalidRoutes())
+			continue
+		}
+		v4, v6 := p.viewRibs(view)
+		c.add(p, filterPaths(v4, v6, func(r *routing_table.Route) bool {
+			return g.bgp.validate(p, r) == state
+		}))
+	}
+
+	return &pb.RoutesResponse{
+		Routes: c.result(),
+	}, nil
+}
+
+// GetInvalidPrefixes returns the prefixes with an RPKI invalid path, only those originated by
+// the ASN in the request if one is given.
+func (g *grpcServer) GetInvalidPrefixes(ctx context.Context, in *pb.OriginRequest) (*pb.PrefixesResponse, error) {
+	if g.bgp.vrps == nil {
+		return nil, status.Error(codes.FailedPrecondition, "RPKI is not configured")
+	}
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkReady(); err != nil {
+		return nil, err
+	}
+
+	asn := in.GetAsn()
+	seen := make(map[netip.Prefix]struct{})
+	var results []*pb.Prefix
+	for _, p := range g.snapshotPeers() {
+		var invalid []routing_table.Route
+		if view == viewPre {
+			v4, v6 := p.viewRibs(view)
+			invalid = filterPaths(v4, v6, func(r *routing_table.Route) bool {
+				return g.bgp.validate(p, r) == rpki.Invalid
+			})
+		} else {
+			invalid = p.invalidRoutes()
+		}
+		for _, r := range invalid {
+			if asn != 0 && g.bgp.originAS(p, r.Attributes) != asn {
+				continue
+			}
+			if _, ok := seen[r.Prefix]; !ok {
+				seen[r.Prefix] = struct{}{}
+				results = append(results, &pb.Prefix{Prefix: r.Prefix.String()})
 			}
 		}
 	}
 
-	results := make([]*pb.Route, 0, len(prefixToBest))
-	for _, c := range prefixToBest {
-		results = append(results, formatRouteResponse(&c.route, c.peerIP, c.staleSince))
+	return &pb.PrefixesResponse{
+		Prefixes: results,
+	}, nil
+}
+
+// GetASPAInvalidRoutes returns every path that fails ASPA verification, verifying every path
+// against the ASPAs loaded now.
+func (g *grpcServer) GetASPAInvalidRoutes(ctx context.Context, in *pb.ViewRequest) (*pb.RoutesResponse, error) {
+	if g.bgp.aspas == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no VRP file is configured to load ASPAs from")
+	}
+	view, err := parseView(in.GetView(), viewPost)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkReady(); err != nil {
+		return nil, err
+	}
+
+	c := g.newCollector(view)
+	for _, p := range g.snapshotPeers() {
+		n := g.bgp.aspaNeighbor(p)
+		v4, v6 := p.viewRibs(view)
+		c.add(p, filterPaths(v4, v6, func(r *routing_table.Route) bool {
+			return g.bgp.verifyPath(n, r.Attributes) == rpki.ASPAInvalid
+		}))
 	}
 
 	return &pb.RoutesResponse{
-		Routes: results,
+		Routes: c.result(),
+	}, nil
+}
+
+func (g *grpcServer) ReloadConfig(ctx context.Context, in *pb.Empty) (*pb.ReloadConfigResponse, error) {
+	if g.bgp.Conf.ConfigFile == "" {
+		return nil, status.Error(codes.FailedPrecondition, "bgpwatch was not started with a config file")
+	}
+	res, err := g.bgp.ReloadConfig()
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to reload config: %v", err)
+	}
+	return &pb.ReloadConfigResponse{
+		Added:   res.Added,
+		Removed: res.Removed,
+		Changed: res.Changed,
 	}, nil
 }
 
 func (g *grpcServer) isBetter(curr, best routing_table.Route) bool {
+	// A long-lived stale path is the least preferred (RFC 9494 section 4.6)
+	currStale := slices.Contains(curr.Attributes.Communities, bgp.LLGRStale)
+	bestStale := slices.Contains(best.Attributes.Communities, bgp.LLGRStale)
+	if currStale != bestStale {
+		return bestStale
+	}
+
 	lp1 := curr.Attributes.LocalPref
 	if lp1 == 0 {
 		lp1 = 100
@@ -681,13 +962,17 @@ func anonymizePeer(ip string) string {
 	return "peer-" + hex.EncodeToString(hash[:4])
 }
 
-func (s *Server) getPeerName(p *peer) string {
-	name := anonymizePeer(p.ip)
-
+// peerLabel names a peer by its address alone, for peers that may no longer be connected.
+func (s *Server) peerLabel(ip string) string {
 	// Check config for an override name
-	if cfg, ok := s.Conf.PeersConfig[p.ip]; ok && cfg.Name != "" {
-		name = cfg.Name
+	if cfg, ok := s.peerConfig(ip); ok && cfg.Name != "" {
+		return cfg.Name
 	}
+	return anonymizePeer(ip)
+}
+
+func (s *Server) getPeerName(p *peer) string {
+	name := s.peerLabel(p.ip)
 
 	// Handle multiple sessions from the same name by appending address family if separate
 	if p.v4rib != nil && p.v6rib == nil {
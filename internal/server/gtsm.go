@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxTTL is the TTL GTSM peers send with (RFC 5082 section 3).
+const maxTTL = 255
+
+// errTTLTooLow is returned for a connection from a GTSM peer that arrived from further away
+// than it is configured to be.
+var errTTLTooLow = errors.New("TTL below the GTSM minimum")
+
+// minTTL returns the lowest TTL accepted from the peer, or 0 if GTSM is not enabled.
+func (pc PeerConfig) minTTL() int {
+	if pc.TTLSecurity == 0 {
+		return 0
+	}
+	return maxTTL + 1 - pc.TTLSecurity
+}
+
+// checkTTL compares the TTL or hop limit a connection arrived with against the peer's minimum.
+func (pc PeerConfig) checkTTL(ttl int) error {
+	if ttl < pc.minTTL() {
+		return fmt.Errorf("%w: got %d, want at least %d", errTTLTooLow, ttl, pc.minTTL())
+	}
+	return nil
+}
+
+// recordTTLDrop counts a connection from ip refused by GTSM.
+func (s *Server) recordTTLDrop(ip string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peerStats[ip]; !ok {
+		s.peerStats[ip] = &persistentPeerStats{}
+	}
+	s.peerStats[ip].ttlSecurityDrops++
+}
+
+// ttlSecurity reports whether any peer or listen range uses GTSM, which is when the listener
+// needs to save SYNs and send its SYN-ACKs with the maximum TTL.
+func (t *peerTable) ttlSecurity() bool {
+	for _, pc := range t.peers {
+		if pc.TTLSecurity > 0 {
+			return true
+		}
+	}
+	for _, r := range t.ranges {
+		if r.Template.TTLSecurity > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTTL(t *testing.T) {
+	tests := []struct {
+		desc string
+		hops int
+		ttl  int
+		want error
+	}{
+		{desc: "disabled", ttl: 1},
+		{desc: "directly connected", hops: 1, ttl: 255},
+		{desc: "one hop too far", hops: 1, ttl: 254, want: errTTLTooLow},
+		{desc: "within hops", hops: 3, ttl: 253},
+		{desc: "beyond hops", hops: 3, ttl: 252, want: errTTLTooLow},
+		{desc: "default TTL", hops: 1, ttl: 64, want: errTTLTooLow},
+	}
+	for _, test := range tests {
+		pc := PeerConfig{TTLSecurity: test.hops}
+		if got := pc.checkTTL(test.ttl); !errors.Is(got, test.want) {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestTTLSecurityConfigured(t *testing.T) {
+	tests := []struct {
+		desc  string
+		table peerTable
+		want  bool
+	}{
+		{desc: "no peers"},
+		{desc: "no GTSM", table: peerTable{peers: map[string]PeerConfig{"192.0.2.1": {}}}},
+		{desc: "GTSM peer", table: peerTable{peers: map[string]PeerConfig{"192.0.2.1": {}, "192.0.2.2": {TTLSecurity: 1}}}, want: true},
+		{desc: "GTSM listen range", table: peerTable{ranges: []ListenRange{{Template: PeerConfig{TTLSecurity: 2}}}}, want: true},
+	}
+	for _, test := range tests {
+		if got := test.table.ttlSecurity(); got != test.want {
+			t.Errorf("Test (%s): got %t, want %t", test.desc, got, test.want)
+		}
+	}
+}
@@ -13,11 +13,11 @@ import (
 // IngestBenchmark runs a full-table ingestion benchmark.
 // It returns stats about the run.
 type BenchStats struct {
-	Duration         time.Duration
-	GCCycles         uint32
-	TotalAlloc       uint64
-	HeapObjs         uint64
-	SteadyStateHeap  uint64
+	Duration        time.Duration
+	GCCycles        uint32
+	TotalAlloc      uint64
+	HeapObjs        uint64
+	SteadyStateHeap uint64
 }
 
 func RunIngestBenchmark(prefixCount int, useAddPath bool) (BenchStats, error) {
@@ -29,7 +29,7 @@ func RunIngestBenchmark(prefixCount int, useAddPath bool) (BenchStats, error) {
 		Quiet: true,
 	}
 	srv := New(conf)
-	
+
 	c1, c2 := net.Pipe()
 	defer c1.Close()
 	defer c2.Close()
@@ -40,6 +40,7 @@ func RunIngestBenchmark(prefixCount int, useAddPath bool) (BenchStats, error) {
 		ip:     "127.0.0.1",
 		quiet:  true,
 	}
+	p.state.Store(uint32(StateEstablished))
 	if useAddPath {
 		p.param.AddPath = []bgp.AddPathCapability{
 			{AFI: 1, SAFI: 1, SendReceive: 3},
@@ -57,7 +58,7 @@ func RunIngestBenchmark(prefixCount int, useAddPath bool) (BenchStats, error) {
 	// Pack 100 prefixes per message to be more realistic
 	packCount := 100
 	updateMsg := generateMockUpdate(useAddPath, packCount)
-	
+
 	// 4. Record baseline stats
 	runtime.GC()
 	var m1, m2 runtime.MemStats
@@ -7,15 +7,16 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"time"
 )
 
 func (s *Server) listen(c Config) {
-	if c.PeersConfig != nil {
-		for _, peerConf := range c.PeersConfig {
-			if peerConf.Password != "" {
-				log.Printf("Warning: TCP MD5 authentication for peer %s is not supported on this OS", peerConf.IP)
-			}
-		}
+	for _, k := range s.peerConf.Load().md5Keys() {
+		log.Printf("Warning: TCP MD5 authentication for %s is not supported on this OS", k.prefix)
+	}
+	for _, k := range s.peerConf.Load().aoKeys() {
+		log.Printf("Warning: TCP-AO authentication for %s is not supported on this OS", k.prefix)
 	}
 
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
@@ -25,3 +26,66 @@ func (s *Server) listen(c Config) {
 	s.listener = l
 	log.Printf("Listening on port %d (No MD5 support)\n", c.Port)
 }
+
+// updateMD5 only warns about keys added by a reload, as they cannot be installed.
+func (s *Server) updateMD5(from, to []md5Key) error {
+	have := make(map[netip.Prefix]bool)
+	for _, k := range from {
+		have[k.prefix] = true
+	}
+	for _, k := range to {
+		if !have[k.prefix] {
+			log.Printf("Warning: TCP MD5 authentication for %s is not supported on this OS", k.prefix)
+		}
+	}
+	return nil
+}
+
+// updateTCPAO only warns about keys added by a reload, as they cannot be installed.
+func (s *Server) updateTCPAO(from, to []aoKey) error {
+	added, _ := diffAOKeys(from, to)
+	for _, k := range added {
+		log.Printf("Warning: TCP-AO authentication for %s is not supported on this OS", k.prefix)
+	}
+	return nil
+}
+
+// updateConnTCPAO does nothing, as no session can be using TCP-AO on this OS.
+func updateConnTCPAO(conn net.Conn, from, to []aoKey, current TCPAOKey) error {
+	return nil
+}
+
+// setTCPAOCurrent does nothing, as no session can be using TCP-AO on this OS.
+func setTCPAOCurrent(conn net.Conn, k TCPAOKey) error {
+	return nil
+}
+
+// dialPeer opens an outbound connection to a peer configured in active mode.
+func (s *Server) dialPeer(pc PeerConfig, addr string, timeout time.Duration) (net.Conn, error) {
+	if pc.Password != "" {
+		log.Printf("Warning: TCP MD5 authentication for peer %s is not supported on this OS", pc.IP)
+	}
+	if len(pc.TCPAO) > 0 {
+		log.Printf("Warning: TCP-AO authentication for peer %s is not supported on this OS", pc.IP)
+	}
+	if pc.TTLSecurity > 0 {
+		log.Printf("Warning: TTL security for peer %s is not supported on this OS", pc.IP)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// setTTLSecurity only warns, as GTSM is not supported on this OS.
+func setTTLSecurity(conn net.Conn, pc PeerConfig) error {
+	log.Printf("Warning: TTL security for peer %s is not supported on this OS", pc.IP)
+	return nil
+}
+
+// clearTTLSecurity does nothing, as the listener is never prepared for GTSM on this OS.
+func clearTTLSecurity(conn net.Conn) error {
+	return nil
+}
+
+// updateTTLSecurity does nothing, as GTSM is not supported on this OS.
+func (s *Server) updateTTLSecurity(on bool) error {
+	return nil
+}
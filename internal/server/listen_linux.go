@@ -5,12 +5,16 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"golang.org/x/sys/cpu"
 	"golang.org/x/sys/unix"
 )
 
@@ -20,66 +24,30 @@ func (s *Server) listen(c Config) {
 			var sockErr error
 			err := rc.Control(func(fd uintptr) {
 				// Detect socket family to determine how to pass peer addresses
-				sa, err := unix.Getsockname(int(fd))
+				isIPv6, err := isIPv6Socket(int(fd))
 				if err != nil {
-					sockErr = fmt.Errorf("getsockname failed: %w", err)
+					sockErr = err
 					return
 				}
-				isIPv6 := false
-				if _, ok := sa.(*unix.SockaddrInet6); ok {
-					isIPv6 = true
+
+				// Only needed when a peer uses GTSM
+				if s.peerConf.Load().ttlSecurity() {
+					if err := setListenerTTLSecurity(int(fd), isIPv6, true); err != nil {
+						log.Printf("Warning: unable to prepare the listener for TTL security: %v\n", err)
+					}
+				}
+
+				// Apply TCP MD5 option for each peer and listen range that has a password
+				for _, k := range s.peerConf.Load().md5Keys() {
+					if err := setTCPMD5(int(fd), k.prefix, k.password, isIPv6); err != nil {
+						sockErr = fmt.Errorf("failed to set TCP_MD5SIG for %s: %w", k.prefix, err)
+					}
 				}
 
-				// Apply TCP MD5 option for each peer that has a password
-				if c.PeersConfig != nil {
-					for _, peerConf := range c.PeersConfig {
-						if peerConf.Password == "" {
-							continue
-						}
-
-						ip := net.ParseIP(peerConf.IP)
-						if ip == nil {
-							log.Printf("Warning: Invalid IP address %s in config", peerConf.IP)
-							continue
-						}
-
-						var sig unix.TCPMD5Sig
-
-						// Cap password length at 80 bytes (TCP_MD5SIG_MAXKEYLEN)
-						key := peerConf.Password
-						if len(key) > 80 {
-							key = key[:80]
-						}
-						sig.Keylen = uint16(len(key))
-						copy(sig.Key[:], key)
-
-						if isIPv6 {
-							// For IPv6 sockets (including dual-stack), we must use AF_INET6
-							// and 16-byte addresses (IPv4-mapped if necessary).
-							sig.Addr.Family = unix.AF_INET6
-							sig.Prefixlen = 128
-							raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(&sig.Addr))
-							raw.Family = unix.AF_INET6
-							copy(raw.Addr[:], ip.To16())
-						} else {
-							// For IPv4-only sockets, we use AF_INET.
-							ip4 := ip.To4()
-							if ip4 == nil {
-								// IPv6 peer on IPv4 socket is not possible
-								continue
-							}
-							sig.Addr.Family = unix.AF_INET
-							sig.Prefixlen = 32
-							raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&sig.Addr))
-							raw.Family = unix.AF_INET
-							copy(raw.Addr[:], ip4)
-						}
-
-						// Apply to the socket
-						err = unix.SetsockoptTCPMD5Sig(int(fd), unix.IPPROTO_TCP, unix.TCP_MD5SIG, &sig)
-						if err != nil {
-							sockErr = fmt.Errorf("failed to set TCP_MD5SIG for peer %s (keylen %d): %w", peerConf.IP, sig.Keylen, err)
-						}
+				// and the TCP-AO keys of those that use it instead
+				for _, k := range s.peerConf.Load().aoKeys() {
+					if err := addTCPAOKey(int(fd), k, isIPv6, false); err != nil {
+						sockErr = fmt.Errorf("failed to add TCP-AO key %d/%d for %s: %w", k.sendID, k.recvID, k.prefix, err)
 					}
 				}
 			})
@@ -90,7 +58,7 @@ func (s *Server) listen(c Config) {
 		},
 	}
 
-	// Disable MPTCP as it is incompatible with TCP_MD5SIG
+	// Disable MPTCP as it is incompatible with TCP_MD5SIG and TCP-AO
 	lc.SetMultipathTCP(false)
 
 	l, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", c.Port))
@@ -100,3 +68,569 @@ func (s *Server) listen(c Config) {
 	s.listener = l
 	log.Printf("Listening on port %d (Linux with MD5 support)\n", c.Port)
 }
+
+// updateMD5 replaces the MD5 keys from on the listening socket with to, removing the keys of
+// peers and listen ranges no longer configured and installing those added or changed.
+func (s *Server) updateMD5(from, to []md5Key) error {
+	l, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[netip.Prefix]string)
+	for _, k := range to {
+		want[k.prefix] = k.password
+	}
+	have := make(map[netip.Prefix]string)
+	for _, k := range from {
+		have[k.prefix] = k.password
+	}
+
+	var errs []error
+	err = rc.Control(func(fd uintptr) {
+		isIPv6, err := isIPv6Socket(int(fd))
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		// A key with no password removes the key for its prefix
+		for prefix := range have {
+			if _, ok := want[prefix]; ok {
+				continue
+			}
+			if err := setTCPMD5(int(fd), prefix, "", isIPv6); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove TCP_MD5SIG for %s: %w", prefix, err))
+			}
+		}
+		for prefix, password := range want {
+			if have[prefix] == password {
+				continue
+			}
+			if err := setTCPMD5(int(fd), prefix, password, isIPv6); err != nil {
+				errs = append(errs, fmt.Errorf("failed to set TCP_MD5SIG for %s: %w", prefix, err))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// isIPv6Socket reports whether fd is an IPv6 socket, which may be dual-stack.
+func isIPv6Socket(fd int) (bool, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return false, fmt.Errorf("getsockname failed: %w", err)
+	}
+	_, ok := sa.(*unix.SockaddrInet6)
+	return ok, nil
+}
+
+// dialPeer opens an outbound connection to a peer configured in active mode. The peer's
+// MD5 or TCP-AO keys and TTL security are set before connecting so that they apply to the SYN
+// and the peer's answer.
+func (s *Server) dialPeer(pc PeerConfig, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, rc syscall.RawConn) error {
+			if pc.TTLSecurity > 0 {
+				var sockErr error
+				err := rc.Control(func(fd uintptr) {
+					sockErr = setMinTTL(int(fd), pc.minTTL(), network == "tcp4")
+				})
+				if sockErr != nil {
+					return fmt.Errorf("failed to set TTL security for peer %s: %w", pc.IP, sockErr)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if pc.Password == "" && len(pc.TCPAO) == 0 {
+				return nil
+			}
+			ip, err := netip.ParseAddr(pc.IP)
+			if err != nil {
+				return fmt.Errorf("invalid IP address %s in config", pc.IP)
+			}
+			ip = ip.Unmap()
+			host := netip.PrefixFrom(ip, ip.BitLen())
+			var sockErr error
+			err = rc.Control(func(fd uintptr) {
+				if pc.Password != "" {
+					if sockErr = setTCPMD5(int(fd), host, pc.Password, network == "tcp6"); sockErr != nil {
+						sockErr = fmt.Errorf("failed to set TCP_MD5SIG for peer %s: %w", pc.IP, sockErr)
+					}
+					return
+				}
+				// The first key is the one the session starts with
+				for i, k := range pc.TCPAO {
+					if sockErr = addTCPAOKey(int(fd), newAOKey(host, k), network == "tcp6", i == 0); sockErr != nil {
+						sockErr = fmt.Errorf("failed to add TCP-AO key %d for peer %s: %w", k.ID, pc.IP, sockErr)
+						return
+					}
+				}
+			})
+			if sockErr != nil {
+				return sockErr
+			}
+			return err
+		},
+	}
+
+	// Disable MPTCP as it is incompatible with TCP_MD5SIG and TCP-AO
+	d.SetMultipathTCP(false)
+
+	return d.Dial("tcp", addr)
+}
+
+// updateTCPAO replaces the TCP-AO keys from on the listening socket with to. Connections
+// already accepted keep their own copy of the keys, see updateConnTCPAO.
+func (s *Server) updateTCPAO(from, to []aoKey) error {
+	added, removed := diffAOKeys(from, to)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	l, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	err = rc.Control(func(fd uintptr) {
+		isIPv6, err := isIPv6Socket(int(fd))
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		for _, k := range added {
+			if err := addTCPAOKey(int(fd), k, isIPv6, false); err != nil {
+				errs = append(errs, fmt.Errorf("failed to add TCP-AO key %d/%d for %s: %w", k.sendID, k.recvID, k.prefix, err))
+			}
+		}
+		for _, k := range removed {
+			if err := delTCPAOKey(int(fd), k, isIPv6, true); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove TCP-AO key %d/%d for %s: %w", k.sendID, k.recvID, k.prefix, err))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// updateConnTCPAO rolls the TCP-AO keys of an established session over from one set to
+// another without closing it. New keys are added first, then current is made the key we send
+// with and ask the peer for, and only then are the old keys removed.
+func updateConnTCPAO(conn net.Conn, from, to []aoKey, current TCPAOKey) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	added, removed := diffAOKeys(from, to)
+
+	var errs []error
+	err = rc.Control(func(fd uintptr) {
+		isIPv6, err := isIPv6Socket(int(fd))
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		for _, k := range added {
+			if err := addTCPAOKey(int(fd), k, isIPv6, false); err != nil {
+				errs = append(errs, fmt.Errorf("failed to add TCP-AO key %d/%d: %w", k.sendID, k.recvID, err))
+			}
+		}
+		if err := setCurrentTCPAOKey(int(fd), current); err != nil {
+			errs = append(errs, fmt.Errorf("failed to select TCP-AO key %d: %w", current.ID, err))
+			return
+		}
+		for _, k := range removed {
+			if err := delTCPAOKey(int(fd), k, isIPv6, false); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove TCP-AO key %d/%d: %w", k.sendID, k.recvID, err))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// setTCPAOCurrent makes k the key an accepted connection sends with and asks the peer for.
+// The kernel starts it with whichever key the peer asked for in its SYN.
+func setTCPAOCurrent(conn net.Conn, k TCPAOKey) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = setCurrentTCPAOKey(int(fd), k)
+	})
+	if sockErr != nil {
+		return sockErr
+	}
+	return err
+}
+
+// TCP-AO socket options from linux/tcp.h, which x/sys/unix does not have yet
+const (
+	tcpAOAddKey = 38
+	tcpAODelKey = 39
+	tcpAOInfo   = 40
+)
+
+// tcpAOAdd is struct tcp_ao_add, the argument of TCP_AO_ADD_KEY.
+type tcpAOAdd struct {
+	addr      [128]byte // struct __kernel_sockaddr_storage
+	algName   [64]byte
+	ifindex   int32
+	flags     uint32 // set_current:1, set_rnext:1
+	reserved2 uint16
+	prefix    uint8
+	sndid     uint8
+	rcvid     uint8
+	maclen    uint8
+	keyflags  uint8
+	keylen    uint8
+	key       [maxTCPAOKeyLen]byte
+}
+
+// tcpAODel is struct tcp_ao_del, the argument of TCP_AO_DEL_KEY.
+type tcpAODel struct {
+	addr       [128]byte
+	ifindex    int32
+	flags      uint32 // set_current:1, set_rnext:1, del_async:1
+	reserved2  uint16
+	prefix     uint8
+	sndid      uint8
+	rcvid      uint8
+	currentKey uint8
+	rnext      uint8
+	keyflags   uint8
+}
+
+// tcpAOInfoOpt is struct tcp_ao_info_opt, the argument of TCP_AO_INFO.
+type tcpAOInfoOpt struct {
+	flags          uint32 // set_current:1, set_rnext:1, ao_required:1, set_counters:1, accept_icmps:1
+	reserved2      uint16
+	currentKey     uint8
+	rnext          uint8
+	pktGood        uint64
+	pktBad         uint64
+	pktKeyNotFound uint64
+	pktAORequired  uint64
+	pktDroppedICMP uint64
+}
+
+// aoFlag returns the nth of the one bit fields the TCP-AO structures start with. C compilers
+// allocate bit fields from the least significant bit on little-endian machines and from the
+// most significant one on big-endian machines.
+func aoFlag(n int) uint32 {
+	if cpu.IsBigEndian {
+		return 1 << (31 - n)
+	}
+	return 1 << n
+}
+
+// aoSockaddr writes the address of prefix into a sockaddr_storage for a socket of the given
+// family. As with MD5, IPv4 peers of an IPv6 socket are IPv4-mapped and keep an IPv4 prefix
+// length. It returns false for an IPv6 peer on an IPv4 socket, which cannot connect.
+func aoSockaddr(b *[128]byte, prefix netip.Prefix, isIPv6 bool) bool {
+	addr := prefix.Addr()
+	if isIPv6 {
+		raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(b))
+		raw.Family = unix.AF_INET6
+		raw.Addr = addr.As16()
+		return true
+	}
+	if !addr.Is4() {
+		return false
+	}
+	raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(b))
+	raw.Family = unix.AF_INET
+	raw.Addr = addr.As4()
+	return true
+}
+
+// newTCPAOAdd builds the TCP_AO_ADD_KEY argument for k. With current set the key is also made
+// the one we send with and ask the peer for, which a listening socket does not have.
+func newTCPAOAdd(k aoKey, isIPv6, current bool) (tcpAOAdd, bool) {
+	var add tcpAOAdd
+	if !aoSockaddr(&add.addr, k.prefix, isIPv6) {
+		return add, false
+	}
+	copy(add.algName[:], k.algorithm)
+	if current {
+		add.flags = aoFlag(0) | aoFlag(1)
+	}
+	add.prefix = uint8(k.prefix.Bits())
+	add.sndid = k.sendID
+	add.rcvid = k.recvID
+	add.maclen = tcpAOMACLen
+	add.keylen = uint8(copy(add.key[:], k.secret))
+	return add, true
+}
+
+func addTCPAOKey(fd int, k aoKey, isIPv6, current bool) error {
+	add, ok := newTCPAOAdd(k, isIPv6, current)
+	if !ok {
+		return nil
+	}
+	return setsockoptAO(fd, tcpAOAddKey, &add)
+}
+
+// delTCPAOKey removes k from the socket. async is only valid for a listening socket, where it
+// leaves connections being set up with the key to finish in the background.
+func delTCPAOKey(fd int, k aoKey, isIPv6, async bool) error {
+	var del tcpAODel
+	if !aoSockaddr(&del.addr, k.prefix, isIPv6) {
+		return nil
+	}
+	if async {
+		del.flags = aoFlag(2)
+	}
+	del.prefix = uint8(k.prefix.Bits())
+	del.sndid = k.sendID
+	del.rcvid = k.recvID
+	return setsockoptAO(fd, tcpAODelKey, &del)
+}
+
+// setCurrentTCPAOKey makes k the Current_key, which we send with, and the RNext_key, which we
+// ask the peer to send with (RFC 5925 section 7.5.2).
+func setCurrentTCPAOKey(fd int, k TCPAOKey) error {
+	info := tcpAOInfoOpt{
+		flags:      aoFlag(0) | aoFlag(1),
+		currentKey: k.sendID(),
+		rnext:      k.recvID(),
+	}
+	return setsockoptAO(fd, tcpAOInfo, &info)
+}
+
+func setsockoptAO[T tcpAOAdd | tcpAODel | tcpAOInfoOpt](fd, opt int, v *T) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, uintptr(opt),
+		uintptr(unsafe.Pointer(v)), unsafe.Sizeof(*v), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setTCPMD5 installs the MD5 key for every peer address within prefix on the socket, using
+// TCP_MD5SIG_EXT so that ranges as well as single hosts can be keyed.
+func setTCPMD5(fd int, prefix netip.Prefix, password string, isIPv6 bool) error {
+	var sig unix.TCPMD5Sig
+
+	// Cap password length at 80 bytes (TCP_MD5SIG_MAXKEYLEN)
+	key := password
+	if len(key) > 80 {
+		key = key[:80]
+	}
+	sig.Keylen = uint16(len(key))
+	copy(sig.Key[:], key)
+	sig.Flags = unix.TCP_MD5SIG_FLAG_PREFIX
+
+	addr := prefix.Addr()
+	if isIPv6 {
+		// For IPv6 sockets (including dual-stack), we must use AF_INET6
+		// and 16-byte addresses (IPv4-mapped if necessary). The kernel takes
+		// the prefix length of an IPv4-mapped address as an IPv4 one.
+		sig.Addr.Family = unix.AF_INET6
+		sig.Prefixlen = uint8(prefix.Bits())
+		raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(&sig.Addr))
+		raw.Family = unix.AF_INET6
+		raw.Addr = addr.As16()
+	} else {
+		// For IPv4-only sockets, we use AF_INET.
+		if !addr.Is4() {
+			// IPv6 peer on IPv4 socket is not possible
+			return nil
+		}
+		sig.Addr.Family = unix.AF_INET
+		sig.Prefixlen = uint8(prefix.Bits())
+		raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&sig.Addr))
+		raw.Family = unix.AF_INET
+		raw.Addr = addr.As4()
+	}
+
+	if err := unix.SetsockoptTCPMD5Sig(fd, unix.IPPROTO_TCP, unix.TCP_MD5SIG_EXT, &sig); err != nil {
+		return fmt.Errorf("keylen %d prefix length %d: %w", sig.Keylen, sig.Prefixlen, err)
+	}
+	return nil
+}
+
+// setTTLSecurity applies GTSM to a connection accepted from the peer pc. IP_MINTTL on the
+// listener would hold every peer to the same minimum, so instead the TTL of the SYN saved by
+// the listener is checked against the peer's own. The minimum is then set on the connection
+// for the kernel to drop any later packet below it.
+func setTTLSecurity(conn net.Conn, pc PeerConfig) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv4 := tc.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if ttl, ok := savedSYNTTL(int(fd)); ok {
+			if sockErr = pc.checkTTL(ttl); sockErr != nil {
+				return
+			}
+		}
+		sockErr = setMinTTL(int(fd), pc.minTTL(), ipv4)
+	})
+	if sockErr != nil {
+		return sockErr
+	}
+	return err
+}
+
+// clearTTLSecurity undoes what the listener did for GTSM peers on a connection accepted from
+// a peer that does not use it. The saved SYN is freed and packets go back to the system
+// default TTL.
+func clearTTLSecurity(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		savedSYNTTL(int(fd))
+		isIPv6, err := isIPv6Socket(int(fd))
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sockErr = setTTL(int(fd), -1, isIPv6)
+	})
+	if sockErr != nil {
+		return sockErr
+	}
+	return err
+}
+
+// updateTTLSecurity prepares the listener for GTSM peers when a reload adds the first of them,
+// and stops saving SYNs and sending TTL 255 once the last is removed.
+func (s *Server) updateTTLSecurity(on bool) error {
+	l, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		isIPv6, err := isIPv6Socket(int(fd))
+		if err != nil {
+			sockErr = err
+			return
+		}
+		sockErr = setListenerTTLSecurity(int(fd), isIPv6, on)
+	})
+	if sockErr != nil {
+		return sockErr
+	}
+	return err
+}
+
+// setListenerTTLSecurity has the listener keep the SYN of each connection, so GTSM peers can
+// be checked on accept, and send SYN-ACKs with the TTL they expect. Turning it off restores
+// the system defaults.
+func setListenerTTLSecurity(fd int, isIPv6, on bool) error {
+	save, ttl := 0, -1
+	if on {
+		save, ttl = 1, maxTTL
+	}
+	var errs []error
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_SAVE_SYN, save); err != nil {
+		errs = append(errs, fmt.Errorf("TCP_SAVE_SYN: %w", err))
+	}
+	if err := setTTL(fd, ttl, isIPv6); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// setTTL sets the TTL packets are sent with, including to IPv4 peers of an IPv6 socket. A TTL
+// of -1 is the system default.
+func setTTL(fd, ttl int, isIPv6 bool) error {
+	if isIPv6 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl); err != nil {
+			return fmt.Errorf("IPV6_UNICAST_HOPS: %w", err)
+		}
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl); err != nil {
+		return fmt.Errorf("IP_TTL: %w", err)
+	}
+	return nil
+}
+
+// setMinTTL drops packets arriving with a TTL, or hop limit, below minTTL and sends ours with
+// the maximum. An IPv4 peer on a dual-stack socket uses the IPv4 options.
+func setMinTTL(fd, minTTL int, ipv4 bool) error {
+	if ipv4 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, maxTTL); err != nil {
+			return fmt.Errorf("IP_TTL: %w", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MINTTL, minTTL); err != nil {
+			return fmt.Errorf("IP_MINTTL: %w", err)
+		}
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, maxTTL); err != nil {
+		return fmt.Errorf("IPV6_UNICAST_HOPS: %w", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MINHOPCOUNT, minTTL); err != nil {
+		return fmt.Errorf("IPV6_MINHOPCOUNT: %w", err)
+	}
+	return nil
+}
+
+// savedSYNTTL returns the TTL or hop limit of the SYN that opened an accepted connection,
+// which the kernel keeps from the IP header onwards when TCP_SAVE_SYN is set on the listener.
+func savedSYNTTL(fd int) (int, bool) {
+	var buf [512]byte
+	n := uint32(len(buf))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, unix.TCP_SAVED_SYN,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, false
+	}
+	switch {
+	case n > 8 && buf[0]>>4 == 4:
+		return int(buf[8]), true
+	case n > 7 && buf[0]>>4 == 6:
+		return int(buf[7]), true
+	}
+	return 0, false
+}
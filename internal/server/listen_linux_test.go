@@ -0,0 +1,130 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/cpu"
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPAOStructs(t *testing.T) {
+	// Sizes of the structures in linux/tcp.h, which the kernel checks
+	for desc, test := range map[string]struct{ got, want uintptr }{
+		"tcp_ao_add":       {unsafe.Sizeof(tcpAOAdd{}), 288},
+		"tcp_ao_del":       {unsafe.Sizeof(tcpAODel{}), 144},
+		"tcp_ao_info_opt":  {unsafe.Sizeof(tcpAOInfoOpt{}), 48},
+		"tcp_ao_add.key":   {unsafe.Offsetof(tcpAOAdd{}.key), 208},
+		"tcp_ao_del.rcvid": {unsafe.Offsetof(tcpAODel{}.rcvid), 140},
+	} {
+		if test.got != test.want {
+			t.Errorf("Test (%s): got %d, want %d", desc, test.got, test.want)
+		}
+	}
+}
+
+func TestNewTCPAOAdd(t *testing.T) {
+	k := aoKey{prefix: netip.MustParsePrefix("192.0.2.0/24"), sendID: 5, recvID: 6, algorithm: "cmac(aes128)", secret: "s3cret"}
+
+	// An IPv4 peer of a dual-stack socket is IPv4-mapped with an IPv4 prefix length
+	add, ok := newTCPAOAdd(k, true, true)
+	if !ok {
+		t.Fatalf("IPv4 key refused on an IPv6 socket")
+	}
+	sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&add.addr))
+	if sa.Family != unix.AF_INET6 || netip.AddrFrom16(sa.Addr) != netip.MustParseAddr("::ffff:192.0.2.0") || add.prefix != 24 {
+		t.Errorf("got address %v/%d family %d, want ::ffff:192.0.2.0/24", netip.AddrFrom16(sa.Addr), add.prefix, sa.Family)
+	}
+	if add.sndid != 5 || add.rcvid != 6 || add.maclen != 12 || add.keylen != 6 || string(add.key[:add.keylen]) != "s3cret" {
+		t.Errorf("got key %d/%d maclen %d key %q", add.sndid, add.rcvid, add.maclen, add.key[:add.keylen])
+	}
+	if got := string(add.algName[:len(k.algorithm)+1]); got != "cmac(aes128)\x00" {
+		t.Errorf("got algorithm %q", got)
+	}
+
+	// set_current and set_rnext are the first two bit fields
+	want := uint32(3)
+	if cpu.IsBigEndian {
+		want = 3 << 30
+	}
+	if add.flags != want {
+		t.Errorf("got flags %#x, want %#x", add.flags, want)
+	}
+
+	v6 := aoKey{prefix: netip.MustParsePrefix("2001:db8::1/128")}
+	if _, ok := newTCPAOAdd(v6, false, false); ok {
+		t.Errorf("IPv6 key accepted on an IPv4 socket")
+	}
+}
+
+func TestListenerTTLSecurity(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	srv := New(Config{Quiet: true})
+	srv.listener = l
+
+	// sockopts returns TCP_SAVE_SYN and IP_TTL of the listener or a connection
+	sockopts := func(c syscall.Conn) (int, int) {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatalf("SyscallConn: %v", err)
+		}
+		var save, ttl int
+		rc.Control(func(fd uintptr) {
+			save, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVE_SYN)
+			ttl, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+		})
+		return save, ttl
+	}
+	_, defaultTTL := sockopts(l.(*net.TCPListener))
+
+	if err := srv.updateTTLSecurity(true); errors.Is(err, unix.ENOPROTOOPT) {
+		t.Skipf("TCP_SAVE_SYN not supported: %v", err)
+	} else if err != nil {
+		t.Fatalf("updateTTLSecurity: %v", err)
+	}
+	if save, ttl := sockopts(l.(*net.TCPListener)); save != 1 || ttl != maxTTL {
+		t.Errorf("got TCP_SAVE_SYN %d and TTL %d with GTSM, want 1 and %d", save, ttl, maxTTL)
+	}
+
+	// A connection from a peer without GTSM has its SYN freed and the default TTL
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+	if err := clearTTLSecurity(conn); err != nil {
+		t.Fatalf("clearTTLSecurity: %v", err)
+	}
+	if _, ttl := sockopts(conn.(*net.TCPConn)); ttl != defaultTTL {
+		t.Errorf("got TTL %d on the connection, want %d", ttl, defaultTTL)
+	}
+	rc, _ := conn.(*net.TCPConn).SyscallConn()
+	rc.Control(func(fd uintptr) {
+		if ttl, ok := savedSYNTTL(int(fd)); ok {
+			t.Errorf("saved SYN with TTL %d kept after clearing", ttl)
+		}
+	})
+
+	if err := srv.updateTTLSecurity(false); err != nil {
+		t.Fatalf("updateTTLSecurity: %v", err)
+	}
+	if save, ttl := sockopts(l.(*net.TCPListener)); save != 0 || ttl != defaultTTL {
+		t.Errorf("got TCP_SAVE_SYN %d and TTL %d without GTSM, want 0 and %d", save, ttl, defaultTTL)
+	}
+}
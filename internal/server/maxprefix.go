@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// Actions taken when a peer exceeds its maximum prefixes
+const (
+	maxPrefixLog      = "log"
+	maxPrefixDrop     = "drop"
+	maxPrefixTeardown = "teardown"
+
+	defaultMaxPrefixWarning = 75
+)
+
+// prefixRib is the part of an IPv4 or IPv6 RIB needed to enforce a prefix limit.
+type prefixRib interface {
+	Count() int
+	Lookup(netip.Prefix) *routing_table.Route
+}
+
+// prefixLimit returns the maximum number of prefixes for the family, 0 if there is no limit.
+func (pc PeerConfig) prefixLimit(afi uint16) int {
+	if afi == 2 {
+		return int(pc.MaxPrefixesV6)
+	}
+	return int(pc.MaxPrefixesV4)
+}
+
+func (pc PeerConfig) maxPrefixAction() string {
+	if pc.MaxPrefixAction == "" {
+		return maxPrefixTeardown
+	}
+	return pc.MaxPrefixAction
+}
+
+func (pc PeerConfig) maxPrefixWarning() int {
+	if pc.MaxPrefixWarning == 0 {
+		return defaultMaxPrefixWarning
+	}
+	return pc.MaxPrefixWarning
+}
+
+// limitFlags returns the per-session warning and limit state of a family. Called with
+// p.mutex held.
+func (p *peer) limitFlags(afi uint16) (warned, exceeded *bool) {
+	if afi == 2 {
+		return &p.v6limitWarned, &p.v6limitExceeded
+	}
+	return &p.v4limitWarned, &p.v4limitExceeded
+}
+
+// dropExcessRoutes applies the drop action to routes about to be inserted in rib. Routes for
+// prefixes not yet in the RIB are dropped once the family is at its limit, while updates to
+// prefixes already held are always accepted.
+func (p *peer) dropExcessRoutes(afi uint16, rib prefixRib, routes []routing_table.Route) []routing_table.Route {
+	pc, _ := p.server.peerConfig(p.ip)
+	limit := pc.prefixLimit(afi)
+	if limit == 0 || pc.maxPrefixAction() != maxPrefixDrop {
+		return routes
+	}
+
+	room := limit - rib.Count()
+	added := make(map[netip.Prefix]bool)
+	kept := routes[:0]
+	for _, r := range routes {
+		switch {
+		case added[r.Prefix] || rib.Lookup(r.Prefix) != nil:
+		case room > 0:
+			room--
+			added[r.Prefix] = true
+		default:
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	dropped := len(routes) - len(kept)
+	if dropped == 0 {
+		return kept
+	}
+	p.mutex.Lock()
+	_, exceeded := p.limitFlags(afi)
+	first := !*exceeded
+	*exceeded = true
+	p.mutex.Unlock()
+	if first {
+		log.Printf("%s exceeded its limit of %d AFI %d prefixes, dropping new prefixes\n", p.ip, limit, afi)
+	}
+	p.server.recordPrefixLimit(p.ip, false, first, dropped)
+	return kept
+}
+
+// checkPrefixLimit compares the number of prefixes held for a family against the peer's
+// limit, warning once the threshold is crossed and acting once the limit is exceeded. It
+// returns false if the session has been torn down.
+func (p *peer) checkPrefixLimit(afi uint16, count int) bool {
+	pc, _ := p.server.peerConfig(p.ip)
+	limit := pc.prefixLimit(afi)
+	if limit == 0 {
+		return true
+	}
+
+	p.mutex.Lock()
+	warned, exceeded := p.limitFlags(afi)
+	warn := !*warned && count*100 >= limit*pc.maxPrefixWarning()
+	breach := !*exceeded && count > limit
+	*warned = *warned || warn
+	*exceeded = *exceeded || breach
+	p.mutex.Unlock()
+
+	if warn {
+		log.Printf("%s has %d AFI %d prefixes, %d%% of its limit of %d\n", p.ip, count, afi, pc.maxPrefixWarning(), limit)
+	}
+	if !breach {
+		if warn {
+			p.server.recordPrefixLimit(p.ip, true, false, 0)
+		}
+		return true
+	}
+	p.server.recordPrefixLimit(p.ip, warn, true, 0)
+
+	if pc.maxPrefixAction() != maxPrefixTeardown {
+		log.Printf("%s exceeded its limit of %d AFI %d prefixes with %d\n", p.ip, limit, afi, count)
+		return true
+	}
+
+	restart := time.Duration(pc.MaxPrefixRestart) * time.Second
+	log.Printf("%s exceeded its limit of %d AFI %d prefixes with %d, closing the session\n", p.ip, limit, afi, count)
+	p.server.holdPeer(p.ip, restart)
+
+	// The data is the AFI, SAFI and the limit (RFC 4486 section 4)
+	data := binary.BigEndian.AppendUint16(nil, afi)
+	data = append(data, 1)
+	data = binary.BigEndian.AppendUint32(data, uint32(limit))
+	p.notify(bgp.Cease, bgp.CeaseMaxPrefixes, data)
+	p.conn.Close()
+	return false
+}
+
+// recordPrefixLimit counts a warning threshold crossed, a limit exceeded and routes dropped
+// for the peer at ip.
+func (s *Server) recordPrefixLimit(ip string, warning, breach bool, dropped int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peerStats[ip]; !ok {
+		s.peerStats[ip] = &persistentPeerStats{}
+	}
+	ps := s.peerStats[ip]
+	if warning {
+		ps.maxPrefixWarnings++
+	}
+	if breach {
+		ps.maxPrefixBreaches++
+	}
+	ps.maxPrefixDropped += uint64(dropped)
+}
+
+// holdPeer refuses sessions with the peer at ip for d after a maximum prefix teardown, or
+// until bgpwatch is restarted if d is 0.
+func (s *Server) holdPeer(ip string, d time.Duration) {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	s.mutex.Lock()
+	s.prefixHolds[ip] = until
+	s.mutex.Unlock()
+}
+
+// prefixHeld reports whether sessions with the peer at ip are currently refused.
+func (s *Server) prefixHeld(ip string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	until, ok := s.prefixHolds[ip]
+	if !ok {
+		return false
+	}
+	if until.IsZero() || time.Now().Before(until) {
+		return true
+	}
+	delete(s.prefixHolds, ip)
+	return false
+}
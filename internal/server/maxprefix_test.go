@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// limitPeer returns a peer with an IPv4 RIB, configured with conf.
+func limitPeer(conf PeerConfig) *peer {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{"127.0.0.1": conf}})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	return p
+}
+
+// announce sends an UPDATE for the given /24s, each as three octets.
+func announce(t *testing.T, p *peer, nlri ...[]byte) {
+	t.Helper()
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	var b []byte
+	for _, n := range nlri {
+		b = append(append(b, 24), n...)
+	}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), b))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+}
+
+func TestMaxPrefixLog(t *testing.T) {
+	p := limitPeer(PeerConfig{MaxPrefixesV4: 4, MaxPrefixWarning: 50, MaxPrefixAction: maxPrefixLog})
+
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100})
+	ps := p.server.peerStats[p.ip]
+	if ps == nil || ps.maxPrefixWarnings != 1 || ps.maxPrefixBreaches != 0 {
+		t.Fatalf("got counters %+v at the warning threshold, want one warning", ps)
+	}
+
+	// Only the first breach per session is counted, and nothing is removed
+	announce(t, p, []byte{203, 0, 113}, []byte{10, 0, 0}, []byte{10, 0, 1})
+	announce(t, p, []byte{10, 0, 2})
+	if ps.maxPrefixWarnings != 1 || ps.maxPrefixBreaches != 1 || ps.maxPrefixDropped != 0 {
+		t.Errorf("got counters %+v after exceeding the limit, want one warning and one breach", ps)
+	}
+	if p.v4rib.Count() != 6 {
+		t.Errorf("got %d prefixes, want 6", p.v4rib.Count())
+	}
+}
+
+func TestMaxPrefixDrop(t *testing.T) {
+	p := limitPeer(PeerConfig{MaxPrefixesV4: 2, MaxPrefixAction: maxPrefixDrop})
+
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100}, []byte{203, 0, 113})
+	for prefix, want := range map[string]bool{"192.0.2.0/24": true, "198.51.100.0/24": true, "203.0.113.0/24": false} {
+		if got := p.v4rib.Lookup(netip.MustParsePrefix(prefix)) != nil; got != want {
+			t.Errorf("Test (%s): got present %t, want %t", prefix, got, want)
+		}
+	}
+
+	// Prefixes already held can still be updated at the limit
+	announce(t, p, []byte{198, 51, 100}, []byte{10, 0, 0})
+	if p.v4rib.Count() != 2 {
+		t.Errorf("got %d prefixes, want 2", p.v4rib.Count())
+	}
+	ps := p.server.peerStats[p.ip]
+	if ps == nil || ps.maxPrefixBreaches != 1 || ps.maxPrefixDropped != 2 || ps.maxPrefixWarnings != 1 {
+		t.Errorf("got counters %+v, want one warning, one breach and two dropped routes", ps)
+	}
+}
+
+func TestMaxPrefixTeardown(t *testing.T) {
+	p := limitPeer(PeerConfig{MaxPrefixesV4: 1, MaxPrefixRestart: 60})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p.conn = c1
+
+	got := make(chan []byte, 1)
+	go func() {
+		msg := make([]byte, 28)
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c2, msg); err != nil {
+			got <- nil
+			return
+		}
+		got <- msg
+	}()
+
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100})
+	want := bgp.CreateNotificationWithData(bgp.Cease, bgp.CeaseMaxPrefixes, []byte{0, 1, 1, 0, 0, 0, 1})
+	if msg := <-got; !cmp.Equal(msg, want) {
+		t.Errorf("got notification %#v, want %#v", msg, want)
+	}
+	if ps := p.server.peerStats[p.ip]; ps == nil || len(ps.notifications) != 1 || ps.maxPrefixBreaches != 1 {
+		t.Errorf("got counters %+v, want the breach and its notification recorded", ps)
+	}
+	if !p.server.prefixHeld(p.ip) {
+		t.Errorf("peer not held down after teardown")
+	}
+}
+
+func TestPrefixHeld(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+
+	srv.holdPeer("192.0.2.1", 0)
+	srv.holdPeer("192.0.2.2", time.Hour)
+	srv.prefixHolds["192.0.2.3"] = time.Now().Add(-time.Second)
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "192.0.2.1", want: true},
+		{ip: "192.0.2.2", want: true},
+		{ip: "192.0.2.3"},
+		{ip: "192.0.2.4"},
+	}
+	for _, test := range tests {
+		if got := srv.prefixHeld(test.ip); got != test.want {
+			t.Errorf("Test (%s): got %t, want %t", test.ip, got, test.want)
+		}
+	}
+	if _, ok := srv.prefixHolds["192.0.2.3"]; ok {
+		t.Errorf("expired hold not removed")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// notifyError is a protocol error that is reported to the peer in a NOTIFICATION before the
+// connection is closed.
+type notifyError struct {
+	code    uint8
+	subcode uint8
+	data    []byte
+	err     error
+}
+
+func (e *notifyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notifyError) Unwrap() error {
+	return e.err
+}
+
+func newNotifyError(code, subcode uint8, data []byte, format string, a ...any) error {
+	return &notifyError{
+		code:    code,
+		subcode: subcode,
+		data:    data,
+		err:     fmt.Errorf(format, a...),
+	}
+}
+
+// notificationTimeout bounds how long we wait to write a NOTIFICATION. The connection is
+// about to be closed, so a peer that has stopped reading must not hold up the teardown.
+const notificationTimeout = 500 * time.Millisecond
+
+// maxNotificationHistory is the number of notifications kept per peer.
+const maxNotificationHistory = 32
+
+// notificationRecord is a NOTIFICATION sent to or received from a peer.
+type notificationRecord struct {
+	time time.Time
+	sent bool
+	msg  bgp.NotificationMessage
+}
+
+// recordNotification adds a notification to the peer's history and makes it the last one.
+func (s *Server) recordNotification(ip string, sent bool, msg bgp.NotificationMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peerStats[ip]; !ok {
+		s.peerStats[ip] = &persistentPeerStats{}
+	}
+	ps := s.peerStats[ip]
+
+	direction := "received"
+	if sent {
+		direction = "sent"
+	}
+	ps.lastNotification = fmt.Sprintf("%s %v", direction, msg)
+
+	ps.notifications = append(ps.notifications, notificationRecord{
+		time: time.Now(),
+		sent: sent,
+		msg:  msg,
+	})
+	if len(ps.notifications) > maxNotificationHistory {
+		ps.notifications = ps.notifications[len(ps.notifications)-maxNotificationHistory:]
+	}
+}
+
+// notify sends a NOTIFICATION to the peer and records it in the peer's history.
+func (p *peer) notify(code, subcode uint8, data []byte) {
+	msg := bgp.NotificationMessage{
+		Code:    code,
+		Subcode: subcode,
+		Data:    data,
+	}
+	p.server.recordNotification(p.ip, true, msg)
+	p.mutex.Lock()
+	p.notification = &msg
+	p.mutex.Unlock()
+
+	p.conn.SetWriteDeadline(time.Now().Add(notificationTimeout))
+	p.send(bgp.CreateNotificationWithData(code, subcode, data))
+}
+
+// closeWithError tells the peer why the session is being torn down, if err is a protocol
+// error, and closes the connection. Errors reading from the socket are closed silently as
+// there is nobody left to tell.
+func (p *peer) closeWithError(err error) {
+	var ne *notifyError
+	var ae *bgp.AttrError
+	switch {
+	case errors.As(err, &ne):
+		p.notify(ne.code, ne.subcode, ne.data)
+	case errors.As(err, &ae):
+		p.notify(bgp.UpdateError, ae.Subcode, ae.Data)
+	}
+	p.conn.Close()
+}
+
+// localASN returns our ASN towards the peer at ip, the configured local_as if there is one.
+func (s *Server) localASN(ip string) uint32 {
+	if pc, ok := s.peerConfig(ip); ok && pc.LocalAS != 0 {
+		return pc.LocalAS
+	}
+	return s.Conf.Asn
+}
+
+// checkOpen validates the fields of a received OPEN as per RFC 4271 section 6.2.
+func (p *peer) checkOpen(version uint8, asn uint32, rid bgp.BGPID, params bgp.Parameters) error {
+	if version != 4 {
+		return newNotifyError(bgp.OpenError, bgp.UnsupportedVersion, []byte{0, 4}, "unsupported BGP version: %d", version)
+	}
+	if asn == 0 {
+		return newNotifyError(bgp.OpenError, bgp.BadPeerAS, nil, "invalid peer AS: %d", asn)
+	}
+	pc, _ := p.server.peerConfig(p.ip)
+	if expected := pc.RemoteAS; len(expected) > 0 && !expected.Contains(asn) {
+		return newNotifyError(bgp.OpenError, bgp.BadPeerAS, nil, "peer AS %d, expected %v", asn, expected)
+	}
+	// No peer may share our identifier, internal or external
+	if rid == (bgp.BGPID{}) || rid == p.server.Conf.Rid {
+		return newNotifyError(bgp.OpenError, bgp.BadBGPIdentifier, nil, "invalid BGP identifier: %v", rid)
+	}
+
+	if err := p.checkRole(params); err != nil {
+		return err
+	}
+
+	// We only store unicast routes, so a peer offering none of them is of no use to us
+	if len(params.AddrFamilies) > 0 {
+		for _, a := range params.AddrFamilies {
+			if a.SAFI == 1 && (a.AFI == 1 || a.AFI == 2) {
+				return nil
+			}
+		}
+		log.Printf("%s offers no unicast address families\n", p.ip)
+		return newNotifyError(bgp.OpenError, bgp.UnsupportedCapability, []byte{1, 4, 0, 1, 0, 1, 1, 4, 0, 2, 0, 1},
+			"no supported address families")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+)
+
+// openBody returns an OPEN message without the BGP header, as read by HandleOpen.
+func openBody(version uint8, asn, holdtime uint16, rid [4]byte, params []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(version)
+	binary.Write(&b, binary.BigEndian, asn)
+	binary.Write(&b, binary.BigEndian, holdtime)
+	b.Write(rid[:])
+	b.WriteByte(uint8(len(params)))
+	b.Write(params)
+	return b.Bytes()
+}
+
+func TestOpenErrors(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	remote := [4]byte{2, 2, 2, 2}
+	mpL2VPN := []byte{2, 6, 1, 4, 0, 25, 0, 65}
+
+	tests := []struct {
+		desc        string
+		conf        PeerConfig
+		input       []byte
+		wantSubcode uint8
+		wantData    []byte
+	}{
+		{
+			desc:        "unsupported version",
+			input:       openBody(3, 64500, 90, remote, nil),
+			wantSubcode: bgp.UnsupportedVersion,
+			wantData:    []byte{0, 4},
+		},
+		{
+			desc:        "peer AS zero",
+			input:       openBody(4, 0, 90, remote, nil),
+			wantSubcode: bgp.BadPeerAS,
+		},
+		{
+			desc:        "unexpected peer AS",
+			conf:        PeerConfig{RemoteAS: ASNSet{{Low: 64501, High: 64501}}},
+			input:       openBody(4, 64500, 90, remote, nil),
+			wantSubcode: bgp.BadPeerAS,
+		},
+		{
+			desc:        "peer AS outside the expected range",
+			conf:        PeerConfig{RemoteAS: ASNSet{{Low: 64510, High: 64520}}},
+			input:       openBody(4, 64500, 90, remote, nil),
+			wantSubcode: bgp.BadPeerAS,
+		},
+		{
+			desc:        "zero BGP identifier",
+			input:       openBody(4, 64500, 90, [4]byte{}, nil),
+			wantSubcode: bgp.BadBGPIdentifier,
+		},
+		{
+			desc:        "iBGP peer with our BGP identifier",
+			input:       openBody(4, 64512, 90, rid, nil),
+			wantSubcode: bgp.BadBGPIdentifier,
+		},
+		{
+			desc:        "iBGP peer with our BGP identifier under a local AS override",
+			conf:        PeerConfig{LocalAS: 64500},
+			input:       openBody(4, 64500, 90, rid, nil),
+			wantSubcode: bgp.BadBGPIdentifier,
+		},
+		{
+			desc:        "eBGP peer with our BGP identifier",
+			input:       openBody(4, 64500, 90, rid, nil),
+			wantSubcode: bgp.BadBGPIdentifier,
+		},
+		{
+			desc:        "unacceptable hold time",
+			input:       openBody(4, 64500, 2, remote, nil),
+			wantSubcode: bgp.UnacceptableHoldTime,
+		},
+		{
+			desc:        "authentication parameter",
+			input:       openBody(4, 64500, 90, remote, []byte{1, 1, 0}),
+			wantSubcode: bgp.UnsupportedOptParam,
+		},
+		{
+			desc:        "no unicast families",
+			input:       openBody(4, 64500, 90, remote, mpL2VPN),
+			wantSubcode: bgp.UnsupportedCapability,
+			wantData:    []byte{1, 4, 0, 1, 0, 1, 1, 4, 0, 2, 0, 1},
+		},
+	}
+	for _, test := range tests {
+		srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{"127.0.0.1": test.conf}})
+		p := &peer{
+			server: srv,
+			ip:     "127.0.0.1",
+			in:     bytes.NewReader(test.input),
+		}
+		var ne *notifyError
+		if err := p.HandleOpen(); !errors.As(err, &ne) {
+			t.Errorf("Test (%s): got %v, want a notification", test.desc, err)
+			continue
+		}
+		if ne.code != bgp.OpenError || ne.subcode != test.wantSubcode || !cmp.Equal(ne.data, test.wantData) {
+			t.Errorf("Test (%s): got %d / %d %v, want %d / %d %v", test.desc, ne.code, ne.subcode, ne.data, bgp.OpenError, test.wantSubcode, test.wantData)
+		}
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	marker := bytes.Repeat([]byte{0xff}, 16)
+	tests := []struct {
+		desc        string
+		input       []byte
+		wantSubcode uint8
+		wantData    []byte
+	}{
+		{
+			desc:        "bad marker",
+			input:       append(bytes.Repeat([]byte{0}, 16), 0, 19, bgp.Keepalive),
+			wantSubcode: bgp.ConnNotSynchronized,
+		},
+		{
+			desc:        "unknown type",
+			input:       append(marker, 0, 19, 9),
+			wantSubcode: bgp.BadMessageType,
+			wantData:    []byte{9},
+		},
+		{
+			desc:        "keepalive with a body",
+			input:       append(marker, 0, 20, bgp.Keepalive, 0),
+			wantSubcode: bgp.BadMessageLength,
+			wantData:    []byte{0, 20},
+		},
+		{
+			desc:        "open too short",
+			input:       append(marker, 0, 20, bgp.Open, 4),
+			wantSubcode: bgp.BadMessageLength,
+			wantData:    []byte{0, 20},
+		},
+	}
+	for _, test := range tests {
+		srv := New(Config{Quiet: true})
+		c1, c2 := net.Pipe()
+		p := &peer{
+			server: srv,
+			conn:   c1,
+			ip:     "127.0.0.1",
+			quiet:  true,
+		}
+		p.state.Store(uint32(StateActive))
+		go p.peerWorker()
+		go c2.Write(test.input)
+
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		got := make([]byte, 21+len(test.wantData))
+		if _, err := io.ReadFull(c2, got); err != nil {
+			t.Errorf("Test (%s): no notification received: %v", test.desc, err)
+			c2.Close()
+			continue
+		}
+		if got[18] != bgp.Notification || got[19] != bgp.HeaderError || got[20] != test.wantSubcode || !bytes.Equal(got[21:], test.wantData) {
+			t.Errorf("Test (%s): got %#v, want header error %d with data %v", test.desc, got[18:], test.wantSubcode, test.wantData)
+		}
+		srv.mutex.RLock()
+		if ps := srv.peerStats[p.ip]; ps == nil || len(ps.notifications) != 1 || !ps.notifications[0].sent || ps.notifications[0].msg.Subcode != test.wantSubcode {
+			t.Errorf("Test (%s): sent notification not recorded", test.desc)
+		}
+		srv.mutex.RUnlock()
+		c2.Close()
+	}
+}
+
+func TestReceivedNotificationHistory(t *testing.T) {
+	srv := New(Config{Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+	}
+
+	body := append([]byte{bgp.Cease, bgp.CeaseAdminShutdown, 23}, "maintenance until 02:00"...)
+	p.in = bytes.NewReader(body)
+	if err := p.handleNotification(); err != nil {
+		t.Fatalf("handleNotification: %v", err)
+	}
+
+	want := "received Cease / Administrative Shutdown: maintenance until 02:00"
+	if got := srv.peerStats[p.ip].lastNotification; got != want {
+		t.Errorf("got last notification %q, want %q", got, want)
+	}
+
+	resp, err := (&grpcServer{bgp: srv}).GetNotifications(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatalf("GetNotifications: %v", err)
+	}
+	history, ok := resp.Peers[anonymizePeer(p.ip)]
+	if !ok || len(history.Notifications) != 1 {
+		t.Fatalf("got %v, want one notification for %s", resp.Peers, anonymizePeer(p.ip))
+	}
+	n := history.Notifications[0]
+	if n.Sent || n.CodeName != "Cease" || n.SubcodeName != "Administrative Shutdown" || n.Message != "maintenance until 02:00" {
+		t.Errorf("got %+v", n)
+	}
+}
+
+func TestNotificationHistoryLimit(t *testing.T) {
+	srv := New(Config{Quiet: true})
+	for i := 0; i < maxNotificationHistory+5; i++ {
+		srv.recordNotification("127.0.0.1", true, bgp.NotificationMessage{Code: bgp.Cease, Subcode: uint8(i)})
+	}
+	history := srv.peerStats["127.0.0.1"].notifications
+	if len(history) != maxNotificationHistory {
+		t.Fatalf("got %d notifications, want %d", len(history), maxNotificationHistory)
+	}
+	if history[0].msg.Subcode != 5 {
+		t.Errorf("oldest notification has subcode %d, want 5", history[0].msg.Subcode)
+	}
+}
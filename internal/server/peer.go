@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -37,40 +38,68 @@ var (
 )
 
 type peer struct {
-	server          *Server
-	peerAsn         uint32
-	isIBGP          bool
-	holdtime        uint16
-	ip              string
-	conn            net.Conn
-	v4eor           bool
-	v6eor           bool
-	weor            bool
-	quiet           bool
-	mutex           sync.RWMutex
-	param           bgp.Parameters
-	rid             bgp.BGPID
-	keepalives      uint64
-	lastKeepalive   time.Time
-	updates         uint64
-	withdraws       uint64
-	startTime       time.Time
-	establishedTime time.Time
-	in              *bytes.Reader
+	server           *Server
+	peerAsn          uint32
+	isIBGP           bool
+	holdtime         uint16
+	ip               string
+	conn             net.Conn
+	v4eor            bool
+	v6eor            bool
+	weor             bool
+	quiet            bool
+	mutex            sync.RWMutex
+	param            bgp.Parameters
+	rid              bgp.BGPID
+	keepalives       uint64
+	lastKeepalive    time.Time
+	updates          uint64
+	withdraws        uint64
+	startTime        time.Time
+	establishedTime  time.Time
+	in               *bytes.Reader
 	prefixes         *bgp.PrefixAttributes
 	v4rib            *routing_table.IPv4Rib
 	v6rib            *routing_table.IPv6Rib
+	v4pre            *routing_table.IPv4Rib // routes as received, if kept before the import policy
+	v6pre            *routing_table.IPv6Rib
+	invalid          map[routing_table.PrefixWithID]struct{} // paths that fail origin validation
+	importMu         sync.Mutex                              // held while routes are imported
 	status           atomic.Uint32
 	staleSince       time.Time
 	restartTimer     *time.Timer
 	eorFallbackTimer *time.Timer
+	llgrTimers       map[uint16]*time.Timer
+	notification     *bgp.NotificationMessage // sent or received, ending the session
+	holdTimer        *time.Timer
+	holdDuration     time.Duration
+	keepaliveTimer   *time.Timer
+	v4disabled       bool
+	v6disabled       bool
+	v4refresh        *time.Timer // running from a BoRR until its EoRR
+	v6refresh        *time.Timer
+	v4limitWarned    bool
+	v6limitWarned    bool
+	v4limitExceeded  bool
+	v6limitExceeded  bool
 	msgRecv          uint64
 	inUpdates        uint64
 	memCleanupOnce   sync.Once
+
+	// RFC 4271 session state. outbound is set for connections we initiated, and collision
+	// points at the connection this one may collide with until its OPEN has been received.
+	state              atomic.Uint32
+	reachedEstablished atomic.Bool
+	outbound           bool
+	collision          *peer
+	sendMu             sync.Mutex
 }
 
 func (p *peer) peerWorker() {
 	defer p.server.remove(p)
+	defer p.state.Store(uint32(StateIdle))
+	defer p.stopTimers()
+	p.startHoldTimer(openHoldTime)
 	for {
 		maxLen := uint16(bgp.MaxMessage)
 		if p.param.ExtendedMessage {
@@ -80,9 +109,10 @@ func (p *peer) peerWorker() {
 		msg, stdBuf, extBuf, err := p.getMessage(maxLen)
 		if err != nil {
 			log.Printf("Bad BGP message from %s: %v\n", p.ip, err)
-			p.conn.Close()
+			p.closeWithError(err)
 			return
 		}
+		p.resetHoldTimer()
 
 		if p.in == nil {
 			p.in = bytes.NewReader(msg)
@@ -100,34 +130,74 @@ func (p *peer) peerWorker() {
 			return
 		}
 
+		state := SessionState(p.state.Load())
 		switch header {
 		case bgp.Open:
+			// An OPEN is only valid before one has been received. Inbound connections wait
+			// in Active for the peer to speak first, outbound ones have already sent theirs.
+			if state != StateActive && state != StateOpenSent {
+				p.fsmError(header, state)
+				return
+			}
 			if err := p.HandleOpen(); err != nil {
-				log.Printf("Error handling Open: %v\n", err)
-				p.conn.Close()
+				log.Printf("Error handling Open from %s: %v\n", p.ip, err)
+				p.closeWithError(err)
 				return
 			}
-			p.conn.Write(bgp.CreateOpen(p.server.Conf.Asn, p.holdtime, p.rid, &p.param))
+			if state == StateActive {
+				p.send(bgp.CreateOpen(p.server.localASN(p.ip), p.server.localHoldTime(p.ip), p.rid, p.server.openParameters(p.ip, p.param)))
+			}
+			p.send(bgp.CreateKeepAlive())
+			p.state.Store(uint32(StateOpenConfirm))
+
+			// A negotiated hold time of zero means neither side sends keepalives
+			hold := time.Duration(p.holdtime) * time.Second
+			p.startHoldTimer(hold)
+			p.startKeepaliveTimer(hold / 3)
 
 		case bgp.Keepalive:
+			if state != StateOpenConfirm && state != StateEstablished {
+				p.fsmError(header, state)
+				return
+			}
 			if err := p.HandleKeepalive(); err != nil {
 				log.Printf("Error handling Keepalive: %v\n", err)
 				p.conn.Close()
 				return
 			}
-			p.conn.Write(bgp.CreateKeepAlive())
+			if state == StateOpenConfirm {
+				p.state.Store(uint32(StateEstablished))
+				p.reachedEstablished.Store(true)
+				log.Printf("Session with %s is Established\n", p.ip)
+			}
 
 		case bgp.Update:
+			if state != StateEstablished {
+				p.fsmError(header, state)
+				return
+			}
 			p.mutex.Lock()
 			p.inUpdates++
 			p.mutex.Unlock()
 			if err := p.handleUpdate(); err != nil {
-				log.Printf("Error handling Update: %v\n", err)
-				p.conn.Close()
+				log.Printf("Error handling Update from %s: %v\n", p.ip, err)
+				p.server.recordUpdateError(p.ip, bgp.ActionSessionReset)
+				p.closeWithError(err)
 				return
 			}
 			p.logUpdate()
 
+		case bgp.Refresh:
+			if state != StateEstablished {
+				p.fsmError(header, state)
+				return
+			}
+			if err := p.handleRefresh(); err != nil {
+				log.Printf("Error handling Route Refresh from %s: %v\n", p.ip, err)
+				p.closeWithError(err)
+				return
+			}
+
 		case bgp.Notification:
 			if err := p.handleNotification(); err != nil {
 				log.Printf("Error handling Notification: %v\n", err)
@@ -148,6 +218,15 @@ func (p *peer) peerWorker() {
 	}
 }
 
+// minMessageLength is the smallest valid length of each message type we understand.
+var minMessageLength = map[uint8]int{
+	bgp.Open:         29,
+	bgp.Update:       23,
+	bgp.Notification: 21,
+	bgp.Keepalive:    bgp.MinMessage,
+	bgp.Refresh:      23,
+}
+
 func (p *peer) getMessage(maxLen uint16) ([]byte, *[bgp.MaxMessage]byte, *[bgp.MaxExtendedMessage]byte, error) {
 	stdBuf := standardPool.Get().(*[bgp.MaxMessage]byte)
 
@@ -160,13 +239,20 @@ func (p *peer) getMessage(maxLen uint16) ([]byte, *[bgp.MaxMessage]byte, *[bgp.M
 	// Validate marker
 	if !bytes.Equal(stdBuf[:16], bgpMarker) {
 		standardPool.Put(stdBuf)
-		return nil, nil, nil, fmt.Errorf("packet is not a BGP packet")
+		return nil, nil, nil, newNotifyError(bgp.HeaderError, bgp.ConnNotSynchronized, nil, "packet is not a BGP packet")
 	}
 
 	msgLen := int(binary.BigEndian.Uint16(stdBuf[16:18]))
-	if msgLen < bgp.MinMessage || msgLen > int(maxLen) {
+	msgType := stdBuf[18]
+	minLen, ok := minMessageLength[msgType]
+	if !ok {
+		standardPool.Put(stdBuf)
+		return nil, nil, nil, newNotifyError(bgp.HeaderError, bgp.BadMessageType, []byte{msgType}, "unknown message type: %d", msgType)
+	}
+	if msgLen < minLen || msgLen > int(maxLen) || (msgType == bgp.Keepalive && msgLen != bgp.MinMessage) {
+		data := []byte{stdBuf[16], stdBuf[17]}
 		standardPool.Put(stdBuf)
-		return nil, nil, nil, fmt.Errorf("invalid BGP message length: %d (max: %d)", msgLen, maxLen)
+		return nil, nil, nil, newNotifyError(bgp.HeaderError, bgp.BadMessageLength, data, "invalid BGP message length: %d (max: %d)", msgLen, maxLen)
 	}
 
 	if msgLen <= bgp.MaxMessage {
@@ -194,6 +280,33 @@ func (p *peer) getMessage(maxLen uint16) ([]byte, *[bgp.MaxMessage]byte, *[bgp.M
 
 // getMessage is deprecated, use p.getMessage()
 
+// send writes a message to the peer. Writes may come from goroutines other than the
+// peerWorker, so they are serialised.
+func (p *peer) send(msg []byte) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	_, err := p.conn.Write(msg)
+	return err
+}
+
+// fsmError handles a message that is not valid in the current state by sending an
+// FSM Error notification and closing the connection. The subcode names the state as per
+// RFC 6608, which leaves it unspecified for the states before OpenSent.
+func (p *peer) fsmError(msgType uint8, state SessionState) {
+	log.Printf("Unexpected message type %d from %s in state %s\n", msgType, p.ip, state)
+	var subcode uint8
+	switch state {
+	case StateOpenSent:
+		subcode = bgp.FsmUnexpectedOpenSent
+	case StateOpenConfirm:
+		subcode = bgp.FsmUnexpectedOpenConfirm
+	case StateEstablished:
+		subcode = bgp.FsmUnexpectedEstablished
+	}
+	p.notify(bgp.FsmError, subcode, nil)
+	p.conn.Close()
+}
+
 func (p *peer) getType() (uint8, error) {
 	var t uint8
 	if err := binary.Read(p.in, binary.BigEndian, &t); err != nil {
@@ -217,9 +330,6 @@ func (p *peer) HandleOpen() error {
 	if err := binary.Read(p.in, binary.BigEndian, &version); err != nil {
 		return err
 	}
-	if version != 4 {
-		return fmt.Errorf("unsupported BGP version: %d", version)
-	}
 
 	var asn16 uint16
 	if err := binary.Read(p.in, binary.BigEndian, &asn16); err != nil {
@@ -247,24 +357,47 @@ func (p *peer) HandleOpen() error {
 	}
 
 	params, err := bgp.DecodeOptionalParameters(&pbuffer)
+	if errors.Is(err, bgp.ErrUnsupportedOptParam) {
+		return newNotifyError(bgp.OpenError, bgp.UnsupportedOptParam, nil, "%v", err)
+	}
+	if errors.Is(err, bgp.ErrRoleMismatch) {
+		return newNotifyError(bgp.OpenError, bgp.RoleMismatch, nil, "%v", err)
+	}
 	if err != nil {
+		return newNotifyError(bgp.OpenError, 0, nil, "malformed optional parameters: %v", err)
+	}
+
+	asn := uint32(asn16)
+	if params.ASN32 != [4]byte{} {
+		asn = binary.BigEndian.Uint32(params.ASN32[:])
+	}
+	if err := p.checkOpen(version, asn, rid, params); err != nil {
 		return err
 	}
 
+	if p.collision != nil && !p.server.resolveCollision(p, rid) {
+		return fmt.Errorf("connection lost collision resolution")
+	}
+
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	p.peerAsn = uint32(asn16)
-	p.holdtime = holdtime
 	p.param = params
 
+	negotiated, ok := negotiateHoldTime(p.server.localHoldTime(p.ip), holdtime)
+	if !ok {
+		return newNotifyError(bgp.OpenError, bgp.UnacceptableHoldTime, nil, "unacceptable hold time: %d", holdtime)
+	}
+	p.holdtime = negotiated
+
 	// Check for 32-bit ASN capability
 	emptyASN := [4]byte{}
 	if !bytes.Equal(params.ASN32[:], emptyASN[:]) {
 		p.peerAsn = binary.BigEndian.Uint32(params.ASN32[:])
 	}
 
-	if p.peerAsn == p.server.Conf.Asn {
+	if p.peerAsn == p.server.localASN(p.ip) {
 		p.isIBGP = true
 		log.Printf("iBGP session established with peer %s (AS %d)\n", p.ip, p.peerAsn)
 	} else {
@@ -304,6 +437,14 @@ func (p *peer) HandleOpen() error {
 	if v6 && p.v6rib == nil {
 		p.v6rib = routing_table.NewIPv6Rib(p.server.v6AttrTable)
 	}
+	if p.server.keepsPrePolicy(p.ip) {
+		if v4 && p.v4pre == nil {
+			p.v4pre = routing_table.NewIPv4Rib(p.server.v4AttrTable)
+		}
+		if v6 && p.v6pre == nil {
+			p.v6pre = routing_table.NewIPv6Rib(p.server.v6AttrTable)
+		}
+	}
 
 	// All sessions transition to WaitingForEOR state during capability exchange
 	p.status.Store(uint32(StatusWaitingForEOR))
@@ -317,21 +458,19 @@ func (p *peer) HandleOpen() error {
 }
 
 func (p *peer) handleNotification() error {
-	var code uint8
-	if err := binary.Read(p.in, binary.BigEndian, &code); err != nil {
-		return fmt.Errorf("reading notification code: %w", err)
-	}
-	var subcode uint8
-	if err := binary.Read(p.in, binary.BigEndian, &subcode); err != nil {
-		return fmt.Errorf("reading notification subcode: %w", err)
+	body, err := io.ReadAll(p.in)
+	if err != nil {
+		return fmt.Errorf("reading notification: %w", err)
 	}
-	log.Printf("Notification received from %s: code %d, subcode %d\n", p.ip, code, subcode)
-	p.server.mutex.Lock()
-	if _, ok := p.server.peerStats[p.ip]; !ok {
-		p.server.peerStats[p.ip] = &persistentPeerStats{}
+	msg, err := bgp.DecodeNotification(body)
+	if err != nil {
+		return err
 	}
-	p.server.peerStats[p.ip].lastNotification = fmt.Sprintf("%d / %d", code, subcode)
-	p.server.mutex.Unlock()
+	log.Printf("Notification received from %s: %v\n", p.ip, msg)
+	p.server.recordNotification(p.ip, false, msg)
+	p.mutex.Lock()
+	p.notification = &msg
+	p.mutex.Unlock()
 	return nil
 }
 
@@ -361,7 +500,7 @@ func (p *peer) handleUpdate() error {
 		}
 		wd, err := bgp.DecodeIPv4Withdraws(wbuf, v4AddPath)
 		if err != nil {
-			return err
+			return &bgp.AttrError{Action: bgp.ActionSessionReset, Subcode: bgp.MalformedAttrList, Err: err}
 		}
 		pa.V4Withdraws = wd.V4Withdraws
 	}
@@ -394,7 +533,8 @@ func (p *peer) handleUpdate() error {
 		return err
 	}
 
-	attr, err := bgp.DecodePathAttributes(abuf, v6AddPath, p.server.Conf.IgnoreCommunities)
+	asn4 := p.param.ASN32 != [4]byte{}
+	attr, err := bgp.DecodePathAttributes(abuf, asn4, v4AddPath, v6AddPath, p.server.Conf.IgnoreCommunities)
 	if err != nil {
 		return err
 	}
@@ -403,19 +543,30 @@ func (p *peer) handleUpdate() error {
 	if p.in.Len() > 0 {
 		v4prefixes, err := bgp.DecodeIPv4NLRI(p.in, v4AddPath)
 		if err != nil {
-			return err
+			return &bgp.AttrError{Action: bgp.ActionSessionReset, Subcode: bgp.InvalidNetworkField, Err: err}
 		}
 		pa.V4prefixes = v4prefixes
 	}
 
 	if pa.Attr != nil {
-		pa.V4NextHop = pa.Attr.NextHopv4
+		if pa.Attr.NextHopv4 != "" {
+			pa.V4NextHops = []string{pa.Attr.NextHopv4}
+		}
+		// IPv4 routes in MP_REACH_NLRI use its next hop rather than NEXT_HOP (RFC 4760 section 3)
+		if len(pa.Attr.Ipv4NLRI) > 0 {
+			pa.V4prefixes = append(pa.V4prefixes, pa.Attr.Ipv4NLRI...)
+			pa.V4NextHops = pa.Attr.NextHopsv4
+		}
+		pa.V4Withdraws = append(pa.V4Withdraws, pa.Attr.V4Withdraws...)
+		pa.V4EoR = pa.Attr.V4EoR
 		pa.V6prefixes = pa.Attr.Ipv6NLRI
 		pa.V6NextHops = pa.Attr.NextHopsv6
 		pa.V6EoR = pa.Attr.V6EoR
 		pa.V6Withdraws = pa.Attr.V6Withdraws
 	}
 
+	p.handleAttrErrors(&pa)
+
 	p.mutex.Lock()
 	if pa.V4EoR {
 		p.v4eor = true
@@ -430,6 +581,84 @@ func (p *peer) handleUpdate() error {
 	return nil
 }
 
+// handleAttrErrors applies the RFC 7606 action for each malformed attribute in the UPDATE.
+// Discarded attributes are simply left out by the decoder, so only treat-as-withdraw and
+// AFI/SAFI disable need anything from us.
+func (p *peer) handleAttrErrors(pa *bgp.PrefixAttributes) {
+	errs := pa.Attr.Errors
+
+	// NEXT_HOP is only mandatory alongside IPv4 NLRI outside MP_REACH_NLRI, which the
+	// attribute decoder never sees
+	if len(pa.V4prefixes) > len(pa.Attr.Ipv4NLRI) && pa.Attr.NextHopv4 == "" {
+		errs = append(errs, bgp.AttrError{Code: 3, Action: bgp.ActionTreatAsWithdraw, Subcode: bgp.MissingWellKnown, Err: fmt.Errorf("missing NEXT_HOP")})
+	}
+
+	for _, e := range errs {
+		log.Printf("Malformed UPDATE from %s: %v\n", p.ip, &e)
+		p.server.recordUpdateError(p.ip, e.Action)
+		switch e.Action {
+		case bgp.ActionTreatAsWithdraw:
+			pa.TreatAsWithdraw = true
+		case bgp.ActionAFISAFIDisable:
+			p.disableFamily(e.AFI, e.SAFI)
+		}
+	}
+
+	p.mutex.RLock()
+	v4disabled, v6disabled := p.v4disabled, p.v6disabled
+	p.mutex.RUnlock()
+	if v4disabled {
+		pa.V4prefixes = nil
+		pa.V4Withdraws = nil
+		pa.V4EoR = false
+	}
+	if v6disabled {
+		pa.V6prefixes = nil
+		pa.V6Withdraws = nil
+		pa.V6EoR = false
+	}
+}
+
+// disableFamily stops accepting routes for an AFI/SAFI after a malformed MP_REACH_NLRI or
+// MP_UNREACH_NLRI and removes what the peer already sent us for it (RFC 7606 section 7.11).
+func (p *peer) disableFamily(afi uint16, safi uint8) {
+	if safi != 1 {
+		return
+	}
+	p.mutex.Lock()
+	switch afi {
+	case 1:
+		if p.v4disabled {
+			p.mutex.Unlock()
+			return
+		}
+		p.v4disabled = true
+		p.v4pre = nil
+	case 2:
+		if p.v6disabled {
+			p.mutex.Unlock()
+			return
+		}
+		p.v6disabled = true
+		p.v6pre = nil
+	default:
+		p.mutex.Unlock()
+		return
+	}
+	v4rib, v6rib := p.v4rib, p.v6rib
+	p.mutex.Unlock()
+
+	log.Printf("Disabling AFI %d SAFI %d for %s\n", afi, safi, p.ip)
+	if afi == 1 && v4rib != nil {
+		v4rib.MarkAllStale()
+		p.server.removeGlobalV4(v4rib.DeleteStaleRoutes())
+	}
+	if afi == 2 && v6rib != nil {
+		v6rib.MarkAllStale()
+		p.server.removeGlobalV6(v6rib.DeleteStaleRoutes())
+	}
+}
+
 func (p *peer) logUpdate() {
 	if p.weor && !(p.v4eor || p.v6eor) {
 		p.mutex.Lock()
@@ -461,8 +690,8 @@ func (p *peer) logUpdate() {
 				log.Printf("%v/%d\n", prefix.Prefix, prefix.Mask)
 			}
 		}
-		if p.prefixes.V4NextHop != "" {
-			log.Printf("With next-hop: %s", p.prefixes.V4NextHop)
+		if len(p.prefixes.V4NextHops) > 0 {
+			log.Printf("With next-hops: %v", p.prefixes.V4NextHops)
 		}
 	}
 
@@ -492,6 +721,9 @@ func (p *peer) logUpdate() {
 		if len(p.prefixes.Attr.LargeCommunities) > 0 {
 			log.Printf("Large Communities: %s\n", bgp.FormatLargeCommunities(&p.prefixes.Attr.LargeCommunities))
 		}
+		if len(p.prefixes.Attr.ExtendCommunities) > 0 {
+			log.Printf("Extended Communities: %s\n", bgp.FormatExtendedCommunities(&p.prefixes.Attr.ExtendCommunities))
+		}
 	}
 
 	if p.prefixes.V4EoR {
@@ -511,19 +743,44 @@ func (p *peer) logUpdate() {
 	p.mutex.Unlock()
 }
 
-func mapAttributes(pa *bgp.PathAttr) *routing_table.RouteAttributes {
+// mapAttributes converts decoded path attributes into their RIB form. nextHops are the next
+// hops for the family being stored, with an IPv6 link-local next hop as the optional second.
+func mapAttributes(pa *bgp.PathAttr, nextHops []string) *routing_table.RouteAttributes {
 	if pa == nil {
 		return &routing_table.RouteAttributes{}
 	}
 
 	ra := &routing_table.RouteAttributes{
-		LocalPref: pa.LocalPref,
+		Origin:          uint8(pa.Origin),
+		Med:             pa.Med,
+		LocalPref:       pa.LocalPref,
+		AtomicAggregate: pa.Atomic,
+		AggregatorAS:    pa.AgAS,
+		OnlyToCustomer:  pa.OTC,
 	}
 
 	for _, seg := range pa.Aspath {
 		if seg.Type == 2 { // AS_SEQUENCE
-			ra.AsPath = append(ra.AsPath, seg.ASN)
+			ra.AsPath = append(ra.AsPath, seg.ASNs...)
 		}
+		ra.AsPathSegments = append(ra.AsPathSegments, routing_table.AsPathSegment{
+			Type: seg.Type,
+			ASNs: seg.ASNs,
+		})
+	}
+
+	if len(nextHops) > 0 {
+		ra.NextHop = parseAddr(nextHops[0])
+	}
+	if len(nextHops) > 1 {
+		ra.LinkLocalNextHop = parseAddr(nextHops[1])
+	}
+	if ip, ok := netip.AddrFromSlice(pa.AgOrigin.To4()); ok {
+		ra.AggregatorAddr = ip
+	}
+	ra.OriginatorID = parseAddr(pa.Originator)
+	for _, c := range pa.ClusterList {
+		ra.ClusterList = append(ra.ClusterList, parseAddr(c))
 	}
 
 	for _, c := range pa.Communities {
@@ -538,17 +795,49 @@ func mapAttributes(pa *bgp.PathAttr) *routing_table.RouteAttributes {
 		})
 	}
 
+	for _, ec := range pa.ExtendCommunities {
+		ra.ExtendedCommunities = append(ra.ExtendedCommunities, toRIBExtendedCommunity(ec))
+	}
+
 	return ra
 }
 
+func toRIBExtendedCommunity(ec bgp.ExtendCommunity) routing_table.ExtendedCommunity {
+	rec := routing_table.ExtendedCommunity{
+		IPv6:    ec.IPv6,
+		Type:    ec.Type,
+		Subtype: ec.Subtype,
+	}
+	copy(rec.Value[:], ec.Value)
+	return rec
+}
+
+// parseAddr returns the zero Addr for an empty or invalid address.
+func parseAddr(s string) netip.Addr {
+	ip, _ := netip.ParseAddr(s)
+	return ip
+}
+
 func (p *peer) processRibUpdates() {
 	p.mutex.RLock()
 	prefixes := p.prefixes
+	v4pre, v6pre := p.v4pre, p.v6pre
 	p.mutex.RUnlock()
 
 	if prefixes == nil {
 		return
 	}
+	p.importMu.Lock()
+	defer p.importMu.Unlock()
+
+	// Treat-as-withdraw (RFC 7606 section 2): routes announced with malformed attributes
+	// replace nothing and are removed instead.
+	if prefixes.TreatAsWithdraw {
+		prefixes.V4Withdraws = append(prefixes.V4Withdraws, prefixes.V4prefixes...)
+		prefixes.V6Withdraws = append(prefixes.V6Withdraws, prefixes.V6prefixes...)
+		prefixes.V4prefixes = nil
+		prefixes.V6prefixes = nil
+	}
 
 	p.mutex.Lock()
 	p.withdraws += uint64(len(prefixes.V4Withdraws) + len(prefixes.V6Withdraws))
@@ -565,6 +854,10 @@ func (p *peer) processRibUpdates() {
 			}
 		}
 		removedV4 := p.v4rib.DeleteBatch(v4w)
+		p.forgetRoutes(v4w)
+		if v4pre != nil {
+			v4pre.DeleteBatch(v4w)
+		}
 		if len(removedV4) > 0 {
 			p.server.removeGlobalV4(removedV4)
 		}
@@ -579,6 +872,10 @@ func (p *peer) processRibUpdates() {
 			}
 		}
 		removedV6 := p.v6rib.DeleteBatch(v6w)
+		p.forgetRoutes(v6w)
+		if v6pre != nil {
+			v6pre.DeleteBatch(v6w)
+		}
 		if len(removedV6) > 0 {
 			p.server.removeGlobalV6(removedV6)
 		}
@@ -586,9 +883,10 @@ func (p *peer) processRibUpdates() {
 
 	// Process announcements
 	if prefixes.Attr != nil && (len(prefixes.V4prefixes) > 0 || len(prefixes.V6prefixes) > 0) {
-		ra := mapAttributes(prefixes.Attr)
-
+		otc := p.ingressOTC(prefixes.Attr, len(prefixes.V4prefixes)+len(prefixes.V6prefixes))
 		if len(prefixes.V4prefixes) > 0 && p.v4rib != nil {
+			ra := mapAttributes(prefixes.Attr, prefixes.V4NextHops)
+			ra.OnlyToCustomer = otc
 			var v4a []routing_table.Route
 			for _, pfx := range prefixes.V4prefixes {
 				if ip, ok := netip.AddrFromSlice(pfx.Prefix); ok {
@@ -600,13 +898,30 @@ func (p *peer) processRibUpdates() {
 					})
 				}
 			}
+			if v4pre != nil {
+				v4pre.InsertBatch(v4a)
+			}
+			v4a, rejected := p.importRoutes(v4a)
+			if len(rejected) > 0 {
+				if removed := p.v4rib.DeleteBatch(rejected); len(removed) > 0 {
+					p.server.removeGlobalV4(removed)
+				}
+				p.forgetRoutes(rejected)
+			}
+			v4a = p.dropExcessRoutes(1, p.v4rib, v4a)
 			newV4 := p.v4rib.InsertBatch(v4a)
+			p.validateRoutes(v4a)
 			if len(newV4) > 0 {
 				p.server.addGlobalV4(newV4)
 			}
+			if !p.checkPrefixLimit(1, p.v4rib.Count()) {
+				return
+			}
 		}
 
 		if len(prefixes.V6prefixes) > 0 && p.v6rib != nil {
+			ra := mapAttributes(prefixes.Attr, prefixes.V6NextHops)
+			ra.OnlyToCustomer = otc
 			var v6a []routing_table.Route
 			for _, pfx := range prefixes.V6prefixes {
 				if ip, ok := netip.AddrFromSlice(pfx.Prefix); ok {
@@ -618,10 +933,25 @@ func (p *peer) processRibUpdates() {
 					})
 				}
 			}
+			if v6pre != nil {
+				v6pre.InsertBatch(v6a)
+			}
+			v6a, rejected := p.importRoutes(v6a)
+			if len(rejected) > 0 {
+				if removed := p.v6rib.DeleteBatch(rejected); len(removed) > 0 {
+					p.server.removeGlobalV6(removed)
+				}
+				p.forgetRoutes(rejected)
+			}
+			v6a = p.dropExcessRoutes(2, p.v6rib, v6a)
 			newV6 := p.v6rib.InsertBatch(v6a)
+			p.validateRoutes(v6a)
 			if len(newV6) > 0 {
 				p.server.addGlobalV6(newV6)
 			}
+			if !p.checkPrefixLimit(2, p.v6rib.Count()) {
+				return
+			}
 		}
 	}
 
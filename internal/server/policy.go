@@ -0,0 +1,517 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mellowdrifter/bogons"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// Import policy actions. A term without one modifies the routes it matches and evaluation
+// carries on with the next term.
+const (
+	policyAccept = "accept"
+	policyReject = "reject"
+)
+
+// PrefixListEntry matches Prefix and, with GE and LE, its more specifics of those lengths.
+// Without GE or LE only Prefix itself matches, with GE alone more specifics of at least GE
+// bits, and with LE alone those of at most LE bits.
+type PrefixListEntry struct {
+	Prefix netip.Prefix `json:"prefix"`
+	GE     int          `json:"ge,omitempty"`
+	LE     int          `json:"le,omitempty"`
+}
+
+// PolicyTerm is one term of an import policy. A route matches the term if it meets all of
+// its conditions, so a term without conditions matches every route. PrefixList, ASPathList
+// and CommunityList name lists in the config file. BogonPrefix matches reserved and default
+// prefixes, BogonASN paths through a private or reserved AS, and LongerThanV4 and
+// LongerThanV6 prefixes more specific than that length.
+type PolicyTerm struct {
+	Name string `json:"name,omitempty"`
+
+	PrefixList    string `json:"prefix_list,omitempty"`
+	ASPathList    string `json:"as_path_list,omitempty"`
+	CommunityList string `json:"community_list,omitempty"`
+	BogonPrefix   bool   `json:"bogon_prefix,omitempty"`
+	BogonASN      bool   `json:"bogon_asn,omitempty"`
+	LongerThanV4  int    `json:"longer_than_v4,omitempty"`
+	LongerThanV6  int    `json:"longer_than_v6,omitempty"`
+
+	// Action is accept or reject, which ends evaluation, or empty to apply the other actions
+	// and carry on. SetLocalPref replaces the LOCAL_PREF, AddCommunities tags the route with
+	// standard or large communities, and StripCommunities removes those matching the named
+	// community list.
+	Action           string   `json:"action,omitempty"`
+	SetLocalPref     *uint32  `json:"set_local_pref,omitempty"`
+	AddCommunities   []string `json:"add_communities,omitempty"`
+	StripCommunities string   `json:"strip_communities,omitempty"`
+}
+
+// Policy is a compiled import policy. Its terms are evaluated in order, and routes that no
+// term accepts or rejects are accepted with whatever changes the terms made.
+type Policy struct {
+	Name  string
+	terms []policyTerm
+}
+
+type policyTerm struct {
+	prefixes     []PrefixListEntry
+	asPaths      []*regexp.Regexp
+	communities  []communityPattern
+	bogonPrefix  bool
+	bogonASN     bool
+	longerThanV4 int
+	longerThanV6 int
+
+	action       string
+	setLocalPref *uint32
+	add          []communityPattern
+	strip        []communityPattern
+}
+
+// compilePolicies checks the import policies in the config file and the lists they use.
+func compilePolicies(cf *ConfigFile) (map[string]*Policy, error) {
+	for name, entries := range cf.PrefixLists {
+		for _, e := range entries {
+			if err := e.validate(); err != nil {
+				return nil, fmt.Errorf("prefix list %s: %v", name, err)
+			}
+		}
+	}
+	asPaths := make(map[string][]*regexp.Regexp)
+	for name, exprs := range cf.ASPathLists {
+		for _, expr := range exprs {
+			re, err := regexp.Compile(ciscoRegexpToGo(expr))
+			if err != nil {
+				return nil, fmt.Errorf("as path list %s: invalid regex %q: %v", name, expr, err)
+			}
+			asPaths[name] = append(asPaths[name], re)
+		}
+	}
+	communities := make(map[string][]communityPattern)
+	for name, patterns := range cf.CommunityLists {
+		for _, s := range patterns {
+			c, err := parseCommunityPattern(s, true)
+			if err != nil {
+				return nil, fmt.Errorf("community list %s: %v", name, err)
+			}
+			communities[name] = append(communities[name], c)
+		}
+	}
+
+	policies := make(map[string]*Policy, len(cf.Policies))
+	for name, terms := range cf.Policies {
+		pol := &Policy{Name: name}
+		for i, t := range terms {
+			term, err := t.compile(cf.PrefixLists, asPaths, communities)
+			if err != nil {
+				if t.Name != "" {
+					return nil, fmt.Errorf("policy %s term %s: %v", name, t.Name, err)
+				}
+				return nil, fmt.Errorf("policy %s term %d: %v", name, i+1, err)
+			}
+			pol.terms = append(pol.terms, term)
+		}
+		policies[name] = pol
+	}
+	return policies, nil
+}
+
+// lookupPolicy returns the named policy, or nil if name is empty.
+func lookupPolicy(policies map[string]*Policy, name string) (*Policy, error) {
+	if name == "" {
+		return nil, nil
+	}
+	pol, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown import_policy %q", name)
+	}
+	return pol, nil
+}
+
+func (t PolicyTerm) compile(prefixes map[string][]PrefixListEntry, asPaths map[string][]*regexp.Regexp, communities map[string][]communityPattern) (policyTerm, error) {
+	term := policyTerm{
+		bogonPrefix:  t.BogonPrefix,
+		bogonASN:     t.BogonASN,
+		longerThanV4: t.LongerThanV4,
+		longerThanV6: t.LongerThanV6,
+		action:       t.Action,
+		setLocalPref: t.SetLocalPref,
+	}
+	var ok bool
+	if t.PrefixList != "" {
+		if term.prefixes, ok = prefixes[t.PrefixList]; !ok {
+			return term, fmt.Errorf("unknown prefix list %q", t.PrefixList)
+		}
+	}
+	if t.ASPathList != "" {
+		if term.asPaths, ok = asPaths[t.ASPathList]; !ok {
+			return term, fmt.Errorf("unknown as path list %q", t.ASPathList)
+		}
+	}
+	if t.CommunityList != "" {
+		if term.communities, ok = communities[t.CommunityList]; !ok {
+			return term, fmt.Errorf("unknown community list %q", t.CommunityList)
+		}
+	}
+	if t.StripCommunities != "" {
+		if term.strip, ok = communities[t.StripCommunities]; !ok {
+			return term, fmt.Errorf("unknown community list %q", t.StripCommunities)
+		}
+	}
+	if t.LongerThanV4 < 0 || t.LongerThanV4 > 32 {
+		return term, fmt.Errorf("invalid longer_than_v4: %d", t.LongerThanV4)
+	}
+	if t.LongerThanV6 < 0 || t.LongerThanV6 > 128 {
+		return term, fmt.Errorf("invalid longer_than_v6: %d", t.LongerThanV6)
+	}
+	switch t.Action {
+	case "", policyAccept, policyReject:
+	default:
+		return term, fmt.Errorf("unknown action: %q", t.Action)
+	}
+	for _, s := range t.AddCommunities {
+		c, err := parseCommunityPattern(s, false)
+		if err != nil {
+			return term, err
+		}
+		term.add = append(term.add, c)
+	}
+	return term, nil
+}
+
+func (e PrefixListEntry) validate() error {
+	if !e.Prefix.IsValid() {
+		return fmt.Errorf("entry missing prefix")
+	}
+	bits := e.Prefix.Addr().BitLen()
+	if e.GE != 0 && (e.GE < e.Prefix.Bits() || e.GE > bits) {
+		return fmt.Errorf("%s: invalid ge %d", e.Prefix, e.GE)
+	}
+	if e.LE != 0 && (e.LE < e.Prefix.Bits() || e.LE > bits || e.LE < e.GE) {
+		return fmt.Errorf("%s: invalid le %d", e.Prefix, e.LE)
+	}
+	return nil
+}
+
+// matches reports whether prefix is matched by the entry.
+func (e PrefixListEntry) matches(prefix netip.Prefix) bool {
+	if e.Prefix.Addr().Is4() != prefix.Addr().Is4() || prefix.Bits() < e.Prefix.Bits() {
+		return false
+	}
+	if !e.Prefix.Masked().Contains(prefix.Addr()) {
+		return false
+	}
+	lo, hi := e.Prefix.Bits(), e.Prefix.Bits()
+	switch {
+	case e.GE != 0 && e.LE != 0:
+		lo, hi = e.GE, e.LE
+	case e.GE != 0:
+		lo, hi = e.GE, prefix.Addr().BitLen()
+	case e.LE != 0:
+		hi = e.LE
+	}
+	return prefix.Bits() >= lo && prefix.Bits() <= hi
+}
+
+// Apply runs routes, which may share their attributes, through the policy. It returns the
+// routes accepted, with new attributes where a term changed them, and the rejected paths.
+func (pol *Policy) Apply(routes []routing_table.Route) ([]routing_table.Route, []routing_table.PrefixWithID) {
+	type outcome struct {
+		attrs *routing_table.RouteAttributes
+		terms string
+	}
+	// Routes that went through the same modifying terms share the same new attributes
+	modified := make(map[outcome]*routing_table.RouteAttributes)
+
+	var accepted []routing_table.Route
+	var rejected []routing_table.PrefixWithID
+	for _, r := range routes {
+		var applied []int
+		reject := false
+		for i, t := range pol.terms {
+			if !t.matches(&r) {
+				continue
+			}
+			if t.setLocalPref != nil || len(t.add) > 0 || len(t.strip) > 0 {
+				applied = append(applied, i)
+			}
+			if t.action != "" {
+				reject = t.action == policyReject
+				break
+			}
+		}
+		if reject {
+			rejected = append(rejected, routing_table.PrefixWithID{Prefix: r.Prefix, PathID: r.PathID})
+			continue
+		}
+		if len(applied) > 0 {
+			key := outcome{r.Attributes, fmt.Sprint(applied)}
+			ra, ok := modified[key]
+			if !ok {
+				ra = pol.modify(r.Attributes, applied)
+				modified[key] = ra
+			}
+			r.Attributes = ra
+		}
+		accepted = append(accepted, r)
+	}
+	return accepted, rejected
+}
+
+// modify returns a copy of ra changed by the terms at the given indexes, in order.
+func (pol *Policy) modify(ra *routing_table.RouteAttributes, terms []int) *routing_table.RouteAttributes {
+	out := *ra
+	out.Communities = slices.Clone(ra.Communities)
+	out.LargeCommunities = slices.Clone(ra.LargeCommunities)
+	for _, i := range terms {
+		t := &pol.terms[i]
+		if t.setLocalPref != nil {
+			out.LocalPref = *t.setLocalPref
+		}
+		if len(t.strip) > 0 {
+			out.Communities = slices.DeleteFunc(out.Communities, func(c uint32) bool { return matchStandard(t.strip, c) })
+			out.LargeCommunities = slices.DeleteFunc(out.LargeCommunities, func(c routing_table.LargeCommunity) bool { return matchLarge(t.strip, c) })
+		}
+		for _, c := range t.add {
+			if c.large {
+				if lc := c.largeCommunity(); !slices.Contains(out.LargeCommunities, lc) {
+					out.LargeCommunities = append(out.LargeCommunities, lc)
+				}
+			} else if v := c.standard(); !slices.Contains(out.Communities, v) {
+				out.Communities = append(out.Communities, v)
+			}
+		}
+	}
+	return &out
+}
+
+// importRoutes runs routes from the peer through its import policy, if it has one, returning
+// those to store and the paths rejected. A rejected path may replace one accepted before, so
+// the caller removes them from the RIB.
+func (p *peer) importRoutes(routes []routing_table.Route) ([]routing_table.Route, []routing_table.PrefixWithID) {
+	pc, _ := p.server.peerConfig(p.ip)
+	if pc.Import == nil {
+		return routes, nil
+	}
+	accepted, rejected := pc.Import.Apply(routes)
+	if len(rejected) > 0 {
+		p.server.mutex.Lock()
+		if _, ok := p.server.peerStats[p.ip]; !ok {
+			p.server.peerStats[p.ip] = &persistentPeerStats{}
+		}
+		p.server.peerStats[p.ip].policyRejects += uint64(len(rejected))
+		p.server.mutex.Unlock()
+	}
+	return accepted, rejected
+}
+
+// importRib is the part of an IPv4 or IPv6 RIB needed to run its routes through the import
+// policy again.
+type importRib interface {
+	pathRib
+	prefixRib
+	InsertBatch([]routing_table.Route) []netip.Prefix
+	DeleteBatch([]routing_table.PrefixWithID) []netip.Prefix
+}
+
+// reimport runs the routes kept before the import policy through it again, replacing those
+// in the post-policy RIB, so a changed policy applies to routes already learned. Stale paths
+// are left for the restart or refresh underway to replace or purge.
+func (p *peer) reimport(afi uint16, pre, post importRib) {
+	p.importMu.Lock()
+	defer p.importMu.Unlock()
+
+	var routes []routing_table.Route
+	keep := make(map[routing_table.PrefixWithID]bool)
+	for _, pfx := range pre.AllPrefixes() {
+		for _, r := range pre.AllPaths(pfx) {
+			if r.Stale {
+				keep[routing_table.PrefixWithID{Prefix: pfx, PathID: r.PathID}] = true
+				continue
+			}
+			routes = append(routes, r)
+		}
+	}
+	accepted, _ := p.importRoutes(routes)
+	for _, r := range accepted {
+		keep[routing_table.PrefixWithID{Prefix: r.Prefix, PathID: r.PathID}] = true
+	}
+
+	var gone []routing_table.PrefixWithID
+	for _, pfx := range post.AllPrefixes() {
+		for _, r := range post.AllPaths(pfx) {
+			if k := (routing_table.PrefixWithID{Prefix: pfx, PathID: r.PathID}); !keep[k] {
+				gone = append(gone, k)
+			}
+		}
+	}
+	removed := post.DeleteBatch(gone)
+	p.forgetRoutes(gone)
+	accepted = p.dropExcessRoutes(afi, post, accepted)
+	added := post.InsertBatch(accepted)
+	p.validateRoutes(accepted)
+
+	if afi == 1 {
+		p.server.removeGlobalV4(removed)
+		p.server.addGlobalV4(added)
+	} else {
+		p.server.removeGlobalV6(removed)
+		p.server.addGlobalV6(added)
+	}
+	p.checkPrefixLimit(afi, post.Count())
+}
+
+// matches reports whether a route meets all of the term's conditions.
+func (t *policyTerm) matches(r *routing_table.Route) bool {
+	is4 := r.Prefix.Addr().Is4()
+	if t.longerThanV4 > 0 || t.longerThanV6 > 0 {
+		switch {
+		case is4 && t.longerThanV4 > 0 && r.Prefix.Bits() > t.longerThanV4:
+		case !is4 && t.longerThanV6 > 0 && r.Prefix.Bits() > t.longerThanV6:
+		default:
+			return false
+		}
+	}
+	if t.bogonPrefix && bogons.ValidPublicAddr(r.Prefix.Addr()) {
+		return false
+	}
+	if t.prefixes != nil && !matchPrefixList(t.prefixes, r.Prefix) {
+		return false
+	}
+	if t.bogonASN && !hasBogonASN(r.Attributes) {
+		return false
+	}
+	if t.asPaths != nil && !matchASPathList(t.asPaths, r.Attributes) {
+		return false
+	}
+	if t.communities != nil && !hasCommunity(t.communities, r.Attributes) {
+		return false
+	}
+	return true
+}
+
+func matchPrefixList(entries []PrefixListEntry, prefix netip.Prefix) bool {
+	for _, e := range entries {
+		if e.matches(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBogonASN reports whether a path goes through a private or reserved AS. Confederation
+// segments, which hold member AS numbers from within the confederation, are not checked.
+func hasBogonASN(ra *routing_table.RouteAttributes) bool {
+	for _, seg := range ra.AsPathSegments {
+		if seg.Type != 1 && seg.Type != 2 { // AS_SET, AS_SEQUENCE
+			continue
+		}
+		for _, asn := range seg.ASNs {
+			if !bogons.ValidPublicASN(asn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchASPathList matches the AS_SEQUENCE ASNs of a path, separated by spaces, as
+// GetPrefixesByAsPath does.
+func matchASPathList(exprs []*regexp.Regexp, ra *routing_table.RouteAttributes) bool {
+	asns := make([]string, len(ra.AsPath))
+	for i, asn := range ra.AsPath {
+		asns[i] = strconv.FormatUint(uint64(asn), 10)
+	}
+	path := strings.Join(asns, " ")
+	for _, re := range exprs {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCommunity(patterns []communityPattern, ra *routing_table.RouteAttributes) bool {
+	for _, c := range ra.Communities {
+		if matchStandard(patterns, c) {
+			return true
+		}
+	}
+	for _, c := range ra.LargeCommunities {
+		if matchLarge(patterns, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// communityPattern is a standard community, asn:value, or a large community,
+// global:local1:local2. In community lists any part may be * to match every value.
+type communityPattern struct {
+	large bool
+	parts [3]uint32
+	any   [3]bool
+}
+
+func parseCommunityPattern(s string, wildcards bool) (communityPattern, error) {
+	var c communityPattern
+	fields := strings.Split(s, ":")
+	bits := 16
+	switch len(fields) {
+	case 2:
+	case 3:
+		c.large, bits = true, 32
+	default:
+		return c, fmt.Errorf("invalid community %q", s)
+	}
+	for i, f := range fields {
+		if f == "*" && wildcards {
+			c.any[i] = true
+			continue
+		}
+		v, err := strconv.ParseUint(f, 10, bits)
+		if err != nil {
+			return c, fmt.Errorf("invalid community %q", s)
+		}
+		c.parts[i] = uint32(v)
+	}
+	return c, nil
+}
+
+func (c communityPattern) match(i int, v uint32) bool {
+	return c.any[i] || c.parts[i] == v
+}
+
+func (c communityPattern) standard() uint32 {
+	return c.parts[0]<<16 | c.parts[1]
+}
+
+func (c communityPattern) largeCommunity() routing_table.LargeCommunity {
+	return routing_table.LargeCommunity{GlobalAdmin: c.parts[0], LocalData1: c.parts[1], LocalData2: c.parts[2]}
+}
+
+func matchStandard(patterns []communityPattern, v uint32) bool {
+	for _, c := range patterns {
+		if !c.large && c.match(0, v>>16) && c.match(1, v&0xffff) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchLarge(patterns []communityPattern, v routing_table.LargeCommunity) bool {
+	for _, c := range patterns {
+		if c.large && c.match(0, v.GlobalAdmin) && c.match(1, v.LocalData1) && c.match(2, v.LocalData2) {
+			return true
+		}
+	}
+	return false
+}
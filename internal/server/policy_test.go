@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// testPolicy compiles the config file fragment in config and returns its policy named test.
+func testPolicy(t *testing.T, config string) *Policy {
+	t.Helper()
+	var cf ConfigFile
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := compilePolicies(&cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policies["test"]
+}
+
+func TestPrefixListEntry(t *testing.T) {
+	tests := []struct {
+		entry  string
+		prefix string
+		want   bool
+	}{
+		{entry: `{"prefix": "10.0.0.0/8"}`, prefix: "10.0.0.0/8", want: true},
+		{entry: `{"prefix": "10.0.0.0/8"}`, prefix: "10.1.0.0/16"},
+		{entry: `{"prefix": "10.0.0.0/8", "le": 16}`, prefix: "10.1.0.0/16", want: true},
+		{entry: `{"prefix": "10.0.0.0/8", "le": 16}`, prefix: "10.1.1.0/24"},
+		{entry: `{"prefix": "10.0.0.0/8", "ge": 24}`, prefix: "10.1.1.0/24", want: true},
+		{entry: `{"prefix": "10.0.0.0/8", "ge": 24}`, prefix: "10.0.0.0/8"},
+		{entry: `{"prefix": "10.0.0.0/8", "ge": 16, "le": 24}`, prefix: "10.1.1.128/25"},
+		{entry: `{"prefix": "10.0.0.0/8", "ge": 16, "le": 24}`, prefix: "11.1.0.0/16"},
+		{entry: `{"prefix": "0.0.0.0/0"}`, prefix: "::/0"},
+		{entry: `{"prefix": "2001:db8::/32", "le": 48}`, prefix: "2001:db8:1::/48", want: true},
+	}
+	for _, test := range tests {
+		var e PrefixListEntry
+		if err := json.Unmarshal([]byte(test.entry), &e); err != nil {
+			t.Fatal(err)
+		}
+		if got := e.matches(netip.MustParsePrefix(test.prefix)); got != test.want {
+			t.Errorf("Test (%s %s): got %t, want %t", test.entry, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestPolicyApply(t *testing.T) {
+	pol := testPolicy(t, `{
+		"prefix_lists": {"default": [{"prefix": "0.0.0.0/0"}, {"prefix": "::/0"}]},
+		"as_path_lists": {"transit": ["_3356_"]},
+		"community_lists": {"blackhole": ["65535:666"], "internal": ["64496:*", "64496:*:*"]},
+		"policies": {"test": [
+			{"name": "default", "prefix_list": "default", "action": "reject"},
+			{"name": "too specific", "longer_than_v4": 24, "longer_than_v6": 48, "action": "reject"},
+			{"name": "private ASNs", "bogon_asn": true, "action": "reject"},
+			{"name": "blackholes", "community_list": "blackhole", "action": "accept"},
+			{"name": "strip", "strip_communities": "internal"},
+			{"name": "transit", "as_path_list": "transit", "set_local_pref": 50, "add_communities": ["64496:3356", "64496:1:3356"]},
+			{"name": "reserved", "bogon_prefix": true, "action": "reject"}
+		]}
+	}`)
+
+	attrs := func(path []uint32, communities ...uint32) *routing_table.RouteAttributes {
+		return &routing_table.RouteAttributes{
+			AsPath:           path,
+			AsPathSegments:   []routing_table.AsPathSegment{{Type: 2, ASNs: path}},
+			LocalPref:        100,
+			Communities:      communities,
+			LargeCommunities: []routing_table.LargeCommunity{{GlobalAdmin: 64496, LocalData1: 7, LocalData2: 7}},
+		}
+	}
+	public := attrs([]uint32{174, 13335}, 64496<<16|1, 174<<16|1)
+	transit := attrs([]uint32{3356, 13335}, 64496<<16|1)
+	route := func(prefix string, ra *routing_table.RouteAttributes) routing_table.Route {
+		return routing_table.Route{Prefix: netip.MustParsePrefix(prefix), Attributes: ra}
+	}
+
+	accepted, rejected := pol.Apply([]routing_table.Route{
+		route("0.0.0.0/0", public),
+		route("1.1.1.0/25", public),
+		route("2606:4700::/64", public),
+		route("1.0.0.0/24", attrs([]uint32{174, 64512})),
+		route("1.1.1.0/24", attrs([]uint32{174}, 65535<<16|666, 64496<<16|1)),
+		route("8.8.8.0/24", public),
+		route("9.9.9.0/24", transit),
+		route("9.9.10.0/24", transit),
+		route("10.0.0.0/8", public),
+		route("2606:4700::/32", public),
+	})
+
+	var gotRejected []string
+	for _, r := range rejected {
+		gotRejected = append(gotRejected, r.Prefix.String())
+	}
+	if want := []string{"0.0.0.0/0", "1.1.1.0/25", "2606:4700::/64", "1.0.0.0/24", "10.0.0.0/8"}; !cmp.Equal(gotRejected, want) {
+		t.Errorf("got rejected %v, want %v", gotRejected, want)
+	}
+
+	stripped := attrs([]uint32{174, 13335}, 174<<16|1)
+	stripped.LargeCommunities = []routing_table.LargeCommunity{}
+	tagged := attrs([]uint32{3356, 13335}, 64496<<16|3356)
+	tagged.LocalPref = 50
+	tagged.LargeCommunities = []routing_table.LargeCommunity{{GlobalAdmin: 64496, LocalData1: 1, LocalData2: 3356}}
+	want := []routing_table.Route{
+		route("1.1.1.0/24", attrs([]uint32{174}, 65535<<16|666, 64496<<16|1)),
+		route("8.8.8.0/24", stripped),
+		route("9.9.9.0/24", tagged),
+		route("9.9.10.0/24", tagged),
+		route("2606:4700::/32", stripped),
+	}
+	opts := []cmp.Option{cmp.Comparer(func(a, b netip.Prefix) bool { return a == b }), cmp.Comparer(func(a, b netip.Addr) bool { return a == b })}
+	if diff := cmp.Diff(want, accepted, opts...); diff != "" {
+		t.Errorf("accepted routes differ (-want +got):\n%s", diff)
+	}
+	if accepted[2].Attributes != accepted[3].Attributes {
+		t.Errorf("routes changed by the same terms do not share their attributes")
+	}
+	if public.LocalPref != 100 || len(public.Communities) != 2 || len(public.LargeCommunities) != 1 {
+		t.Errorf("the received attributes were changed: %+v", public)
+	}
+}
+
+func TestImportPolicy(t *testing.T) {
+	pol := testPolicy(t, `{
+		"prefix_lists": {"doc": [{"prefix": "192.0.2.0/24"}]},
+		"policies": {"test": [{"prefix_list": "doc", "action": "reject"}]}
+	}`)
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Import: pol},
+	}})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100})
+	if got := p.v4rib.AllPrefixes(); len(got) != 1 || got[0] != netip.MustParsePrefix("198.51.100.0/24") {
+		t.Errorf("got %v in the RIB, want 198.51.100.0/24", got)
+	}
+
+	// A path rejected after it was accepted replaces it, so the path is removed
+	srv.peerConf.Store(&peerTable{peers: map[string]PeerConfig{"127.0.0.1": {IP: "127.0.0.1"}}})
+	announce(t, p, []byte{192, 0, 2})
+	srv.peerConf.Store(&peerTable{peers: map[string]PeerConfig{"127.0.0.1": {IP: "127.0.0.1", Import: pol}}})
+	announce(t, p, []byte{192, 0, 2})
+	if got := p.v4rib.Count(); got != 1 {
+		t.Errorf("got %d prefixes in the RIB, want 1", got)
+	}
+	if got := srv.peerStats[p.ip].policyRejects; got != 2 {
+		t.Errorf("got %d policy rejects, want 2", got)
+	}
+}
+
+func TestReapplyImport(t *testing.T) {
+	config := `{
+		"prefix_lists": {"doc": [{"prefix": "192.0.2.0/24"}], "test": [{"prefix": "198.51.100.0/24"}]},
+		"policies": {"test": [{"prefix_list": "%s", "action": "reject"}]}
+	}`
+	rejectDoc, rejectTest := testPolicy(t, fmt.Sprintf(config, "doc")), testPolicy(t, fmt.Sprintf(config, "test"))
+	table := func(pol *Policy, prePolicy bool) *peerTable {
+		return &peerTable{peers: map[string]PeerConfig{"127.0.0.1": {IP: "127.0.0.1", Import: pol, PrePolicy: &prePolicy}}}
+	}
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	srv.peerConf.Store(table(rejectDoc, true))
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := &peer{
+		server: srv,
+		conn:   c1,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}, RouteRefresh: true},
+	}
+	p.state.Store(uint32(StateEstablished))
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	p.v4pre = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	srv.peers = []*peer{p}
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100})
+
+	// Routes kept before the policy are run through the new one
+	srv.applyPeers(table(rejectTest, true))
+	want := netip.MustParsePrefix("192.0.2.0/24")
+	if got := p.v4rib.AllPrefixes(); len(got) != 1 || got[0] != want {
+		t.Errorf("got %v in the RIB after the policy changed, want %v", got, want)
+	}
+	if _, ok := srv.v4PrefixRefs[netip.MustParsePrefix("198.51.100.0/24")]; ok {
+		t.Errorf("198.51.100.0/24 still counted globally after the policy rejected it")
+	}
+	if srv.v4PrefixRefs[want] != 1 {
+		t.Errorf("%v not counted globally after the policy accepted it", want)
+	}
+
+	// Without them the peer is asked to re-send its routes
+	srv.applyPeers(table(rejectTest, false))
+	got := make(chan []byte, 1)
+	go func() {
+		msg := make([]byte, 23)
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c2, msg); err != nil {
+			got <- nil
+			return
+		}
+		got <- msg
+	}()
+	srv.applyPeers(table(rejectDoc, false))
+	if msg := <-got; !cmp.Equal(msg, bgp.CreateRouteRefresh(1, 1, bgp.RefreshRequest)) {
+		t.Errorf("got message %#v, want a route refresh", msg)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// refreshStaleTime bounds how long routes stay stale after a BoRR, for a peer that never
+// sends the EoRR (RFC 7313 section 4).
+const refreshStaleTime = 5 * time.Minute
+
+// handleRefresh handles a ROUTE-REFRESH from the peer. We advertise nothing, so a request is
+// answered with an empty BoRR/EoRR pair at most. BoRR and EoRR bracket the peer re-sending a
+// family (RFC 7313): BoRR marks its routes stale and EoRR removes those not re-advertised.
+// They are ignored unless enhanced route refresh was negotiated.
+func (p *peer) handleRefresh() error {
+	body, err := io.ReadAll(p.in)
+	if err != nil {
+		return fmt.Errorf("reading route refresh: %w", err)
+	}
+	rr, err := bgp.DecodeRouteRefresh(body)
+	if err != nil {
+		if !p.param.EnhancedRefresh {
+			log.Printf("Ignoring malformed route refresh from %s: %v\n", p.ip, err)
+			return nil
+		}
+		// The data is the complete message, header included
+		msg := append([]byte{}, bgpMarker...)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(bgp.MinMessage+len(body)))
+		msg = append(msg, bgp.Refresh)
+		msg = append(msg, body...)
+		return newNotifyError(bgp.RefreshError, bgp.InvalidRefreshLength, msg, "%v", err)
+	}
+	log.Printf("Route refresh %v from %s\n", rr, p.ip)
+
+	if rr.SAFI != 1 || (rr.AFI != 1 && rr.AFI != 2) {
+		return nil
+	}
+
+	switch rr.Subtype {
+	case bgp.RefreshRequest:
+		if p.param.EnhancedRefresh {
+			p.send(bgp.CreateRouteRefresh(rr.AFI, rr.SAFI, bgp.RefreshBoRR))
+			p.send(bgp.CreateRouteRefresh(rr.AFI, rr.SAFI, bgp.RefreshEoRR))
+		}
+	case bgp.RefreshBoRR, bgp.RefreshEoRR:
+		// Only a peer that negotiated enhanced route refresh brackets a re-advertisement
+		if !p.param.EnhancedRefresh {
+			log.Printf("Ignoring %v from %s without enhanced route refresh\n", rr, p.ip)
+			return nil
+		}
+		if rr.Subtype == bgp.RefreshBoRR {
+			p.beginRefresh(rr.AFI)
+		} else {
+			p.endRefresh(rr.AFI, nil)
+		}
+	}
+	return nil
+}
+
+// beginRefresh marks every route in the family stale until the peer has re-advertised it.
+// Should the EoRR never come, the stale routes are purged after refreshStaleTime.
+func (p *peer) beginRefresh(afi uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch {
+	case afi == 1 && p.v4rib != nil:
+		p.v4rib.MarkAllStale()
+		if p.v4pre != nil {
+			p.v4pre.MarkAllStale()
+		}
+		p.v4refresh = p.startRefreshTimer(p.v4refresh, afi)
+	case afi == 2 && p.v6rib != nil:
+		p.v6rib.MarkAllStale()
+		if p.v6pre != nil {
+			p.v6pre.MarkAllStale()
+		}
+		p.v6refresh = p.startRefreshTimer(p.v6refresh, afi)
+	}
+}
+
+// startRefreshTimer replaces the family's refresh timer, old if one is running. Called with
+// p.mutex held.
+func (p *peer) startRefreshTimer(old *time.Timer, afi uint16) *time.Timer {
+	if old != nil {
+		old.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(refreshStaleTime, func() {
+		log.Printf("No EoRR from %s for AFI %d within %v\n", p.ip, afi, refreshStaleTime)
+		p.endRefresh(afi, t)
+	})
+	return t
+}
+
+// endRefresh purges the routes that were not re-advertised since BoRR. expired is the refresh
+// timer when it fires, and nil for an EoRR. An EoRR without a preceding BoRR, or a timer for
+// a refresh already ended, is ignored.
+func (p *peer) endRefresh(afi uint16, expired *time.Timer) {
+	end := func(t **time.Timer) bool {
+		if *t == nil || (expired != nil && *t != expired) {
+			return false
+		}
+		(*t).Stop()
+		*t = nil
+		return true
+	}
+
+	p.mutex.Lock()
+	v4rib, v6rib := p.v4rib, p.v6rib
+	v4pre, v6pre := p.v4pre, p.v6pre
+	var v4, v6 bool
+	switch afi {
+	case 1:
+		v4 = end(&p.v4refresh)
+	case 2:
+		v6 = end(&p.v6refresh)
+	}
+	p.mutex.Unlock()
+
+	if v4 && v4pre != nil {
+		v4pre.DeleteStaleRoutes()
+	}
+	if v6 && v6pre != nil {
+		v6pre.DeleteStaleRoutes()
+	}
+	if v4 && v4rib != nil {
+		removed := v4rib.DeleteStaleRoutes()
+		p.server.removeGlobalV4(removed)
+		log.Printf("Enhanced route refresh from %s complete, removed %d v4 prefixes\n", p.ip, len(removed))
+	}
+	if v6 && v6rib != nil {
+		removed := v6rib.DeleteStaleRoutes()
+		p.server.removeGlobalV6(removed)
+		log.Printf("Enhanced route refresh from %s complete, removed %d v6 prefixes\n", p.ip, len(removed))
+	}
+}
+
+// requestRefresh asks the peer to re-send its routes for an AFI/SAFI. It fails if the session
+// is not established, the peer did not advertise route refresh or the family was not negotiated.
+func (p *peer) requestRefresh(afi uint16, safi uint8) error {
+	if SessionState(p.state.Load()) != StateEstablished {
+		return fmt.Errorf("session is %s", SessionState(p.state.Load()))
+	}
+	p.mutex.RLock()
+	param := p.param
+	p.mutex.RUnlock()
+	if !param.RouteRefresh && !param.EnhancedRefresh {
+		return fmt.Errorf("peer does not support route refresh")
+	}
+	if !familyNegotiated(param, afi, safi) {
+		return fmt.Errorf("AFI %d SAFI %d was not negotiated", afi, safi)
+	}
+	log.Printf("Sending route refresh for AFI %d SAFI %d to %s\n", afi, safi, p.ip)
+	return p.send(bgp.CreateRouteRefresh(afi, safi, bgp.RefreshRequest))
+}
+
+// familyNegotiated reports whether routes for the AFI/SAFI can be exchanged with a peer. Without
+// multiprotocol capabilities that is IPv4 unicast only.
+func familyNegotiated(param bgp.Parameters, afi uint16, safi uint8) bool {
+	if len(param.AddrFamilies) == 0 {
+		return afi == 1 && safi == 1
+	}
+	for _, f := range param.AddrFamilies {
+		if f.AFI == afi && f.SAFI == safi {
+			return true
+		}
+	}
+	return false
+}
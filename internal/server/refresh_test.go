@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+func TestEnhancedRefresh(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}, EnhancedRefresh: true},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	attrs := bytes.Join([][]byte{origin, aspath, nexthop}, nil)
+	kept := []byte{0x18, 0xc0, 0x00, 0x02}
+	dropped := []byte{0x18, 0xc6, 0x33, 0x64}
+
+	p.in = bytes.NewReader(updateBody(nil, attrs, append(kept, dropped...)))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+
+	// An EoRR without a BoRR removes nothing
+	p.in = bytes.NewReader([]byte{0, 1, bgp.RefreshEoRR, 1})
+	if err := p.handleRefresh(); err != nil {
+		t.Fatalf("handleRefresh: %v", err)
+	}
+	if p.v4rib.Count() != 2 {
+		t.Fatalf("got %d prefixes after unexpected EoRR, want 2", p.v4rib.Count())
+	}
+
+	p.in = bytes.NewReader([]byte{0, 1, bgp.RefreshBoRR, 1})
+	if err := p.handleRefresh(); err != nil {
+		t.Fatalf("handleRefresh: %v", err)
+	}
+	p.in = bytes.NewReader(updateBody(nil, attrs, kept))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	p.in = bytes.NewReader([]byte{0, 1, bgp.RefreshEoRR, 1})
+	if err := p.handleRefresh(); err != nil {
+		t.Fatalf("handleRefresh: %v", err)
+	}
+	if p.v4refresh != nil {
+		t.Errorf("refresh timer still running after EoRR")
+	}
+
+	want := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	if got := p.v4rib.AllPrefixes(); !cmp.Equal(got, want, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })) {
+		t.Errorf("got prefixes %v after EoRR, want %v", got, want)
+	}
+	if _, ok := srv.v4PrefixRefs[netip.MustParsePrefix("198.51.100.0/24")]; ok {
+		t.Errorf("198.51.100.0/24 still counted globally after EoRR")
+	}
+}
+
+func TestRefreshTimer(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}, EnhancedRefresh: true},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), []byte{0x18, 0xc0, 0x00, 0x02}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+
+	// A second BoRR restarts the timer, and the first no longer purges anything
+	p.beginRefresh(1)
+	first := p.v4refresh
+	p.beginRefresh(1)
+	if p.v4refresh == nil || p.v4refresh == first {
+		t.Fatalf("refresh timer not restarted by a second BoRR")
+	}
+	p.endRefresh(1, first)
+	if p.v4rib.Count() != 1 || p.v4refresh == nil {
+		t.Errorf("refresh ended by a timer that was replaced")
+	}
+
+	// Without an EoRR, the stale routes are purged once the timer fires
+	p.endRefresh(1, p.v4refresh)
+	if p.v4rib.Count() != 0 {
+		t.Errorf("got %d prefixes after the refresh timer fired, want 0", p.v4rib.Count())
+	}
+	if p.v4refresh != nil {
+		t.Errorf("refresh timer kept after it fired")
+	}
+
+	// and the timer is stopped when the session goes down
+	p.beginRefresh(1)
+	p.stopTimers()
+	if p.v4refresh != nil {
+		t.Errorf("refresh timer kept after the session went down")
+	}
+}
+
+func TestRefreshWithoutEnhanced(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), []byte{0x18, 0xc0, 0x00, 0x02}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+
+	// BoRR and EoRR from a peer that never negotiated enhanced route refresh change nothing
+	for _, subtype := range []uint8{bgp.RefreshBoRR, bgp.RefreshEoRR} {
+		p.in = bytes.NewReader([]byte{0, 1, subtype, 1})
+		if err := p.handleRefresh(); err != nil {
+			t.Fatalf("handleRefresh: %v", err)
+		}
+	}
+	if p.v4refresh != nil {
+		t.Errorf("refresh started without enhanced route refresh")
+	}
+	if p.v4rib.Count() != 1 {
+		t.Errorf("got %d prefixes after BoRR and EoRR, want 1", p.v4rib.Count())
+	}
+}
+
+func TestRefreshErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		enhanced bool
+		input    []byte
+		wantErr  bool
+	}{
+		{
+			desc:     "bad length with enhanced refresh",
+			enhanced: true,
+			input:    []byte{0, 1, 0, 1, 0},
+			wantErr:  true,
+		},
+		{
+			desc:  "bad length without enhanced refresh is ignored",
+			input: []byte{0, 1, 0, 1, 0},
+		},
+		{
+			desc:     "unknown subtype is ignored",
+			enhanced: true,
+			input:    []byte{0, 1, 3, 1},
+		},
+	}
+	for _, test := range tests {
+		rid, _ := GetRid("1.1.1.1")
+		srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+		p := &peer{
+			server: srv,
+			ip:     "127.0.0.1",
+			quiet:  true,
+			param:  bgp.Parameters{EnhancedRefresh: test.enhanced},
+		}
+		p.in = bytes.NewReader(test.input)
+		err := p.handleRefresh()
+		if (err != nil) != test.wantErr {
+			t.Fatalf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+		}
+		if err == nil {
+			continue
+		}
+		var ne *notifyError
+		if !errors.As(err, &ne) || ne.code != bgp.RefreshError || ne.subcode != bgp.InvalidRefreshLength {
+			t.Errorf("Test (%s): got %v, want ROUTE-REFRESH Message Error / Invalid Message Length", test.desc, err)
+			continue
+		}
+		// The data field carries the whole message
+		want := append(bytes.Repeat([]byte{0xff}, 16), 0, 24, bgp.Refresh)
+		want = append(want, test.input...)
+		if !cmp.Equal(ne.data, want) {
+			t.Errorf("Test (%s): got data %#v, want %#v", test.desc, ne.data, want)
+		}
+	}
+}
+
+func TestRequestRefresh(t *testing.T) {
+	tests := []struct {
+		desc    string
+		state   SessionState
+		param   bgp.Parameters
+		afi     uint16
+		wantErr bool
+	}{
+		{
+			desc:  "IPv6 unicast",
+			state: StateEstablished,
+			param: bgp.Parameters{RouteRefresh: true, AddrFamilies: []bgp.Addr{{AFI: 1, SAFI: 1}, {AFI: 2, SAFI: 1}}},
+			afi:   2,
+		},
+		{
+			desc:  "IPv4 unicast without multiprotocol capabilities",
+			state: StateEstablished,
+			param: bgp.Parameters{EnhancedRefresh: true},
+			afi:   1,
+		},
+		{
+			desc:    "family not negotiated",
+			state:   StateEstablished,
+			param:   bgp.Parameters{RouteRefresh: true, AddrFamilies: []bgp.Addr{{AFI: 1, SAFI: 1}}},
+			afi:     2,
+			wantErr: true,
+		},
+		{
+			desc:    "no route refresh capability",
+			state:   StateEstablished,
+			param:   bgp.Parameters{AddrFamilies: []bgp.Addr{{AFI: 1, SAFI: 1}}},
+			afi:     1,
+			wantErr: true,
+		},
+		{
+			desc:    "session not established",
+			state:   StateOpenConfirm,
+			param:   bgp.Parameters{RouteRefresh: true},
+			afi:     1,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		c1, c2 := net.Pipe()
+		p := &peer{
+			conn:  c1,
+			ip:    "127.0.0.1",
+			param: test.param,
+		}
+		p.state.Store(uint32(test.state))
+
+		got := make(chan []byte, 1)
+		go func() {
+			msg := make([]byte, 23)
+			c2.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(c2, msg); err != nil {
+				got <- nil
+				return
+			}
+			got <- msg
+		}()
+
+		err := p.requestRefresh(test.afi, 1)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+		}
+		if err == nil {
+			if msg := <-got; !cmp.Equal(msg, bgp.CreateRouteRefresh(test.afi, 1, bgp.RefreshRequest)) {
+				t.Errorf("Test (%s): got message %#v", test.desc, msg)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// ReloadResult lists the peers, by address, and listen ranges, by prefix, changed by a reload.
+type ReloadResult struct {
+	Added, Removed, Changed []string
+}
+
+// reloadOnSIGHUP reloads the config file each time the process receives a SIGHUP.
+func (s *Server) reloadOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ch:
+			log.Printf("SIGHUP received, reloading %s\n", s.Conf.ConfigFile)
+			if _, err := s.ReloadConfig(); err != nil {
+				log.Printf("Unable to reload config: %v\n", err)
+			}
+		}
+	}
+}
+
+// ReloadConfig reads the config file again and applies it to the running server. The running
+// configuration is left untouched if the file is not valid.
+func (s *Server) ReloadConfig() (ReloadResult, error) {
+	if s.Conf.ConfigFile == "" {
+		return ReloadResult{}, fmt.Errorf("no config file to reload")
+	}
+	cf, err := ReadConfigFile(s.Conf.ConfigFile)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	peers := make(map[string]PeerConfig)
+	for _, p := range cf.Peers {
+		peers[p.IP] = p
+	}
+	return s.applyPeers(&peerTable{peers: peers, ranges: cf.ListenRanges}), nil
+}
+
+// applyPeers replaces the peer configuration with t. MD5 and TCP-AO keys are updated on the
+// listening socket, which is also prepared for GTSM only while a peer uses it. Peers no longer
+// configured are sent a Cease / Peer De-configured and have their routes removed, a changed
+// import policy is applied to the routes of established sessions, established sessions roll
+// over to their new TCP-AO keys, routes kept before an import policy are freed for peers that
+// no longer keep them, and connect loops are started for new active peers. Other changes, such
+// as names, apply as soon as they are next looked up.
+func (s *Server) applyPeers(t *peerTable) ReloadResult {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.peerConf.Load()
+	res := diffPeers(old, t)
+	if err := s.updateMD5(old.md5Keys(), t.md5Keys()); err != nil {
+		log.Printf("Unable to update MD5 keys: %v\n", err)
+	}
+	if err := s.updateTCPAO(old.aoKeys(), t.aoKeys()); err != nil {
+		log.Printf("Unable to update TCP-AO keys: %v\n", err)
+	}
+	if on := t.ttlSecurity(); on != old.ttlSecurity() {
+		if err := s.updateTTLSecurity(on); err != nil {
+			log.Printf("Unable to update TTL security on the listener: %v\n", err)
+		}
+	}
+	s.peerConf.Store(t)
+
+	s.deconfigurePeers()
+	s.reapplyImport(old, t)
+	s.dropPrePolicy()
+	s.rolloverTCPAO(old, t)
+	s.startActiveSessions()
+
+	log.Printf("Config reloaded: %d added, %d removed, %d changed\n", len(res.Added), len(res.Removed), len(res.Changed))
+	return res
+}
+
+// diffPeers compares the peers and listen ranges of two configurations.
+func diffPeers(old, t *peerTable) ReloadResult {
+	was, now := old.entries(), t.entries()
+	var res ReloadResult
+	for key, pc := range now {
+		prev, ok := was[key]
+		switch {
+		case !ok:
+			res.Added = append(res.Added, key)
+		case !reflect.DeepEqual(prev, pc):
+			res.Changed = append(res.Changed, key)
+		}
+	}
+	for key := range was {
+		if _, ok := now[key]; !ok {
+			res.Removed = append(res.Removed, key)
+		}
+	}
+	slices.Sort(res.Added)
+	slices.Sort(res.Removed)
+	slices.Sort(res.Changed)
+	return res
+}
+
+// entries returns the peers by address and the listen range templates by prefix.
+func (t *peerTable) entries() map[string]PeerConfig {
+	e := make(map[string]PeerConfig)
+	for ip, pc := range t.peers {
+		e[ip] = pc
+	}
+	for _, r := range t.ranges {
+		e[r.Prefix.String()] = r.Template
+	}
+	return e
+}
+
+// deconfigurePeers tears down the sessions of peers that are no longer configured and
+// removes their routes, including those held for a peer that is down.
+func (s *Server) deconfigurePeers() {
+	s.mutex.RLock()
+	var gone []*peer
+	for _, p := range s.peers {
+		if _, ok := s.peerConfig(p.ip); !ok {
+			gone = append(gone, p)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, p := range gone {
+		// The session ends with the notification, which rules out Graceful Restart
+		if SessionState(p.state.Load()) != StateIdle {
+			log.Printf("Peer %s de-configured, closing the session\n", p.ip)
+			p.notify(bgp.Cease, bgp.CeasePeerDeconfigured, nil)
+			p.conn.Close()
+			continue
+		}
+
+		p.mutex.Lock()
+		if p.restartTimer != nil {
+			p.restartTimer.Stop()
+			p.restartTimer = nil
+		}
+		for afi, t := range p.llgrTimers {
+			t.Stop()
+			delete(p.llgrTimers, afi)
+		}
+		p.mutex.Unlock()
+		log.Printf("Peer %s de-configured, removing routes\n", p.ip)
+		s.destroyPeer(p.ip)
+	}
+}
+
+// reapplyImport brings the routes of established sessions whose import policy changed in line
+// with the new policy. Routes kept before the policy are run through it again, and peers whose
+// routes are not kept are asked to re-send them.
+func (s *Server) reapplyImport(old, t *peerTable) {
+	s.mutex.RLock()
+	peers := slices.Clone(s.peers)
+	s.mutex.RUnlock()
+
+	for _, p := range peers {
+		pc, ok := t.lookup(p.ip)
+		prev, _ := old.lookup(p.ip)
+		if !ok || reflect.DeepEqual(prev.Import, pc.Import) || SessionState(p.state.Load()) != StateEstablished {
+			continue
+		}
+		log.Printf("Import policy of %s changed, applying it to routes already learned\n", p.ip)
+
+		p.mutex.RLock()
+		v4rib, v6rib, v4pre, v6pre := p.v4rib, p.v6rib, p.v4pre, p.v6pre
+		p.mutex.RUnlock()
+		switch {
+		case v4pre != nil && v4rib != nil:
+			p.reimport(1, v4pre, v4rib)
+		case v4rib != nil:
+			if err := p.requestRefresh(1, 1); err != nil {
+				log.Printf("Unable to re-apply the import policy of %s to IPv4: %v\n", p.ip, err)
+			}
+		}
+		switch {
+		case v6pre != nil && v6rib != nil:
+			p.reimport(2, v6pre, v6rib)
+		case v6rib != nil:
+			if err := p.requestRefresh(2, 1); err != nil {
+				log.Printf("Unable to re-apply the import policy of %s to IPv6: %v\n", p.ip, err)
+			}
+		}
+	}
+}
+
+// rolloverTCPAO moves the established sessions whose TCP-AO keys changed to the new keys,
+// without bringing them down.
+func (s *Server) rolloverTCPAO(old, t *peerTable) {
+	s.mutex.RLock()
+	peers := slices.Clone(s.peers)
+	s.mutex.RUnlock()
+
+	for _, p := range peers {
+		pc, ok := t.lookup(p.ip)
+		if !ok || len(pc.TCPAO) == 0 || SessionState(p.state.Load()) == StateIdle {
+			continue
+		}
+		// Moving a key to the front changes the key in use without changing the set of keys
+		from, to := old.aoKeysFor(p.ip), t.aoKeysFor(p.ip)
+		added, removed := diffAOKeys(from, to)
+		prev, _ := old.lookup(p.ip)
+		if len(added) == 0 && len(removed) == 0 && len(prev.TCPAO) > 0 && reflect.DeepEqual(prev.TCPAO[0], pc.TCPAO[0]) {
+			continue
+		}
+		if err := updateConnTCPAO(p.conn, from, to, pc.TCPAO[0]); err != nil {
+			log.Printf("Unable to roll over the TCP-AO keys of %s: %v\n", p.ip, err)
+			continue
+		}
+		log.Printf("Rolled over the TCP-AO keys of %s to key %d\n", p.ip, pc.TCPAO[0].ID)
+	}
+}
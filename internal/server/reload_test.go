@@ -0,0 +1,151 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+func TestDiffPeers(t *testing.T) {
+	hold := uint16(30)
+	old := &peerTable{
+		peers: map[string]PeerConfig{
+			"192.0.2.1": {IP: "192.0.2.1", Name: "one"},
+			"192.0.2.2": {IP: "192.0.2.2", Name: "two"},
+			"192.0.2.3": {IP: "192.0.2.3", HoldTime: &hold},
+		},
+		ranges: []ListenRange{
+			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Template: PeerConfig{Name: "edge-{ip}"}},
+		},
+	}
+
+	tests := []struct {
+		desc string
+		t    *peerTable
+		want ReloadResult
+	}{
+		{
+			desc: "unchanged",
+			t:    old,
+		},
+		{
+			desc: "peers",
+			t: &peerTable{
+				peers: map[string]PeerConfig{
+					"192.0.2.1": {IP: "192.0.2.1", Name: "uno"},
+					"192.0.2.3": {IP: "192.0.2.3", HoldTime: &hold},
+					"192.0.2.4": {IP: "192.0.2.4"},
+				},
+				ranges: old.ranges,
+			},
+			want: ReloadResult{Added: []string{"192.0.2.4"}, Removed: []string{"192.0.2.2"}, Changed: []string{"192.0.2.1"}},
+		},
+		{
+			desc: "listen ranges",
+			t: &peerTable{
+				peers: old.peers,
+				ranges: []ListenRange{
+					{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Template: PeerConfig{Name: "edge-{ip}", Password: "secret"}},
+					{Prefix: netip.MustParsePrefix("2001:db8::/32")},
+				},
+			},
+			want: ReloadResult{Added: []string{"2001:db8::/32"}, Changed: []string{"10.0.0.0/8"}},
+		},
+	}
+	for _, test := range tests {
+		if got := diffPeers(old, test.t); !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peers.json")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"peers": [
+		{"ip": "127.0.0.1", "name": "old"},
+		{"ip": "127.0.0.2"},
+		{"ip": "127.0.0.3"}
+	]}`)
+	peers, err := LoadConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: peers, ConfigFile: file})
+
+	// An established peer and one that is down with its routes held for Graceful Restart
+	up := &peer{server: srv, ip: "127.0.0.2", quiet: true}
+	up.state.Store(uint32(StateEstablished))
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	up.conn = c1
+	stale := &peer{server: srv, ip: "127.0.0.3", quiet: true}
+	stale.state.Store(uint32(StateIdle))
+	stale.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	stale.restartTimer = time.NewTimer(time.Hour)
+	announce(t, stale, []byte{192, 0, 2})
+	srv.peers = []*peer{up, stale}
+
+	got := make(chan []byte, 1)
+	go func() {
+		msg := make([]byte, 21)
+		c2.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(c2, msg); err != nil {
+			got <- nil
+			return
+		}
+		got <- msg
+	}()
+
+	// Bad files leave the running configuration alone
+	writeConfig(`{"peers": [{"name": "no address"}]}`)
+	if _, err := srv.ReloadConfig(); err == nil {
+		t.Fatalf("reload of an invalid config succeeded")
+	}
+	if _, ok := srv.peerConfig("127.0.0.3"); !ok {
+		t.Fatalf("invalid config was applied")
+	}
+
+	writeConfig(`{"peers": [
+		{"ip": "127.0.0.1", "name": "new"},
+		{"ip": "127.0.0.4"}
+	]}`)
+	res, err := srv.ReloadConfig()
+	if err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	want := ReloadResult{Added: []string{"127.0.0.4"}, Removed: []string{"127.0.0.2", "127.0.0.3"}, Changed: []string{"127.0.0.1"}}
+	if !cmp.Equal(res, want) {
+		t.Errorf("got %+v, want %+v", res, want)
+	}
+
+	if name := srv.peerLabel("127.0.0.1"); name != "new" {
+		t.Errorf("got name %q, want new", name)
+	}
+	if msg, want := <-got, bgp.CreateNotification(bgp.Cease, bgp.CeasePeerDeconfigured); !cmp.Equal(msg, want) {
+		t.Errorf("got notification %#v, want %#v", msg, want)
+	}
+	if len(srv.peers) != 1 || srv.peers[0] != up {
+		t.Errorf("got peers %v, want only the established peer until its session closes", srv.peers)
+	}
+	if stale.v4rib != nil || srv.v4Masks[24] != 0 {
+		t.Errorf("routes of the de-configured peer not removed")
+	}
+	if stale.restartTimer != nil {
+		t.Errorf("restart timer of the de-configured peer still running")
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// localRole returns our BGP Role towards the peer at ip, if one is configured.
+func (s *Server) localRole(ip string) (bgp.Role, bool) {
+	pc, ok := s.peerConfig(ip)
+	if !ok || pc.Role == "" {
+		return 0, false
+	}
+	// The role was validated when the config was loaded
+	role, err := bgp.ParseRole(pc.Role)
+	return role, err == nil
+}
+
+// openParameters returns the capabilities to offer the peer at ip, based on params. The BGP
+// Role is our own, never one mirrored from the peer.
+func (s *Server) openParameters(ip string, params bgp.Parameters) *bgp.Parameters {
+	params.Role, params.HasRole = s.localRole(ip)
+	return &params
+}
+
+// checkRole verifies the peer's BGP Role against ours (RFC 9234 section 4.2). A peer without
+// the capability is only refused when strict mode is configured.
+func (p *peer) checkRole(params bgp.Parameters) error {
+	local, ok := p.server.localRole(p.ip)
+	if !ok {
+		return nil
+	}
+	if !params.HasRole {
+		if pc, _ := p.server.peerConfig(p.ip); pc.StrictRole {
+			return newNotifyError(bgp.OpenError, bgp.RoleMismatch, nil, "no BGP role from peer, strict mode requires %s", local)
+		}
+		return nil
+	}
+	if !local.Matches(params.Role) {
+		return newNotifyError(bgp.OpenError, bgp.RoleMismatch, nil, "peer role %s does not match local role %s", params.Role, local)
+	}
+	return nil
+}
+
+// ingressOTC applies the RFC 9234 ingress procedure to n routes received with attributes pa.
+// It returns the Only-To-Customer value to store and counts the routes if they are leaks.
+func (p *peer) ingressOTC(pa *bgp.PathAttr, n int) uint32 {
+	local, ok := p.server.localRole(p.ip)
+	if !ok {
+		return pa.OTC
+	}
+	otc := bgp.IngressOTC(local, p.peerAsn, pa.OTC)
+	if bgp.IsRouteLeak(local, p.peerAsn, otc) {
+		if !p.quiet {
+			log.Printf("%d routes from %s with OTC %d are route leaks\n", n, p.ip, otc)
+		}
+		p.server.recordRouteLeaks(p.ip, n)
+	}
+	return otc
+}
+
+// recordRouteLeaks counts n routes from ip flagged as leaks by the OTC ingress rules.
+func (s *Server) recordRouteLeaks(ip string, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peerStats[ip]; !ok {
+		s.peerStats[ip] = &persistentPeerStats{}
+	}
+	s.peerStats[ip].routeLeaks += uint64(n)
+}
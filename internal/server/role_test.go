@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+func TestCheckRole(t *testing.T) {
+	tests := []struct {
+		desc    string
+		conf    PeerConfig
+		params  bgp.Parameters
+		wantErr bool
+	}{
+		{
+			desc:   "no role configured",
+			params: bgp.Parameters{HasRole: true, Role: bgp.RoleProvider},
+		},
+		{
+			desc:   "matching roles",
+			conf:   PeerConfig{Role: "customer"},
+			params: bgp.Parameters{HasRole: true, Role: bgp.RoleProvider},
+		},
+		{
+			desc:    "mismatched roles",
+			conf:    PeerConfig{Role: "customer"},
+			params:  bgp.Parameters{HasRole: true, Role: bgp.RoleCustomer},
+			wantErr: true,
+		},
+		{
+			desc: "no role from the peer",
+			conf: PeerConfig{Role: "peer"},
+		},
+		{
+			desc:    "no role from the peer in strict mode",
+			conf:    PeerConfig{Role: "peer", StrictRole: true},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		rid, _ := GetRid("1.1.1.1")
+		srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{"127.0.0.1": test.conf}})
+		p := &peer{server: srv, ip: "127.0.0.1", quiet: true}
+
+		err := p.checkRole(test.params)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test (%s): got error %v, want error %t", test.desc, err, test.wantErr)
+			continue
+		}
+		var ne *notifyError
+		if err != nil && (!errors.As(err, &ne) || ne.code != bgp.OpenError || ne.subcode != bgp.RoleMismatch) {
+			t.Errorf("Test (%s): got %v, want OPEN Message Error / Role Mismatch", test.desc, err)
+		}
+	}
+}
+
+func TestOpenParameters(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{"127.0.0.1": {Role: "rs"}}})
+
+	// The peer's own role must not be sent back to it
+	got := srv.openParameters("127.0.0.1", bgp.Parameters{HasRole: true, Role: bgp.RoleRSClient})
+	if !got.HasRole || got.Role != bgp.RoleRS {
+		t.Errorf("got role %v (%t), want rs", got.Role, got.HasRole)
+	}
+	got = srv.openParameters("127.0.0.2", bgp.Parameters{HasRole: true, Role: bgp.RoleRSClient})
+	if got.HasRole {
+		t.Errorf("got role %v for a peer without one configured", got.Role)
+	}
+}
+
+func TestRouteLeaks(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{"127.0.0.1": {Role: "peer"}}})
+	p := &peer{
+		server:  srv,
+		ip:      "127.0.0.1",
+		quiet:   true,
+		peerAsn: 65000,
+		param:   bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	otherOTC := []byte{0xc0, 0x23, 0x04, 0x00, 0x00, 0xfd, 0xe9}
+
+	// A route without OTC from a peer is stamped with the peer's ASN and is no leak
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), []byte{0x18, 0xc0, 0x00, 0x02}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	r := p.v4rib.Lookup(netip.MustParsePrefix("192.0.2.0/24"))
+	if r == nil || r.Attributes.OnlyToCustomer != 65000 {
+		t.Fatalf("got route %+v, want OTC 65000", r)
+	}
+
+	// Another AS in the OTC means the route was leaked along the way
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop, otherOTC}, nil), []byte{0x18, 0xc6, 0x33, 0x64, 0x18, 0xcb, 0x00, 0x71}))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if ps := srv.peerStats[p.ip]; ps == nil || ps.routeLeaks != 2 {
+		t.Errorf("got counters %+v, want two route leaks", ps)
+	}
+	if p.v4rib.Count() != 3 {
+		t.Errorf("got %d prefixes, want leaked routes kept", p.v4rib.Count())
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// vrpFilePoll is how often the VRP file is checked for a new export.
+const vrpFilePoll = time.Minute
+
+// maxLookups caps the cost of finding the prefixes within a VRP, well short of overflowing
+// when summed.
+const maxLookups = 1 << 30
+
+// startRPKI loads the VRPs from the sources in the config and keeps them up to date.
+func (s *Server) startRPKI() {
+	if s.Conf.RPKI.VRPFile != "" {
+		go s.watchVRPFile(s.Conf.RPKI.VRPFile)
+	}
+	if s.Conf.RPKI.RTRServer != "" {
+		go rpki.NewClient(s.Conf.RPKI.RTRServer, s.updateVRPs).Run(s.stop)
+	}
+}
+
+// watchVRPFile loads the VRPs and ASPAs in the VRP file, then loads them again each time it is
+// replaced. A file that fails to load is tried again at the next poll, keeping what was loaded
+// before.
+func (s *Server) watchVRPFile(name string) {
+	var modified time.Time
+	var vrps []rpki.VRP
+	ticker := time.NewTicker(vrpFilePoll)
+	defer ticker.Stop()
+
+	for {
+		if fi, err := os.Stat(name); err != nil {
+			log.Printf("Unable to read VRP file: %v\n", err)
+		} else if !fi.ModTime().Equal(modified) {
+			f, err := rpki.ReadFile(name)
+			if err != nil {
+				log.Printf("Unable to load VRP file %s: %v\n", name, err)
+			} else {
+				added, removed := rpki.Diff(vrps, f.VRPs)
+				vrps, modified = f.VRPs, fi.ModTime()
+				log.Printf("Loaded %d VRPs from %s, %d added and %d removed\n", len(vrps), name, len(added), len(removed))
+				s.updateVRPs(added, removed)
+				s.aspas.Replace(f.ASPAs)
+				log.Printf("Loaded %d ASPAs from %s\n", len(f.ASPAs), name)
+			}
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateVRPs applies a change from one of the VRP sources, then revalidates the paths for
+// the prefixes it covers.
+func (s *Server) updateVRPs(announced, withdrawn []rpki.VRP) {
+	changed := s.vrps.Update(announced, withdrawn)
+	if len(changed) == 0 {
+		return
+	}
+	prefixes := s.coveredPrefixes(changed)
+
+	s.mutex.RLock()
+	peers := make([]*peer, len(s.peers))
+	copy(peers, s.peers)
+	s.mutex.RUnlock()
+
+	for _, p := range peers {
+		p.revalidate(prefixes)
+	}
+}
+
+// coveredPrefixes returns the prefixes held by any peer that fall within the changed VRP
+// prefixes. The more specifics of each are looked up at the lengths in use, unless that
+// takes more lookups than walking every prefix held, as it can for a short VRP prefix.
+func (s *Server) coveredPrefixes(changed []netip.Prefix) []netip.Prefix {
+	s.globalMasksMu.RLock()
+	defer s.globalMasksMu.RUnlock()
+
+	held := len(s.v4PrefixRefs) + len(s.v6PrefixRefs)
+	lookups := 0
+	for _, vrp := range changed {
+		if lookups += s.lookupCost(vrp); lookups > held {
+			covered := rpki.NewPrefixSet(changed)
+			var prefixes []netip.Prefix
+			for _, refs := range []map[netip.Prefix]uint16{s.v4PrefixRefs, s.v6PrefixRefs} {
+				for prefix := range refs {
+					if covered.Covers(prefix) {
+						prefixes = append(prefixes, prefix)
+					}
+				}
+			}
+			return prefixes
+		}
+	}
+
+	var prefixes []netip.Prefix
+	for _, vrp := range changed {
+		vrp = vrp.Masked()
+		refs, masks := s.familyRefs(vrp)
+		for bits := vrp.Bits(); bits <= vrp.Addr().BitLen(); bits++ {
+			if masks[int32(bits)] == 0 {
+				continue
+			}
+			prefix := netip.PrefixFrom(vrp.Addr(), bits)
+			for range 1 << (bits - vrp.Bits()) {
+				if refs[prefix] > 0 {
+					prefixes = append(prefixes, prefix)
+				}
+				prefix = nextPrefix(prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// lookupCost returns the number of lookups needed to find the prefixes held within vrp, at
+// most maxLookups. Called with globalMasksMu held.
+func (s *Server) lookupCost(vrp netip.Prefix) int {
+	_, masks := s.familyRefs(vrp)
+	cost := 0
+	for bits := vrp.Bits(); bits <= vrp.Addr().BitLen(); bits++ {
+		if masks[int32(bits)] == 0 {
+			continue
+		}
+		if bits-vrp.Bits() >= 30 {
+			return maxLookups
+		}
+		cost = min(cost+1<<(bits-vrp.Bits()), maxLookups)
+	}
+	return cost
+}
+
+// familyRefs returns the prefixes held, and the count of each length, of prefix's family.
+func (s *Server) familyRefs(prefix netip.Prefix) (map[netip.Prefix]uint16, map[int32]int32) {
+	if prefix.Addr().Is4() {
+		return s.v4PrefixRefs, s.v4Masks
+	}
+	return s.v6PrefixRefs, s.v6Masks
+}
+
+// nextPrefix returns the prefix of the same length that follows prefix.
+func nextPrefix(prefix netip.Prefix) netip.Prefix {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits() - 1; i >= 0; i-- {
+		bit := byte(0x80 >> (i % 8))
+		b[i/8] ^= bit
+		if b[i/8]&bit != 0 {
+			break
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(addr, prefix.Bits())
+}
+
+// originAS returns the origin AS of a path from p (RFC 6811 section 2): the last AS of a path
+// that ends in an AS_SEQUENCE, our own AS towards p for a path from within our AS or
+// confederation, or 0 for a path that ends in an AS_SET, which has none.
+func (s *Server) originAS(p *peer, ra *routing_table.RouteAttributes) uint32 {
+	segs := ra.AsPathSegments
+	if len(segs) == 0 {
+		return s.localASN(p.ip)
+	}
+	last := segs[len(segs)-1]
+	switch last.Type {
+	case 1: // AS_SET
+		return 0
+	case 2: // AS_SEQUENCE
+		return last.ASNs[len(last.ASNs)-1]
+	default:
+		return s.localASN(p.ip)
+	}
+}
+
+// validate returns the origin validation state of a path from p. It must only be called when
+// RPKI is configured.
+func (s *Server) validate(p *peer, r *routing_table.Route) rpki.State {
+	return s.vrps.Validate(r.Prefix, s.originAS(p, r.Attributes))
+}
+
+// validationState returns the name of the origin validation state of a path from p, or an
+// empty string if RPKI is not configured.
+func (s *Server) validationState(p *peer, r *routing_table.Route) string {
+	if s.vrps == nil {
+		return ""
+	}
+	return s.validate(p, r).String()
+}
+
+// validateRoutes records the state of paths just stored in the peer's RIB.
+func (p *peer) validateRoutes(routes []routing_table.Route) {
+	if p.server.vrps == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range routes {
+		p.setInvalid(routing_table.PrefixWithID{Prefix: routes[i].Prefix, PathID: routes[i].PathID}, p.server.validate(p, &routes[i]) == rpki.Invalid)
+	}
+}
+
+// forgetRoutes drops paths withdrawn from the peer's RIB from its invalid paths.
+func (p *peer) forgetRoutes(withdrawn []routing_table.PrefixWithID) {
+	if p.server.vrps == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, w := range withdrawn {
+		delete(p.invalid, w)
+	}
+}
+
+// setInvalid records whether a path is invalid. Called with p.mutex held.
+func (p *peer) setInvalid(key routing_table.PrefixWithID, invalid bool) {
+	if !invalid {
+		delete(p.invalid, key)
+		return
+	}
+	if p.invalid == nil {
+		p.invalid = make(map[routing_table.PrefixWithID]struct{})
+	}
+	p.invalid[key] = struct{}{}
+}
+
+// revalidate updates the state of the peer's paths for prefixes covered by changed VRPs.
+func (p *peer) revalidate(prefixes []netip.Prefix) {
+	p.mutex.RLock()
+	v4, v6 := p.v4rib, p.v6rib
+	p.mutex.RUnlock()
+
+	var affected []routing_table.Route
+	for _, prefix := range prefixes {
+		switch {
+		case prefix.Addr().Is4() && v4 != nil:
+			affected = append(affected, v4.AllPaths(prefix)...)
+		case prefix.Addr().Is6() && v6 != nil:
+			affected = append(affected, v6.AllPaths(prefix)...)
+		}
+	}
+	p.validateRoutes(affected)
+}
+
+// pathRib is the part of an IPv4 or IPv6 RIB needed to walk its paths.
+type pathRib interface {
+	AllPrefixes() []netip.Prefix
+	AllPaths(netip.Prefix) []routing_table.Route
+}
+
+// invalidRoutes returns the peer's invalid paths. Paths no longer in its RIB, removed other
+// than by a withdrawal, such as stale paths purged after a restart, are dropped on the way.
+func (p *peer) invalidRoutes() []routing_table.Route {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var routes []routing_table.Route
+	for key := range p.invalid {
+		var paths []routing_table.Route
+		switch {
+		case key.Prefix.Addr().Is4() && p.v4rib != nil:
+			paths = p.v4rib.AllPaths(key.Prefix)
+		case key.Prefix.Addr().Is6() && p.v6rib != nil:
+			paths = p.v6rib.AllPaths(key.Prefix)
+		}
+		i := slices.IndexFunc(paths, func(r routing_table.Route) bool { return r.PathID == key.PathID })
+		if i < 0 {
+			delete(p.invalid, key)
+			continue
+		}
+		routes = append(routes, paths[i])
+	}
+	return routes
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/mellowdrifter/routing_table"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOriginAS(t *testing.T) {
+	srv := New(Config{Asn: 64512, PeersConfig: map[string]PeerConfig{
+		"127.0.0.2": {IP: "127.0.0.2", LocalAS: 64513},
+	}})
+	tests := []struct {
+		desc string
+		ip   string
+		segs []routing_table.AsPathSegment
+		want uint32
+	}{
+		{
+			desc: "sequence",
+			segs: []routing_table.AsPathSegment{{Type: 2, ASNs: []uint32{64500, 64501}}},
+			want: 64501,
+		},
+		{
+			desc: "ending in a set",
+			segs: []routing_table.AsPathSegment{{Type: 2, ASNs: []uint32{64500}}, {Type: 1, ASNs: []uint32{64501, 64502}}},
+		},
+		{
+			desc: "set before the origin",
+			segs: []routing_table.AsPathSegment{{Type: 1, ASNs: []uint32{64501, 64502}}, {Type: 2, ASNs: []uint32{64500}}},
+			want: 64500,
+		},
+		{
+			desc: "confederation",
+			segs: []routing_table.AsPathSegment{{Type: 3, ASNs: []uint32{65001}}},
+			want: 64512,
+		},
+		{
+			desc: "empty",
+			want: 64512,
+		},
+		{
+			desc: "empty from a peer with a local AS",
+			ip:   "127.0.0.2",
+			want: 64513,
+		},
+		{
+			desc: "confederation from a peer with a local AS",
+			ip:   "127.0.0.2",
+			segs: []routing_table.AsPathSegment{{Type: 3, ASNs: []uint32{65001}}},
+			want: 64513,
+		},
+	}
+	for _, test := range tests {
+		p := &peer{server: srv, ip: "127.0.0.1"}
+		if test.ip != "" {
+			p.ip = test.ip
+		}
+		if got := srv.originAS(p, &routing_table.RouteAttributes{AsPathSegments: test.segs}); got != test.want {
+			t.Errorf("Test (%s): got %d, want %d", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestOriginValidation(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, RPKI: RPKIConfig{RTRServer: "127.0.0.1:3323"}})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	srv.peers = []*peer{p}
+	g := &grpcServer{bgp: srv}
+
+	vrp := func(prefix string, asn uint32) rpki.VRP {
+		return rpki.VRP{Prefix: netip.MustParsePrefix(prefix), MaxLength: 24, ASN: asn}
+	}
+	wantInvalid := func(desc string, want ...string) {
+		t.Helper()
+		resp, err := g.GetRoutesByValidationState(context.Background(), &pb.ValidationStateRequest{State: "invalid"})
+		if err != nil {
+			t.Fatalf("Test (%s): %v", desc, err)
+		}
+		var got []string
+		for _, r := range resp.GetRoutes() {
+			got = append(got, r.GetPrefix())
+			if r.GetValidationState() != "invalid" {
+				t.Errorf("Test (%s): got state %q for %s, want invalid", desc, r.GetValidationState(), r.GetPrefix())
+			}
+		}
+		slices.Sort(got)
+		if !cmp.Equal(got, want) {
+			t.Errorf("Test (%s): got invalid %v, want %v", desc, got, want)
+		}
+		if n := srv.collectStats().GetPeerStats()[srv.getPeerName(p)].GetRpkiInvalids(); n != uint64(len(want)) {
+			t.Errorf("Test (%s): got %d invalids in the peer stats, want %d", desc, n, len(want))
+		}
+	}
+
+	// Paths are validated as they are stored, against the VRPs already loaded
+	srv.updateVRPs([]rpki.VRP{vrp("192.0.2.0/24", 64500)}, nil)
+	announce(t, p, []byte{192, 0, 2}, []byte{198, 51, 100})
+	wantInvalid("stored", "192.0.2.0/24")
+
+	// and again when the VRPs covering them change
+	srv.updateVRPs([]rpki.VRP{vrp("198.51.100.0/24", 64501)}, nil)
+	wantInvalid("new VRP", "192.0.2.0/24", "198.51.100.0/24")
+	for asn, want := range map[uint32]int{0: 2, 65000: 2, 64500: 0} {
+		resp, err := g.GetInvalidPrefixes(context.Background(), &pb.OriginRequest{Asn: asn})
+		if err != nil || len(resp.GetPrefixes()) != want {
+			t.Errorf("Test (AS%d): got invalid prefixes %v, %v, want %d", asn, resp.GetPrefixes(), err, want)
+		}
+	}
+	srv.updateVRPs([]rpki.VRP{vrp("192.0.2.0/22", 65000)}, nil)
+	wantInvalid("authorized", "198.51.100.0/24")
+
+	resp, err := g.GetRoutesByValidationState(context.Background(), &pb.ValidationStateRequest{State: "valid"})
+	if err != nil || len(resp.GetRoutes()) != 1 || resp.GetRoutes()[0].GetPrefix() != "192.0.2.0/24" {
+		t.Errorf("got valid routes %v, %v, want 192.0.2.0/24", resp.GetRoutes(), err)
+	}
+
+	// Withdrawn paths are no longer invalid, nor are those removed from the RIB otherwise
+	p.in = bytes.NewReader(updateBody([]byte{24, 198, 51, 100}, nil, nil))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	wantInvalid("withdrawn")
+	announce(t, p, []byte{198, 51, 100})
+	wantInvalid("announced again", "198.51.100.0/24")
+	p.v4rib.DeleteBatch([]routing_table.PrefixWithID{{Prefix: netip.MustParsePrefix("198.51.100.0/24")}})
+	wantInvalid("removed")
+
+	if _, err := g.GetRoutesByValidationState(context.Background(), &pb.ValidationStateRequest{State: "unknown"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown state, want InvalidArgument", err)
+	}
+	g = &grpcServer{bgp: New(Config{Rid: rid, Asn: 64512})}
+	if _, err := g.GetRoutesByValidationState(context.Background(), &pb.ValidationStateRequest{State: "invalid"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v without RPKI, want FailedPrecondition", err)
+	}
+}
+
+func TestCoveredPrefixes(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	var v4, v6 []netip.Prefix
+	for _, p := range []string{"192.0.2.0/24", "192.0.3.0/24", "192.0.0.0/22", "198.51.100.0/24", "10.0.0.0/8", "2001:db8::/32", "2001:db8:1::/48"} {
+		prefix := netip.MustParsePrefix(p)
+		if prefix.Addr().Is4() {
+			v4 = append(v4, prefix)
+		} else {
+			v6 = append(v6, prefix)
+		}
+	}
+	srv.addGlobalV4(v4)
+	srv.addGlobalV6(v6)
+
+	tests := []struct {
+		desc string
+		vrps []string
+		want []string
+	}{
+		{
+			desc: "exact match",
+			vrps: []string{"198.51.100.0/24"},
+			want: []string{"198.51.100.0/24"},
+		},
+		{
+			desc: "more specifics",
+			vrps: []string{"192.0.2.0/23"},
+			want: []string{"192.0.2.0/24", "192.0.3.0/24"},
+		},
+		{
+			desc: "less specifics are not covered",
+			vrps: []string{"192.0.2.0/24", "2001:db8:1::/48"},
+			want: []string{"192.0.2.0/24", "2001:db8:1::/48"},
+		},
+		{
+			desc: "short VRP prefixes walk every prefix held",
+			vrps: []string{"192.0.0.0/8", "2001:db8::/32"},
+			want: []string{"192.0.0.0/22", "192.0.2.0/24", "192.0.3.0/24", "2001:db8:1::/48", "2001:db8::/32"},
+		},
+		{
+			desc: "nothing held",
+			vrps: []string{"203.0.113.0/24"},
+		},
+	}
+	for _, test := range tests {
+		var vrps []netip.Prefix
+		for _, v := range test.vrps {
+			vrps = append(vrps, netip.MustParsePrefix(v))
+		}
+		var got []string
+		for _, prefix := range srv.coveredPrefixes(vrps) {
+			got = append(got, prefix.String())
+		}
+		slices.Sort(got)
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("Test (%s): got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
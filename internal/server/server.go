@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -15,32 +16,61 @@ import (
 
 	"github.com/mellowdrifter/bgpwatch/internal/bgp"
 	"github.com/mellowdrifter/bgpwatch/internal/procstats"
+	"github.com/mellowdrifter/bgpwatch/internal/rpki"
 	"github.com/mellowdrifter/routing_table"
 	"google.golang.org/grpc"
 )
 
 type Server struct {
-	listener      net.Listener
-	peers         []*peer
-	mutex         sync.RWMutex
-	globalMasksMu sync.RWMutex
-	v4Masks       map[int32]int32
-	v6Masks       map[int32]int32
-	v4PrefixRefs  map[netip.Prefix]uint16
-	v6PrefixRefs  map[netip.Prefix]uint16
-	v4AttrTable   *routing_table.AttrTable
-	v6AttrTable   *routing_table.AttrTable
-	sampler       *procstats.Sampler
-	Conf          Config
-	grManager     GracefulRestartManager
-	grpcServer    *grpc.Server
-	peerStats     map[string]*persistentPeerStats
+	listener       net.Listener
+	peers          []*peer
+	mutex          sync.RWMutex
+	globalMasksMu  sync.RWMutex
+	v4Masks        map[int32]int32
+	v6Masks        map[int32]int32
+	v4PrefixRefs   map[netip.Prefix]uint16
+	v6PrefixRefs   map[netip.Prefix]uint16
+	v4AttrTable    *routing_table.AttrTable
+	v6AttrTable    *routing_table.AttrTable
+	sampler        *procstats.Sampler
+	Conf           Config
+	grManager      GracefulRestartManager
+	grpcServer     *grpc.Server
+	peerStats      map[string]*persistentPeerStats
+	prefixHolds    map[string]time.Time // peers refused after a max-prefix teardown
+	peerConf       atomic.Pointer[peerTable]
+	vrps           *rpki.Table     // nil unless RPKI is configured
+	aspas          *rpki.ASPATable // nil unless a VRP file is configured
+	activeSessions map[string]bool // peers with a running connect loop
+	reloadMu       sync.Mutex
 	cleanupPending atomic.Bool
+	stop           chan struct{}
 }
 
 type persistentPeerStats struct {
 	flaps            uint32
 	lastNotification string
+	notifications    []notificationRecord
+
+	// RFC 7606 actions taken for malformed UPDATEs
+	attrDiscards     uint64
+	treatAsWithdraws uint64
+	afiSafiDisables  uint64
+	sessionResets    uint64
+
+	// Routes flagged as leaks by the RFC 9234 OTC ingress rules
+	routeLeaks uint64
+
+	// Maximum prefix limits: warning thresholds crossed, limits exceeded and routes dropped
+	maxPrefixWarnings uint64
+	maxPrefixBreaches uint64
+	maxPrefixDropped  uint64
+
+	// Connections refused for arriving with a TTL below the GTSM minimum
+	ttlSecurityDrops uint64
+
+	// Paths rejected by the import policy
+	policyRejects uint64
 }
 
 type Config struct {
@@ -52,10 +82,27 @@ type Config struct {
 	Eor               bool
 	Quiet             bool
 	IgnoreCommunities bool
-	PeersConfig       map[string]PeerConfig
-	Asn               uint32
+
+	// PeersConfig and ListenRanges are the peers configured at startup. ConfigFile, if set,
+	// is the file they were read from, which is read again on SIGHUP or ReloadConfig.
+	PeersConfig  map[string]PeerConfig
+	ListenRanges []ListenRange
+	ConfigFile   string
+
+	// RPKI enables origin validation with the VRPs from these sources.
+	RPKI RPKIConfig
+
+	Asn      uint32
+	HoldTime uint16
+
+	// GRRestartTime caps the restart time a peer advertises in its Graceful Restart
+	// capability, 15 minutes if not set.
 	GRRestartTime     time.Duration
 	GREoRFallbackTime time.Duration
+
+	// LLGRStaleTime caps the long-lived stale time a peer advertises in its Long-Lived
+	// Graceful Restart capability, 24 hours if not set.
+	LLGRStaleTime time.Duration
 }
 
 func New(conf Config) *Server {
@@ -70,6 +117,17 @@ func New(conf Config) *Server {
 		sampler:      procstats.NewSampler(30 * time.Second),
 		Conf:         conf,
 		peerStats:    make(map[string]*persistentPeerStats),
+		prefixHolds:  make(map[string]time.Time),
+		stop:         make(chan struct{}),
+
+		activeSessions: make(map[string]bool),
+	}
+	s.peerConf.Store(&peerTable{peers: conf.PeersConfig, ranges: conf.ListenRanges})
+	if conf.RPKI.VRPFile != "" || conf.RPKI.RTRServer != "" {
+		s.vrps = rpki.NewTable()
+	}
+	if conf.RPKI.VRPFile != "" {
+		s.aspas = rpki.NewASPATable()
 	}
 	s.grManager = NewGracefulRestartManager(s)
 	return s
@@ -77,8 +135,12 @@ func New(conf Config) *Server {
 
 func (s *Server) Start() {
 	s.listen(s.Conf)
-	go s.clean()
 	s.grpcServer = s.startGRPC(s.Conf.GrpcPort)
+	s.startActiveSessions()
+	s.startRPKI()
+	if s.Conf.ConfigFile != "" {
+		go s.reloadOnSIGHUP()
+	}
 
 	for {
 		conn, err := s.listener.Accept()
@@ -100,6 +162,9 @@ func (s *Server) Stop() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if !s.isStopped() {
+		close(s.stop)
+	}
 	if s.listener != nil {
 		s.listener.Close()
 	}
@@ -115,6 +180,15 @@ func (s *Server) Stop() {
 	s.peers = nil
 }
 
+func (s *Server) isStopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetRid converts the string RID to actual BGPID.
 func GetRid(srid string) (bgp.BGPID, error) {
 	s := strings.Split(srid, ".")
@@ -134,120 +208,164 @@ func GetRid(srid string) (bgp.BGPID, error) {
 	return rid, nil
 }
 
-// clean checks for and removes stale clients that haven't sent a keepalive within their holdtime.
-func (s *Server) clean() {
-	ticker := time.NewTicker(30 * time.Second)
-	for range ticker.C {
-		s.mutex.RLock()
-		now := time.Now()
-		var dead []*peer
-		for _, p := range s.peers {
-			p.mutex.RLock()
-			if p.holdtime > 0 && !p.lastKeepalive.IsZero() {
-				if now.Sub(p.lastKeepalive) > time.Duration(p.holdtime)*time.Second {
-					dead = append(dead, p)
-				}
-			}
-			p.mutex.RUnlock()
-		}
-		s.mutex.RUnlock()
-
-		for _, p := range dead {
-			log.Printf("Holdtimer expired for %s", p.conn.RemoteAddr().String())
-			p.conn.Write(bgp.CreateNotification(bgp.HoldTimeExpired, 0))
-			s.mutex.Lock()
-			if _, ok := s.peerStats[p.ip]; !ok {
-				s.peerStats[p.ip] = &persistentPeerStats{}
-			}
-			s.peerStats[p.ip].lastNotification = "HOLD TIMER"
-			s.mutex.Unlock()
-			p.conn.Close()
-		}
-	}
-}
-
 // accept adds a new client to the current list of clients being served.
 func (s *Server) accept(conn net.Conn) *peer {
 	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	// Whitelist check
-	if s.Conf.PeersConfig != nil {
-		if _, ok := s.Conf.PeersConfig[ip]; !ok {
+	if s.peerConf.Load().restricted() {
+		if _, ok := s.peerConfig(ip); !ok {
 			log.Printf("Connection from %v ignored (not in config)\n", conn.RemoteAddr().String())
 			conn.Close()
 			return nil
 		}
 	}
+	if s.prefixHeld(ip) {
+		log.Printf("Connection from %v refused after exceeding its maximum prefixes\n", conn.RemoteAddr().String())
+		conn.Close()
+		return nil
+	}
+
+	pc, _ := s.peerConfig(ip)
+	if pc.TTLSecurity > 0 {
+		if err := setTTLSecurity(conn, pc); err != nil {
+			if errors.Is(err, errTTLTooLow) {
+				s.recordTTLDrop(ip)
+			}
+			log.Printf("Connection from %v refused by TTL security: %v\n", conn.RemoteAddr().String(), err)
+			conn.Close()
+			return nil
+		}
+	} else if err := clearTTLSecurity(conn); err != nil {
+		log.Printf("Unable to clear TTL security from %v: %v\n", conn.RemoteAddr().String(), err)
+	}
+
+	if len(pc.TCPAO) > 0 {
+		if err := setTCPAOCurrent(conn, pc.TCPAO[0]); err != nil {
+			log.Printf("Unable to select TCP-AO key %d for %s: %v\n", pc.TCPAO[0].ID, ip, err)
+		}
+	}
 
 	log.Printf("Connection from %v, total peers: %d\n",
 		conn.RemoteAddr().String(), len(s.peers)+1)
 
+	return s.addPeer(conn, ip, false)
+}
+
+// addPeer creates a peer for a new connection. If another connection to the same peer is
+// still being set up and exactly one of the two was initiated by us, the new peer is not
+// registered yet; the collision is resolved once its OPEN arrives.
+func (s *Server) addPeer(conn net.Conn, ip string, outbound bool) *peer {
+	peer := &peer{
+		server:    s,
+		conn:      conn,
+		rid:       s.Conf.Rid,
+		weor:      s.Conf.Eor,
+		quiet:     s.Conf.Quiet,
+		ip:        ip,
+		mutex:     sync.RWMutex{},
+		startTime: time.Now(),
+		outbound:  outbound,
+	}
+	// All new or restarting sessions start in Waiting for EoR state
+	peer.status.Store(uint32(StatusWaitingForEOR))
+	// Outbound connections send their OPEN straight away, inbound ones wait for the peer's.
+	if outbound {
+		peer.state.Store(uint32(StateOpenSent))
+	} else {
+		peer.state.Store(uint32(StateActive))
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	var oldV4Rib *routing_table.IPv4Rib
-	var oldV6Rib *routing_table.IPv6Rib
-	var oldStatus uint32
-	var oldStaleSince time.Time
+	for _, check := range s.peers {
+		if check.ip != ip {
+			continue
+		}
+		state := SessionState(check.state.Load())
+		if check.outbound != outbound && state != StateIdle && state != StateEstablished {
+			log.Printf("Possible connection collision with %s, deferring until Open is received\n", ip)
+			peer.collision = check
+			return peer
+		}
+		break
+	}
+
+	s.registerLocked(peer)
+	return peer
+}
+
+// register adds p to the list of peers, taking over the RIBs of any previous connection.
+func (s *Server) register(p *peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registerLocked(p)
+}
+
+func (s *Server) registerLocked(peer *peer) {
+	ip := peer.ip
 
 	// If new client trying to connect with existing connection, remove old peer from pool
 	for i, check := range s.peers {
 		if ip == check.ip {
 			check.mutex.Lock()
-			oldV4Rib = check.v4rib
-			oldV6Rib = check.v6rib
-			oldStatus = check.status.Load()
-			oldStaleSince = check.staleSince
+			oldV4Rib := check.v4rib
+			oldV6Rib := check.v6rib
+			oldInvalid := check.invalid
+			oldStatus := check.status.Load()
+			oldStaleSince := check.staleSince
+			oldParam := check.param
 			check.v4rib = nil
 			check.v6rib = nil
+			check.invalid = nil
+
+			// The restart and LLGR timers carry over to the new connection, which must
+			// complete its OPEN before they fire. The old connection's EoR wait is over.
+			restartTimer := check.restartTimer
+			check.restartTimer = nil
+			llgrTimers := check.llgrTimers
+			check.llgrTimers = nil
+			if check.eorFallbackTimer != nil {
+				check.eorFallbackTimer.Stop()
+				check.eorFallbackTimer = nil
+			}
 			check.mutex.Unlock()
 
 			// If old peer wasn't already stale, mark the stolen RIBs as stale now.
 			if PeerStatus(oldStatus) == StatusEstablished {
-				if oldV4Rib != nil {
-					oldV4Rib.MarkAllStale()
-				}
-				if oldV6Rib != nil {
-					oldV6Rib.MarkAllStale()
-				}
-				oldStatus = uint32(StatusGRStale)
+				s.retainStale(oldParam, oldV4Rib, oldV6Rib)
 				oldStaleSince = time.Now()
 			}
 
 			check.conn.Close()
 			s.peers = append(s.peers[:i], s.peers[i+1:]...)
-			if _, ok := s.peerStats[ip]; !ok {
-				s.peerStats[ip] = &persistentPeerStats{}
+			if check.reachedEstablished.Load() {
+				if _, ok := s.peerStats[ip]; !ok {
+					s.peerStats[ip] = &persistentPeerStats{}
+				}
+				s.peerStats[ip].flaps++
 			}
-			s.peerStats[ip].flaps++
+
+			peer.mutex.Lock()
+			peer.v4rib = oldV4Rib
+			peer.v6rib = oldV6Rib
+			peer.invalid = oldInvalid
+			peer.staleSince = oldStaleSince
+			peer.restartTimer = restartTimer
+			peer.llgrTimers = llgrTimers
+			peer.mutex.Unlock()
 			break
 		}
 	}
 
-	peer := &peer{
-		server:    s,
-		conn:      conn,
-		rid:       s.Conf.Rid,
-		weor:      s.Conf.Eor,
-		quiet:     s.Conf.Quiet,
-		ip:        ip,
-		mutex:     sync.RWMutex{},
-		startTime: time.Now(),
-		v4rib:     oldV4Rib,
-		v6rib:     oldV6Rib,
-	}
-	// All new or restarting sessions start in Waiting for EoR state
-	peer.status.Store(uint32(StatusWaitingForEOR))
-	peer.staleSince = oldStaleSince
-
+	peer.collision = nil
 	s.peers = append(s.peers, peer)
 	peerIPs := make([]string, len(s.peers))
 	for i, p := range s.peers {
 		peerIPs[i] = p.ip
 	}
 	log.Printf("Peer list after add: %v\n", peerIPs)
-
-	return peer
 }
 
 // remove removes a client from the current list of clients being served.
@@ -268,16 +386,23 @@ func (s *Server) remove(p *peer) {
 	s.mutex.RUnlock()
 
 	if stillActive {
-		log.Printf("Peer %s disconnected, holding routes (Graceful Restart)\n", p.ip)
-		if p.v4rib != nil {
-			p.v4rib.MarkAllStale()
-		}
-		if p.v6rib != nil {
-			p.v6rib.MarkAllStale()
-		}
 		p.mutex.Lock()
-		p.staleSince = time.Now()
+		// A connection that went down before completing its OPEN is still within the
+		// previous session's restart or long-lived stale time, and its routes are already stale.
+		if p.restartTimer == nil && len(p.llgrTimers) == 0 {
+			if !s.retainStale(p.param, p.v4rib, p.v6rib) {
+				p.mutex.Unlock()
+				log.Printf("Peer %s disconnected without Graceful Restart, removing routes\n", p.ip)
+				s.destroyPeer(p.ip)
+				return
+			}
+			p.staleSince = time.Now()
+		}
+		// The peer sends its routes again when it reconnects, so only those after the import
+		// policy are held
+		p.v4pre, p.v6pre = nil, nil
 		p.mutex.Unlock()
+		log.Printf("Peer %s disconnected, holding routes (Graceful Restart)\n", p.ip)
 		_ = s.grManager.HandlePeerDown(context.Background(), p.ip)
 		return
 	}
@@ -296,6 +421,26 @@ func (s *Server) addGlobalV4(newPrefixes []netip.Prefix) {
 	}
 }
 
+// recordUpdateError counts an RFC 7606 action taken for a malformed UPDATE from ip.
+func (s *Server) recordUpdateError(ip string, action bgp.ErrorAction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.peerStats[ip]; !ok {
+		s.peerStats[ip] = &persistentPeerStats{}
+	}
+	ps := s.peerStats[ip]
+	switch action {
+	case bgp.ActionAttributeDiscard:
+		ps.attrDiscards++
+	case bgp.ActionTreatAsWithdraw:
+		ps.treatAsWithdraws++
+	case bgp.ActionAFISAFIDisable:
+		ps.afiSafiDisables++
+	case bgp.ActionSessionReset:
+		ps.sessionResets++
+	}
+}
+
 func (s *Server) removeGlobalV4(removedPrefixes []netip.Prefix) {
 	s.globalMasksMu.Lock()
 	defer s.globalMasksMu.Unlock()
@@ -360,6 +505,8 @@ func (s *Server) destroyPeer(ip string) {
 			v6Prefixes = deadPeer.v6rib.AllPrefixes()
 			deadPeer.v6rib = nil
 		}
+		deadPeer.v4pre, deadPeer.v6pre = nil, nil
+		deadPeer.invalid = nil
 		deadPeer.mutex.Unlock()
 
 		if len(v4Prefixes) > 0 {
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+)
+
+// maxTCPAOKeyLen is TCP_AO_MAXKEYLEN, the longest secret the kernel takes.
+const maxTCPAOKeyLen = 80
+
+// tcpAOAlgorithms maps the RFC 5926 algorithms to the kernel's crypto API names. Both produce a
+// 96 bit MAC.
+var tcpAOAlgorithms = map[string]string{
+	"hmac-sha-1-96":   "hmac(sha1)",
+	"aes-128-cmac-96": "cmac(aes128)",
+}
+
+const tcpAOMACLen = 12
+
+func (k TCPAOKey) sendID() uint8 {
+	if k.SendID != nil {
+		return *k.SendID
+	}
+	return k.ID
+}
+
+func (k TCPAOKey) recvID() uint8 {
+	if k.RecvID != nil {
+		return *k.RecvID
+	}
+	return k.ID
+}
+
+func (k TCPAOKey) validate() error {
+	if _, ok := tcpAOAlgorithms[k.Algorithm]; !ok {
+		return fmt.Errorf("unknown algorithm: %q", k.Algorithm)
+	}
+	if k.Secret == "" || len(k.Secret) > maxTCPAOKeyLen {
+		return fmt.Errorf("secret must be 1 to %d bytes", maxTCPAOKeyLen)
+	}
+	return nil
+}
+
+// aoKey is a TCP-AO master key tuple for the peers within a prefix.
+type aoKey struct {
+	prefix         netip.Prefix
+	sendID, recvID uint8
+	algorithm      string
+	secret         string
+}
+
+func newAOKey(prefix netip.Prefix, k TCPAOKey) aoKey {
+	return aoKey{
+		prefix:    prefix,
+		sendID:    k.sendID(),
+		recvID:    k.recvID(),
+		algorithm: tcpAOAlgorithms[k.Algorithm],
+		secret:    k.Secret,
+	}
+}
+
+// aoKeys returns the TCP-AO keys of the configured peers, as host prefixes, and of the listen
+// ranges.
+func (t *peerTable) aoKeys() []aoKey {
+	var keys []aoKey
+	for _, pc := range t.peers {
+		if len(pc.TCPAO) == 0 {
+			continue
+		}
+		ip, err := netip.ParseAddr(pc.IP)
+		if err != nil {
+			log.Printf("Warning: Invalid IP address %s in config", pc.IP)
+			continue
+		}
+		ip = ip.Unmap()
+		for _, k := range pc.TCPAO {
+			keys = append(keys, newAOKey(netip.PrefixFrom(ip, ip.BitLen()), k))
+		}
+	}
+	for _, r := range t.ranges {
+		for _, k := range r.Template.TCPAO {
+			keys = append(keys, newAOKey(r.Prefix, k))
+		}
+	}
+	return keys
+}
+
+// aoKeysFor returns the TCP-AO keys that match the peer at ip, which are those a connection
+// accepted from it takes from the listening socket.
+func (t *peerTable) aoKeysFor(ip string) []aoKey {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	var keys []aoKey
+	for _, k := range t.aoKeys() {
+		if k.prefix.Contains(addr) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// diffAOKeys returns the keys in to that are not in from, and those in from no longer in to.
+func diffAOKeys(from, to []aoKey) (added, removed []aoKey) {
+	have := make(map[aoKey]bool)
+	for _, k := range from {
+		have[k] = true
+	}
+	want := make(map[aoKey]bool)
+	for _, k := range to {
+		want[k] = true
+		if !have[k] {
+			added = append(added, k)
+		}
+	}
+	for _, k := range from {
+		if !want[k] {
+			removed = append(removed, k)
+		}
+	}
+	return added, removed
+}
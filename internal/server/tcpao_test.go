@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAOKeysFor(t *testing.T) {
+	three := uint8(3)
+	table := &peerTable{
+		peers: map[string]PeerConfig{
+			"10.20.0.1": {IP: "10.20.0.1", TCPAO: []TCPAOKey{{ID: 1, Algorithm: "aes-128-cmac-96", Secret: "core"}}},
+			"10.30.0.1": {IP: "10.30.0.1", Password: "md5"},
+		},
+		ranges: []ListenRange{
+			{
+				Prefix:   netip.MustParsePrefix("10.20.0.0/16"),
+				Template: PeerConfig{TCPAO: []TCPAOKey{{ID: 2, Algorithm: "hmac-sha-1-96", Secret: "edge", RecvID: &three}}},
+			},
+		},
+	}
+	core := aoKey{prefix: netip.MustParsePrefix("10.20.0.1/32"), sendID: 1, recvID: 1, algorithm: "cmac(aes128)", secret: "core"}
+	edge := aoKey{prefix: netip.MustParsePrefix("10.20.0.0/16"), sendID: 2, recvID: 3, algorithm: "hmac(sha1)", secret: "edge"}
+
+	tests := []struct {
+		ip   string
+		want []aoKey
+	}{
+		{ip: "10.20.0.1", want: []aoKey{core, edge}},
+		{ip: "::ffff:10.20.9.9", want: []aoKey{edge}},
+		{ip: "10.30.0.1"},
+	}
+	for _, test := range tests {
+		got := table.aoKeysFor(test.ip)
+		added, removed := diffAOKeys(got, test.want)
+		if len(added) > 0 || len(removed) > 0 {
+			t.Errorf("Test (%s): got %+v, want %+v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestDiffAOKeys(t *testing.T) {
+	prefix := netip.MustParsePrefix("192.0.2.1/32")
+	old := aoKey{prefix: prefix, sendID: 1, recvID: 1, algorithm: "cmac(aes128)", secret: "old"}
+	next := aoKey{prefix: prefix, sendID: 2, recvID: 2, algorithm: "cmac(aes128)", secret: "new"}
+
+	tests := []struct {
+		desc        string
+		from, to    []aoKey
+		wantAdded   []aoKey
+		wantRemoved []aoKey
+	}{
+		{desc: "unchanged", from: []aoKey{old}, to: []aoKey{old}},
+		{desc: "new key", from: []aoKey{old}, to: []aoKey{next, old}, wantAdded: []aoKey{next}},
+		{desc: "old key removed", from: []aoKey{old, next}, to: []aoKey{next}, wantRemoved: []aoKey{old}},
+	}
+	for _, test := range tests {
+		added, removed := diffAOKeys(test.from, test.to)
+		if !slices.Equal(added, test.wantAdded) || !slices.Equal(removed, test.wantRemoved) {
+			t.Errorf("Test (%s): got %+v, %+v, want %+v, %+v", test.desc, added, removed, test.wantAdded, test.wantRemoved)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+// openHoldTime is the hold timer used until an OPEN has been received, the "large value"
+// suggested by RFC 4271 section 8.2.2.
+const openHoldTime = 4 * time.Minute
+
+// localHoldTime returns the hold time we offer to the peer at ip. A hold_time configured
+// for the peer takes precedence, including 0 which disables keepalives altogether.
+func (s *Server) localHoldTime(ip string) uint16 {
+	if pc, ok := s.peerConfig(ip); ok && pc.HoldTime != nil {
+		return *pc.HoldTime
+	}
+	if s.Conf.HoldTime != 0 {
+		return s.Conf.HoldTime
+	}
+	return defaultHoldTime
+}
+
+// negotiateHoldTime returns the hold time to use for the session, the smaller of ours and
+// the peer's. Values of 1 and 2 seconds are not allowed by RFC 4271 section 4.2.
+func negotiateHoldTime(local, remote uint16) (uint16, bool) {
+	if remote == 1 || remote == 2 {
+		return 0, false
+	}
+	return min(local, remote), true
+}
+
+// startHoldTimer (re)starts the hold timer with duration d. A zero duration stops it.
+func (p *peer) startHoldTimer(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.holdTimer != nil {
+		p.holdTimer.Stop()
+		p.holdTimer = nil
+	}
+	if d == 0 {
+		return
+	}
+	p.holdDuration = d
+	p.holdTimer = time.AfterFunc(d, p.holdTimerExpired)
+}
+
+// resetHoldTimer restarts the hold timer after a message has been received from the peer.
+func (p *peer) resetHoldTimer() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.holdTimer != nil {
+		p.holdTimer.Reset(p.holdDuration)
+	}
+}
+
+func (p *peer) holdTimerExpired() {
+	log.Printf("Hold timer expired for %s\n", p.ip)
+	p.notify(bgp.HoldTimeExpired, 0, nil)
+	p.conn.Close()
+}
+
+// startKeepaliveTimer sends a KEEPALIVE every d until the timers are stopped.
+func (p *peer) startKeepaliveTimer(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.keepaliveTimer != nil {
+		p.keepaliveTimer.Stop()
+		p.keepaliveTimer = nil
+	}
+	if d == 0 {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		if err := p.send(bgp.CreateKeepAlive()); err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if p.keepaliveTimer == t {
+			t.Reset(d)
+		}
+		p.mutex.Unlock()
+	})
+	p.keepaliveTimer = t
+}
+
+func (p *peer) stopTimers() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.holdTimer != nil {
+		p.holdTimer.Stop()
+		p.holdTimer = nil
+	}
+	if p.keepaliveTimer != nil {
+		p.keepaliveTimer.Stop()
+		p.keepaliveTimer = nil
+	}
+	for _, t := range []**time.Timer{&p.v4refresh, &p.v6refresh} {
+		if *t != nil {
+			(*t).Stop()
+			*t = nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+)
+
+func TestNegotiateHoldTime(t *testing.T) {
+	tests := []struct {
+		desc   string
+		local  uint16
+		remote uint16
+		want   uint16
+		wantOk bool
+	}{
+		{
+			desc:   "peer lower",
+			local:  90,
+			remote: 30,
+			want:   30,
+			wantOk: true,
+		},
+		{
+			desc:   "local lower",
+			local:  9,
+			remote: 180,
+			want:   9,
+			wantOk: true,
+		},
+		{
+			desc:   "peer disables",
+			local:  90,
+			remote: 0,
+			want:   0,
+			wantOk: true,
+		},
+		{
+			desc:   "local disables",
+			local:  0,
+			remote: 90,
+			want:   0,
+			wantOk: true,
+		},
+		{
+			desc:   "unacceptable",
+			local:  90,
+			remote: 2,
+			wantOk: false,
+		},
+	}
+	for _, test := range tests {
+		got, ok := negotiateHoldTime(test.local, test.remote)
+		if ok != test.wantOk || got != test.want {
+			t.Errorf("Test (%s): got %d/%v, want %d/%v", test.desc, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestLocalHoldTime(t *testing.T) {
+	zero := uint16(0)
+	srv := New(Config{
+		HoldTime: 30,
+		PeersConfig: map[string]PeerConfig{
+			"192.0.2.1": {IP: "192.0.2.1", HoldTime: &zero},
+			"192.0.2.2": {IP: "192.0.2.2"},
+		},
+	})
+	if got := srv.localHoldTime("192.0.2.1"); got != 0 {
+		t.Errorf("per-peer hold time: got %d, want 0", got)
+	}
+	if got := srv.localHoldTime("192.0.2.2"); got != 30 {
+		t.Errorf("global hold time: got %d, want 30", got)
+	}
+	if got := New(Config{}).localHoldTime("192.0.2.3"); got != defaultHoldTime {
+		t.Errorf("default hold time: got %d, want %d", got, defaultHoldTime)
+	}
+}
+
+func TestKeepaliveTimer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	p := &peer{server: New(Config{}), conn: c1, ip: "127.0.0.1"}
+	p.startKeepaliveTimer(20 * time.Millisecond)
+	defer p.stopTimers()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		msg := make([]byte, bgp.MinMessage)
+		if _, err := io.ReadFull(c2, msg); err != nil {
+			t.Fatalf("keepalive %d not received: %v", i, err)
+		}
+		if msg[18] != bgp.Keepalive {
+			t.Fatalf("got message type %d, want keepalive", msg[18])
+		}
+	}
+}
+
+func TestHoldTimerExpiry(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	srv := New(Config{})
+	p := &peer{server: srv, conn: c1, ip: "127.0.0.1"}
+	p.startHoldTimer(20 * time.Millisecond)
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	msg := make([]byte, 21)
+	if _, err := io.ReadFull(c2, msg); err != nil {
+		t.Fatalf("notification not received: %v", err)
+	}
+	if msg[18] != bgp.Notification || msg[19] != bgp.HoldTimeExpired {
+		t.Errorf("got type %d code %d, want hold timer expired notification", msg[18], msg[19])
+	}
+	if _, err := c2.Read(msg); err != io.EOF {
+		t.Errorf("connection not closed after hold timer expiry: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	"github.com/mellowdrifter/routing_table"
+)
+
+// updateBody returns an UPDATE message without the BGP header, as read by handleUpdate.
+func updateBody(withdrawn, attrs, nlri []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(len(withdrawn)))
+	b.Write(withdrawn)
+	binary.Write(&b, binary.BigEndian, uint16(len(attrs)))
+	b.Write(attrs)
+	b.Write(nlri)
+	return b.Bytes()
+}
+
+func TestTreatAsWithdraw(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	nexthop := []byte{0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01}
+	nlri := []byte{0x18, 0xc0, 0x00, 0x02}
+	prefix := netip.MustParsePrefix("192.0.2.0/24")
+
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop}, nil), nlri))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("valid update: %v", err)
+	}
+	if p.v4rib.Count() != 1 {
+		t.Fatalf("got %d prefixes after valid update, want 1", p.v4rib.Count())
+	}
+
+	// Same prefix again, now with a community attribute that has a bad length
+	badComm := []byte{0xc0, 0x08, 0x03, 0xfd, 0xe8, 0x02}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop, badComm}, nil), nlri))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("malformed update should not reset the session: %v", err)
+	}
+	if p.v4rib.Count() != 0 {
+		t.Errorf("%v still present after treat-as-withdraw", prefix)
+	}
+
+	// A malformed ATOMIC_AGGREGATE is dropped and the route kept
+	badAtomic := []byte{0x40, 0x06, 0x01, 0x00}
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, nexthop, badAtomic}, nil), nlri))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("malformed update should not reset the session: %v", err)
+	}
+	if p.v4rib.Count() != 1 {
+		t.Errorf("got %d prefixes after attribute discard, want 1", p.v4rib.Count())
+	}
+
+	ps := srv.peerStats[p.ip]
+	if ps == nil || ps.treatAsWithdraws != 1 || ps.attrDiscards != 1 || ps.sessionResets != 0 {
+		t.Errorf("got counters %+v, want one treat-as-withdraw and one attribute discard", ps)
+	}
+}
+
+func TestUpdateErrorSessionReset(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	p := &peer{
+		server: srv,
+		conn:   c1,
+		ip:     "127.0.0.1",
+		quiet:  true,
+	}
+	p.state.Store(uint32(StateEstablished))
+
+	done := make(chan bool)
+	go func() {
+		p.peerWorker()
+		done <- true
+	}()
+
+	// A withdrawn routes field with a /33 can't be parsed at all
+	body := updateBody([]byte{0x21, 0x0a, 0x00, 0x00, 0x00, 0x00}, nil, nil)
+	msg := append(bytes.Repeat([]byte{0xff}, 16), 0, 0, bgp.Update)
+	binary.BigEndian.PutUint16(msg[16:], uint16(19+len(body)))
+	go c2.Write(append(msg, body...))
+
+	header := make([]byte, 21)
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatalf("no notification received: %v", err)
+	}
+	if header[18] != bgp.Notification || header[19] != bgp.UpdateError || header[20] != bgp.MalformedAttrList {
+		t.Errorf("got type %d code %d subcode %d, want UPDATE Message Error / Malformed Attribute List", header[18], header[19], header[20])
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("peerWorker did not exit after a session reset")
+	}
+	if ps := srv.peerStats[p.ip]; ps == nil || ps.sessionResets != 1 {
+		t.Errorf("session reset not counted: %+v", ps)
+	}
+}
+
+func TestMapAttributes(t *testing.T) {
+	tests := []struct {
+		desc     string
+		pa       *bgp.PathAttr
+		nextHops []string
+		want     *routing_table.RouteAttributes
+	}{
+		{
+			desc: "nil",
+			want: &routing_table.RouteAttributes{},
+		},
+		{
+			desc: "ipv4 with every attribute",
+			pa: &bgp.PathAttr{
+				Origin: 2,
+				Aspath: []bgp.AsnSegment{
+					{Type: 2, ASNs: []uint32{64512, 64513}},
+					{Type: 1, ASNs: []uint32{64514, 64515}},
+					{Type: 1, ASNs: []uint32{64516}},
+				},
+				Med:         50,
+				LocalPref:   200,
+				Atomic:      true,
+				AgAS:        64513,
+				AgOrigin:    net.IPv4(192, 0, 2, 1),
+				Originator:  "10.0.0.1",
+				ClusterList: []string{"10.0.0.2", "10.0.0.3"},
+				Communities: []bgp.Community{{High: 64512, Low: 100}},
+				ExtendCommunities: []bgp.ExtendCommunity{
+					{Type: 0x00, Subtype: 0x02, Value: []byte{0xfc, 0x00, 0x00, 0x00, 0x00, 0x64}},
+				},
+			},
+			nextHops: []string{"192.0.2.254"},
+			want: &routing_table.RouteAttributes{
+				Origin:    2,
+				AsPath:    []uint32{64512, 64513},
+				Med:       50,
+				LocalPref: 200,
+				AsPathSegments: []routing_table.AsPathSegment{
+					{Type: 2, ASNs: []uint32{64512, 64513}},
+					{Type: 1, ASNs: []uint32{64514, 64515}},
+					{Type: 1, ASNs: []uint32{64516}},
+				},
+				NextHop:         netip.MustParseAddr("192.0.2.254"),
+				AtomicAggregate: true,
+				AggregatorAS:    64513,
+				AggregatorAddr:  netip.MustParseAddr("192.0.2.1"),
+				OriginatorID:    netip.MustParseAddr("10.0.0.1"),
+				ClusterList:     []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3")},
+				Communities:     []uint32{64512<<16 | 100},
+				ExtendedCommunities: []routing_table.ExtendedCommunity{
+					{Type: 0x00, Subtype: 0x02, Value: [18]byte{0xfc, 0x00, 0x00, 0x00, 0x00, 0x64}},
+				},
+			},
+		},
+		{
+			desc: "ipv6 with link-local next hop",
+			pa: &bgp.PathAttr{
+				Aspath: []bgp.AsnSegment{{Type: 2, ASNs: []uint32{64512}}},
+			},
+			nextHops: []string{"2001:db8::1", "fe80::1"},
+			want: &routing_table.RouteAttributes{
+				AsPath:           []uint32{64512},
+				AsPathSegments:   []routing_table.AsPathSegment{{Type: 2, ASNs: []uint32{64512}}},
+				NextHop:          netip.MustParseAddr("2001:db8::1"),
+				LinkLocalNextHop: netip.MustParseAddr("fe80::1"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		got := mapAttributes(tc.pa, tc.nextHops)
+		if diff := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+			t.Errorf("Test (%s): mapAttributes() mismatch (-want +got):\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestIPv4InMPReach(t *testing.T) {
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true})
+	p := &peer{
+		server: srv,
+		ip:     "127.0.0.1",
+		quiet:  true,
+		param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+	}
+	p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	p.v6rib = routing_table.NewIPv6Rib(srv.v6AttrTable)
+
+	origin := []byte{0x40, 0x01, 0x01, 0x00}
+	aspath := []byte{0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8}
+	mpReach := []byte{0x80, 0x0e, 0x0d, 0x00, 0x01, 0x01, 0x04, 0xc0, 0x00, 0x02, 0x01, 0x00, 0x18, 0xc6, 0x33, 0x64}
+	prefix := netip.MustParsePrefix("198.51.100.0/24")
+
+	// No NEXT_HOP attribute, as it isn't needed with only MP_REACH_NLRI
+	p.in = bytes.NewReader(updateBody(nil, bytes.Join([][]byte{origin, aspath, mpReach}, nil), nil))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if p.v4rib.Count() != 1 || p.v6rib.Count() != 0 {
+		t.Fatalf("got %d IPv4 and %d IPv6 prefixes, want 1 and 0", p.v4rib.Count(), p.v6rib.Count())
+	}
+	if r := p.v4rib.Lookup(prefix); r == nil || r.Attributes.NextHop != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("got route %+v, want %v via 192.0.2.1", r, prefix)
+	}
+	if ps := srv.peerStats[p.ip]; ps != nil && ps.treatAsWithdraws != 0 {
+		t.Errorf("got %d treat-as-withdraws, want 0", ps.treatAsWithdraws)
+	}
+
+	mpUnreach := []byte{0x80, 0x0f, 0x07, 0x00, 0x01, 0x01, 0x18, 0xc6, 0x33, 0x64}
+	p.in = bytes.NewReader(updateBody(nil, mpUnreach, nil))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if p.v4rib.Count() != 0 {
+		t.Errorf("%v still present after MP_UNREACH_NLRI", prefix)
+	}
+
+	eor := []byte{0x80, 0x0f, 0x03, 0x00, 0x01, 0x01}
+	p.in = bytes.NewReader(updateBody(nil, eor, nil))
+	if err := p.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if !p.v4eor || p.v6eor {
+		t.Errorf("got v4eor %t v6eor %t, want only IPv4 End-of-RIB", p.v4eor, p.v6eor)
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/netip"
+	"regexp"
+	"slices"
+	"time"
+
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/mellowdrifter/routing_table"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Views of the routes that queries look in. The pre and post views are every path received
+// from each peer, before and after its import policy, and loc-rib the best of those paths for
+// each prefix.
+const (
+	viewPre    = "pre"
+	viewPost   = "post"
+	viewLocRIB = "loc-rib"
+)
+
+// parseView checks the view of a request, which is def if not given.
+func parseView(view, def string) (string, error) {
+	switch view {
+	case "":
+		return def, nil
+	case viewPre, viewPost, viewLocRIB:
+		return view, nil
+	}
+	return "", status.Errorf(codes.InvalidArgument, "unknown view %q, want pre, post or loc-rib", view)
+}
+
+// queryRib is the part of an IPv4 or IPv6 RIB that queries search.
+type queryRib interface {
+	pathRib
+	Lookup(netip.Prefix) *routing_table.Route
+	Search(netip.Addr) *routing_table.Route
+	AllPathsSearch(netip.Addr) []routing_table.Route
+	PrefixesByOriginASN(uint32) []routing_table.Route
+	PrefixesByAsPathRegex(*regexp.Regexp) []routing_table.Route
+	PrefixesByCommunity(uint32) []routing_table.Route
+	PrefixesByLargeCommunity(routing_table.LargeCommunity) []routing_table.Route
+	PrefixesByExtendedCommunity(routing_table.ExtendedCommunity) []routing_table.Route
+}
+
+// keepsPrePolicy reports whether the routes of the peer at ip are kept as received, before
+// its import policy.
+func (s *Server) keepsPrePolicy(ip string) bool {
+	pc, _ := s.peerConfig(ip)
+	return pc.Import != nil && (pc.PrePolicy == nil || *pc.PrePolicy)
+}
+
+// viewRibs returns the peer's IPv4 and IPv6 RIBs in a view, nil for those it does not have.
+// The routes of a peer without an import policy are the same before and after it, so its pre
+// view is its post-policy RIBs. A peer with a policy whose routes are not kept before it has
+// no pre view.
+func (p *peer) viewRibs(view string) (v4, v6 queryRib) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	v4rib, v6rib := p.v4rib, p.v6rib
+	if view == viewPre {
+		if pc, _ := p.server.peerConfig(p.ip); pc.Import != nil {
+			v4rib, v6rib = p.v4pre, p.v6pre
+		}
+	}
+	if v4rib != nil {
+		v4 = v4rib
+	}
+	if v6rib != nil {
+		v6 = v6rib
+	}
+	return v4, v6
+}
+
+// dropPrePolicy frees the routes kept before the import policy of peers that no longer keep
+// them. Peers that now keep them start with their next session.
+func (s *Server) dropPrePolicy() {
+	s.mutex.RLock()
+	peers := slices.Clone(s.peers)
+	s.mutex.RUnlock()
+
+	for _, p := range peers {
+		if s.keepsPrePolicy(p.ip) {
+			continue
+		}
+		p.mutex.Lock()
+		p.v4pre, p.v6pre = nil, nil
+		p.mutex.Unlock()
+	}
+}
+
+// routeCollector gathers the routes found by a query: every path in the pre and post views,
+// and the best of them for each prefix in loc-rib.
+type routeCollector struct {
+	g      *grpcServer
+	view   string
+	routes []*pb.Route
+	best   map[netip.Prefix]bestRoute
+}
+
+type bestRoute struct {
+	route      routing_table.Route
+	peer       *peer
+	staleSince time.Time
+}
+
+func (g *grpcServer) newCollector(view string) *routeCollector {
+	return &routeCollector{g: g, view: view, best: make(map[netip.Prefix]bestRoute)}
+}
+
+// add collects routes found in p's RIBs.
+func (c *routeCollector) add(p *peer, routes []routing_table.Route) {
+	p.mutex.RLock()
+	stSince := p.staleSince
+	p.mutex.RUnlock()
+
+	for _, r := range routes {
+		if c.view != viewLocRIB {
+			c.routes = append(c.routes, c.g.bgp.formatRouteResponse(&r, p, stSince))
+			continue
+		}
+		existing, ok := c.best[r.Prefix]
+		if !ok || c.g.isBetter(r, existing.route) {
+			c.best[r.Prefix] = bestRoute{route: r, peer: p, staleSince: stSince}
+		}
+	}
+}
+
+// result returns the routes collected.
+func (c *routeCollector) result() []*pb.Route {
+	for _, b := range c.best {
+		c.routes = append(c.routes, c.g.bgp.formatRouteResponse(&b.route, b.peer, b.staleSince))
+	}
+	return c.routes
+}
+
+// viewRoutes runs query against both RIBs of every peer in the view.
+func (g *grpcServer) viewRoutes(view string, query func(queryRib) []routing_table.Route) []*pb.Route {
+	c := g.newCollector(view)
+	for _, p := range g.snapshotPeers() {
+		v4, v6 := p.viewRibs(view)
+		var all []routing_table.Route
+		if v4 != nil {
+			all = query(v4)
+		}
+		if v6 != nil {
+			all = append(all, query(v6)...)
+		}
+		c.add(p, all)
+	}
+	return c.result()
+}
+
+// filterPaths returns the paths in the RIBs that keep reports true for.
+func filterPaths(v4, v6 queryRib, keep func(*routing_table.Route) bool) []routing_table.Route {
+	var paths []routing_table.Route
+	for _, rib := range []queryRib{v4, v6} {
+		if rib == nil {
+			continue
+		}
+		for _, prefix := range rib.AllPrefixes() {
+			for _, r := range rib.AllPaths(prefix) {
+				if keep(&r) {
+					paths = append(paths, r)
+				}
+			}
+		}
+	}
+	return paths
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/mellowdrifter/bgpwatch/internal/bgp"
+	pb "github.com/mellowdrifter/bgpwatch/proto"
+	"github.com/mellowdrifter/routing_table"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestViews(t *testing.T) {
+	pol := testPolicy(t, `{
+		"prefix_lists": {"one": [{"prefix": "1.1.1.0/24"}]},
+		"policies": {"test": [
+			{"prefix_list": "one", "action": "reject"},
+			{"set_local_pref": 200}
+		]}
+	}`)
+	rid, _ := GetRid("1.1.1.1")
+	srv := New(Config{Rid: rid, Asn: 64512, Quiet: true, PeersConfig: map[string]PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Import: pol},
+		"127.0.0.2": {IP: "127.0.0.2"},
+	}})
+	newPeer := func(ip string) *peer {
+		p := &peer{
+			server: srv,
+			ip:     ip,
+			quiet:  true,
+			param:  bgp.Parameters{ASN32: [4]byte{0, 0, 0xfd, 0xe8}},
+		}
+		p.v4rib = routing_table.NewIPv4Rib(srv.v4AttrTable)
+		return p
+	}
+	filtered, open := newPeer("127.0.0.1"), newPeer("127.0.0.2")
+	filtered.v4pre = routing_table.NewIPv4Rib(srv.v4AttrTable)
+	srv.peers = []*peer{filtered, open}
+	g := &grpcServer{bgp: srv}
+
+	for _, p := range srv.peers {
+		announce(t, p, []byte{1, 1, 1}, []byte{8, 8, 8})
+	}
+
+	tests := []struct {
+		view    string
+		address string
+		want    int
+	}{
+		{view: "pre", address: "1.1.1.0/24", want: 2},
+		{view: "post", address: "1.1.1.0/24", want: 1},
+		{view: "", address: "8.8.8.8", want: 2},
+		{view: "post", address: "8.8.8.0/24", want: 2},
+		{view: "loc-rib", address: "8.8.8.0/24", want: 1},
+	}
+	for _, test := range tests {
+		resp, err := g.GetRoutes(context.Background(), &pb.RouteRequest{Address: test.address, View: test.view})
+		if err != nil {
+			t.Fatalf("Test (%s %s): %v", test.view, test.address, err)
+		}
+		if got := len(resp.GetRoutes()); got != test.want {
+			t.Errorf("Test (%s %s): got %d routes, want %d", test.view, test.address, got, test.want)
+		}
+	}
+
+	// The policy raised the local preference of the filtered peer's route, so it is the best
+	resp, err := g.GetPrefixesByAsPath(context.Background(), &pb.AsPathRequest{Regex: "^65000$"})
+	if err != nil {
+		t.Fatalf("GetPrefixesByAsPath: %v", err)
+	}
+	if len(resp.GetRoutes()) != 2 {
+		t.Fatalf("got %d routes from the default loc-rib view, want 2", len(resp.GetRoutes()))
+	}
+	for _, r := range resp.GetRoutes() {
+		if r.GetPrefix() == "8.8.8.0/24" && r.GetLocalPref() != 200 {
+			t.Errorf("got local pref %d for the best 8.8.8.0/24, want 200", r.GetLocalPref())
+		}
+	}
+	resp, err = g.GetPrefixesByAsPath(context.Background(), &pb.AsPathRequest{Regex: "^65000$", View: "pre"})
+	if err != nil {
+		t.Fatalf("GetPrefixesByAsPath: %v", err)
+	}
+	if got := len(resp.GetRoutes()); got != 4 {
+		t.Errorf("got %d routes from the pre view, want 4", got)
+	}
+
+	if _, err := g.GetRoutes(context.Background(), &pb.RouteRequest{Address: "8.8.8.8", View: "adj-rib-out"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown view, want InvalidArgument", err)
+	}
+
+	// Both families kept as received are counted
+	filtered.v6pre = routing_table.NewIPv6Rib(srv.v6AttrTable)
+	filtered.v6pre.InsertBatch([]routing_table.Route{{Prefix: netip.MustParsePrefix("2001:db8::/32"), Attributes: &routing_table.RouteAttributes{}}})
+	stats := srv.collectStats().GetPeerStats()
+	if got := stats[srv.getPeerName(filtered)].GetPrePolicyPathCount(); got != 3 {
+		t.Errorf("got %d pre-policy paths, want 3", got)
+	}
+	if got := stats[srv.getPeerName(filtered)].GetPathCount(); got != 1 {
+		t.Errorf("got %d post-policy paths, want 1", got)
+	}
+
+	// Withdrawals remove the routes received too
+	filtered.in = bytes.NewReader(updateBody([]byte{24, 1, 1, 1}, nil, nil))
+	if err := filtered.handleUpdate(); err != nil {
+		t.Fatalf("handleUpdate: %v", err)
+	}
+	if got := filtered.v4pre.Count(); got != 1 {
+		t.Errorf("got %d pre-policy prefixes after the withdrawal, want 1", got)
+	}
+
+	// Routes received are no longer kept once turned off
+	off := false
+	srv.peerConf.Store(&peerTable{peers: map[string]PeerConfig{
+		"127.0.0.1": {IP: "127.0.0.1", Import: pol, PrePolicy: &off},
+		"127.0.0.2": {IP: "127.0.0.2"},
+	}})
+	srv.dropPrePolicy()
+	if filtered.v4pre != nil {
+		t.Errorf("pre-policy RIB kept after it was turned off")
+	}
+	r, err := g.GetRoutes(context.Background(), &pb.RouteRequest{Address: "8.8.8.0/24", View: "pre"})
+	if err != nil {
+		t.Fatalf("GetRoutes: %v", err)
+	}
+	if got := len(r.GetRoutes()); got != 1 {
+		t.Errorf("got %d routes from the pre view, want 1 from the peer without a policy", got)
+	}
+}